@@ -29,8 +29,13 @@ type UnpackSpec struct {
 	BaseDirectory string
 }
 
+// VolumeMeta is what is recorded about a volume next to it, so that it can be
+// accounted for and cleaned up without fetching its layer again.
 type VolumeMeta struct {
 	Size int64
+	// OriginDigest is the digest of the blob the volume was unpacked from
+	OriginDigest string `json:",omitempty"`
+	CreatedAt    time.Time
 }
 
 type Fetcher interface {
@@ -214,7 +219,7 @@ func (p *BaseImagePuller) unpackLayer(logger lager.Logger, layerInfo, parentLaye
 		return err
 	}
 
-	return p.finalizeVolume(logger, tempVolumeName, volumePath, layerInfo.ChainID, volSize)
+	return p.finalizeVolume(logger, tempVolumeName, volumePath, layerInfo, volSize)
 }
 
 func (p *BaseImagePuller) createTemporaryVolumeDirectory(logger lager.Logger, layerInfo groot.LayerInfo, spec groot.BaseImageSpec) (string, string, error) {
@@ -238,8 +243,14 @@ func (p *BaseImagePuller) createTemporaryVolumeDirectory(logger lager.Logger, la
 	return tempVolumeName, volumePath, nil
 }
 
-func (p *BaseImagePuller) finalizeVolume(logger lager.Logger, tempVolumeName, volumePath, chainID string, volSize int64) error {
-	if err := p.volumeDriver.WriteVolumeMeta(logger, chainID, VolumeMeta{Size: volSize}); err != nil {
+func (p *BaseImagePuller) finalizeVolume(logger lager.Logger, tempVolumeName, volumePath string, layerInfo groot.LayerInfo, volSize int64) error {
+	chainID := layerInfo.ChainID
+	metadata := VolumeMeta{
+		Size:         volSize,
+		OriginDigest: layerInfo.BlobID,
+		CreatedAt:    time.Now(),
+	}
+	if err := p.volumeDriver.WriteVolumeMeta(logger, chainID, metadata); err != nil {
 		return errorspkg.Wrapf(err, "writing volume `%s` metadata", chainID)
 	}
 
@@ -258,15 +258,21 @@ var _ = Describe("Base Image Puller", func() {
 			Expect(fakeVolumeDriver.WriteVolumeMetaCallCount()).To(Equal(3))
 			_, id, metadata := fakeVolumeDriver.WriteVolumeMetaArgsForCall(0)
 			Expect(id).To(Equal("layer-111"))
-			Expect(metadata).To(Equal(base_image_puller.VolumeMeta{Size: 100}))
+			Expect(metadata.Size).To(BeEquivalentTo(100))
+			Expect(metadata.OriginDigest).To(Equal("i-am-a-layer"))
+			Expect(metadata.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
 
 			_, id, metadata = fakeVolumeDriver.WriteVolumeMetaArgsForCall(1)
 			Expect(id).To(Equal("chain-222"))
-			Expect(metadata).To(Equal(base_image_puller.VolumeMeta{Size: 200}))
+			Expect(metadata.Size).To(BeEquivalentTo(200))
+			Expect(metadata.OriginDigest).To(Equal("i-am-another-layer"))
+			Expect(metadata.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
 
 			_, id, metadata = fakeVolumeDriver.WriteVolumeMetaArgsForCall(2)
 			Expect(id).To(Equal("chain-333"))
-			Expect(metadata).To(Equal(base_image_puller.VolumeMeta{Size: 300}))
+			Expect(metadata.Size).To(BeEquivalentTo(300))
+			Expect(metadata.OriginDigest).To(Equal("i-am-the-last-layer"))
+			Expect(metadata.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
 		})
 
 		It("emits a metric with the unpack and download time for each layer", func() {
@@ -73,7 +73,7 @@ var CleanCommand = cli.Command{
 		logger.Debug("clean-config", lager.Data{"currentConfig": cfg})
 
 		rootless := os.Getuid() != 0
-		var unmounter overlayxfs.Unmounter = mount.RootfulUnmounter{}
+		var unmounter overlayxfs.Unmounter = mount.RetryingUnmounter{}
 		if rootless {
 			unmounter = mount.RootlessUnmounter{}
 		}
@@ -139,12 +139,13 @@ var CreateCommand = cli.Command{
 		}
 
 		rootless := os.Getuid() != 0
-		var unmounter overlayxfs.Unmounter = mount.RootfulUnmounter{}
+		var unmounter overlayxfs.Unmounter = mount.RetryingUnmounter{}
 		if rootless {
 			unmounter = mount.RootlessUnmounter{}
 		}
-		fsDriver := overlayxfs.NewDriver(cfg.StorePath, cfg.TardisBin, unmounter, loopback.NewNoopDirectIO())
 		metricsEmitter := metrics.NewEmitter(logger, cfg.MetronEndpoint)
+		fsDriver := overlayxfs.NewDriver(cfg.StorePath, cfg.TardisBin, unmounter, loopback.NewNoopDirectIO()).
+			WithMetricsEmitter(metricsEmitter)
 
 		initLocksDir := filepath.Join("/", "var", "run")
 		storeLocksDir := filepath.Join(storePath, storepkg.LocksDirName)
@@ -53,11 +53,13 @@ var DeleteCommand = cli.Command{
 		}
 
 		rootless := os.Getuid() != 0
-		var unmounter overlayxfs.Unmounter = mount.RootfulUnmounter{}
+		var unmounter overlayxfs.Unmounter = mount.RetryingUnmounter{}
 		if rootless {
 			unmounter = mount.RootlessUnmounter{}
 		}
-		fsDriver := overlayxfs.NewDriver(cfg.StorePath, cfg.TardisBin, unmounter, loopback.NewNoopDirectIO())
+		metricsEmitter := metrics.NewEmitter(logger, cfg.MetronEndpoint)
+		fsDriver := overlayxfs.NewDriver(cfg.StorePath, cfg.TardisBin, unmounter, loopback.NewNoopDirectIO()).
+			WithMetricsEmitter(metricsEmitter)
 
 		imageDriver, err := createImageDriver(logger, cfg, fsDriver)
 		if err != nil {
@@ -70,7 +72,6 @@ var DeleteCommand = cli.Command{
 			filepath.Join(storePath, store.MetaDirName, "dependencies"),
 		)
 
-		metricsEmitter := metrics.NewEmitter(logger, cfg.MetronEndpoint)
 		deleter := groot.IamDeleter(imageManager, dependencyManager, metricsEmitter)
 
 		gc := garbage_collector.NewGC(fsDriver, imageManager, dependencyManager)
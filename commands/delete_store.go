@@ -30,7 +30,7 @@ var DeleteStoreCommand = cli.Command{
 		}
 
 		rootless := os.Getuid() != 0
-		var unmounter overlayxfs.Unmounter = mount.RootfulUnmounter{}
+		var unmounter overlayxfs.Unmounter = mount.RetryingUnmounter{}
 		if rootless {
 			unmounter = mount.RootlessUnmounter{}
 		}
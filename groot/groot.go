@@ -147,7 +147,11 @@ type ReexecSpec struct {
 }
 
 type DiskUsage struct {
-	TotalBytesUsed      int64 `json:"total_bytes_used"`
+	// TotalBytesUsed includes the read-only base layers the image shares with
+	// other images.
+	TotalBytesUsed int64 `json:"total_bytes_used"`
+	// ExclusiveBytesUsed is only what the image wrote to its upperdir. It
+	// never exceeds the quota of the image.
 	ExclusiveBytesUsed  int64 `json:"exclusive_bytes_used"`
 	QuotaSizeBytes      int64 `json:"quota_size_bytes"`
 	CommittedSpaceBytes int64 `json:"committed_space_bytes"`
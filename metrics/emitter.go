@@ -39,3 +39,11 @@ func (e *Emitter) TryEmitDurationFrom(logger lager.Logger, name string, from tim
 		})
 	}
 }
+
+func (e *Emitter) TryIncrementCounter(logger lager.Logger, name string) {
+	if err := metrics.IncrementCounter(name); err != nil {
+		logger.Error("failed-to-emit-metric", err, lager.Data{
+			"key": name,
+		})
+	}
+}
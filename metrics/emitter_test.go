@@ -83,4 +83,20 @@ var _ = Describe("Emitter", func() {
 			))
 		})
 	})
+
+	Describe("TryIncrementCounter", func() {
+		It("increments the counter", func() {
+			emitter.TryIncrementCounter(logger, "foo")
+			emitter.TryIncrementCounter(logger, "foo")
+
+			Eventually(func() uint64 {
+				var total uint64
+				counterEvents := fakeMetron.CounterEvents("foo")
+				for i := range counterEvents {
+					total += counterEvents[i].GetDelta()
+				}
+				return total
+			}, 10*time.Second).Should(Equal(uint64(2)))
+		})
+	})
 })
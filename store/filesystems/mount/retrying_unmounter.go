@@ -0,0 +1,51 @@
+package mount
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultUnmountMaxAttempts = 10
+	DefaultUnmountBaseDelay   = 10 * time.Millisecond
+)
+
+// RetryingUnmounter unmounts with umount2, retrying with an exponential
+// backoff while the mount is busy, e.g. because the processes of a container
+// have not fully exited yet. Any other error is returned right away. Errors
+// are the bare errno, so that callers can tell EBUSY from EINVAL.
+type RetryingUnmounter struct {
+	// MaxAttempts defaults to DefaultUnmountMaxAttempts.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubled on every retry
+	// after it. It defaults to DefaultUnmountBaseDelay.
+	BaseDelay time.Duration
+}
+
+func (u RetryingUnmounter) Unmount(log lager.Logger, path string, flags int) error {
+	log = log.Session("retrying-unmounter", lager.Data{"path": path, "flags": flags})
+	log.Debug("start")
+	defer log.Debug("finish")
+
+	maxAttempts := u.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultUnmountMaxAttempts
+	}
+	delay := u.BaseDelay
+	if delay <= 0 {
+		delay = DefaultUnmountBaseDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := unix.Unmount(path, flags)
+		if err != unix.EBUSY || attempt >= maxAttempts {
+			return err
+		}
+
+		log.Debug("retrying-to-unmount-busy-path", lager.Data{"attempt-number": attempt, "delay": delay.String()})
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
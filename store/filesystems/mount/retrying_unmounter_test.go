@@ -0,0 +1,137 @@
+package mount_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store/filesystems/mount"
+	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/lager/v3/lagertest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("Retrying Unmounter", func() {
+	var (
+		tmpDir        string
+		mountDestPath string
+		mountSrcPath  string
+		logger        *lagertest.TestLogger
+
+		unmounter  mount.RetryingUnmounter
+		unmountErr error
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		mountSrcPath = filepath.Join(tmpDir, "mntsrc")
+		Expect(os.MkdirAll(mountSrcPath, 755)).To(Succeed())
+
+		mountDestPath = filepath.Join(tmpDir, "mntdest")
+		Expect(os.MkdirAll(mountDestPath, 755)).To(Succeed())
+
+		logger = lagertest.NewTestLogger("retrying-unmounter")
+
+		unmounter = mount.RetryingUnmounter{MaxAttempts: 4, BaseDelay: time.Millisecond}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		unmountErr = unmounter.Unmount(logger, mountDestPath, 0)
+	})
+
+	When("the directory to unmount is mounted", func() {
+		BeforeEach(func() {
+			Expect(exec.Command("mount", "--bind", mountSrcPath, mountDestPath).Run()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			err := syscall.Unmount(mountDestPath, 0)
+			// do not fail if not mounted
+			if err != unix.EINVAL {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("unmounts it", func() {
+			Expect(unmountErr).NotTo(HaveOccurred())
+			mountTable, err := ioutil.ReadFile("/proc/self/mountinfo")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(mountTable)).NotTo(ContainSubstring(mountDestPath))
+		})
+
+		When("it stays busy", func() {
+			var busyFile *os.File
+
+			BeforeEach(func() {
+				var err error
+				busyFile, err = os.Create(filepath.Join(mountDestPath, "busyfile"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(busyFile.Close()).To(Succeed())
+			})
+
+			It("returns the bare EBUSY once the attempts run out", func() {
+				Expect(unmountErr).To(Equal(unix.EBUSY))
+			})
+
+			It("logs the retries at debug level", func() {
+				Expect(logger.LogMessages()).To(HaveLen(5))
+				for i := 1; i < 4; i++ {
+					Expect(logger).To(gbytes.Say("retrying-to-unmount-busy-path"))
+				}
+				Expect(logger).NotTo(gbytes.Say("retrying-to-unmount-busy-path"))
+
+				for _, log := range logger.Logs() {
+					Expect(log.LogLevel).To(Equal(lager.DEBUG))
+				}
+			})
+		})
+
+		When("it stops being busy while retrying", func() {
+			BeforeEach(func() {
+				busyFile, err := os.Create(filepath.Join(mountDestPath, "busyfile"))
+				Expect(err).NotTo(HaveOccurred())
+
+				unmounter.BaseDelay = 20 * time.Millisecond
+				time.AfterFunc(30*time.Millisecond, func() { busyFile.Close() })
+			})
+
+			It("unmounts it", func() {
+				Expect(unmountErr).NotTo(HaveOccurred())
+				Expect(logger).To(gbytes.Say("retrying-to-unmount-busy-path"))
+			})
+		})
+	})
+
+	When("the directory to unmount is not mounted", func() {
+		It("returns the bare EINVAL without retrying", func() {
+			Expect(unmountErr).To(Equal(unix.EINVAL))
+			Expect(logger).NotTo(gbytes.Say("retrying-to-unmount"))
+		})
+	})
+
+	When("the directory to unmount does not exist", func() {
+		BeforeEach(func() {
+			Expect(os.RemoveAll(mountDestPath)).To(Succeed())
+		})
+
+		It("returns the bare ENOENT", func() {
+			Expect(unmountErr).To(Equal(unix.ENOENT))
+		})
+	})
+})
@@ -11,14 +11,14 @@ import (
 type RootfulUnmounter struct {
 }
 
-func (u RootfulUnmounter) Unmount(log lager.Logger, path string) error {
+func (u RootfulUnmounter) Unmount(log lager.Logger, path string, flags int) error {
 	var err error
-	log = log.Session("rootful-unmounter", lager.Data{"path": path})
+	log = log.Session("rootful-unmounter", lager.Data{"path": path, "flags": flags})
 	log.Debug("start")
 	defer log.Debug("finish")
 
 	for i := 0; i < 50; i++ {
-		err = unix.Unmount(path, 0)
+		err = unix.Unmount(path, flags)
 		if err == nil {
 			return nil
 		}
@@ -23,8 +23,9 @@ var _ = Describe("Rootful Unmounter", func() {
 		mountSrcPath  string
 		logger        lager.Logger
 
-		unmounter  mount.RootfulUnmounter
-		unmountErr error
+		unmounter    mount.RootfulUnmounter
+		unmountFlags int
+		unmountErr   error
 	)
 
 	BeforeEach(func() {
@@ -41,6 +42,7 @@ var _ = Describe("Rootful Unmounter", func() {
 		logger = lagertest.NewTestLogger("rootful-unmounter")
 
 		unmounter = mount.RootfulUnmounter{}
+		unmountFlags = 0
 	})
 
 	AfterEach(func() {
@@ -48,7 +50,7 @@ var _ = Describe("Rootful Unmounter", func() {
 	})
 
 	JustBeforeEach(func() {
-		unmountErr = unmounter.Unmount(logger, mountDestPath)
+		unmountErr = unmounter.Unmount(logger, mountDestPath, unmountFlags)
 	})
 
 	When("the directory to unmount is mounted", func() {
@@ -93,6 +95,19 @@ var _ = Describe("Rootful Unmounter", func() {
 					Expect(logger).To(gbytes.Say("retrying"))
 				}
 			})
+
+			When("a lazy unmount is requested", func() {
+				BeforeEach(func() {
+					unmountFlags = unix.MNT_DETACH
+				})
+
+				It("detaches it", func() {
+					Expect(unmountErr).NotTo(HaveOccurred())
+					mountTable, err := ioutil.ReadFile("/proc/self/mountinfo")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(mountTable)).NotTo(ContainSubstring(mountDestPath))
+				})
+			})
 		})
 	})
 
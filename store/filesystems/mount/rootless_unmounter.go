@@ -12,7 +12,8 @@ import (
 type RootlessUnmounter struct {
 }
 
-func (u RootlessUnmounter) Unmount(log lager.Logger, path string) error {
+// Unmount ignores the flags, as there is nothing to unmount when rootless.
+func (u RootlessUnmounter) Unmount(log lager.Logger, path string, flags int) error {
 	mounted, err := isMountPoint(path)
 	if err != nil {
 		return err
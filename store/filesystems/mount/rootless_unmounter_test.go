@@ -45,7 +45,7 @@ var _ = Describe("Rootless Unmounter", func() {
 	})
 
 	JustBeforeEach(func() {
-		unmountErr = unmounter.Unmount(logger, mountDestPath)
+		unmountErr = unmounter.Unmount(logger, mountDestPath, 0)
 	})
 
 	When("the directory to unmount is mounted", func() {
@@ -31,6 +31,7 @@ type internalDriver interface {
 	CreateImage(logger lager.Logger, spec image_manager.ImageDriverSpec) (groot.MountInfo, error)
 	DestroyImage(logger lager.Logger, path string) error
 	FetchStats(logger lager.Logger, path string) (groot.VolumeStats, error)
+	ImagePaths(path string) image_manager.ImagePaths
 
 	Marshal(logger lager.Logger) ([]byte, error)
 }
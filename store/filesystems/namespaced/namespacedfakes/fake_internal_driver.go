@@ -91,6 +91,17 @@ type FakeInternalDriver struct {
 	handleOpaqueWhiteoutsReturnsOnCall map[int]struct {
 		result1 error
 	}
+	ImagePathsStub        func(string) image_manager.ImagePaths
+	imagePathsMutex       sync.RWMutex
+	imagePathsArgsForCall []struct {
+		arg1 string
+	}
+	imagePathsReturns struct {
+		result1 image_manager.ImagePaths
+	}
+	imagePathsReturnsOnCall map[int]struct {
+		result1 image_manager.ImagePaths
+	}
 	MarkVolumeArtifactsStub        func(lager.Logger, string) error
 	markVolumeArtifactsMutex       sync.RWMutex
 	markVolumeArtifactsArgsForCall []struct {
@@ -561,6 +572,67 @@ func (fake *FakeInternalDriver) HandleOpaqueWhiteoutsReturnsOnCall(i int, result
 	}{result1}
 }
 
+func (fake *FakeInternalDriver) ImagePaths(arg1 string) image_manager.ImagePaths {
+	fake.imagePathsMutex.Lock()
+	ret, specificReturn := fake.imagePathsReturnsOnCall[len(fake.imagePathsArgsForCall)]
+	fake.imagePathsArgsForCall = append(fake.imagePathsArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	stub := fake.ImagePathsStub
+	fakeReturns := fake.imagePathsReturns
+	fake.recordInvocation("ImagePaths", []interface{}{arg1})
+	fake.imagePathsMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeInternalDriver) ImagePathsCallCount() int {
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
+	return len(fake.imagePathsArgsForCall)
+}
+
+func (fake *FakeInternalDriver) ImagePathsCalls(stub func(string) image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = stub
+}
+
+func (fake *FakeInternalDriver) ImagePathsArgsForCall(i int) string {
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
+	argsForCall := fake.imagePathsArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeInternalDriver) ImagePathsReturns(result1 image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = nil
+	fake.imagePathsReturns = struct {
+		result1 image_manager.ImagePaths
+	}{result1}
+}
+
+func (fake *FakeInternalDriver) ImagePathsReturnsOnCall(i int, result1 image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = nil
+	if fake.imagePathsReturnsOnCall == nil {
+		fake.imagePathsReturnsOnCall = make(map[int]struct {
+			result1 image_manager.ImagePaths
+		})
+	}
+	fake.imagePathsReturnsOnCall[i] = struct {
+		result1 image_manager.ImagePaths
+	}{result1}
+}
+
 func (fake *FakeInternalDriver) MarkVolumeArtifacts(arg1 lager.Logger, arg2 string) error {
 	fake.markVolumeArtifactsMutex.Lock()
 	ret, specificReturn := fake.markVolumeArtifactsReturnsOnCall[len(fake.markVolumeArtifactsArgsForCall)]
@@ -957,6 +1029,8 @@ func (fake *FakeInternalDriver) Invocations() map[string][][]interface{} {
 	defer fake.fetchStatsMutex.RUnlock()
 	fake.handleOpaqueWhiteoutsMutex.RLock()
 	defer fake.handleOpaqueWhiteoutsMutex.RUnlock()
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
 	fake.markVolumeArtifactsMutex.RLock()
 	defer fake.markVolumeArtifactsMutex.RUnlock()
 	fake.marshalMutex.RLock()
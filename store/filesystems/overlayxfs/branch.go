@@ -0,0 +1,140 @@
+package overlayxfs
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// reflinkCopy copies the contents of a directory sharing the data blocks with
+// the source, failing if the filesystem does not support it.
+func reflinkCopy(src, dst string) error {
+	return copyDirContents(src, dst, "--reflink=always")
+}
+
+// WithReflinkCopy replaces how BranchVolume copies a volume with reflinks,
+// e.g. so that tests can exercise the fallback to a regular copy.
+func (d *Driver) WithReflinkCopy(copy func(src, dst string) error) *Driver {
+	d.reflinkCopy = copy
+	return d
+}
+
+// BranchVolume creates a new volume with the contents of an existing one,
+// that can then be modified without affecting the source. The copy uses
+// reflinks when the filesystem supports them, making it cheap, and falls back
+// to a regular copy otherwise.
+func (d *Driver) BranchVolume(logger lager.Logger, srcID, dstID string) (string, error) {
+	logger = logger.Session("overlayxfs-branching-volume", lager.Data{"srcID": srcID, "dstID": dstID})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	srcPath, err := d.volumePath(logger, srcID)
+	if err != nil {
+		logger.Error("source-volume-not-found", err)
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, dstID)); err == nil {
+		return "", errorspkg.Errorf("volume %s already exists", dstID)
+	}
+
+	// Staged under a temporary id, so that concurrent branches to the same
+	// id do not copy into the same directory
+	tempID := stagingVolumeID(dstID)
+	tempPath, err := d.CreateVolume(logger, srcID, tempID)
+	if err != nil {
+		return "", err
+	}
+
+	dstPath, err := d.completeBranch(logger, srcID, srcPath, tempID, tempPath, dstID)
+	if err != nil {
+		if destroyErr := d.DestroyVolume(logger, tempID); destroyErr != nil {
+			logger.Error("destroying-branch-failed", destroyErr)
+		}
+		return "", err
+	}
+
+	return dstPath, nil
+}
+
+func (d *Driver) completeBranch(logger lager.Logger, srcID, srcPath, tempID, tempPath, dstID string) (string, error) {
+	if err := d.copyVolume(logger, srcID, srcPath, tempID, tempPath); err != nil {
+		return "", err
+	}
+
+	dstPath := filepath.Join(filepath.Dir(tempPath), dstID)
+	if err := d.MoveVolume(logger, tempPath, dstPath); err != nil {
+		return "", err
+	}
+
+	// MoveVolume leaves the volume in place when another branch to the same
+	// id got there first
+	if _, err := os.Stat(tempPath); err == nil {
+		return "", errorspkg.Errorf("volume %s already exists", dstID)
+	}
+
+	if err := d.moveVolumeMeta(tempID, dstID); err != nil {
+		return "", errorspkg.Wrap(err, "moving volume metadata")
+	}
+
+	return dstPath, nil
+}
+
+func (d *Driver) copyVolume(logger lager.Logger, srcID, srcPath, dstID, dstPath string) error {
+	if err := d.reflinkCopy(srcPath, dstPath); err != nil {
+		logger.Info("reflink-copy-failed-falling-back-to-copy", lager.Data{"error": err.Error()})
+
+		if err := emptyDir(dstPath); err != nil {
+			return errorspkg.Wrap(err, "cleaning up failed reflink copy")
+		}
+
+		if err := copyDirContents(srcPath, dstPath); err != nil {
+			logger.Error("copying-volume-failed", err)
+			return errorspkg.Wrap(err, "copying volume")
+		}
+	}
+
+	size, err := d.VolumeSize(logger, srcID)
+	if err != nil {
+		if size, err = calculatePathSize(logger, dstPath); err != nil {
+			return errorspkg.Wrap(err, "calculating volume size")
+		}
+	}
+
+	return d.WriteVolumeMeta(logger, dstID, base_image_puller.VolumeMeta{Size: size})
+}
+
+func copyDirContents(src, dst string, extraArgs ...string) error {
+	args := append([]string{"--archive"}, extraArgs...)
+	args = append(args, src+"/.", dst)
+
+	cmd := exec.Command("cp", args...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errorspkg.Wrapf(err, "cp failed: %s", stderr.String())
+	}
+
+	return nil
+}
+
+func emptyDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package overlayxfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/moby/sys/mountinfo"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrMetadataCorrupt = errorspkg.New("metadata does not match its checksum")
+
+// checksumKey is the field of a metadata document holding the checksum of
+// the rest of it. Keeping it in the same file, written with a rename, means
+// the two can never be out of step. Metadata written before checksums were
+// introduced has none and is trusted as is.
+const checksumKey = "sha256"
+
+// metadataChecksum sums the fields of the document but its checksum. They
+// are marshalled again so that the sum does not depend on the order or the
+// spacing of the fields.
+func metadataChecksum(fields map[string]json.RawMessage) (string, error) {
+	withoutChecksum := map[string]json.RawMessage{}
+	for key, value := range fields {
+		if key != checksumKey {
+			withoutChecksum[key] = value
+		}
+	}
+
+	contents, err := json.Marshal(withoutChecksum)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeChecksummedFile adds the checksum to a JSON metadata document and
+// replaces the file with it atomically.
+func writeChecksummedFile(path string, contents []byte, perm os.FileMode) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return err
+	}
+
+	checksum, err := metadataChecksum(fields)
+	if err != nil {
+		return err
+	}
+	fields[checksumKey], _ = json.Marshal(checksum)
+
+	checksummed, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(path, checksummed, perm)
+}
+
+// replaceFile atomically replaces the file at path. Each writer uses its own
+// temporary file, removed on failure, so that files written concurrently,
+// e.g. the metadata of an image being touched while mounted, are not torn.
+func replaceFile(path string, contents []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// verifyChecksum checks the contents read from a metadata file against the
+// checksum they hold, if any.
+func verifyChecksum(path string, contents []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return errorspkg.Wrapf(err, "decoding %s", path)
+	}
+
+	var checksum string
+	if _, ok := fields[checksumKey]; !ok {
+		return nil
+	}
+	if err := json.Unmarshal(fields[checksumKey], &checksum); err != nil {
+		return errorspkg.Wrap(ErrMetadataCorrupt, path)
+	}
+
+	expected, err := metadataChecksum(fields)
+	if err != nil {
+		return err
+	}
+	if checksum != expected {
+		return errorspkg.Wrap(ErrMetadataCorrupt, path)
+	}
+
+	return nil
+}
+
+func hasChecksum(path string) bool {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return false
+	}
+	_, ok := fields[checksumKey]
+	return ok
+}
+
+// RepairMetadata rewrites the volume and image metadata that is corrupt, and
+// adds checksums to the metadata that has none. The size of volumes is
+// measured again, while images can only be repaired when their overlay is
+// mounted, from the mount. Images it cannot repair are quarantined when
+// quarantining is enabled. It returns the paths of the metadata it rewrote,
+// along with an error listing the images it could not repair.
+func (d *Driver) RepairMetadata(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-repairing-metadata")
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	repaired := []string{}
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, volumeID := range volumeIDs {
+		metaPath := d.volumeMetaFilePath(volumeID)
+		if metadata, err := d.readVolumeMeta(volumeID); err == nil {
+			if hasChecksum(metaPath) {
+				continue
+			}
+
+			if err := d.WriteVolumeMeta(logger, volumeID, metadata); err != nil {
+				return repaired, err
+			}
+			repaired = append(repaired, metaPath)
+			continue
+		}
+
+		logger.Info("regenerating-volume-metadata", lager.Data{"volumeID": volumeID})
+		if err := d.GenerateVolumeMeta(logger, volumeID); err != nil {
+			logger.Error("regenerating-volume-metadata-failed", err, lager.Data{"volumeID": volumeID})
+			return repaired, errorspkg.Wrapf(err, "regenerating metadata of volume %s", volumeID)
+		}
+		repaired = append(repaired, metaPath)
+	}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return repaired, err
+	}
+
+	mounts, err := d.imageOverlayMounts()
+	if err != nil {
+		return repaired, err
+	}
+	mountsByRootfs := map[string]*mountinfo.Info{}
+	for _, mount := range mounts {
+		mountsByRootfs[mount.Mountpoint] = mount
+	}
+
+	unrepairable := []string{}
+	for _, imageID := range imageIDs {
+		imagePath := d.imagePath(imageID)
+		metadataPath := filepath.Join(imagePath, imageMetadataName)
+
+		metadata, err := d.readImageMetadata(imagePath)
+		if err == nil {
+			if hasChecksum(metadataPath) {
+				continue
+			}
+		} else if os.IsNotExist(errorspkg.Cause(err)) {
+			continue
+		} else {
+			mount, mounted := mountsByRootfs[filepath.Join(imagePath, RootfsDir)]
+			if !mounted {
+				err = errorspkg.New("the image is not mounted")
+			} else {
+				metadata, err = d.imageMetadataFromMount(imagePath, mount)
+			}
+			if err != nil {
+				logger.Info("cannot-repair-image", lager.Data{"imageID": imageID, "error": err.Error()})
+				if d.quarantine {
+					if err := d.quarantineImage(logger, imageID); err == nil {
+						continue
+					}
+				}
+				unrepairable = append(unrepairable, imageID)
+				continue
+			}
+		}
+
+		logger.Info("rewriting-image-metadata", lager.Data{"imageID": imageID})
+		if err := d.writeImageMetadata(imagePath, metadata); err != nil {
+			logger.Error("rewriting-image-metadata-failed", err, lager.Data{"imageID": imageID})
+			return repaired, err
+		}
+		repaired = append(repaired, metadataPath)
+	}
+
+	if len(unrepairable) > 0 {
+		return repaired, errorspkg.Errorf("could not repair the metadata of the images: %s", strings.Join(unrepairable, ", "))
+	}
+
+	return repaired, nil
+}
+
+// imageMetadataFromMount rebuilds the metadata of an image from its overlay
+// mount. The options the kernel reports for the mount are kept, as it leaves
+// out the ones set to their default. Protected paths and extra mounts cannot
+// be told apart, so images with mounts under their rootfs are not rebuilt.
+func (d *Driver) imageMetadataFromMount(imagePath string, mount *mountinfo.Info) (imageMetadata, error) {
+	rootfsDir := filepath.Join(imagePath, RootfsDir)
+	subMounts, err := d.mountsUnder(rootfsDir)
+	if err != nil {
+		return imageMetadata{}, err
+	}
+	if len(subMounts) > 0 {
+		return imageMetadata{}, errorspkg.Errorf("the rootfs has mounts under it: %s", strings.Join(subMounts, ", "))
+	}
+
+	metadata := imageMetadata{MountSource: mount.Source, ReadOnly: true}
+	for _, lowerDir := range reversed(overlayLowerDirs(mount)) {
+		volumeID, ok := d.volumeIDFromLowerDir(lowerDir)
+		if !ok {
+			return imageMetadata{}, errorspkg.Errorf("lowerdir %s is not a volume of the store", lowerDir)
+		}
+		metadata.BaseVolumeIDs = append(metadata.BaseVolumeIDs, volumeID)
+	}
+
+	for _, option := range strings.Split(mount.VFSOptions, ",") {
+		name := strings.SplitN(option, "=", 2)[0]
+		switch name {
+		case "rw", "ro", "lowerdir", "workdir":
+		case "upperdir":
+			metadata.ReadOnly = false
+			upperDir := strings.TrimPrefix(option, "upperdir=")
+			if filepath.Dir(upperDir) == imagePath {
+				continue
+			}
+
+			// Upper devices keep the upperdir under a directory named after
+			// the image
+			deviceImagePath := filepath.Dir(upperDir)
+			if filepath.Base(deviceImagePath) != filepath.Base(imagePath) {
+				return imageMetadata{}, errorspkg.Errorf("upperdir %s is not the one of the image", upperDir)
+			}
+			metadata.UpperDevicePath = filepath.Dir(deviceImagePath)
+		default:
+			metadata.MountOptions = append(metadata.MountOptions, option)
+		}
+	}
+
+	return metadata, nil
+}
+
+// readVolumeMeta reads and verifies the metadata of a volume.
+func (d *Driver) readVolumeMeta(id string) (base_image_puller.VolumeMeta, error) {
+	metaPath := d.volumeMetaFilePath(id)
+	contents, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return base_image_puller.VolumeMeta{}, err
+	}
+
+	var metadata base_image_puller.VolumeMeta
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return base_image_puller.VolumeMeta{}, err
+	}
+
+	if err := verifyChecksum(metaPath, contents); err != nil {
+		return base_image_puller.VolumeMeta{}, err
+	}
+
+	return metadata, nil
+}
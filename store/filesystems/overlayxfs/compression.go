@@ -0,0 +1,133 @@
+package overlayxfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// compressedUpperName is the archive holding the upperdir of an image whose
+// upperdir has been compressed. Its presence is what marks the image as
+// compressed.
+const compressedUpperName = "diff.tar.gz"
+
+// CompressIdleUpper trades CPU for disk on images that are not in use: it
+// compresses the upperdir of an unmounted image into an archive and removes
+// the upperdir. The upperdir is restored by MountImage before mounting. It
+// returns the number of bytes saved, which can be negative when the upperdir
+// does not compress well. Images keeping their upperdir on the upper device
+// are not compressed, as it is only bound into the image path.
+func (d *Driver) CompressIdleUpper(logger lager.Logger, imagePath string) (int64, error) {
+	logger = logger.Session("overlayxfs-compressing-upperdir", lager.Data{"imagePath": imagePath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	mounted, err := d.IsImageMounted(logger, imagePath)
+	if err != nil {
+		logger.Error("checking-if-image-is-mounted-failed", err)
+		return 0, err
+	}
+	if mounted {
+		return 0, errorspkg.Errorf("image %s is mounted, refusing to compress its upperdir", imagePath)
+	}
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return 0, err
+	}
+	if metadata.UpperDevicePath != "" {
+		return 0, errorspkg.Errorf("image %s keeps its upperdir on the upper device, refusing to compress it", imagePath)
+	}
+
+	archivePath := filepath.Join(imagePath, compressedUpperName)
+	if _, err := os.Stat(archivePath); err == nil {
+		logger.Debug("upperdir-already-compressed")
+		return 0, nil
+	}
+
+	upperDir := filepath.Join(imagePath, UpperDir)
+	upperSize, err := calculatePathSize(logger, upperDir)
+	if err != nil {
+		logger.Error("calculating-upperdir-size-failed", err)
+		return 0, errorspkg.Wrap(err, "calculating upperdir size")
+	}
+
+	tmpArchivePath := archivePath + ".tmp"
+	if err := runTar(logger, "--create", "--gzip", "--file", tmpArchivePath, "--directory", imagePath, UpperDir); err != nil {
+		_ = os.Remove(tmpArchivePath)
+		return 0, errorspkg.Wrap(err, "compressing upperdir")
+	}
+
+	// Once the archive is in place the image is considered compressed, so a
+	// crash before the upperdir is removed is recovered from on decompression.
+	if err := os.Rename(tmpArchivePath, archivePath); err != nil {
+		_ = os.Remove(tmpArchivePath)
+		return 0, errorspkg.Wrap(err, "moving upperdir archive")
+	}
+
+	if err := os.RemoveAll(upperDir); err != nil {
+		logger.Error("removing-upperdir-failed", err)
+		return 0, errorspkg.Wrap(err, "removing upperdir")
+	}
+
+	archiveStat, err := os.Stat(archivePath)
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "stating upperdir archive")
+	}
+
+	return upperSize - archiveStat.Size(), nil
+}
+
+// decompressUpper restores the upperdir of an image compressed by
+// CompressIdleUpper. It does nothing if the image is not compressed.
+func (d *Driver) decompressUpper(logger lager.Logger, imagePath string) error {
+	archivePath := filepath.Join(imagePath, compressedUpperName)
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	logger = logger.Session("decompressing-upperdir", lager.Data{"imagePath": imagePath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	// Leftovers of an interrupted compression or decompression
+	upperDir := filepath.Join(imagePath, UpperDir)
+	if err := os.RemoveAll(upperDir); err != nil {
+		return errorspkg.Wrap(err, "removing partial upperdir")
+	}
+
+	if err := runTar(logger, "--extract", "--gzip", "--same-owner", "--file", archivePath, "--directory", imagePath); err != nil {
+		return err
+	}
+
+	return os.Remove(archivePath)
+}
+
+func runTar(logger lager.Logger, args ...string) error {
+	return runTarWithInput(logger, nil, args...)
+}
+
+func runTarWithInput(logger lager.Logger, stdin io.Reader, args ...string) error {
+	return runTarWithIO(logger, stdin, nil, args...)
+}
+
+func runTarWithIO(logger lager.Logger, stdin io.Reader, stdout io.Writer, args ...string) error {
+	args = append([]string{"--xattrs", "--xattrs-include=*", "--numeric-owner", "--preserve-permissions"}, args...)
+	cmd := exec.Command("tar", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		logger.Error("tar-failed", err, lager.Data{"args": cmd.Args, "stderr": stderr.String()})
+		return errorspkg.Wrapf(err, "tar failed: %s", stderr.String())
+	}
+
+	return nil
+}
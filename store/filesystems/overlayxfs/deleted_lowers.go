@@ -0,0 +1,77 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// deletedSuffixes are how the kernel marks paths deleted from under a mount.
+// Mount options are not unescaped by the mountinfo parser, hence the octal
+// space.
+var deletedSuffixes = []string{` (deleted)`, `\040(deleted)`}
+
+// ImagesWithDeletedLowers returns the ids of the mounted images whose overlay
+// has a lowerdir that no longer exists, either marked as deleted in mountinfo
+// or missing on disk. Their rootfs keeps working off the deleted directory
+// until unmounted, but cannot be mounted again.
+func (d *Driver) ImagesWithDeletedLowers(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-images-with-deleted-lowers")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	mounts, err := d.imageOverlayMounts()
+	if err != nil {
+		logger.Error("reading-mounts-failed", err)
+		return nil, err
+	}
+
+	affected := map[string]bool{}
+	for _, mount := range mounts {
+		imageID := filepath.Base(filepath.Dir(mount.Mountpoint))
+		for _, lowerDir := range overlayLowerDirs(mount) {
+			deleted, err := d.isLowerDirDeleted(lowerDir)
+			if err != nil {
+				return nil, err
+			}
+			if deleted {
+				logger.Info("found-deleted-lowerdir", lager.Data{"imageID": imageID, "lowerDir": lowerDir})
+				affected[imageID] = true
+			}
+		}
+	}
+
+	imageIDs := []string{}
+	for imageID := range affected {
+		imageIDs = append(imageIDs, imageID)
+	}
+	sort.Strings(imageIDs)
+
+	return imageIDs, nil
+}
+
+func (d *Driver) isLowerDirDeleted(lowerDir string) (bool, error) {
+	for _, suffix := range deletedSuffixes {
+		if strings.HasSuffix(lowerDir, suffix) {
+			return true, nil
+		}
+	}
+
+	// Lowerdirs are usually links relative to the store path
+	if !filepath.IsAbs(lowerDir) {
+		lowerDir = filepath.Join(d.storePath, lowerDir)
+	}
+
+	if _, err := os.Stat(lowerDir); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, errorspkg.Wrapf(err, "stat lowerdir %s", lowerDir)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,86 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	quotapkg "code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/quota"
+	"code.cloudfoundry.org/lager/v3"
+	"golang.org/x/sys/unix"
+)
+
+// DestroyImagePlan is what DestroyImage would do to an image, in order.
+type DestroyImagePlan struct {
+	// Unmounts are the mount points it would unmount: the protected paths,
+	// the rootfs and the upperdirs bound from an upper device.
+	Unmounts []string
+	// Removals are the directories it would delete.
+	Removals []string
+}
+
+// DestroyImageDryRun reports the mount points and directories DestroyImage
+// would unmount and delete, without touching them.
+func (d *Driver) DestroyImageDryRun(logger lager.Logger, imagePath string) (DestroyImagePlan, error) {
+	logger = logger.Session("overlayxfs-destroy-image-dry-run", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	unlockStore, err := d.lockStore(unix.LOCK_EX)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return DestroyImagePlan{}, err
+	}
+	defer unlockStore()
+
+	plan := DestroyImagePlan{Unmounts: []string{}, Removals: []string{}}
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		return plan, nil
+	}
+
+	// Images that failed to be created might not have metadata
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		metadata = imageMetadata{}
+	}
+
+	rootfsDir := filepath.Join(imagePath, RootfsDir)
+	mountPoints := []string{}
+	for i := len(metadata.ExtraMounts) - 1; i >= 0; i-- {
+		if target, err := extraMountTarget(rootfsDir, metadata.ExtraMounts[i].Destination); err == nil {
+			mountPoints = append(mountPoints, target)
+		}
+	}
+	for i := len(metadata.ProtectedPaths) - 1; i >= 0; i-- {
+		if target, err := protectedPathTarget(rootfsDir, metadata.ProtectedPaths[i]); err == nil {
+			mountPoints = append(mountPoints, target)
+		}
+	}
+	mountPoints = append(mountPoints, rootfsDir)
+	if metadata.UpperDevicePath != "" {
+		mountPoints = append(mountPoints, filepath.Join(imagePath, UpperDir), filepath.Join(imagePath, WorkDir))
+	}
+
+	for _, mountPoint := range mountPoints {
+		mounted, err := d.isMountPoint(mountPoint)
+		if err != nil {
+			logger.Error("reading-mountinfo-failed", err)
+			return DestroyImagePlan{}, err
+		}
+		if mounted {
+			plan.Unmounts = append(plan.Unmounts, mountPoint)
+		}
+	}
+
+	if metadata.UpperDevicePath != "" {
+		upperDir, _ := overlayUpperDirs(imagePath, metadata.UpperDevicePath)
+		plan.Removals = append(plan.Removals, filepath.Dir(upperDir))
+	}
+	plan.Removals = append(plan.Removals, imagePath)
+
+	if projectID, err := quotapkg.GetProjectID(logger, imagePath); err == nil && projectID != 0 {
+		plan.Removals = append(plan.Removals, filepath.Join(d.storePath, IDDir, strconv.Itoa(int(projectID))))
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,234 @@
+package overlayxfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	quotapkg "code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/quota"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultUnmountAttempts is how many times DestroyStore tries to unmount
+	// a busy image before giving up on it, or falling back to a lazy unmount
+	// when the destroy options allow it.
+	DefaultUnmountAttempts = 3
+	// DefaultUnmountBackoff is the wait before the first retry, doubled on
+	// every retry after it.
+	DefaultUnmountBackoff = 100 * time.Millisecond
+)
+
+// ErrStoreStillMounted is returned by DestroyStore when mounts are left under
+// the store once its images are unmounted, as removing the store would
+// recurse into them.
+var ErrStoreStillMounted = errorspkg.New("store still has mounts")
+
+type DestroyStoreSummary struct {
+	// DestroyedImages are the ids of the images unmounted and released.
+	DestroyedImages []string
+	// StuckImages maps the ids of the images that could not be unmounted or
+	// released to the reason why.
+	StuckImages map[string]string
+}
+
+// WithUnmountRetries sets how many times DestroyStore tries to unmount an
+// image whose rootfs is busy, and how long it waits before the first retry.
+// Once they are used up it falls back to a lazy unmount if the destroy options
+// allow detached unmounts.
+func (d *Driver) WithUnmountRetries(attempts int, backoff time.Duration) *Driver {
+	d.unmountAttempts = attempts
+	d.unmountBackoff = backoff
+	return d
+}
+
+// DestroyStore unmounts and releases the quota of every image, then removes
+// the whole store. Images that cannot be unmounted do not stop the others
+// from being destroyed; they are reported in the summary and the store is
+// kept, so that DestroyStore can be called again once they are free. The
+// store is kept too while anything is still mounted under it.
+func (d *Driver) DestroyStore(logger lager.Logger) (DestroyStoreSummary, error) {
+	logger = logger.Session("overlayxfs-destroying-store", lager.Data{"storePath": d.storePath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	summary := DestroyStoreSummary{
+		DestroyedImages: []string{},
+		StuckImages:     map[string]string{},
+	}
+
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return summary, err
+	}
+	defer finishOperation()
+
+	unlockStore, err := d.lockStore(unix.LOCK_EX)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return summary, err
+	}
+	defer unlockStore()
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return summary, err
+	}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil && !os.IsNotExist(errorspkg.Cause(err)) {
+		return summary, err
+	}
+
+	for _, imageID := range imageIDs {
+		imagePath := d.imagePath(imageID)
+		rootfsPath := filepath.Join(imagePath, RootfsDir)
+		d.unmountRootfsSubmounts(logger, rootfsPath)
+		if err := d.unmountRootfsWithRetries(logger, rootfsPath); err != nil {
+			logger.Error("unmounting-rootfs-failed", err, lager.Data{"imageID": imageID})
+			summary.StuckImages[imageID] = errorspkg.Wrap(err, "unmounting").Error()
+			continue
+		}
+
+		// The store itself is removed below, but not the binds of the upper
+		// device nor its directories
+		if metadata, err := d.readImageMetadata(imagePath); err == nil && metadata.UpperDevicePath != "" {
+			if err := d.removeDeviceUpperDirs(logger, imagePath, metadata.UpperDevicePath); err != nil {
+				logger.Error("removing-upper-device-dirs-failed", err, lager.Data{"imageID": imageID})
+				summary.StuckImages[imageID] = errorspkg.Wrap(err, "removing upper device dirs").Error()
+				continue
+			}
+		}
+
+		// Project ids are reused, and the XFS quota records would outlive the
+		// store otherwise
+		if err := d.ReleaseQuota(logger, imagePath); err != nil {
+			logger.Error("releasing-quota-failed", err, lager.Data{"imageID": imageID})
+			summary.StuckImages[imageID] = errorspkg.Wrap(err, "releasing quota").Error()
+			continue
+		}
+
+		summary.DestroyedImages = append(summary.DestroyedImages, imageID)
+	}
+
+	if len(summary.StuckImages) > 0 {
+		logger.Info("keeping-store-with-stuck-images", lager.Data{"summary": summary})
+		return summary, errorspkg.Errorf("%d images could not be destroyed: %s", len(summary.StuckImages), stuckImagesList(summary.StuckImages))
+	}
+
+	mountPoints, err := d.storeMounts()
+	if err != nil {
+		logger.Error("listing-store-mounts-failed", err)
+		return summary, err
+	}
+	if len(mountPoints) > 0 {
+		logger.Info("keeping-store-with-mounts", lager.Data{"mountPoints": mountPoints})
+		return summary, errorspkg.Wrapf(ErrStoreStillMounted, "%s", strings.Join(mountPoints, ", "))
+	}
+
+	if err := os.RemoveAll(d.storePath); err != nil {
+		logger.Error("removing-store-failed", err)
+		return summary, errorspkg.Wrap(err, "removing store")
+	}
+
+	return summary, nil
+}
+
+// unmountRootfsWithRetries unmounts the rootfs, retrying with a backoff while
+// it is busy, then lazily once the retries are used up if allowed.
+func (d *Driver) unmountRootfsWithRetries(logger lager.Logger, rootfsPath string) error {
+	options := d.destroyOptions
+
+	backoff := d.unmountBackoff
+	for attempt := 1; ; attempt++ {
+		err := d.unmounter.Unmount(logger, rootfsPath, options.UnmountFlags)
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+			logger.Debug("rootfs-not-mounted", lager.Data{"rootfsPath": rootfsPath})
+			return nil
+		}
+		if err == nil || !errors.Is(err, unix.EBUSY) {
+			return err
+		}
+
+		if attempt >= d.unmountAttempts {
+			if !options.AllowDetachedUnmount || options.UnmountFlags&unix.MNT_DETACH != 0 {
+				return errorspkg.Wrapf(err, "rootfs still busy after %d attempts", attempt)
+			}
+			break
+		}
+
+		logger.Info("rootfs-busy-retrying", lager.Data{"rootfsPath": rootfsPath, "attempt": attempt, "backoff": backoff.String()})
+		<-d.clock.After(backoff)
+		backoff *= 2
+	}
+
+	logger.Info("rootfs-busy-falling-back-to-lazy-unmount", lager.Data{"rootfsPath": rootfsPath})
+	return d.unmounter.Unmount(logger, rootfsPath, options.UnmountFlags|unix.MNT_DETACH)
+}
+
+func stuckImagesList(stuckImages map[string]string) string {
+	entries := []string{}
+	for imageID, reason := range stuckImages {
+		entries = append(entries, fmt.Sprintf("%s (%s)", imageID, reason))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ", ")
+}
+
+// ReleaseQuota lifts the disk limit of the image and gives its project id
+// back, so that the id can be reused without the limit coming along.
+func (d *Driver) ReleaseQuota(logger lager.Logger, imagePath string) error {
+	logger = logger.Session("overlayxfs-releasing-quota", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	limit, err := readImageQuota(imagePath)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	projectID, err := quotapkg.GetProjectID(logger, imagePath)
+	if err != nil {
+		logger.Error("fetching-project-id-failed", err)
+		return errorspkg.Wrap(err, "fetching project id")
+	}
+
+	// A limit of 0 means no limit
+	if err := d.quotaManager.SetLimit(logger, imagePath, 0); err != nil {
+		logger.Error("lifting-limit-failed", err)
+		return errorspkg.Wrap(err, "lifting disk limit")
+	}
+
+	if err := os.Remove(filepath.Join(imagePath, imageQuotaName)); err != nil {
+		return errorspkg.Wrap(err, "removing image quota")
+	}
+
+	if projectID != 0 {
+		d.releaseProjectID(logger, imagePath, projectID)
+	}
+
+	return nil
+}
+
+// releaseProjectID makes the project id of the image available again and
+// removes the image from the project mapping files.
+func (d *Driver) releaseProjectID(logger lager.Logger, imagePath string, projectID uint32) {
+	if err := os.RemoveAll(filepath.Join(d.storePath, IDDir, strconv.Itoa(int(projectID)))); err != nil {
+		logger.Error("removing-project-id-folder-failed", err)
+	}
+
+	if err := d.forgetImageProject(logger, imagePath); err != nil {
+		logger.Error("removing-project-mapping-failed", err)
+	}
+}
@@ -0,0 +1,88 @@
+package overlayxfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSysBlockDevicesPath is where the kernel exposes block devices by
+// number.
+const DefaultSysBlockDevicesPath = "/sys/dev/block"
+
+// WithSysBlockDevicesPath replaces where block devices are looked up by
+// number, e.g. for tests to fake the devices.
+func (d *Driver) WithSysBlockDevicesPath(path string) *Driver {
+	d.sysBlockDevicesPath = path
+	return d
+}
+
+// IOInfo is the IO configuration of the block device backing the store.
+type IOInfo struct {
+	// Device is the name of the disk, e.g. sda, even when the store lives on
+	// one of its partitions.
+	Device string
+	// Scheduler is the IO scheduler in use, e.g. mq-deadline.
+	Scheduler string
+	// AvailableSchedulers are the schedulers the device can be switched to.
+	AvailableSchedulers []string
+	// QueueDepth is the number of requests the scheduler can queue.
+	QueueDepth int
+}
+
+// BackingDeviceIOInfo reports the IO scheduler and queue depth of the block
+// device the store lives on.
+func (d *Driver) BackingDeviceIOInfo(logger lager.Logger) (IOInfo, error) {
+	logger = logger.Session("overlayxfs-backing-device-io-info", lager.Data{"storePath": d.storePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	var stat unix.Stat_t
+	if err := unix.Stat(d.storePath, &stat); err != nil {
+		return IOInfo{}, errorspkg.Wrap(err, "stat store")
+	}
+
+	deviceNumber := fmt.Sprintf("%d:%d", unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev)))
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(d.sysBlockDevicesPath, deviceNumber))
+	if err != nil {
+		logger.Error("resolving-device-failed", err, lager.Data{"device": deviceNumber})
+		return IOInfo{}, errorspkg.Wrapf(err, "resolving block device %s", deviceNumber)
+	}
+
+	// Partitions share the queue of their disk
+	if _, err := os.Stat(filepath.Join(devicePath, "partition")); err == nil {
+		devicePath = filepath.Dir(devicePath)
+	}
+
+	info := IOInfo{Device: filepath.Base(devicePath)}
+
+	schedulers, err := ioutil.ReadFile(filepath.Join(devicePath, "queue", "scheduler"))
+	if err != nil {
+		return IOInfo{}, errorspkg.Wrapf(err, "reading scheduler of %s", info.Device)
+	}
+	for _, scheduler := range strings.Fields(string(schedulers)) {
+		if strings.HasPrefix(scheduler, "[") && strings.HasSuffix(scheduler, "]") {
+			scheduler = strings.Trim(scheduler, "[]")
+			info.Scheduler = scheduler
+		}
+		info.AvailableSchedulers = append(info.AvailableSchedulers, scheduler)
+	}
+
+	queueDepth, err := ioutil.ReadFile(filepath.Join(devicePath, "queue", "nr_requests"))
+	if err != nil {
+		return IOInfo{}, errorspkg.Wrapf(err, "reading queue depth of %s", info.Device)
+	}
+	info.QueueDepth, err = strconv.Atoi(strings.TrimSpace(string(queueDepth)))
+	if err != nil {
+		return IOInfo{}, errorspkg.Wrapf(err, "parsing queue depth of %s", info.Device)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,101 @@
+package overlayxfs
+
+import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/lager/v3"
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+// WithDigestAlgorithm sets the algorithm content digests are computed with,
+// e.g. to match the conventions of the registry the layers come from. The
+// default is sha256.
+func (d *Driver) WithDigestAlgorithm(algorithm digestpkg.Algorithm) *Driver {
+	d.digestAlgorithm = algorithm
+	return d
+}
+
+// VolumeDigest computes a digest of the contents of the volume: the paths,
+// modes, ownership and data of its files, in a stable order. Timestamps are
+// left out, so that copies of a volume have the same digest.
+func (d *Driver) VolumeDigest(logger lager.Logger, id string) (digestpkg.Digest, error) {
+	logger = logger.Session("overlayxfs-volume-digest", lager.Data{"volumeID": id, "algorithm": d.digestAlgorithm})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumePath, err := d.volumePath(logger, id)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := d.contentDigest(volumePath)
+	if err != nil {
+		logger.Error("computing-digest-failed", err)
+		return "", errorspkg.Wrapf(err, "computing digest of volume %s", id)
+	}
+
+	return digest, nil
+}
+
+// contentDigest is the digest of a directory tree, computed with the
+// algorithm of the driver.
+func (d *Driver) contentDigest(root string) (digestpkg.Digest, error) {
+	if !d.digestAlgorithm.Available() {
+		return "", errorspkg.Errorf("digest algorithm %q is not available", d.digestAlgorithm)
+	}
+
+	digester := d.digestAlgorithm.Digester()
+	hash := digester.Hash()
+
+	// Walk visits the entries in lexical order
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		var uid, gid uint32
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00%d\x00%d\x00", relPath, info.Mode(), uid, gid)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", target)
+		case info.Mode().IsRegular():
+			fmt.Fprintf(hash, "%d\x00", info.Size())
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if _, err := io.Copy(hash, file); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return digester.Digest(), nil
+}
@@ -0,0 +1,31 @@
+package overlayxfs
+
+import "os"
+
+// DefaultDirMode is the mode of the directories of volumes and images.
+const DefaultDirMode os.FileMode = 0755
+
+// WithVolumeDirMode sets the mode of the directories of the volumes created,
+// e.g. to let a runtime user of their group traverse them. The default is
+// DefaultDirMode.
+func (d *Driver) WithVolumeDirMode(mode os.FileMode) *Driver {
+	d.volumeDirMode = mode
+	return d
+}
+
+// WithImageDirMode sets the mode of the upperdir, workdir and rootfs
+// directories of the images created. The default is DefaultDirMode.
+func (d *Driver) WithImageDirMode(mode os.FileMode) *Driver {
+	d.imageDirMode = mode
+	return d
+}
+
+// imageDirectoryMode is the mode an image directory is created with. The
+// workdir is private to overlay, which must be the only one writing to it, so
+// it is never made writable by the group or others.
+func (d *Driver) imageDirectoryMode(name string) os.FileMode {
+	if name == WorkDir {
+		return d.imageDirMode &^ 0022
+	}
+	return d.imageDirMode
+}
@@ -0,0 +1,83 @@
+package overlayxfs
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DiskLimitCapacityPolicy decides what CreateImage does when the requested
+// disk limit is larger than the space left in the store.
+type DiskLimitCapacityPolicy int
+
+const (
+	// IgnoreDiskLimitCapacity applies the requested limit as is.
+	IgnoreDiskLimitCapacity DiskLimitCapacityPolicy = iota
+	// ClampDiskLimitToCapacity applies the space left as the limit instead.
+	ClampDiskLimitToCapacity
+	// RejectDiskLimitAboveCapacity fails with ErrDiskLimitExceedsCapacity.
+	RejectDiskLimitAboveCapacity
+)
+
+var ErrDiskLimitExceedsCapacity = errorspkg.New("disk limit exceeds the space left in the store")
+
+// WithDiskLimitCapacityPolicy sets the policy used when creating images. The
+// default is IgnoreDiskLimitCapacity.
+func (d *Driver) WithDiskLimitCapacityPolicy(policy DiskLimitCapacityPolicy) *Driver {
+	d.diskLimitCapacityPolicy = policy
+	return d
+}
+
+// fitDiskLimitToCapacity applies the capacity policy to the exclusive disk
+// limit of a new image. The caller holds the capacity lock until the limit is
+// recorded.
+func (d *Driver) fitDiskLimitToCapacity(logger lager.Logger, diskLimit int64) (int64, error) {
+	if d.diskLimitCapacityPolicy == IgnoreDiskLimitCapacity {
+		return diskLimit, nil
+	}
+
+	available, err := d.uncommittedSpace()
+	if err != nil {
+		logger.Error("measuring-uncommitted-space-failed", err)
+		return 0, err
+	}
+
+	if diskLimit <= available {
+		return diskLimit, nil
+	}
+
+	if d.diskLimitCapacityPolicy == ClampDiskLimitToCapacity && available >= MinQuota {
+		logger.Info("clamping-disk-limit-to-capacity", lager.Data{"diskLimit": diskLimit, "available": available})
+		return available, nil
+	}
+
+	err = errorspkg.Wrapf(ErrDiskLimitExceedsCapacity, "disk limit %d, space left %d", diskLimit, available)
+	logger.Error("disk-limit-exceeds-capacity", err)
+	return 0, err
+}
+
+// uncommittedSpace is the free space of the store minus the limits recorded
+// for the existing images. Images are counted for their whole limit, whatever
+// they already wrote, rather than measuring the usage of each of them: the
+// space left is underestimated, never overcommitted.
+func (d *Driver) uncommittedSpace() (int64, error) {
+	stat, err := d.fsOperations.Statfs(d.storePath)
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "statfs store")
+	}
+	available := int64(stat.Bavail) * stat.Bsize
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, imageID := range imageIDs {
+		limit, err := readImageQuota(d.imagePath(imageID))
+		if err != nil {
+			return 0, err
+		}
+		available -= limit
+	}
+
+	return available, nil
+}
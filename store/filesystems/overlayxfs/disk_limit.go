@@ -0,0 +1,189 @@
+package overlayxfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DiskLimitShrinkPolicy decides what UpdateDiskLimit does when the requested
+// limit is below what the image already uses.
+type DiskLimitShrinkPolicy int
+
+const (
+	// RefuseDiskLimitBelowUsage leaves the current limit in place and returns
+	// ErrDiskLimitBelowUsage.
+	RefuseDiskLimitBelowUsage DiskLimitShrinkPolicy = iota
+	// ClampDiskLimitToUsage applies the current usage as the limit instead.
+	ClampDiskLimitToUsage
+)
+
+// maxDiskLimitClampAttempts bounds how many times a clamped limit is raised
+// to keep up with an image that is being written to.
+const maxDiskLimitClampAttempts = 5
+
+var ErrDiskLimitBelowUsage = errorspkg.New("disk limit is below the current usage of the image")
+
+// DefaultInodeLimit is the number of inodes images with a disk limit are
+// capped to when their spec does not set one, so that a single image cannot
+// run the store out of inodes while staying within its disk limit.
+const DefaultInodeLimit = 1024 * 1024
+
+// WithDefaultInodeLimit replaces DefaultInodeLimit. A limit of 0 leaves the
+// images without an inode limit unless their spec sets one.
+func (d *Driver) WithDefaultInodeLimit(limit uint64) *Driver {
+	d.inodeLimit = limit
+	return d
+}
+
+// WithDiskLimitShrinkPolicy sets the policy used by UpdateDiskLimit. The
+// default is RefuseDiskLimitBelowUsage.
+func (d *Driver) WithDiskLimitShrinkPolicy(policy DiskLimitShrinkPolicy) *Driver {
+	d.diskLimitShrinkPolicy = policy
+	return d
+}
+
+// UpdateDiskLimit changes the exclusive disk limit of an existing image
+// without ever leaving it below the usage of the image.
+//
+// XFS has no compare-and-set for project quotas: the kernel checks every
+// block allocation against the limit in place at that time, but it accepts a
+// limit lower than the blocks already accounted to the project and never
+// frees blocks to honour it. A container writing to the image between the
+// usage being read and the new limit being set could therefore leave the
+// image over its limit. To close that window the usage is read again once
+// the limit is set: with ClampDiskLimitToUsage the limit is raised to follow
+// it, and with RefuseDiskLimitBelowUsage the previous limit is restored.
+func (d *Driver) UpdateDiskLimit(logger lager.Logger, imagePath string, diskLimit int64) error {
+	logger = logger.Session("overlayxfs-updating-disk-limit", lager.Data{"imagePath": imagePath, "diskLimit": diskLimit})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	if diskLimit <= 0 {
+		return errorspkg.Errorf("invalid disk limit: %d", diskLimit)
+	}
+
+	if diskLimit < MinQuota {
+		logger.Debug("overwriting-disk-quota", lager.Data{"oldLimit": diskLimit, "newLimit": MinQuota})
+		diskLimit = MinQuota
+	}
+
+	previousLimit, err := readImageQuota(imagePath)
+	if err != nil {
+		logger.Error("reading-image-quota-failed", err)
+		return err
+	}
+
+	usage, err := d.quotaManager.Usage(logger, imagePath)
+	if err != nil {
+		logger.Error("reading-usage-failed", err)
+		return errorspkg.Wrap(err, "reading image usage")
+	}
+
+	for attempt := 0; ; attempt++ {
+		if usage > diskLimit {
+			if d.diskLimitShrinkPolicy != ClampDiskLimitToUsage || attempt >= maxDiskLimitClampAttempts {
+				return d.refuseDiskLimit(logger, imagePath, previousLimit, diskLimit, usage, attempt > 0)
+			}
+
+			logger.Info("clamping-disk-limit-to-usage", lager.Data{"usage": usage})
+			diskLimit = usage
+		}
+
+		if err := d.quotaManager.SetLimit(logger, imagePath, diskLimit); err != nil {
+			logger.Error("applying-quota-failed", err)
+			return errorspkg.Wrap(err, "apply disk limit")
+		}
+
+		usage, err = d.quotaManager.Usage(logger, imagePath)
+		if err != nil {
+			logger.Error("reading-usage-failed", err)
+			return errorspkg.Wrap(err, "reading image usage")
+		}
+
+		if usage <= diskLimit {
+			break
+		}
+		logger.Info("usage-grew-while-applying-limit", lager.Data{"usage": usage, "attempt": attempt})
+	}
+
+	return writeImageQuota(logger, imagePath, diskLimit)
+}
+
+// refuseDiskLimit puts back the limit the image had before UpdateDiskLimit,
+// if it was already changed, and returns ErrDiskLimitBelowUsage.
+func (d *Driver) refuseDiskLimit(logger lager.Logger, imagePath string, previousLimit, diskLimit, usage int64, limitChanged bool) error {
+	refusedErr := errorspkg.Wrapf(ErrDiskLimitBelowUsage, "disk limit %d, usage %d", diskLimit, usage)
+	logger.Error("disk-limit-below-usage", refusedErr)
+
+	if !limitChanged {
+		return refusedErr
+	}
+
+	if err := d.quotaManager.SetLimit(logger, imagePath, previousLimit); err != nil {
+		logger.Error("restoring-previous-disk-limit-failed", err, lager.Data{"previousLimit": previousLimit})
+		return errorspkg.Wrap(refusedErr, "restoring previous disk limit failed")
+	}
+
+	return refusedErr
+}
+
+// readImageQuota returns the limit recorded for the image, or 0 (no limit)
+// when the image was created without one.
+func readImageQuota(imagePath string) (int64, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(imagePath, imageQuotaName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "reading image quota")
+	}
+
+	diskLimit, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "parsing image quota")
+	}
+
+	return diskLimit, nil
+}
+
+// tardisQuotaManager reads and sets quotas through tardis, as they require
+// privileges the driver might not have.
+type tardisQuotaManager struct {
+	driver *Driver
+}
+
+func (q *tardisQuotaManager) Usage(logger lager.Logger, imagePath string) (int64, error) {
+	output, err := q.driver.runTardis(logger, "stats", "--volume-path", imagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	stats := groot.VolumeStats{}
+	if err := json.Unmarshal(output.Bytes(), &stats); err != nil {
+		return 0, errorspkg.Wrapf(err, "decoding stats: %s", output.String())
+	}
+
+	return stats.DiskUsage.ExclusiveBytesUsed, nil
+}
+
+func (q *tardisQuotaManager) SetLimit(logger lager.Logger, imagePath string, limit int64) error {
+	if err := q.driver.checkXFS(imagePath); err != nil {
+		return err
+	}
+
+	_, err := q.driver.runTardis(logger, "limit", "--disk-limit-bytes", strconv.FormatInt(limit, 10), "--image-path", imagePath)
+	return err
+}
+
+func (q *tardisQuotaManager) SetInodeLimit(logger lager.Logger, imagePath string, limit uint64) error {
+	_, err := q.driver.runTardis(logger, "limit", "--inode-limit", strconv.FormatUint(limit, 10), "--image-path", imagePath)
+	return err
+}
@@ -2,7 +2,9 @@ package overlayxfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,16 +14,20 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/grootfs/base_image_puller"
 	"code.cloudfoundry.org/grootfs/groot"
 	"code.cloudfoundry.org/grootfs/relogger"
 	"code.cloudfoundry.org/grootfs/store"
 	"code.cloudfoundry.org/grootfs/store/filesystems"
+	"code.cloudfoundry.org/grootfs/store/filesystems/mount"
 	quotapkg "code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/quota"
 	"code.cloudfoundry.org/grootfs/store/filesystems/spec"
 	"code.cloudfoundry.org/grootfs/store/image_manager"
 	"code.cloudfoundry.org/lager/v3"
+	digestpkg "github.com/opencontainers/go-digest"
 	errorspkg "github.com/pkg/errors"
 	shortid "github.com/ventu-io/go-shortid"
 	"golang.org/x/sys/unix"
@@ -41,7 +47,7 @@ const (
 
 //go:generate counterfeiter . Unmounter
 type Unmounter interface {
-	Unmount(log lager.Logger, path string) error
+	Unmount(log lager.Logger, path string, flags int) error
 }
 
 //go:generate counterfeiter . DirectIO
@@ -49,20 +55,154 @@ type DirectIO interface {
 	Configure(path string) error
 }
 
+//go:generate counterfeiter . Clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+//go:generate counterfeiter . KernelLogReader
+type KernelLogReader interface {
+	ReadKernelLog() ([]string, error)
+	// Timestamp returns the current time as the kernel log timestamps its
+	// messages, i.e. since boot.
+	Timestamp() (time.Duration, error)
+}
+
+//go:generate counterfeiter . QuotaManager
+type QuotaManager interface {
+	Usage(logger lager.Logger, imagePath string) (int64, error)
+	SetLimit(logger lager.Logger, imagePath string, limit int64) error
+	SetInodeLimit(logger lager.Logger, imagePath string, limit uint64) error
+}
+
+// NewDriver returns a driver for the store. Images are unmounted with
+// mount.RetryingUnmounter when no unmounter is given.
 func NewDriver(storePath, tardisBinPath string, unmounter Unmounter, directIO DirectIO) *Driver {
-	return &Driver{
-		storePath:     storePath,
-		tardisBinPath: tardisBinPath,
-		unmounter:     unmounter,
-		directIO:      directIO,
-	}
+	if unmounter == nil {
+		unmounter = mount.RetryingUnmounter{}
+	}
+
+	driver := &Driver{
+		storePath:                   storePath,
+		tardisBinPath:               tardisBinPath,
+		unmounter:                   unmounter,
+		directIO:                    directIO,
+		clock:                       systemClock{},
+		fsOperations:                OSFSOperations{},
+		kernelLogReader:             klogctlReader{},
+		cleanupOnError:              true,
+		importReserve:               DefaultImportReserve,
+		inodeLimit:                  DefaultInodeLimit,
+		stagingGracePeriod:          DefaultStagingGracePeriod,
+		removeAttempts:              DefaultRemoveAttempts,
+		removeBackoff:               DefaultRemoveBackoff,
+		unmountAttempts:             DefaultUnmountAttempts,
+		unmountBackoff:              DefaultUnmountBackoff,
+		digestAlgorithm:             digestpkg.Canonical,
+		sparseThreshold:             DefaultSparseThreshold,
+		metaDirName:                 store.MetaDirName,
+		metricsEmitter:              noopMetricsEmitter{},
+		volumeDirMode:               DefaultDirMode,
+		imageDirMode:                DefaultDirMode,
+		reflinkCopy:                 reflinkCopy,
+		overlayModuleParametersPath: DefaultOverlayModuleParametersPath,
+		mountInfoPath:               DefaultMountInfoPath,
+		kernelReleasePath:           DefaultKernelReleasePath,
+		pathMax:                     unix.PathMax,
+		sysBlockDevicesPath:         DefaultSysBlockDevicesPath,
+		filesystemsPath:             DefaultFilesystemsPath,
+		mountDataMax:                unix.Getpagesize(),
+		metricsCache: metricsCache{
+			ttl:       DefaultMetricsCacheTTL,
+			threshold: DefaultQuotaThreshold,
+		},
+	}
+	driver.quotaManager = &tardisQuotaManager{driver: driver}
+	driver.mounter = &fsOperationsMounter{driver: driver}
+
+	return driver
 }
 
 type Driver struct {
-	storePath     string
-	tardisBinPath string
-	unmounter     Unmounter
-	directIO      DirectIO
+	storePath                   string
+	tardisBinPath               string
+	unmounter                   Unmounter
+	mounter                     Mounter
+	directIO                    DirectIO
+	quotaManager                QuotaManager
+	diskLimitShrinkPolicy       DiskLimitShrinkPolicy
+	diskLimitCapacityPolicy     DiskLimitCapacityPolicy
+	maintenanceMode             atomic.Bool
+	destroyOptions              DestroyOptions
+	clock                       Clock
+	fsOperations                FSOperations
+	kernelLogReader             KernelLogReader
+	cleanupOnError              bool
+	createRateLimiter           *tokenBucket
+	mountTimeout                time.Duration
+	importReserve               int64
+	inodeLimit                  uint64
+	metricsCache                metricsCache
+	upperDevicePath             string
+	quarantine                  bool
+	stagingGracePeriod          time.Duration
+	removeAttempts              int
+	removeBackoff               time.Duration
+	unmountAttempts             int
+	unmountBackoff              time.Duration
+	digestAlgorithm             digestpkg.Algorithm
+	missingParentPolicy         MissingParentPolicy
+	sparseThreshold             int64
+	volumeCache                 volumeCache
+	allowedOverlayOptions       map[string]bool
+	maxLayers                   int
+	skipXFSCheck                bool
+	skipMountVerification       bool
+	metaDirName                 string
+	metricsEmitter              MetricsEmitter
+	volumeDirMode               os.FileMode
+	imageDirMode                os.FileMode
+	operations                  operationTracker
+	reflinkCopy                 func(src, dst string) error
+	overlayModuleParametersPath string
+	mountInfoPath               string
+	kernelReleasePath           string
+	pathMax                     int
+	sysBlockDevicesPath         string
+	filesystemsPath             string
+	mountDataMax                int
+}
+
+// WithClock replaces the system clock used to timestamp images.
+func (d *Driver) WithClock(clock Clock) *Driver {
+	d.clock = clock
+	return d
+}
+
+// WithCleanupOnError decides whether CreateImage removes the directories of
+// an image it failed to create. It defaults to true; disabling it leaves them
+// around for debugging.
+func (d *Driver) WithCleanupOnError(cleanup bool) *Driver {
+	d.cleanupOnError = cleanup
+	return d
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithQuotaManager replaces the tardis backed quota manager used to read
+// image usage and apply disk limits.
+func (d *Driver) WithQuotaManager(quotaManager QuotaManager) *Driver {
+	d.quotaManager = quotaManager
+	return d
 }
 
 func (d *Driver) InitFilesystem(logger lager.Logger, filesystemPath, storePath string) error {
@@ -70,6 +210,13 @@ func (d *Driver) InitFilesystem(logger lager.Logger, filesystemPath, storePath s
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
+	// Only a warning: a kernel building overlay as a module lists it once it
+	// is loaded, which the first mount does. Mounting fails with
+	// ErrOverlayNotSupported on kernels really lacking it.
+	if err := d.CheckOverlaySupport(logger); err != nil {
+		logger.Info("overlay-support-not-confirmed", lager.Data{"error": err.Error()})
+	}
+
 	logger.Debug("trying-to-remount-fs", lager.Data{"filesystemPath": filesystemPath, "storePath": storePath})
 	if err := d.mountFilesystem(logger, filesystemPath, storePath, "remount"); err == nil {
 		logger.Debug("remounting-fs-succeeded", lager.Data{"filesystemPath": filesystemPath, "storePath": storePath})
@@ -92,7 +239,12 @@ func (d *Driver) MountFilesystem(logger lager.Logger, filesystemPath, storePath
 }
 
 func (d *Driver) DeInitFilesystem(logger lager.Logger, storePath string) error {
-	if err := d.unmounter.Unmount(logger, storePath); err != nil {
+	err := d.unmounter.Unmount(logger, storePath, 0)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+		logger.Debug("store-not-mounted", lager.Data{"storePath": storePath})
+		return nil
+	}
+	if err != nil {
 		logger.Error("unmounting-store-path-failed", err, lager.Data{"storePath": storePath})
 		return errorspkg.Wrapf(err, "unmounting store path")
 	}
@@ -106,6 +258,11 @@ func (d *Driver) ConfigureStore(logger lager.Logger, storePath, backingStorePath
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
+	if err := d.checkXFS(storePath); err != nil {
+		logger.Error("checking-store-filesystem-failed", err)
+		return err
+	}
+
 	if err := d.createWhiteoutDevice(logger, storePath, ownerUID, ownerGID); err != nil {
 		logger.Error("creating-whiteout-device-failed", err)
 		return errorspkg.Wrap(err, "Creating whiteout device")
@@ -128,6 +285,12 @@ func (d *Driver) ConfigureStore(logger lager.Logger, storePath, backingStorePath
 		return errorspkg.Wrap(err, "Create ids directory")
 	}
 
+	metaDir := filepath.Join(storePath, d.metaDirName)
+	if err := d.createStoreDirectory(logger, metaDir, ownerUID, ownerGID); err != nil {
+		logger.Error("creating-meta-directory-failed", err)
+		return errorspkg.Wrap(err, "Create meta directory")
+	}
+
 	if _, err := os.Stat(backingStorePath); err != nil {
 		if os.IsNotExist(err) {
 			logger.Info("backing store file does not exist", lager.Data{"backingStorePath": backingStorePath})
@@ -159,13 +322,7 @@ func (d *Driver) ValidateFileSystem(logger lager.Logger, path string) error {
 }
 
 func (d *Driver) VolumePath(logger lager.Logger, id string) (string, error) {
-	volPath := filepath.Join(d.storePath, store.VolumesDirName, id)
-	_, err := os.Stat(volPath)
-	if err == nil {
-		return volPath, nil
-	}
-
-	return "", errorspkg.Wrapf(err, "volume does not exist `%s`", id)
+	return d.volumePath(logger, id)
 }
 
 func (d *Driver) CreateVolume(logger lager.Logger, parentID string, id string) (string, error) {
@@ -173,8 +330,50 @@ func (d *Driver) CreateVolume(logger lager.Logger, parentID string, id string) (
 	logger.Info("starting")
 	defer logger.Info("ending")
 
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return "", err
+	}
+	defer finishOperation()
+
+	if err := d.waitForCreateRate(logger); err != nil {
+		return "", err
+	}
+
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return "", err
+	}
+	defer unlockStore()
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return "", err
+	}
+
+	if err := validateVolumeID(id); err != nil {
+		logger.Error("validating-volume-id-failed", err)
+		return "", err
+	}
+
+	if err := d.checkParentVolume(logger, parentID); err != nil {
+		logger.Error("checking-parent-volume-failed", err)
+		return "", err
+	}
+
 	volumePath := filepath.Join(d.storePath, store.VolumesDirName, id)
-	if err := os.Mkdir(volumePath, 0755); err != nil {
+	if err := os.Mkdir(volumePath, d.volumeDirMode); err != nil {
+		if os.IsExist(err) {
+			path, err := d.existingVolume(id, volumePath)
+			if err != nil {
+				logger.Error("reusing-existing-volume-failed", err)
+				return "", err
+			}
+			logger.Info("volume-already-exists")
+			return path, nil
+		}
 		logger.Error("creating-volume-dir-failed", err)
 		return "", errorspkg.Wrap(err, "creating volume")
 	}
@@ -193,10 +392,15 @@ func (d *Driver) CreateVolume(logger lager.Logger, parentID string, id string) (
 		return "", errorspkg.Wrap(err, "creating link file")
 	}
 
-	if err := os.Chmod(volumePath, 0755); err != nil {
+	if err := os.Chmod(volumePath, d.volumeDirMode); err != nil {
 		logger.Error("changing-volume-permissions-failed", err)
 		return "", errorspkg.Wrap(err, "changing volume permissions")
 	}
+
+	if err := d.markVolumeComplete(id); err != nil {
+		logger.Error("marking-volume-complete-failed", err)
+		return "", errorspkg.Wrap(err, "marking volume complete")
+	}
 	return volumePath, nil
 }
 
@@ -207,13 +411,35 @@ func (d *Driver) DestroyVolume(logger lager.Logger, id string) error {
 	logger.Info("starting")
 	defer logger.Info("ending")
 
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return err
+	}
+	defer finishOperation()
+
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return err
+	}
+	defer unlockStore()
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return err
+	}
+
+	d.InvalidateVolumeCache(id)
 	if err := d.removeVolumeLink(linkInfoPath); err != nil {
 		return err
 	}
 
 	volumeMetaFilePath := d.volumeMetaFilePath(id)
-	if err := os.Remove(volumeMetaFilePath); err != nil && !os.IsNotExist(err) {
-		logger.Error("deleting-metadata-file-failed", err, lager.Data{"path": volumeMetaFilePath})
+	for _, path := range []string{volumeMetaFilePath, d.volumeCompleteMarkerPath(id), d.volumeLastUsedPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("deleting-metadata-file-failed", err, lager.Data{"path": path})
+		}
 	}
 
 	if err := os.RemoveAll(volumePath); err != nil {
@@ -255,6 +481,10 @@ func (d *Driver) Volumes(logger lager.Logger) ([]string, error) {
 	}
 
 	for _, volumeInfo := range existingVolumes {
+		// Hidden entries are temporary files of other tools, not volumes
+		if !volumeInfo.IsDir() || strings.HasPrefix(volumeInfo.Name(), ".") || isVolumeDigestDir(volumeInfo.Name()) {
+			continue
+		}
 		volumes = append(volumes, volumeInfo.Name())
 	}
 
@@ -262,20 +492,126 @@ func (d *Driver) Volumes(logger lager.Logger) ([]string, error) {
 }
 
 func (d *Driver) CreateImage(logger lager.Logger, spec image_manager.ImageDriverSpec) (groot.MountInfo, error) {
+	return d.CreateImageContext(context.Background(), logger, spec)
+}
+
+// CreateImageContext is CreateImage giving up, and cleaning up the image,
+// once the context is done.
+func (d *Driver) CreateImageContext(ctx context.Context, logger lager.Logger, spec image_manager.ImageDriverSpec) (groot.MountInfo, error) {
+	defer d.metricsEmitter.TryEmitDurationFrom(logger, MetricCreateImageTime, time.Now())
+	defer d.volumeCache.clear()
+
+	mountInfo, err := d.createImage(ctx, logger, spec)
+	if err != nil {
+		d.metricsEmitter.TryIncrementCounter(logger, MetricCreateImageFailures)
+	}
+
+	return mountInfo, err
+}
+
+func (d *Driver) createImage(ctx context.Context, logger lager.Logger, spec image_manager.ImageDriverSpec) (groot.MountInfo, error) {
 	logger = logger.Session("overlayxfs-creating-image", lager.Data{"spec": spec})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	if _, err := os.Stat(spec.ImagePath); os.IsNotExist(err) {
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return groot.MountInfo{}, err
+	}
+	defer finishOperation()
+
+	if err := d.waitForCreateRate(logger); err != nil {
+		return groot.MountInfo{}, err
+	}
+
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return groot.MountInfo{}, err
+	}
+	defer unlockStore()
+
+	if err := ctx.Err(); err != nil {
+		logger.Error("context-done", err)
+		return groot.MountInfo{}, err
+	}
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return groot.MountInfo{}, err
+	}
+
+	if err := validateImagePathElements(spec.ImagePath); err != nil {
+		logger.Error("validating-image-path-failed", err)
+		return groot.MountInfo{}, err
+	}
+
+	if _, err := d.fsOperations.Stat(spec.ImagePath); os.IsNotExist(err) {
 		logger.Error("image-path-not-found", err)
 		return groot.MountInfo{}, errorspkg.Wrap(err, "image path does not exist")
 	}
 
+	if len(spec.BaseVolumeDigests) > 0 {
+		if len(spec.BaseVolumeIDs) > 0 {
+			return groot.MountInfo{}, errorspkg.New("base volumes must be given either by id or by digest")
+		}
+
+		for _, digest := range spec.BaseVolumeDigests {
+			volumeID, err := d.resolveVolumeDigest(logger, digest)
+			if err != nil {
+				logger.Error("resolving-volume-digest-failed", err, lager.Data{"digest": digest})
+				return groot.MountInfo{}, err
+			}
+			spec.BaseVolumeIDs = append(spec.BaseVolumeIDs, volumeID)
+		}
+	}
+
+	if err := d.checkLayerCount(len(spec.BaseVolumeIDs)); err != nil {
+		logger.Error("checking-layer-count-failed", err)
+		return groot.MountInfo{}, err
+	}
+
+	if spec.ReadOnly {
+		if err := checkReadOnlySpec(spec); err != nil {
+			logger.Error("invalid-read-only-spec", err)
+			return groot.MountInfo{}, err
+		}
+	}
+
+	// The volumes are recorded bottom layer first regardless, so that the
+	// image can be mounted again without the spec
+	if spec.LowerOrderTopFirst {
+		spec.BaseVolumeIDs = reversed(spec.BaseVolumeIDs)
+	}
+
+	mountOptions, err := d.overlayMountOptions(logger, spec)
+	if err != nil {
+		return groot.MountInfo{}, err
+	}
+
+	mountSource, err := overlayMountSource(spec)
+	if err != nil {
+		logger.Error("invalid-mount-source", err, lager.Data{"mountSource": spec.MountSource})
+		return groot.MountInfo{}, err
+	}
+
+	if err := checkExtraMounts(filepath.Join(spec.ImagePath, RootfsDir), spec.ExtraMounts); err != nil {
+		logger.Error("invalid-extra-mounts", err)
+		return groot.MountInfo{}, err
+	}
+
 	baseVolumePaths, baseVolumeSize, err := d.getLowerDirs(logger, spec.BaseVolumeIDs)
 	if err != nil {
 		logger.Error("generating-lowerdir-paths-failed", err)
 		return groot.MountInfo{}, errorspkg.Wrap(err, "generating lowerdir paths failed")
 	}
+	d.touchVolumes(logger, spec.BaseVolumeIDs)
+
+	if err := ctx.Err(); err != nil {
+		logger.Error("context-done", err)
+		return groot.MountInfo{}, err
+	}
 
 	if err := d.applyDiskLimit(logger, spec, baseVolumeSize); err != nil {
 		return groot.MountInfo{}, errorspkg.Wrap(err, "applying disk limits")
@@ -290,18 +626,63 @@ func (d *Driver) CreateImage(logger lager.Logger, spec image_manager.ImageDriver
 		"workdir":  workDir,
 		"rootfs":   rootfsDir,
 	}
+	upperDevicePath := d.upperDevicePath
+	if spec.ReadOnly {
+		directories = map[string]string{"rootfs": rootfsDir}
+		upperDevicePath = ""
+	}
+
+	created := false
+	createdDirectories := map[string]string{}
+	defer func() {
+		if !created && d.cleanupOnError {
+			d.cleanupFailedImage(logger, spec.ImagePath, createdDirectories)
+		}
+	}()
 
-	if err := d.createImageDirectories(logger, directories, spec.OwnerUID, spec.OwnerGID); err != nil {
+	if err := d.createImageDirectories(logger, directories, createdDirectories, spec.OwnerUID, spec.OwnerGID); err != nil {
 		return groot.MountInfo{}, err
 	}
 
+	if upperDevicePath != "" {
+		if err := d.createDeviceUpperDirs(logger, spec.ImagePath, spec.OwnerUID, spec.OwnerGID); err != nil {
+			return groot.MountInfo{}, err
+		}
+	}
+	overlayUpperDir, overlayWorkDir := overlayUpperDirs(spec.ImagePath, upperDevicePath)
+
+	if !spec.ReadOnly {
+		if err := d.ensureUpperDirsOwnership(logger, overlayUpperDir, overlayWorkDir, spec.OwnerUID, spec.OwnerGID); err != nil {
+			logger.Error("ensuring-upper-dirs-ownership-failed", err)
+			return groot.MountInfo{}, err
+		}
+	}
+
 	if err := os.Chdir(d.storePath); err != nil {
 		return groot.MountInfo{}, errorspkg.Wrap(err, "failed to change directory to the store path")
 	}
 
+	if err := ctx.Err(); err != nil {
+		logger.Error("context-done", err)
+		return groot.MountInfo{}, err
+	}
+
 	if spec.Mount {
-		mountData := d.formatMountData(baseVolumePaths, workDir, upperDir, false)
-		if err := d.mountImage(logger, rootfsDir, mountData); err != nil {
+		if spec.ReadOnly {
+			err = d.mountReadOnlyImage(logger, mountSource, rootfsDir, baseVolumePaths, mountOptions)
+		} else {
+			err = d.mountImage(logger, mountSource, rootfsDir, d.formatMountData(baseVolumePaths, overlayWorkDir, overlayUpperDir, false, mountOptions))
+		}
+		if err != nil {
+			return groot.MountInfo{}, err
+		}
+
+		if err := d.protectPaths(logger, rootfsDir, spec.ProtectedPaths); err != nil {
+			return groot.MountInfo{}, err
+		}
+
+		if err := d.mountExtraMounts(logger, rootfsDir, spec.ExtraMounts); err != nil {
+			d.unprotectPaths(logger, rootfsDir, spec.ProtectedPaths)
 			return groot.MountInfo{}, err
 		}
 	}
@@ -311,11 +692,34 @@ func (d *Driver) CreateImage(logger lager.Logger, spec image_manager.ImageDriver
 		return groot.MountInfo{}, errorspkg.Wrapf(err, "writing image info %s", imageInfoFileName)
 	}
 
+	metadata := imageMetadata{
+		BaseVolumeIDs:   spec.BaseVolumeIDs,
+		MountSource:     mountSource,
+		MountOptions:    mountOptions,
+		CreatedAt:       d.clock.Now(),
+		Annotations:     spec.Annotations,
+		UpperDevicePath: upperDevicePath,
+		ProtectedPaths:  spec.ProtectedPaths,
+		ExtraMounts:     spec.ExtraMounts,
+		ReadOnly:        spec.ReadOnly,
+	}
+	if spec.Mount {
+		metadata.LastMountedAt = metadata.CreatedAt
+	}
+	if err := d.writeImageMetadata(spec.ImagePath, metadata); err != nil {
+		logger.Error("writing-image-metadata-failed", err)
+		return groot.MountInfo{}, err
+	}
+
+	created = true
+	if spec.ReadOnly {
+		return d.readOnlyMountInfo(mountSource, baseVolumePaths, mountOptions), nil
+	}
 	return groot.MountInfo{
 		Destination: "/",
-		Source:      "overlay",
+		Source:      mountSource,
 		Type:        "overlay",
-		Options:     []string{d.formatMountData(baseVolumePaths, workDir, upperDir, true)},
+		Options:     []string{d.formatMountData(baseVolumePaths, overlayWorkDir, overlayUpperDir, true, mountOptions)},
 	}, nil
 }
 
@@ -324,9 +728,17 @@ func (d *Driver) MoveVolume(logger lager.Logger, from, to string) error {
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return err
+	}
+	defer unlockStore()
+
 	if _, err := os.Stat(from); os.IsNotExist(err) {
 		return errorspkg.Wrap(err, "source volume doesn't exist")
 	}
+	d.InvalidateVolumeCache(filepath.Base(from))
 
 	oldLinkFile := filepath.Join(d.storePath, LinksDirName, filepath.Base(from))
 	shortID, err := ioutil.ReadFile(oldLinkFile)
@@ -340,6 +752,11 @@ func (d *Driver) MoveVolume(logger lager.Logger, from, to string) error {
 		return errorspkg.Wrap(err, "moving link file")
 	}
 
+	if err := d.moveVolumeCompleteMarker(from, to); err != nil {
+		logger.Error("moving-complete-marker-failed", err)
+		return errorspkg.Wrap(err, "moving volume complete marker")
+	}
+
 	linkPath := filepath.Join(d.storePath, LinksDirName, string(shortID))
 	if err := os.Remove(linkPath); err != nil {
 		return errorspkg.Wrap(err, "removing symlink")
@@ -391,18 +808,39 @@ func (d *Driver) WriteVolumeMeta(logger lager.Logger, id string, metadata base_i
 	logger = logger.Session("overlayxfs-writing-volume-metadata", lager.Data{"volumeID": id})
 	logger.Debug("starting")
 	defer logger.Debug("ending")
-	metaFile, err := os.Create(d.volumeMetaFilePath(id))
+	contents, err := json.Marshal(metadata)
 	if err != nil {
-		return errorspkg.Wrap(err, "creating metadata file")
+		return errorspkg.Wrap(err, "encoding metadata")
 	}
 
-	if err = json.NewEncoder(metaFile).Encode(metadata); err != nil {
+	if err := writeChecksummedFile(d.volumeMetaFilePath(id), contents, 0644); err != nil {
 		return errorspkg.Wrap(err, "writing metadata file")
 	}
 
 	return nil
 }
 
+// ReadVolumeMeta returns the metadata written for the volume by
+// WriteVolumeMeta. It is kept in the meta directory rather than in the volume,
+// whose contents are the layer.
+func (d *Driver) ReadVolumeMeta(logger lager.Logger, id string) (base_image_puller.VolumeMeta, error) {
+	logger = logger.Session("overlayxfs-reading-volume-metadata", lager.Data{"volumeID": id})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := validateVolumeID(id); err != nil {
+		return base_image_puller.VolumeMeta{}, err
+	}
+
+	metadata, err := d.readVolumeMeta(id)
+	if err != nil {
+		logger.Error("reading-metadata-failed", err)
+		return base_image_puller.VolumeMeta{}, errorspkg.Wrapf(err, "reading metadata of volume %s", id)
+	}
+
+	return metadata, nil
+}
+
 func (d *Driver) MarkVolumeArtifacts(logger lager.Logger, id string) error {
 	volumePath, err := d.VolumePath(logger, id)
 	if err != nil {
@@ -456,19 +894,23 @@ func (d *Driver) mountFilesystem(logger lager.Logger, source, destination, optio
 	return nil
 }
 
-func (d *Driver) createImageDirectories(logger lager.Logger, directories map[string]string, ownerUID, ownerGID int) error {
+// createImageDirectories creates the directories of an image, recording the
+// ones it created in created so that they can be rolled back.
+func (d *Driver) createImageDirectories(logger lager.Logger, directories, created map[string]string, ownerUID, ownerGID int) error {
 	for name, directory := range directories {
-		if err := os.Mkdir(directory, 0755); err != nil {
+		mode := d.imageDirectoryMode(name)
+		if err := d.fsOperations.Mkdir(directory, mode); err != nil {
 			logger.Error(fmt.Sprintf("creating-%s-folder-failed", name), err)
 			return errorspkg.Wrapf(err, "creating %s folder", name)
 		}
+		created[name] = directory
 
-		if err := os.Chmod(directory, 0755); err != nil {
+		if err := d.fsOperations.Chmod(directory, mode); err != nil {
 			logger.Error(fmt.Sprintf("chmoding-%s-folder-failed", name), err)
 			return errorspkg.Wrapf(err, "chmoding %s folder", name)
 		}
 
-		if err := os.Chown(directory, ownerUID, ownerGID); err != nil {
+		if err := d.fsOperations.Chown(directory, ownerUID, ownerGID); err != nil {
 			logger.Error(fmt.Sprintf("chowning-%s-folder-failed", name), err)
 			return errorspkg.Wrapf(err, "chowning %s folder", name)
 		}
@@ -477,7 +919,7 @@ func (d *Driver) createImageDirectories(logger lager.Logger, directories map[str
 	return nil
 }
 
-func (d *Driver) formatMountData(lowerDirs []string, workDir, upperDir string, absolute bool) string {
+func (d *Driver) formatMountData(lowerDirs []string, workDir, upperDir string, absolute bool, extraOptions []string) string {
 	if absolute {
 		for i, lowerDir := range lowerDirs {
 			lowerDirs[i] = filepath.Join(d.storePath, lowerDir)
@@ -485,28 +927,125 @@ func (d *Driver) formatMountData(lowerDirs []string, workDir, upperDir string, a
 	}
 
 	lowerDirsOpt := strings.Join(lowerDirs, ":")
-	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirsOpt, upperDir, workDir)
+	mountData := fmt.Sprintf("lowerdir=%s", lowerDirsOpt)
+	// Images without an upperdir are read-only
+	if upperDir != "" {
+		mountData += fmt.Sprintf(",upperdir=%s,workdir=%s", upperDir, workDir)
+	}
+	for _, option := range extraOptions {
+		mountData += "," + option
+	}
+
+	return mountData
+}
+
+// cleanupFailedImage removes what a failed CreateImage left behind, so that
+// retrying starts from a clean image directory. Only the directories it
+// created are removed: a directory that already existed might belong to an
+// image created before at the same path.
+func (d *Driver) cleanupFailedImage(logger lager.Logger, imagePath string, directories map[string]string) {
+	logger = logger.Session("cleaning-up-failed-image", lager.Data{"imagePath": imagePath, "directories": directories})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	if _, ok := directories["rootfs"]; !ok {
+		d.removeImageDirectories(logger, directories)
+		return
+	}
+
+	mounted, err := d.IsImageMounted(logger, imagePath)
+	if err != nil {
+		logger.Error("checking-if-image-is-mounted-failed", err)
+		mounted = true
+	}
+
+	if mounted {
+		if err := d.unmountRootfs(logger, directories["rootfs"]); err != nil {
+			logger.Error("unmounting-rootfs-failed", err)
+			return
+		}
+	}
+
+	if d.upperDevicePath != "" {
+		if err := d.removeDeviceUpperDirs(logger, imagePath, d.upperDevicePath); err != nil {
+			logger.Error("removing-upper-device-dirs-failed", err)
+			return
+		}
+	}
+
+	d.removeImageDirectories(logger, directories)
+}
+
+func (d *Driver) removeImageDirectories(logger lager.Logger, directories map[string]string) {
+	for name, directory := range directories {
+		if err := d.fsOperations.RemoveAll(directory); err != nil {
+			logger.Error(fmt.Sprintf("removing-%s-folder-failed", name), err)
+			continue
+		}
+		logger.Info(fmt.Sprintf("removed-%s-folder", name))
+	}
 }
 
-func (d *Driver) mountImage(logger lager.Logger, rootfsDir, mountData string) error {
-	logger.Session("mounting-overlay-to-rootfs", lager.Data{"mountData": mountData, "rootfsDir": rootfsDir})
+func (d *Driver) mountImage(logger lager.Logger, source, rootfsDir, mountData string) error {
+	logger.Session("mounting-overlay-to-rootfs", lager.Data{"source": source, "mountData": mountData, "rootfsDir": rootfsDir})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
-	if err := unix.Mount("overlay", rootfsDir, "overlay", 0, mountData); err != nil {
+	if err := d.validateMountDataLength(mountData); err != nil {
+		logger.Error("validating-mount-data-length-failed", err)
+		return err
+	}
+
+	kernelLogStart, kernelLogErr := d.kernelLogReader.Timestamp()
+	mountStart := time.Now()
+	err := d.mountOverlay(logger, source, rootfsDir, mountData)
+	d.metricsEmitter.TryEmitDurationFrom(logger, MetricMountTime, mountStart)
+	if err != nil {
 		logger.Error("failed", err, lager.Data{"mountData": mountData, "rootfsDir": rootfsDir})
-		return errorspkg.Wrap(err, "mounting overlay")
+		err = errorspkg.Wrap(overlayMountError(err), "mounting overlay")
+		if kernelLogErr != nil {
+			logger.Debug("reading-kernel-log-timestamp-failed", lager.Data{"error": kernelLogErr.Error()})
+			return err
+		}
+		return d.withKernelLogContext(logger, err, kernelLogStart)
 	}
+
+	if d.skipMountVerification {
+		return nil
+	}
+
+	if err := d.verifyOverlayMount(source, rootfsDir, mountData); err != nil {
+		logger.Error("verifying-mount-failed", err, lager.Data{"mountData": mountData, "rootfsDir": rootfsDir})
+		if unmountErr := d.unmounter.Unmount(logger, rootfsDir, 0); unmountErr != nil {
+			logger.Error("cleaning-up-mount-failed", unmountErr)
+		}
+		return err
+	}
+
 	return nil
 }
 
+func reversed(ids []string) []string {
+	reversedIDs := make([]string, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		reversedIDs = append(reversedIDs, ids[i])
+	}
+	return reversedIDs
+}
+
+// getLowerDirs returns the lowerdirs of the volumes, which are ordered bottom
+// layer first, in the order overlay expects them: top layer first.
 func (d *Driver) getLowerDirs(logger lager.Logger, volumeIDs []string) ([]string, int64, error) {
 	baseVolumePaths := []string{}
 	var totalVolumeSize int64
 	for i := len(volumeIDs) - 1; i >= 0; i-- {
+		if err := validateVolumeID(volumeIDs[i]); err != nil {
+			logger.Error("validating-base-volume-id-failed", err)
+			return nil, 0, err
+		}
 		volumePath := filepath.Join(d.storePath, store.VolumesDirName, volumeIDs[i])
 
-		if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+		if _, err := d.fsOperations.Stat(volumePath); os.IsNotExist(err) {
 			logger.Error("base-volume-path-not-found", err)
 			return nil, 0, errorspkg.Wrap(err, "base volume path does not exist")
 		}
@@ -523,43 +1062,96 @@ func (d *Driver) getLowerDirs(logger lager.Logger, volumeIDs []string) ([]string
 			return nil, 0, errorspkg.Wrapf(err, "reading link id for %s", volumePath)
 		}
 
-		baseVolumePaths = append(baseVolumePaths, filepath.Join(LinksDirName, string(shortID)))
+		lowerDir := filepath.Join(LinksDirName, string(shortID))
+		if err := d.validateLowerDirLength(lowerDir); err != nil {
+			logger.Error("validating-lowerdir-length-failed", err, lager.Data{"volumeID": volumeIDs[i]})
+			return nil, 0, errorspkg.Wrapf(err, "layer %s", volumeIDs[i])
+		}
+
+		baseVolumePaths = append(baseVolumePaths, lowerDir)
 	}
 
 	return baseVolumePaths, totalVolumeSize, nil
 }
 
 func (d *Driver) DestroyImage(logger lager.Logger, imagePath string) error {
+	defer d.metricsEmitter.TryEmitDurationFrom(logger, MetricDestroyImageTime, time.Now())
+
+	if err := d.destroyImage(logger, imagePath); err != nil {
+		d.metricsEmitter.TryIncrementCounter(logger, MetricDestroyImageFailures)
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) destroyImage(logger lager.Logger, imagePath string) error {
 	logger = logger.Session("overlayxfs-destroying-image", lager.Data{"imagePath": imagePath})
 	logger.Info("starting")
 	defer logger.Info("ending")
 
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return err
+	}
+	defer finishOperation()
+
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return err
+	}
+	defer unlockStore()
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return err
+	}
+
 	projectID, err := quotapkg.GetProjectID(logger, imagePath)
 	if err != nil {
 		logger.Error("fetching-project-id-failed", err)
 		logger.Info("skipping-project-id-folder-removal")
 	}
 
-	if err := d.ensureImageDestroyed(logger, imagePath); err != nil {
+	if err := d.ensureImageDestroyed(logger, imagePath, projectID); err != nil {
 		logger.Error("removing-image-path-failed", err)
 		return errorspkg.Wrap(err, "deleting image path")
 	}
 
 	if projectID != 0 {
-		if err := os.RemoveAll(filepath.Join(d.storePath, IDDir, strconv.Itoa(int(projectID)))); err != nil {
-			logger.Error("removing-project-id-folder-failed", err)
-		}
+		d.releaseProjectID(logger, imagePath, projectID)
 	}
 
 	return nil
 }
 
 func (d *Driver) FetchStats(logger lager.Logger, imagePath string) (groot.VolumeStats, error) {
+	return d.FetchStatsContext(context.Background(), logger, imagePath)
+}
+
+// FetchStatsContext is FetchStats giving up once the context is done, e.g.
+// while walking the upperdir of an image without a quota.
+func (d *Driver) FetchStatsContext(ctx context.Context, logger lager.Logger, imagePath string) (groot.VolumeStats, error) {
 	logger = logger.Session("overlayxfs-fetching-stats", lager.Data{"imagePath": imagePath})
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
-	output, err := d.runTardis(logger, "stats", "--volume-path", imagePath)
+	if err := d.validateImagePath(imagePath); err != nil {
+		logger.Error("validating-image-path-failed", err)
+		return groot.VolumeStats{}, err
+	}
+
+	limit, err := readImageQuota(imagePath)
+	if err != nil {
+		return groot.VolumeStats{}, err
+	}
+	if limit == 0 {
+		return d.upperDirStats(ctx, logger, imagePath)
+	}
+
+	output, err := d.runTardisContext(ctx, logger, "stats", "--volume-path", imagePath)
 	if err != nil {
 		logger.Error("fetching-stats-failed", err, lager.Data{"imagePath": imagePath})
 		return groot.VolumeStats{}, errorspkg.Wrapf(err, "fetch stats: %s", output.String())
@@ -589,13 +1181,7 @@ func (d *Driver) VolumeSize(logger lager.Logger, id string) (int64, error) {
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
-	metaFile, err := os.Open(d.volumeMetaFilePath(id))
-	if err != nil {
-		return 0, err
-	}
-
-	var metadata base_image_puller.VolumeMeta
-	err = json.NewDecoder(metaFile).Decode(&metadata)
+	metadata, err := d.readVolumeMeta(id)
 	if err != nil {
 		return 0, err
 	}
@@ -604,7 +1190,7 @@ func (d *Driver) VolumeSize(logger lager.Logger, id string) (int64, error) {
 }
 
 func (d *Driver) volumeMetaFilePath(id string) string {
-	return filepath.Join(d.storePath, store.MetaDirName, fmt.Sprintf("volume-%s", id))
+	return d.metaPath(fmt.Sprintf("volume-%s", id))
 }
 
 func (d *Driver) GenerateVolumeMeta(logger lager.Logger, id string) error {
@@ -622,9 +1208,18 @@ func (d *Driver) GenerateVolumeMeta(logger lager.Logger, id string) error {
 }
 
 func (d *Driver) volumePath(logger lager.Logger, id string) (string, error) {
+	if err := validateVolumeID(id); err != nil {
+		return "", err
+	}
+
 	volPath := filepath.Join(d.storePath, store.VolumesDirName, id)
-	_, err := os.Stat(volPath)
+	if d.volumeCache.exists(id) {
+		return volPath, nil
+	}
+
+	_, err := d.fsOperations.Stat(volPath)
 	if err == nil {
+		d.volumeCache.add(id)
 		return volPath, nil
 	}
 
@@ -698,6 +1293,11 @@ func (d *Driver) createStoreDirectory(logger lager.Logger, path string, ownerUID
 }
 
 func (d *Driver) runTardis(logger lager.Logger, args ...string) (*bytes.Buffer, error) {
+	return d.runTardisContext(context.Background(), logger, args...)
+}
+
+// runTardisContext kills tardis once the context is done.
+func (d *Driver) runTardisContext(ctx context.Context, logger lager.Logger, args ...string) (*bytes.Buffer, error) {
 	logger = logger.Session("run-tardis", lager.Data{"path": d.tardisBinPath, "args": args})
 	logger.Debug("starting")
 	defer logger.Debug("ending")
@@ -710,7 +1310,7 @@ func (d *Driver) runTardis(logger lager.Logger, args ...string) (*bytes.Buffer,
 		return nil, errorspkg.New("missing the setuid bit on tardis")
 	}
 
-	cmd := exec.Command(d.tardisBinPath, args...)
+	cmd := exec.CommandContext(ctx, d.tardisBinPath, args...)
 	stdout := new(bytes.Buffer)
 	relogger := relogger.NewRelogger(logger)
 	cmd.Stdout = io.MultiWriter(stdout, relogger)
@@ -753,6 +1353,12 @@ func (d *Driver) applyDiskLimit(logger lager.Logger, spec image_manager.ImageDri
 	logger.Debug("starting")
 	defer logger.Debug("ending")
 
+	if spec.DiskLimit < 0 {
+		err := errorspkg.Errorf("invalid disk limit %d: must not be negative", spec.DiskLimit)
+		logger.Error("validating-disk-limit-failed", err)
+		return err
+	}
+
 	if spec.DiskLimit == 0 {
 		logger.Debug("no-need-for-quotas")
 		return nil
@@ -771,28 +1377,97 @@ func (d *Driver) applyDiskLimit(logger lager.Logger, spec image_manager.ImageDri
 		}
 	}
 
+	if d.diskLimitCapacityPolicy != IgnoreDiskLimitCapacity {
+		// Held until the limit is recorded in the image quota file, which the
+		// next create counts as committed
+		unlock, err := d.lockCapacity()
+		if err != nil {
+			logger.Error("locking-capacity-failed", err)
+			return err
+		}
+		defer unlock()
+	}
+
+	diskLimit, err := d.fitDiskLimitToCapacity(logger, diskLimit)
+	if err != nil {
+		return err
+	}
+
 	if diskLimit < MinQuota {
 		logger.Debug("overwriting-disk-quota", lager.Data{"oldLimit": diskLimit, "newLimit": MinQuota})
 		diskLimit = MinQuota
 	}
 
-	diskLimitString := strconv.FormatInt(diskLimit, 10)
-
-	if output, err := d.runTardis(logger, "limit", "--disk-limit-bytes", diskLimitString, "--image-path", spec.ImagePath); err != nil {
+	if err := d.quotaManager.SetLimit(logger, spec.ImagePath, diskLimit); err != nil {
 		logger.Error("applying-quota-failed", err, lager.Data{"diskLimit": diskLimit, "imagePath": spec.ImagePath})
-		return errorspkg.Wrapf(err, "apply disk limit: %s", output.String())
+		return errorspkg.Wrap(err, "apply disk limit")
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(spec.ImagePath, imageQuotaName), []byte(diskLimitString), 0600); err != nil {
+	inodeLimit := spec.InodeLimit
+	if inodeLimit == 0 {
+		inodeLimit = d.inodeLimit
+	}
+	if inodeLimit != 0 {
+		if err := d.quotaManager.SetInodeLimit(logger, spec.ImagePath, inodeLimit); err != nil {
+			logger.Error("applying-inode-limit-failed", err, lager.Data{"inodeLimit": inodeLimit, "imagePath": spec.ImagePath})
+			return errorspkg.Wrap(err, "apply inode limit")
+		}
+	}
+
+	if err := ensureProjectInheritance(logger, spec.ImagePath); err != nil {
+		logger.Error("ensuring-project-inheritance-failed", err, lager.Data{"imagePath": spec.ImagePath})
+		return err
+	}
+
+	projectID, err := quotapkg.GetProjectID(logger, spec.ImagePath)
+	if err != nil {
+		logger.Error("fetching-project-id-failed", err)
+		return err
+	}
+	if projectID != 0 {
+		if err := d.recordImageProject(logger, spec.ImagePath, projectID); err != nil {
+			logger.Error("recording-project-mapping-failed", err, lager.Data{"projectID": projectID})
+			return err
+		}
+	}
+
+	return writeImageQuota(logger, spec.ImagePath, diskLimit)
+}
+
+func writeImageQuota(logger lager.Logger, imagePath string, diskLimit int64) error {
+	diskLimitString := strconv.FormatInt(diskLimit, 10)
+	if err := ioutil.WriteFile(filepath.Join(imagePath, imageQuotaName), []byte(diskLimitString), 0600); err != nil {
 		logger.Error("writing-image-quota-failed", err)
 		return errorspkg.Wrap(err, "writing image quota")
 	}
 	return nil
 }
 
-func (d *Driver) ensureImageDestroyed(logger lager.Logger, imagePath string) error {
-	if err := d.unmounter.Unmount(logger, filepath.Join(imagePath, RootfsDir)); err != nil {
+func (d *Driver) ensureImageDestroyed(logger lager.Logger, imagePath string, projectID uint32) error {
+	if err := d.unmountRootfs(logger, filepath.Join(imagePath, RootfsDir)); err != nil {
 		return errorspkg.Wrapf(err, "unmount rootfs path %q failed", filepath.Join(imagePath, RootfsDir))
 	}
-	return os.RemoveAll(imagePath)
+
+	if d.destroyOptions.WaitForUnmount {
+		if err := d.waitForUnmount(logger, imagePath); err != nil {
+			return err
+		}
+	}
+
+	// Images that failed to be created might not have metadata
+	if metadata, err := d.readImageMetadata(imagePath); err == nil && metadata.UpperDevicePath != "" {
+		if err := d.removeDeviceUpperDirs(logger, imagePath, metadata.UpperDevicePath); err != nil {
+			return err
+		}
+	}
+
+	// XFS can keep accounting the space of removed files to the project for a
+	// while, which would count against the next image given the project id
+	if projectID != 0 {
+		if err := clearProjectIDs(logger, imagePath); err != nil {
+			logger.Error("clearing-project-ids-failed", err, lager.Data{"projectID": projectID})
+		}
+	}
+
+	return d.removeAllWithRetries(logger, imagePath)
 }
@@ -1,9 +1,14 @@
 package overlayxfs_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -11,6 +16,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,15 +25,18 @@ import (
 	"code.cloudfoundry.org/grootfs/store/filesystems"
 	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs"
 	fakes "code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/overlayxfsfakes"
+	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/quota"
 	"code.cloudfoundry.org/grootfs/store/image_manager"
 	"code.cloudfoundry.org/grootfs/testhelpers"
 	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/lager/v3/lagertest"
 	"github.com/docker/docker/pkg/system"
+	"github.com/moby/sys/mountinfo"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
+	digestpkg "github.com/opencontainers/go-digest"
 	"golang.org/x/sys/unix"
 )
 
@@ -53,8 +62,8 @@ var _ = Describe("Driver", func() {
 
 	BeforeEach(func() {
 		unmounter = new(fakes.FakeUnmounter)
-		unmounter.UnmountStub = func(log lager.Logger, path string) error {
-			return unix.Unmount(path, 0)
+		unmounter.UnmountStub = func(log lager.Logger, path string, flags int) error {
+			return unix.Unmount(path, flags)
 		}
 		directIO = new(fakes.FakeDirectIO)
 
@@ -68,7 +77,10 @@ var _ = Describe("Driver", func() {
 		var err error
 		storePath, err = ioutil.TempDir(StorePath, "")
 		Expect(err).ToNot(HaveOccurred())
-		driver = overlayxfs.NewDriver(storePath, tardisBinPath, unmounter, directIO)
+		// The store of the suite is not necessarily on XFS, the specs needing
+		// it skip themselves
+		driver = overlayxfs.NewDriver(storePath, tardisBinPath, unmounter, directIO).
+			WithSkipXFSCheck(true)
 
 		Expect(os.MkdirAll(storePath, 0777)).To(Succeed())
 		Expect(os.MkdirAll(filepath.Join(storePath, store.VolumesDirName), 0777)).To(Succeed())
@@ -132,6 +144,22 @@ var _ = Describe("Driver", func() {
 			})
 		})
 
+		Context("when the kernel does not list overlay yet", func() {
+			var filesystemsPath string
+
+			BeforeEach(func() {
+				filesystemsPath = filepath.Join(storePath, "filesystems")
+				Expect(ioutil.WriteFile(filesystemsPath, []byte("nodev\tsysfs\n\txfs\n"), 0644)).To(Succeed())
+				driver.WithFilesystemsPath(filesystemsPath)
+			})
+
+			It("carries on initializing the store", func() {
+				err := driver.InitFilesystem(logger, "/tmp/no-valid", storePath)
+				Expect(errors.Is(err, overlayxfs.ErrOverlayNotSupported)).To(BeFalse())
+				Expect(err).To(MatchError(ContainSubstring("Formatting XFS filesystem")))
+			})
+		})
+
 		Context("when the filesystem is already formatted", func() {
 			BeforeEach(func() {
 				cmd := exec.Command("mkfs.xfs", "-f", fsFile)
@@ -241,7 +269,7 @@ var _ = Describe("Driver", func() {
 		It("succcesfully unmounts a filesystem", func() {
 			Expect(driver.DeInitFilesystem(logger, deinitStorePath)).To(Succeed())
 			Expect(unmounter.UnmountCallCount()).To(Equal(1))
-			_, path := unmounter.UnmountArgsForCall(0)
+			_, path, _ := unmounter.UnmountArgsForCall(0)
 			Expect(path).To(Equal(deinitStorePath))
 		})
 
@@ -266,14 +294,14 @@ var _ = Describe("Driver", func() {
 
 		BeforeEach(func() {
 			layer1ID = randVolumeID()
-			layer1Path = createVolume(storePath, driver, "parent-id", layer1ID, 5000)
+			layer1Path = createVolume(storePath, driver, "", layer1ID, 5000)
 			Expect(ioutil.WriteFile(filepath.Join(layer1Path, "file-hello"), []byte("hello-1"), 0755)).To(Succeed())
 			Expect(ioutil.WriteFile(filepath.Join(layer1Path, "file-bye"), []byte("bye-1"), 0700)).To(Succeed())
 			Expect(os.Mkdir(filepath.Join(layer1Path, "a-folder"), 0700)).To(Succeed())
 			Expect(ioutil.WriteFile(filepath.Join(layer1Path, "a-folder", "folder-file"), []byte("in-a-folder-1"), 0755)).To(Succeed())
 
 			layer2ID = randVolumeID()
-			layer2Path = createVolume(storePath, driver, "parent-id", layer2ID, 10000)
+			layer2Path = createVolume(storePath, driver, "", layer2ID, 10000)
 			Expect(ioutil.WriteFile(filepath.Join(layer2Path, "file-bye"), []byte("bye-2"), 0700)).To(Succeed())
 			Expect(os.Mkdir(filepath.Join(layer2Path, "a-folder"), 0700)).To(Succeed())
 			Expect(ioutil.WriteFile(filepath.Join(layer2Path, "a-folder", "folder-file"), []byte("in-a-folder-2"), 0755)).To(Succeed())
@@ -281,6 +309,337 @@ var _ = Describe("Driver", func() {
 			spec.BaseVolumeIDs = []string{layer1ID}
 		})
 
+		Context("when protected paths are given", func() {
+			BeforeEach(func() {
+				spec.ProtectedPaths = []string{"/a-folder/folder-file"}
+			})
+
+			It("makes them read-only while the rest of the rootfs stays writable", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "a-folder", "folder-file"), []byte("shadowed"), 0755)
+				Expect(errors.Is(err, unix.EROFS)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "file-hello"), []byte("changed"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "a-folder", "new-file"), []byte("new"), 0755)).To(Succeed())
+
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "a-folder", "folder-file")).NotTo(BeAnExistingFile())
+
+				// The binds are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			It("can still destroy the image", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+			})
+
+			It("binds them through the mounter", func() {
+				mounter := new(fakes.FakeMounter)
+				mounter.MountStub = func(_ lager.Logger, source, target, fstype string, flags uintptr, data string) error {
+					return unix.Mount(source, target, fstype, flags, data)
+				}
+				driver.WithMounter(mounter)
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				protectedPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "a-folder", "folder-file")
+				flags := []uintptr{}
+				for i := 0; i < mounter.MountCallCount(); i++ {
+					_, _, target, _, flag, _ := mounter.MountArgsForCall(i)
+					if target == protectedPath {
+						flags = append(flags, flag)
+					}
+				}
+				Expect(flags).To(Equal([]uintptr{unix.MS_BIND, unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY}))
+
+				// The binds are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			Context("when a protected path does not exist in the image", func() {
+				BeforeEach(func() {
+					spec.ProtectedPaths = []string{"/a-folder/folder-file", "/not-there"}
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("protected path /not-there does not exist in the image")))
+				})
+			})
+
+			Context("when a protected path leads out of the rootfs", func() {
+				BeforeEach(func() {
+					Expect(os.Symlink(storePath, filepath.Join(layer1Path, "escape"))).To(Succeed())
+					spec.ProtectedPaths = []string{"/escape"}
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("protected path /escape resolves outside of the rootfs")))
+				})
+			})
+		})
+
+		Context("when extra mounts are given", func() {
+			var sourcePath string
+
+			BeforeEach(func() {
+				var err error
+				sourcePath, err = ioutil.TempDir("", "extra-mount")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(sourcePath, "shared-file"), []byte("shared"), 0644)).To(Succeed())
+
+				spec.ExtraMounts = []image_manager.Mount{
+					{Source: sourcePath, Destination: "data/shared", ReadOnly: true},
+					{Source: filepath.Join(sourcePath, "shared-file"), Destination: "a-folder/shared-file"},
+				}
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(sourcePath)).To(Succeed())
+			})
+
+			It("bind mounts them into the rootfs", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				Expect(ioutil.ReadFile(filepath.Join(rootfsPath, "data", "shared", "shared-file"))).To(Equal([]byte("shared")))
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "data", "shared", "new-file"), []byte("new"), 0644)
+				Expect(errors.Is(err, unix.EROFS)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "a-folder", "shared-file"), []byte("changed"), 0644)).To(Succeed())
+				Expect(ioutil.ReadFile(filepath.Join(sourcePath, "shared-file"))).To(Equal([]byte("changed")))
+
+				// The binds are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			It("unmounts them in reverse order before the rootfs when destroying the image", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(sourcePath, "shared-file")).To(BeAnExistingFile())
+
+				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				unmounted := []string{}
+				for i := 0; i < unmounter.UnmountCallCount(); i++ {
+					_, path, _ := unmounter.UnmountArgsForCall(i)
+					unmounted = append(unmounted, path)
+				}
+				Expect(unmounted).To(Equal([]string{
+					filepath.Join(rootfsPath, "a-folder", "shared-file"),
+					filepath.Join(rootfsPath, "data", "shared"),
+					rootfsPath,
+				}))
+			})
+
+			Context("when the workload replaces a parent of a destination with a symlink", func() {
+				var hostPath string
+
+				BeforeEach(func() {
+					var err error
+					hostPath, err = ioutil.TempDir("", "host")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(os.Mkdir(filepath.Join(hostPath, "shared"), 0755)).To(Succeed())
+				})
+
+				AfterEach(func() {
+					Expect(os.RemoveAll(hostPath)).To(Succeed())
+				})
+
+				It("does not unmount anything out of the rootfs when destroying the image", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+					Expect(os.Rename(filepath.Join(rootfsPath, "data"), filepath.Join(rootfsPath, "moved-data"))).To(Succeed())
+					Expect(os.Symlink(hostPath, filepath.Join(rootfsPath, "data"))).To(Succeed())
+
+					Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+					for i := 0; i < unmounter.UnmountCallCount(); i++ {
+						_, path, _ := unmounter.UnmountArgsForCall(i)
+						Expect(path).NotTo(HavePrefix(hostPath))
+					}
+				})
+			})
+
+			Context("when a destination escapes the rootfs", func() {
+				BeforeEach(func() {
+					spec.ExtraMounts = []image_manager.Mount{{Source: sourcePath, Destination: "../../escape"}}
+				})
+
+				It("returns an error without creating the image", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrMountDestinationOutsideRootfs)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+					Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when a destination leads out of the rootfs through a symlink", func() {
+				BeforeEach(func() {
+					Expect(os.Symlink(storePath, filepath.Join(layer1Path, "escape"))).To(Succeed())
+					spec.ExtraMounts = []image_manager.Mount{{Source: sourcePath, Destination: "escape/shared"}}
+				})
+
+				It("returns an error without creating the destination", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrMountDestinationOutsideRootfs)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+					Expect(filepath.Join(storePath, "shared")).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when a source is not absolute", func() {
+				BeforeEach(func() {
+					spec.ExtraMounts = []image_manager.Mount{{Source: "relative", Destination: "data"}}
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("mount source relative is not absolute")))
+				})
+			})
+		})
+
+		Context("when the image is read-only", func() {
+			var rootfsPath string
+
+			BeforeEach(func() {
+				spec.ReadOnly = true
+				spec.BaseVolumeIDs = []string{layer1ID, layer2ID}
+				rootfsPath = filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+			})
+
+			AfterEach(func() {
+				// Bind mounts are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+			})
+
+			It("mounts the base volumes read-only without an upperdir", func() {
+				mountInfo, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).NotTo(BeAnExistingFile())
+				Expect(ioutil.ReadFile(filepath.Join(rootfsPath, "file-bye"))).To(Equal([]byte("bye-2")))
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "new-file"), []byte("new"), 0755)
+				Expect(errors.Is(err, unix.EROFS)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+
+				Expect(mountInfo.Type).To(Equal("overlay"))
+				Expect(mountInfo.Options).To(HaveLen(1))
+				Expect(mountInfo.Options[0]).To(HavePrefix("lowerdir="))
+				Expect(mountInfo.Options[0]).NotTo(ContainSubstring("upperdir"))
+			})
+
+			It("can be mounted again", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(unix.Unmount(rootfsPath, 0)).To(Succeed())
+
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(ioutil.ReadFile(filepath.Join(rootfsPath, "file-bye"))).To(Equal([]byte("bye-2")))
+				err = ioutil.WriteFile(filepath.Join(rootfsPath, "new-file"), []byte("new"), 0755)
+				Expect(errors.Is(err, unix.EROFS)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+			})
+
+			Context("when there is a single base volume", func() {
+				BeforeEach(func() {
+					spec.BaseVolumeIDs = []string{layer1ID}
+				})
+
+				It("bind mounts it read-only", func() {
+					mountInfo, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).NotTo(BeAnExistingFile())
+					Expect(ioutil.ReadFile(filepath.Join(rootfsPath, "file-hello"))).To(Equal([]byte("hello-1")))
+					err = ioutil.WriteFile(filepath.Join(rootfsPath, "file-hello"), []byte("changed"), 0755)
+					Expect(errors.Is(err, unix.EROFS)).To(BeTrue(), fmt.Sprintf("unexpected error: %v", err))
+
+					Expect(mountInfo.Type).To(Equal("bind"))
+					Expect(mountInfo.Options).To(ConsistOf("bind", "ro"))
+				})
+			})
+
+			Context("when a disk limit is given", func() {
+				BeforeEach(func() {
+					spec.DiskLimit = 10 * mb
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("read-only images cannot have a disk limit")))
+				})
+			})
+		})
+
+		Context("when checking the length of the lowerdirs", func() {
+			var linkPath string
+
+			BeforeEach(func() {
+				shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, layer1ID))
+				Expect(err).NotTo(HaveOccurred())
+				linkPath = filepath.Join(storePath, overlayxfs.LinksDirName, string(shortID))
+			})
+
+			It("accepts lowerdirs within PATH_MAX", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("rejects a lowerdir longer than PATH_MAX, naming the layer", func() {
+				driver.WithPathMax(len(linkPath))
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrLowerDirTooLong)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("layer " + layer1ID)))
+			})
+
+			It("rejects a lowerdir that resolves to a path longer than PATH_MAX", func() {
+				resolvedPath := filepath.Join(storePath, store.VolumesDirName, layer1ID)
+				Expect(len(resolvedPath)).To(BeNumerically(">", len(linkPath)+1))
+				driver.WithPathMax(len(linkPath) + 1)
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrLowerDirTooLong)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("resolves to " + resolvedPath)))
+			})
+		})
+
+		Context("when the image has more layers than fit in the mount data", func() {
+			BeforeEach(func() {
+				mountDataMax := 512
+				driver.WithMountDataMax(mountDataMax)
+
+				spec.BaseVolumeIDs = []string{}
+				lowerDirsLength := 0
+				for lowerDirsLength < mountDataMax {
+					volumeID := randVolumeID()
+					createVolume(storePath, driver, "", volumeID, 0)
+					spec.BaseVolumeIDs = append(spec.BaseVolumeIDs, volumeID)
+
+					shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, volumeID))
+					Expect(err).NotTo(HaveOccurred())
+					lowerDirsLength += len(filepath.Join(overlayxfs.LinksDirName, string(shortID))) + 1
+				}
+			})
+
+			It("returns an error suggesting to squash the layers", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrMountDataTooLong)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("need to be squashed")))
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+			})
+		})
+
 		It("initializes the image path", func() {
 			Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).ToNot(BeAnExistingFile())
 			Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).ToNot(BeAnExistingFile())
@@ -400,6 +759,27 @@ var _ = Describe("Driver", func() {
 			Expect(gid).To(Equal(456))
 		})
 
+		Context("when an image directory mode is set", func() {
+			BeforeEach(func() {
+				driver.WithImageDirMode(0775)
+			})
+
+			It("uses it, without letting others write to the workdir", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				for dir, mode := range map[string]os.FileMode{
+					overlayxfs.UpperDir:  0775,
+					overlayxfs.WorkDir:   0755,
+					overlayxfs.RootfsDir: 0775,
+				} {
+					stat, err := os.Stat(filepath.Join(spec.ImagePath, dir))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stat.Mode().Perm()).To(Equal(mode), dir)
+				}
+			})
+		})
+
 		Context("when Mount is false", func() {
 			BeforeEach(func() {
 				spec.Mount = false
@@ -428,607 +808,5792 @@ var _ = Describe("Driver", func() {
 			})
 		})
 
-		Context("image_info", func() {
+		Context("when redirect_dir=nofollow is requested", func() {
 			BeforeEach(func() {
-				volumeID := randVolumeID()
-				createVolume(storePath, driver, "parent-id", volumeID, 5000)
-
-				spec.BaseVolumeIDs = []string{volumeID}
+				spec.RedirectDirNoFollow = true
 			})
 
-			It("creates a image info file with the total base volume size", func() {
-				Expect(filepath.Join(spec.ImagePath, "image_info")).ToNot(BeAnExistingFile())
-				_, err := driver.CreateImage(logger, spec)
+			It("adds redirect_dir=nofollow to the mount data", func() {
+				mountJson, err := driver.CreateImage(logger, spec)
 				Expect(err).ToNot(HaveOccurred())
 
-				ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_info"), 5000)
+				Expect(mountJson.Options).To(HaveLen(1))
+				Expect(mountJson.Options[0]).To(HaveSuffix(",redirect_dir=nofollow"))
+			})
+
+			Context("when the kernel does not support it", func() {
+				var parametersPath string
+
+				BeforeEach(func() {
+					var err error
+					parametersPath, err = ioutil.TempDir("", "overlay-parameters")
+					Expect(err).NotTo(HaveOccurred())
+					driver.WithOverlayModuleParametersPath(parametersPath)
+				})
+
+				AfterEach(func() {
+					Expect(os.RemoveAll(parametersPath)).To(Succeed())
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(overlayxfs.ErrRedirectDirNoFollowNotSupported))
+				})
+
+				It("does not create the image directories", func() {
+					_, _ = driver.CreateImage(logger, spec)
+					Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).ToNot(BeAnExistingFile())
+				})
+
+				It("does not complain when redirect_dir=nofollow is not requested", func() {
+					spec.RedirectDirNoFollow = false
+					mountJson, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountJson.Options[0]).NotTo(ContainSubstring("redirect_dir"))
+				})
 			})
 		})
 
-		Context("when disk limit is 0", func() {
+		Context("when extra mount options are given", func() {
 			BeforeEach(func() {
-				spec.DiskLimit = 0
+				spec.Mount = false
+				spec.MountOptions = map[string]string{"redirect_dir": "on", "metacopy": "on"}
 			})
 
-			It("doesn't apply any quota", func() {
-				_, err := driver.CreateImage(logger, spec)
+			It("appends them to the mount data in a stable order", func() {
+				mountJson, err := driver.CreateImage(logger, spec)
 				Expect(err).ToNot(HaveOccurred())
 
-				Eventually(logger).Should(gbytes.Say(regexp.QuoteMeta(`overlay+xfs.overlayxfs-creating-image.applying-quotas.no-need-for-quotas`)))
+				Expect(mountJson.Options).To(HaveLen(1))
+				Expect(mountJson.Options[0]).To(MatchRegexp(`^lowerdir=.*,upperdir=.*,workdir=.*,metacopy=on,redirect_dir=on$`))
 			})
 
-			It("does not create an image quota file containing the requested quota", func() {
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).ToNot(HaveOccurred())
+			It("mounts with options the kernel does not show as they are its defaults", func() {
+				spec.Mount = true
+				spec.MountOptions = map[string]string{"index": "off", "xino": "off", "metacopy": "off"}
 
-				Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(driver.IsImageMounted(logger, spec.ImagePath)).To(BeTrue())
 			})
-		})
 
-		Context("when disk limit is > 0", func() {
-			BeforeEach(func() {
-				spec.DiskLimit = 10 * mb
-				Expect(ioutil.WriteFile(filepath.Join(storePath, store.MetaDirName, fmt.Sprintf("volume-%s", layer1ID)), []byte(`{"Size": 3145728}`), 0644)).To(Succeed())
+			It("rejects options overriding the directories of the image", func() {
+				for _, name := range []string{"lowerdir", "upperdir", "workdir", "volatile"} {
+					spec.MountOptions = map[string]string{name: "/tmp"}
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrInvalidMountOption)).To(BeTrue(), name)
+				}
 			})
 
-			It("creates the storeDevice block device in the `images` parent folder", func() {
-				storeDevicePath := filepath.Join(storePath, "storeDevice")
-
-				Expect(storeDevicePath).ToNot(BeAnExistingFile())
+			It("rejects invalid values", func() {
+				spec.MountOptions = map[string]string{"metacopy": "on,lowerdir=/"}
 				_, err := driver.CreateImage(logger, spec)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(storeDevicePath).To(BeAnExistingFile())
+				Expect(errors.Is(err, overlayxfs.ErrInvalidMountOption)).To(BeTrue())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).ToNot(BeAnExistingFile())
 			})
 
-			It("can overwrite files from the lowerdirs", func() {
+			It("rejects redirect_dir along with RedirectDirNoFollow", func() {
+				spec.RedirectDirNoFollow = true
 				_, err := driver.CreateImage(logger, spec)
-				Expect(err).ToNot(HaveOccurred())
-				imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
-
-				dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file", imageRootfsPath), "count=5", "bs=1M")
-				sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
-				Expect(err).NotTo(HaveOccurred())
-				Eventually(sess).Should(gexec.Exit(0))
+				Expect(err).To(MatchError(ContainSubstring("conflicts with RedirectDirNoFollow")))
 			})
 
-			It("allows images to have independent quotas", func() {
+			It("honours the allowed overlay options", func() {
+				driver.WithAllowedOverlayOptions("redirect_dir")
 				_, err := driver.CreateImage(logger, spec)
-				Expect(err).ToNot(HaveOccurred())
-				imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				Expect(errors.Is(err, overlayxfs.ErrOptionNotAllowed)).To(BeTrue())
+			})
+		})
 
-				dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=6", "bs=1M")
-				sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
-				Expect(err).NotTo(HaveOccurred())
-				Eventually(sess).Should(gexec.Exit(0))
+		Context("durability policy", func() {
+			var kernelReleasePath string
 
-				anotherSpec := spec
-				anotherImagePath, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "another-image")
+			fakeKernelRelease := func(release string) {
+				releaseFile, err := ioutil.TempFile("", "osrelease")
 				Expect(err).NotTo(HaveOccurred())
-				anotherSpec.ImagePath = anotherImagePath
-				_, err = driver.CreateImage(logger, anotherSpec)
+				_, err = releaseFile.WriteString(release + "\n")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(releaseFile.Close()).To(Succeed())
+				kernelReleasePath = releaseFile.Name()
+				driver.WithKernelReleasePath(kernelReleasePath)
+			}
+
+			BeforeEach(func() {
+				fakeKernelRelease("5.10.0-generic")
+				spec.Mount = false
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(kernelReleasePath)).To(Succeed())
+			})
+
+			It("does not add volatile by default", func() {
+				mountJson, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountJson.Options[0]).NotTo(ContainSubstring("volatile"))
+			})
+
+			It("does not add volatile for the safe policy", func() {
+				spec.Durability = image_manager.DurabilitySafe
+				mountJson, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountJson.Options[0]).NotTo(ContainSubstring("volatile"))
+			})
+
+			It("adds volatile for the fast policy on kernels supporting it", func() {
+				spec.Durability = image_manager.DurabilityFast
+				for _, release := range []string{"5.10.0-generic", "5.15.0", "6.1.0"} {
+					fakeKernelRelease(release)
+					spec.ImagePath = filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+					Expect(os.Mkdir(spec.ImagePath, 0755)).To(Succeed())
+
+					mountJson, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mountJson.Options[0]).To(HaveSuffix(",volatile"), release)
+				}
+			})
+
+			It("does not add volatile for the fast policy on older kernels", func() {
+				spec.Durability = image_manager.DurabilityFast
+				for _, release := range []string{"5.4.0-150-generic", "4.19.0"} {
+					fakeKernelRelease(release)
+					spec.ImagePath = filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+					Expect(os.Mkdir(spec.ImagePath, 0755)).To(Succeed())
+
+					mountJson, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mountJson.Options[0]).NotTo(ContainSubstring("volatile"), release)
+				}
+			})
+
+			It("logs when falling back to the safe policy", func() {
+				fakeKernelRelease("5.4.0")
+				spec.Durability = image_manager.DurabilityFast
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger).To(gbytes.Say("volatile-not-supported-falling-back-to-safe-durability"))
+			})
+
+			It("rejects unknown policies", func() {
+				spec.Durability = "reckless"
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring(`invalid durability policy "reckless"`)))
+			})
+		})
+
+		Context("when the overlay options are restricted", func() {
+			BeforeEach(func() {
+				driver.WithAllowedOverlayOptions("redirect_dir")
+			})
+
+			It("allows the options in the allowlist", func() {
+				spec.RedirectDirNoFollow = true
+				mountJson, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountJson.Options[0]).To(HaveSuffix(",redirect_dir=nofollow"))
+			})
+
+			It("rejects the other options before mounting", func() {
+				spec.Durability = image_manager.DurabilityFast
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrOptionNotAllowed)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("volatile")))
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+			})
+
+			It("still allows images without options", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when a mount source is provided", func() {
+			BeforeEach(func() {
+				spec.MountSource = randomImageID
+			})
+
+			It("mounts the overlay with that source", func() {
+				_, err := driver.CreateImage(logger, spec)
 				Expect(err).ToNot(HaveOccurred())
-				anotherImageRootfsPath := filepath.Join(anotherImagePath, overlayxfs.RootfsDir)
 
-				dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", anotherImageRootfsPath), "count=6", "bs=1M")
-				sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)))
 				Expect(err).NotTo(HaveOccurred())
-				Eventually(sess).Should(gexec.Exit(0))
+				Expect(mounts).To(HaveLen(1))
+				Expect(mounts[0].Source).To(Equal(randomImageID))
 			})
 
-			Context("inclusive quota", func() {
+			It("returns it in the mountJson object", func() {
+				mountJson, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mountJson.Source).To(Equal(randomImageID))
+			})
+
+			Context("when the mount source would break mountinfo parsing", func() {
+				It("returns an error", func() {
+					for _, source := range []string{"my image", "my\timage", `my\image`, "my\x00image"} {
+						spec.MountSource = source
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("invalid mount source")))
+					}
+				})
+			})
+		})
+
+		Context("when the mount does not show up in mountinfo", func() {
+			var mountInfoPath string
+
+			BeforeEach(func() {
+				mountInfo, err := ioutil.TempFile("", "mountinfo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountInfo.Close()).To(Succeed())
+
+				mountInfoPath = mountInfo.Name()
+				driver.WithMountInfoPath(mountInfoPath)
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(mountInfoPath)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("not found in mountinfo")))
+			})
+
+			It("unmounts the rootfs", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(HaveOccurred())
+
+				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				Expect(unmounter.UnmountCallCount()).To(Equal(1))
+				_, unmountPath, _ := unmounter.UnmountArgsForCall(0)
+				Expect(unmountPath).To(Equal(rootfsPath))
+
+				mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(rootfsPath))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounts).To(BeEmpty())
+			})
+
+			Context("and the verification is skipped", func() {
 				BeforeEach(func() {
-					spec.ExclusiveDiskLimit = false
+					driver.WithSkipMountVerification(true)
 				})
 
-				It("enforces the quota in the image", func() {
+				AfterEach(func() {
+					Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				})
+
+				It("creates the image", func() {
 					_, err := driver.CreateImage(logger, spec)
-					Expect(err).ToNot(HaveOccurred())
-					imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).To(BeADirectory())
+				})
+			})
+		})
 
-					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=5", "bs=1M")
-					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+		Context("when the filesystem operations are faked", func() {
+			var (
+				fsOperations   *fakes.FakeFSOperations
+				fakedStorePath string
+				fakedImagePath string
+			)
+
+			BeforeEach(func() {
+				var err error
+				fakedStorePath, err = ioutil.TempDir("", "faked-store")
+				Expect(err).NotTo(HaveOccurred())
+				for _, dir := range []string{store.VolumesDirName, store.MetaDirName, store.ImageDirName, overlayxfs.LinksDirName} {
+					Expect(os.MkdirAll(filepath.Join(fakedStorePath, dir), 0755)).To(Succeed())
+				}
+				Expect(ioutil.WriteFile(filepath.Join(fakedStorePath, overlayxfs.LinksDirName, "volume-id"), []byte("short-id"), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(volumeMetaPath(fakedStorePath, "volume-id"), []byte(`{"Size": 1000}`), 0644)).To(Succeed())
+
+				fakedImagePath = filepath.Join(fakedStorePath, store.ImageDirName, "image-id")
+				Expect(os.Mkdir(fakedImagePath, 0755)).To(Succeed())
+
+				// The mount is faked, so is the kernel view of it
+				mountInfo := filepath.Join(fakedStorePath, "mountinfo")
+				mountInfoLine := fmt.Sprintf("1 0 0:1 / %s rw - overlay overlay rw\n", filepath.Join(fakedImagePath, overlayxfs.RootfsDir))
+				Expect(ioutil.WriteFile(mountInfo, []byte(mountInfoLine), 0644)).To(Succeed())
+
+				// The directories are not created, stat an existing one owned by the
+				// image owner instead
+				ownedPath := filepath.Join(fakedStorePath, "owned")
+				Expect(os.Mkdir(ownedPath, 0755)).To(Succeed())
+				Expect(os.Chown(ownedPath, 123, 456)).To(Succeed())
+				ownedInfo, err := os.Stat(ownedPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				fsOperations = new(fakes.FakeFSOperations)
+				fsOperations.StatReturns(ownedInfo, nil)
+				driver = overlayxfs.NewDriver(fakedStorePath, tardisBinPath, unmounter, directIO).
+					WithFSOperations(fsOperations).
+					WithQuotaManager(new(fakes.FakeQuotaManager)).
+					WithMountInfoPath(mountInfo)
+
+				spec = image_manager.ImageDriverSpec{
+					BaseVolumeIDs: []string{"volume-id"},
+					ImagePath:     fakedImagePath,
+					Mount:         true,
+					OwnerUID:      123,
+					OwnerGID:      456,
+				}
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(fakedStorePath)).To(Succeed())
+			})
+
+			It("creates the image directories owned by the image owner", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				createdDirs := []string{}
+				for i := 0; i < fsOperations.MkdirCallCount(); i++ {
+					path, perm := fsOperations.MkdirArgsForCall(i)
+					Expect(perm).To(Equal(os.FileMode(0755)))
+					createdDirs = append(createdDirs, path)
+				}
+				Expect(createdDirs).To(ConsistOf(
+					filepath.Join(fakedImagePath, overlayxfs.UpperDir),
+					filepath.Join(fakedImagePath, overlayxfs.WorkDir),
+					filepath.Join(fakedImagePath, overlayxfs.RootfsDir),
+				))
+
+				Expect(fsOperations.ChownCallCount()).To(Equal(3))
+				for i := 0; i < fsOperations.ChownCallCount(); i++ {
+					_, uid, gid := fsOperations.ChownArgsForCall(i)
+					Expect(uid).To(Equal(123))
+					Expect(gid).To(Equal(456))
+				}
+			})
+
+			It("mounts the overlay with the volume links as lowerdirs", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fsOperations.MountCallCount()).To(Equal(1))
+				source, target, fstype, flags, data := fsOperations.MountArgsForCall(0)
+				Expect(source).To(Equal("overlay"))
+				Expect(target).To(Equal(filepath.Join(fakedImagePath, overlayxfs.RootfsDir)))
+				Expect(fstype).To(Equal("overlay"))
+				Expect(flags).To(BeZero())
+				Expect(data).To(Equal(fmt.Sprintf("lowerdir=l/short-id,upperdir=%s,workdir=%s",
+					filepath.Join(fakedImagePath, overlayxfs.UpperDir),
+					filepath.Join(fakedImagePath, overlayxfs.WorkDir),
+				)))
+			})
+
+			Context("when a mounter is given", func() {
+				var mounter *fakes.FakeMounter
+
+				BeforeEach(func() {
+					mounter = new(fakes.FakeMounter)
+					driver = driver.WithMounter(mounter)
+				})
+
+				It("mounts the overlay through it", func() {
+					_, err := driver.CreateImage(logger, spec)
 					Expect(err).NotTo(HaveOccurred())
-					Eventually(sess).Should(gexec.Exit(0))
 
-					dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=4", "bs=1M")
-					sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(fsOperations.MountCallCount()).To(BeZero())
+					Expect(mounter.MountCallCount()).To(Equal(1))
+					_, source, target, fstype, flags, data := mounter.MountArgsForCall(0)
+					Expect(source).To(Equal("overlay"))
+					Expect(target).To(Equal(filepath.Join(fakedImagePath, overlayxfs.RootfsDir)))
+					Expect(fstype).To(Equal("overlay"))
+					Expect(flags).To(BeZero())
+					Expect(data).To(HavePrefix("lowerdir=l/short-id,"))
+				})
+
+				It("binds the upper device dirs through it", func() {
+					driver.WithUpperDevicePath(filepath.Join(fakedStorePath, "upper-device"))
+					_, err := driver.CreateImage(logger, spec)
 					Expect(err).NotTo(HaveOccurred())
-					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
-					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+
+					Expect(fsOperations.MountCallCount()).To(BeZero())
+					targets := []string{}
+					for i := 0; i < mounter.MountCallCount(); i++ {
+						_, _, target, _, flags, _ := mounter.MountArgsForCall(i)
+						if flags&unix.MS_BIND != 0 {
+							targets = append(targets, target)
+						}
+					}
+					Expect(targets).To(ConsistOf(
+						filepath.Join(fakedImagePath, overlayxfs.UpperDir),
+						filepath.Join(fakedImagePath, overlayxfs.WorkDir),
+					))
 				})
 
-				It("creates a image quota file containing the requested quota", func() {
-					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+				It("returns its errors", func() {
+					mounter.MountReturns(errors.New("mount-failed"))
 					_, err := driver.CreateImage(logger, spec)
-					Expect(err).ToNot(HaveOccurred())
+					Expect(err).To(MatchError(ContainSubstring("mount-failed")))
+				})
+			})
 
-					ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_quota"), 10*mb-3145728)
+			It("does not mount when the spec asks not to", func() {
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fsOperations.MountCallCount()).To(BeZero())
+			})
+
+			Context("when mounting takes longer than the mount timeout", func() {
+				var (
+					release         chan struct{}
+					timeout         chan time.Time
+					kernelLogReader *fakes.FakeKernelLogReader
+				)
+
+				BeforeEach(func() {
+					release = make(chan struct{})
+					fsOperations.MountStub = func(string, string, string, uintptr, string) error {
+						<-release
+						return nil
+					}
+					unmounter.UnmountReturns(nil)
+
+					timeout = make(chan time.Time, 1)
+					clock := new(fakes.FakeClock)
+					clock.AfterReturns(timeout)
+
+					kernelLogReader = new(fakes.FakeKernelLogReader)
+					kernelLogReader.ReadKernelLogReturns([]string{
+						"<6>[    1.000000] eth0: link up",
+						"<3>[    2.000000] overlayfs: failed to resolve 'l/short-id': -110",
+					}, nil)
+
+					driver.WithClock(clock).WithKernelLogReader(kernelLogReader).WithMountTimeout(5 * time.Second)
 				})
 
-				Context("when the DiskLimit is smaller than VolumeSize", func() {
-					It("returns an error", func() {
-						spec.DiskLimit = 4000
-						_, err := driver.CreateImage(logger, spec)
-						Expect(err).To(MatchError(ContainSubstring("disk limit is smaller than volume size")))
-					})
+				AfterEach(func() {
+					close(release)
 				})
 
-				Context("when the DiskLimit is less than the minimum quota (1024*256 bytes) after accounting for the VolumeSize", func() {
-					BeforeEach(func() {
-						volumeSize := int64(128 * kb)
-						layerID := randVolumeID()
-						_ = createVolume(storePath, driver, "parent-id", layerID, volumeSize)
+				It("returns ErrMountTimeout with the overlay kernel messages", func() {
+					timeout <- time.Now()
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrMountTimeout)).To(BeTrue())
+					Expect(err).To(MatchError(ContainSubstring("giving up after 5s")))
+					Expect(err).To(MatchError(ContainSubstring("overlayfs: failed to resolve 'l/short-id': -110")))
+					Expect(err.Error()).NotTo(ContainSubstring("eth0"))
+				})
 
-						spec.BaseVolumeIDs = []string{layerID}
-						spec.DiskLimit = volumeSize + (128 * kb)
+				It("detaches the mount once it eventually completes", func() {
+					timeout <- time.Now()
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(HaveOccurred())
+
+					release <- struct{}{}
+					Eventually(func() []int {
+						flags := []int{}
+						for i := 0; i < unmounter.UnmountCallCount(); i++ {
+							_, _, f := unmounter.UnmountArgsForCall(i)
+							flags = append(flags, f)
+						}
+						return flags
+					}).Should(ContainElement(unix.MNT_DETACH))
+				})
+			})
+
+			Describe("DestroyImage", func() {
+				var clock *fakes.FakeClock
+
+				BeforeEach(func() {
+					unmounter.UnmountReturns(nil)
+
+					elapsed := make(chan time.Time)
+					close(elapsed)
+					clock = new(fakes.FakeClock)
+					clock.AfterReturns(elapsed)
+					driver.WithClock(clock)
+				})
+
+				Context("when removing the image fails with ENOTEMPTY once", func() {
+					It("retries after a backoff", func() {
+						fsOperations.RemoveAllReturnsOnCall(0, &os.PathError{Op: "unlinkat", Path: fakedImagePath, Err: unix.ENOTEMPTY})
+
+						Expect(driver.DestroyImage(logger, fakedImagePath)).To(Succeed())
+						Expect(fsOperations.RemoveAllCallCount()).To(Equal(2))
+						Expect(clock.AfterCallCount()).To(Equal(1))
+						Expect(clock.AfterArgsForCall(0)).To(Equal(overlayxfs.DefaultRemoveBackoff))
 					})
+				})
 
-					It("enforces the minimum required quota in the image", func() {
-						_, err := driver.CreateImage(logger, spec)
-						Expect(err).ToNot(HaveOccurred())
-						imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				Context("when removing the image keeps failing with ENOTEMPTY", func() {
+					It("gives up after the configured attempts, backing off exponentially", func() {
+						driver.WithRemoveRetries(3, time.Second)
+						fsOperations.RemoveAllReturns(&os.PathError{Op: "unlinkat", Path: fakedImagePath, Err: unix.ENOTEMPTY})
 
-						dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=1", "bs=128K")
-						sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
-						Expect(err).NotTo(HaveOccurred())
-						Eventually(sess).Should(gexec.Exit(0))
+						err := driver.DestroyImage(logger, fakedImagePath)
+						Expect(err).To(MatchError(ContainSubstring("after 3 attempts")))
+						Expect(fsOperations.RemoveAllCallCount()).To(Equal(3))
+						Expect(clock.AfterArgsForCall(0)).To(Equal(time.Second))
+						Expect(clock.AfterArgsForCall(1)).To(Equal(2 * time.Second))
+					})
+				})
 
-						dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=1", "bs=128K")
-						sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
-						Expect(err).NotTo(HaveOccurred())
-						Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
-						Eventually(sess.Err).Should(gbytes.Say("No space left"))
+				Context("when removing the image fails with a permission error", func() {
+					It("fails without retrying", func() {
+						fsOperations.RemoveAllReturns(&os.PathError{Op: "unlinkat", Path: fakedImagePath, Err: unix.EPERM})
+
+						err := driver.DestroyImage(logger, fakedImagePath)
+						Expect(errors.Is(err, unix.EPERM)).To(BeTrue())
+						Expect(fsOperations.RemoveAllCallCount()).To(Equal(1))
+						Expect(clock.AfterCallCount()).To(BeZero())
 					})
 				})
 			})
 
-			Context("exclusive quota", func() {
+			Describe("lowerdir order", func() {
 				BeforeEach(func() {
-					spec.ExclusiveDiskLimit = true
+					Expect(ioutil.WriteFile(filepath.Join(fakedStorePath, overlayxfs.LinksDirName, "top-volume-id"), []byte("top-short-id"), 0644)).To(Succeed())
+					Expect(ioutil.WriteFile(volumeMetaPath(fakedStorePath, "top-volume-id"), []byte(`{"Size": 1000}`), 0644)).To(Succeed())
 				})
 
-				Context("when the DiskLimit is smaller than VolumeSize", func() {
-					It("succeeds", func() {
-						spec.DiskLimit = 3 * mb
+				It("puts the last volume first by default, as volumes are ordered bottom layer first", func() {
+					spec.BaseVolumeIDs = []string{"volume-id", "top-volume-id"}
+
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, _, _, mountData := fsOperations.MountArgsForCall(0)
+					Expect(mountData).To(ContainSubstring("lowerdir=l/top-short-id:l/short-id,"))
+				})
+
+				Context("when the volumes are ordered top layer first", func() {
+					It("keeps their order", func() {
+						spec.BaseVolumeIDs = []string{"top-volume-id", "volume-id"}
+						spec.LowerOrderTopFirst = true
+
 						_, err := driver.CreateImage(logger, spec)
-						Expect(err).ToNot(HaveOccurred())
+						Expect(err).NotTo(HaveOccurred())
+
+						_, _, _, _, mountData := fsOperations.MountArgsForCall(0)
+						Expect(mountData).To(ContainSubstring("lowerdir=l/top-short-id:l/short-id,"))
 					})
 				})
+			})
 
-				It("enforces the quota in the image", func() {
-					_, err := driver.CreateImage(logger, spec)
-					Expect(err).ToNot(HaveOccurred())
-					imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+			Context("when the upperdir is not owned by the image owner", func() {
+				var upperDir string
 
-					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=8", "bs=1M")
-					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				BeforeEach(func() {
+					upperDir = filepath.Join(fakedImagePath, overlayxfs.UpperDir)
+					rootOwnedInfo, err := os.Stat(fakedStorePath)
 					Expect(err).NotTo(HaveOccurred())
-					Eventually(sess).Should(gexec.Exit(0))
-
-					dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=8", "bs=1M")
-					sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					ownedInfo, err := fsOperations.Stat(fakedImagePath)
 					Expect(err).NotTo(HaveOccurred())
-					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
-					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+
+					// Ownership is only fixed by the chown following the three of the
+					// image directories creation
+					fsOperations.StatStub = func(path string) (os.FileInfo, error) {
+						if path == upperDir && fsOperations.ChownCallCount() < 4 {
+							return rootOwnedInfo, nil
+						}
+						return ownedInfo, nil
+					}
 				})
 
-				It("creates a image quota file containing the requested quota", func() {
-					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+				It("chowns it before mounting", func() {
 					_, err := driver.CreateImage(logger, spec)
-					Expect(err).ToNot(HaveOccurred())
+					Expect(err).NotTo(HaveOccurred())
 
-					ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_quota"), 10*mb)
+					Expect(fsOperations.ChownCallCount()).To(Equal(4))
+					path, uid, gid := fsOperations.ChownArgsForCall(3)
+					Expect(path).To(Equal(upperDir))
+					Expect(uid).To(Equal(123))
+					Expect(gid).To(Equal(456))
+					Expect(fsOperations.MountCallCount()).To(Equal(1))
+				})
+
+				Context("when chowning does not fix it", func() {
+					It("returns an error naming the owners without mounting", func() {
+						rootOwnedInfo, err := os.Stat(fakedStorePath)
+						Expect(err).NotTo(HaveOccurred())
+						fsOperations.StatReturns(rootOwnedInfo, nil)
+
+						_, err = driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring(upperDir + " is owned by 0:0 instead of the image owner 123:456")))
+						Expect(fsOperations.MountCallCount()).To(BeZero())
+					})
 				})
 			})
 
-			Context("when tardis is not in the path", func() {
+			Context("when the upperdir and workdir on the upper device are on different filesystems", func() {
+				It("fails to create the image", func() {
+					driver.WithUpperDevicePath(filepath.Join(fakedStorePath, "upper-device"))
+					fsOperations.StatStub = func(path string) (os.FileInfo, error) {
+						if filepath.Base(path) == overlayxfs.WorkDir {
+							return os.Stat("/proc")
+						}
+						return os.Stat(fakedStorePath)
+					}
+
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("are on different filesystems")))
+					Expect(fsOperations.MountCallCount()).To(BeZero())
+				})
+			})
+
+			Describe("GatherMetrics", func() {
+				var (
+					quotaManager *fakes.FakeQuotaManager
+					clock        *fakes.FakeClock
+					now          time.Time
+				)
+
 				BeforeEach(func() {
-					driver = overlayxfs.NewDriver(storePath, "/bin/bananas", unmounter, directIO)
+					for _, volumeID := range []string{"volume-id", "orphan-volume-id"} {
+						Expect(os.Mkdir(filepath.Join(fakedStorePath, store.VolumesDirName, volumeID), 0755)).To(Succeed())
+					}
+					Expect(ioutil.WriteFile(filepath.Join(fakedImagePath, "metadata.json"), []byte(`{"base_volume_ids": ["volume-id"]}`), 0600)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(fakedImagePath, "image_quota"), []byte(strconv.FormatInt(10*mb, 10)), 0600)).To(Succeed())
+
+					otherImagePath := filepath.Join(fakedStorePath, store.ImageDirName, "other-image-id")
+					Expect(os.Mkdir(otherImagePath, 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(otherImagePath, "metadata.json"), []byte(`{"base_volume_ids": ["volume-id"]}`), 0600)).To(Succeed())
+
+					fsOperations.StatfsReturns(unix.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 600, Bavail: 500, Ffree: 42}, nil)
+
+					quotaManager = new(fakes.FakeQuotaManager)
+					quotaManager.UsageReturns(9*mb+1, nil)
+
+					now = time.Now()
+					clock = new(fakes.FakeClock)
+					clock.NowReturns(now)
+
+					driver.WithQuotaManager(quotaManager).WithClock(clock)
 				})
 
-				It("returns an error", func() {
-					_, err := driver.CreateImage(logger, spec)
-					Expect(err).To(MatchError(ContainSubstring("tardis was not found in the $PATH")))
+				It("reports every metric of the store", func() {
+					metrics, err := driver.GatherMetrics(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(metrics).To(Equal(overlayxfs.StoreMetrics{
+						ImageCount:               2,
+						VolumeCount:              2,
+						UsedBytes:                400 * 4096,
+						FreeBytes:                500 * 4096,
+						FreeInodes:               42,
+						ImagesOverQuotaThreshold: 1,
+						OrphanVolumeCount:        1,
+					}))
+
+					Expect(quotaManager.UsageCallCount()).To(Equal(1))
 				})
 
-				It("does not write quota info", func() {
-					_, _ = driver.CreateImage(logger, spec)
-					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+				It("counts the images under the threshold out", func() {
+					driver.WithQuotaThreshold(0.95)
+
+					metrics, err := driver.GatherMetrics(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(metrics.ImagesOverQuotaThreshold).To(BeZero())
 				})
-			})
+
+				It("reuses the metrics until they expire", func() {
+					_, err := driver.GatherMetrics(logger)
+					Expect(err).NotTo(HaveOccurred())
+
+					fsOperations.StatfsReturns(unix.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 100, Bavail: 50, Ffree: 7}, nil)
+					clock.NowReturns(now.Add(overlayxfs.DefaultMetricsCacheTTL - time.Second))
+					metrics, err := driver.GatherMetrics(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(metrics.FreeInodes).To(BeEquivalentTo(42))
+					Expect(fsOperations.StatfsCallCount()).To(Equal(1))
+
+					clock.NowReturns(now.Add(overlayxfs.DefaultMetricsCacheTTL))
+					metrics, err = driver.GatherMetrics(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(metrics.FreeInodes).To(BeEquivalentTo(7))
+					Expect(metrics.FreeBytes).To(BeEquivalentTo(50 * 4096))
+				})
+			})
+
+			Context("when the image has a disk limit", func() {
+				var quotaManager *fakes.FakeQuotaManager
+
+				BeforeEach(func() {
+					spec.DiskLimit = 10 * mb
+					spec.ExclusiveDiskLimit = true
+
+					quotaManager = new(fakes.FakeQuotaManager)
+					driver.WithQuotaManager(quotaManager)
+				})
+
+				It("caps the inodes of the image to the default inode limit", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(quotaManager.SetInodeLimitCallCount()).To(Equal(1))
+					_, imagePath, limit := quotaManager.SetInodeLimitArgsForCall(0)
+					Expect(imagePath).To(Equal(fakedImagePath))
+					Expect(limit).To(BeEquivalentTo(overlayxfs.DefaultInodeLimit))
+				})
+
+				It("applies the inode limit of the spec instead", func() {
+					spec.InodeLimit = 500
+
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, limit := quotaManager.SetInodeLimitArgsForCall(0)
+					Expect(limit).To(BeEquivalentTo(500))
+				})
+
+				Context("when the default inode limit is disabled", func() {
+					It("does not cap the inodes", func() {
+						driver.WithDefaultInodeLimit(0)
+
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(quotaManager.SetInodeLimitCallCount()).To(BeZero())
+					})
+				})
+
+				Context("when the inode limit cannot be applied", func() {
+					It("fails to create the image", func() {
+						quotaManager.SetInodeLimitReturns(errors.New("quotactl failed"))
+
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("apply inode limit: quotactl failed")))
+					})
+				})
+
+				Context("when the disk limit is negative", func() {
+					It("fails without applying a quota", func() {
+						spec.DiskLimit = -1
+
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("invalid disk limit -1")))
+						Expect(quotaManager.SetLimitCallCount()).To(BeZero())
+						Expect(fsOperations.MkdirCallCount()).To(BeZero())
+					})
+				})
+			})
+
+			Context("when the disk limit exceeds the space left in the store", func() {
+				var quotaManager *fakes.FakeQuotaManager
+
+				BeforeEach(func() {
+					spec.DiskLimit = 10 * mb
+					spec.ExclusiveDiskLimit = true
+					fsOperations.StatfsReturns(unix.Statfs_t{Bsize: 4096, Bavail: uint64(8 * mb / 4096)}, nil)
+
+					otherImagePath := filepath.Join(fakedStorePath, store.ImageDirName, "other-image-id")
+					Expect(os.Mkdir(otherImagePath, 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(otherImagePath, "image_quota"), []byte(strconv.FormatInt(2*mb, 10)), 0600)).To(Succeed())
+
+					quotaManager = new(fakes.FakeQuotaManager)
+					driver.WithQuotaManager(quotaManager)
+				})
+
+				It("applies the requested limit by default", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, limit := quotaManager.SetLimitArgsForCall(0)
+					Expect(limit).To(BeEquivalentTo(10 * mb))
+				})
+
+				Context("when the policy is to clamp the limit", func() {
+					BeforeEach(func() {
+						driver.WithDiskLimitCapacityPolicy(overlayxfs.ClampDiskLimitToCapacity)
+					})
+
+					It("applies the space not committed to other images as the limit", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).NotTo(HaveOccurred())
+
+						_, _, limit := quotaManager.SetLimitArgsForCall(0)
+						Expect(limit).To(BeEquivalentTo(6 * mb))
+						Expect(quotaManager.UsageCallCount()).To(BeZero())
+					})
+				})
+
+				Context("when the policy is to reject the limit", func() {
+					BeforeEach(func() {
+						driver.WithDiskLimitCapacityPolicy(overlayxfs.RejectDiskLimitAboveCapacity)
+					})
+
+					It("returns ErrDiskLimitExceedsCapacity without applying a quota", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(errors.Is(err, overlayxfs.ErrDiskLimitExceedsCapacity)).To(BeTrue())
+						Expect(quotaManager.SetLimitCallCount()).To(BeZero())
+					})
+
+					It("accepts limits fitting in the space left", func() {
+						spec.DiskLimit = 6 * mb
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("does not let concurrent creates commit the same space", func() {
+						quotaManager.SetLimitStub = func(lager.Logger, string, int64) error {
+							time.Sleep(100 * time.Millisecond)
+							return nil
+						}
+
+						secondSpec := spec
+						secondSpec.ImagePath = filepath.Join(fakedStorePath, store.ImageDirName, "second-image-id")
+						Expect(os.Mkdir(secondSpec.ImagePath, 0755)).To(Succeed())
+						mountInfoLines := ""
+						for i, imagePath := range []string{spec.ImagePath, secondSpec.ImagePath} {
+							mountInfoLines += fmt.Sprintf("%d 0 0:1 / %s rw - overlay overlay rw\n", i+1, filepath.Join(imagePath, overlayxfs.RootfsDir))
+						}
+						mountInfo := filepath.Join(fakedStorePath, "mountinfo")
+						Expect(ioutil.WriteFile(mountInfo, []byte(mountInfoLines), 0644)).To(Succeed())
+
+						errs := make(chan error, 2)
+						for _, imageSpec := range []image_manager.ImageDriverSpec{spec, secondSpec} {
+							imageSpec.DiskLimit = 4 * mb
+							go func(imageSpec image_manager.ImageDriverSpec) {
+								defer GinkgoRecover()
+								_, err := driver.CreateImage(logger, imageSpec)
+								errs <- err
+							}(imageSpec)
+						}
+
+						rejected := 0
+						for i := 0; i < 2; i++ {
+							if err := <-errs; err != nil {
+								Expect(errors.Is(err, overlayxfs.ErrDiskLimitExceedsCapacity)).To(BeTrue())
+								rejected++
+							}
+						}
+						Expect(rejected).To(Equal(1))
+						Expect(quotaManager.SetLimitCallCount()).To(Equal(1))
+					})
+				})
+			})
+
+			Context("when quotas are set on a store that is not on XFS", func() {
+				BeforeEach(func() {
+					driver = overlayxfs.NewDriver(fakedStorePath, tardisBinPath, unmounter, directIO).
+						WithFSOperations(fsOperations)
+					fsOperations.StatfsReturns(unix.Statfs_t{Type: 0xEF53}, nil)
+					spec.DiskLimit = 10 * mb
+				})
+
+				It("returns an error naming the filesystem", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrNotXFS)).To(BeTrue())
+					Expect(err).To(MatchError(ContainSubstring("is on ext4, project quotas need XFS")))
+				})
+
+				It("does not check when told to skip it", func() {
+					driver.WithSkipXFSCheck(true)
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrNotXFS)).To(BeFalse())
+				})
+			})
+
+			Context("when the image path does not exist", func() {
+				BeforeEach(func() {
+					fsOperations.StatReturns(nil, os.ErrNotExist)
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("image path does not exist")))
+					Expect(fsOperations.MkdirCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when creating a directory fails", func() {
+				BeforeEach(func() {
+					fsOperations.MkdirReturns(errors.New("read-only filesystem"))
+				})
+
+				It("returns an error without mounting", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("read-only filesystem")))
+					Expect(fsOperations.MountCallCount()).To(BeZero())
+				})
+
+				It("does not touch the directories it did not create", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(HaveOccurred())
+
+					Expect(unmounter.UnmountCallCount()).To(BeZero())
+					Expect(fsOperations.RemoveAllCallCount()).To(BeZero())
+				})
+
+				Context("after other directories were created", func() {
+					BeforeEach(func() {
+						fsOperations.MkdirStub = func(path string, _ os.FileMode) error {
+							if path == filepath.Join(fakedImagePath, overlayxfs.WorkDir) {
+								return errors.New("file exists")
+							}
+							return nil
+						}
+					})
+
+					It("returns the original error", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("creating workdir folder: file exists")))
+					})
+
+					It("removes only the directories it created", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(HaveOccurred())
+
+						createdDirs := map[string]bool{}
+						for i := 0; i < fsOperations.MkdirCallCount(); i++ {
+							path, _ := fsOperations.MkdirArgsForCall(i)
+							createdDirs[path] = path != filepath.Join(fakedImagePath, overlayxfs.WorkDir)
+						}
+
+						for i := 0; i < fsOperations.RemoveAllCallCount(); i++ {
+							Expect(createdDirs[fsOperations.RemoveAllArgsForCall(i)]).To(BeTrue())
+						}
+						Expect(fsOperations.RemoveAllCallCount()).To(Equal(fsOperations.MkdirCallCount() - 1))
+					})
+				})
+			})
+
+			Context("when mounting fails", func() {
+				BeforeEach(func() {
+					fsOperations.MountReturns(errors.New("no such device"))
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("mounting overlay: no such device")))
+				})
+
+				It("unmounts the rootfs and removes the image directories", func() {
+					unmounter.UnmountReturns(nil)
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(HaveOccurred())
+
+					Expect(unmounter.UnmountCallCount()).To(Equal(1))
+					_, unmountedPath, _ := unmounter.UnmountArgsForCall(0)
+					Expect(unmountedPath).To(Equal(filepath.Join(fakedImagePath, overlayxfs.RootfsDir)))
+
+					removedDirs := []string{}
+					for i := 0; i < fsOperations.RemoveAllCallCount(); i++ {
+						removedDirs = append(removedDirs, fsOperations.RemoveAllArgsForCall(i))
+					}
+					Expect(removedDirs).To(ConsistOf(
+						filepath.Join(fakedImagePath, overlayxfs.UpperDir),
+						filepath.Join(fakedImagePath, overlayxfs.WorkDir),
+						filepath.Join(fakedImagePath, overlayxfs.RootfsDir),
+					))
+				})
+
+				Context("because the kernel does not support overlay", func() {
+					BeforeEach(func() {
+						fsOperations.MountReturns(unix.ENODEV)
+					})
+
+					It("returns ErrOverlayNotSupported", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(errors.Is(err, overlayxfs.ErrOverlayNotSupported)).To(BeTrue())
+						Expect(err).To(MatchError(ContainSubstring("no such device")))
+					})
+				})
+
+				Context("when cleanup on error is disabled", func() {
+					BeforeEach(func() {
+						driver.WithCleanupOnError(false)
+					})
+
+					It("leaves the image directories behind", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(HaveOccurred())
+
+						Expect(unmounter.UnmountCallCount()).To(BeZero())
+						Expect(fsOperations.RemoveAllCallCount()).To(BeZero())
+					})
+				})
+
+				Context("and the kernel logged why", func() {
+					var kernelLogReader *fakes.FakeKernelLogReader
+
+					BeforeEach(func() {
+						kernelLogReader = new(fakes.FakeKernelLogReader)
+						kernelLogReader.ReadKernelLogReturns([]string{
+							"<6>[    1.000000] eth0: link up",
+							"<4>[    2.000000] overlayfs: failed to verify upper root origin",
+							"<6>[    3.000000] usb 1-1: new device",
+						}, nil)
+						driver.WithKernelLogReader(kernelLogReader)
+					})
+
+					It("includes the overlay messages in the error", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("mounting overlay: no such device")))
+						Expect(err).To(MatchError(ContainSubstring("overlayfs: failed to verify upper root origin")))
+						Expect(err.Error()).NotTo(ContainSubstring("eth0"))
+						Expect(err.Error()).NotTo(ContainSubstring("usb"))
+					})
+
+					Context("when there are overlay messages from before the mount", func() {
+						BeforeEach(func() {
+							kernelLogReader.TimestampReturns(2*time.Second, nil)
+							kernelLogReader.ReadKernelLogReturns([]string{
+								"<4>[    1.500000] overlayfs: upper fs does not support tmpfile",
+								"<4>[    2.500000] overlayfs: failed to verify upper root origin",
+								"overlayfs: message without a timestamp",
+							}, nil)
+						})
+
+						It("only includes the ones logged since the mount started", func() {
+							_, err := driver.CreateImage(logger, spec)
+							Expect(err).To(MatchError(ContainSubstring("overlayfs: failed to verify upper root origin")))
+							Expect(err.Error()).NotTo(ContainSubstring("tmpfile"))
+							Expect(err.Error()).NotTo(ContainSubstring("without a timestamp"))
+						})
+					})
+
+					Context("when the kernel log time cannot be read", func() {
+						BeforeEach(func() {
+							kernelLogReader.TimestampReturns(0, unix.EPERM)
+						})
+
+						It("returns the mount error alone", func() {
+							_, err := driver.CreateImage(logger, spec)
+							Expect(err).To(MatchError("mounting overlay: no such device"))
+						})
+					})
+
+					Context("when the kernel log cannot be read", func() {
+						BeforeEach(func() {
+							kernelLogReader.ReadKernelLogReturns(nil, unix.EPERM)
+						})
+
+						It("returns the mount error alone", func() {
+							_, err := driver.CreateImage(logger, spec)
+							Expect(err).To(MatchError("mounting overlay: no such device"))
+						})
+					})
+				})
+			})
+		})
+
+		Context("image_info", func() {
+			BeforeEach(func() {
+				volumeID := randVolumeID()
+				createVolume(storePath, driver, "", volumeID, 5000)
+
+				spec.BaseVolumeIDs = []string{volumeID}
+			})
+
+			It("creates a image info file with the total base volume size", func() {
+				Expect(filepath.Join(spec.ImagePath, "image_info")).ToNot(BeAnExistingFile())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_info"), 5000)
+			})
+		})
+
+		Context("when disk limit is 0", func() {
+			BeforeEach(func() {
+				spec.DiskLimit = 0
+			})
+
+			It("doesn't apply any quota", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(logger).Should(gbytes.Say(regexp.QuoteMeta(`overlay+xfs.overlayxfs-creating-image.applying-quotas.no-need-for-quotas`)))
+			})
+
+			It("does not create an image quota file containing the requested quota", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+			})
+		})
+
+		Context("when disk limit is > 0", func() {
+			BeforeEach(func() {
+				spec.DiskLimit = 10 * mb
+				Expect(ioutil.WriteFile(filepath.Join(storePath, store.MetaDirName, fmt.Sprintf("volume-%s", layer1ID)), []byte(`{"Size": 3145728}`), 0644)).To(Succeed())
+			})
+
+			// writeBaseFile writes a 3MB file in the base volume, which the image
+			// copies up on the first write to it.
+			writeBaseFile := func() {
+				statfs := syscall.Statfs_t{}
+				Expect(syscall.Statfs(storePath, &statfs)).To(Succeed())
+				if statfs.Type != filesystems.XfsType {
+					Skip("project quotas require the store to be on XFS")
+				}
+
+				dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/base-file", layer1Path), "count=3", "bs=1M")
+				sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sess).Should(gexec.Exit(0))
+			}
+
+			copyUpBaseFile := func() {
+				baseFile, err := os.OpenFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "base-file"), os.O_WRONLY|os.O_APPEND, 0)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = baseFile.Write([]byte("copied up"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(baseFile.Close()).To(Succeed())
+			}
+
+			It("creates the storeDevice block device in the `images` parent folder", func() {
+				storeDevicePath := filepath.Join(storePath, "storeDevice")
+
+				Expect(storeDevicePath).ToNot(BeAnExistingFile())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storeDevicePath).To(BeAnExistingFile())
+			})
+
+			It("sets the project inheritance flag on the image directory", func() {
+				statfs := syscall.Statfs_t{}
+				Expect(syscall.Statfs(storePath, &statfs)).To(Succeed())
+				if statfs.Type != filesystems.XfsType {
+					Skip("project quotas require the store to be on XFS")
+				}
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				output, err := exec.Command("xfs_io", "-c", "lsattr -v", spec.ImagePath).CombinedOutput()
+				Expect(err).NotTo(HaveOccurred(), string(output))
+				Expect(string(output)).To(ContainSubstring("proj-inherit"))
+			})
+
+			It("keeps the project mapping files in sync with the images", func() {
+				statfs := syscall.Statfs_t{}
+				Expect(syscall.Statfs(storePath, &statfs)).To(Succeed())
+				if statfs.Type != filesystems.XfsType {
+					Skip("project quotas require the store to be on XFS")
+				}
+
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				anotherSpec := spec
+				anotherSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "another-image")
+				Expect(os.Mkdir(anotherSpec.ImagePath, 0755)).To(Succeed())
+				_, err = driver.CreateImage(logger, anotherSpec)
+				Expect(err).ToNot(HaveOccurred())
+
+				projectID, err := quota.GetProjectID(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				anotherProjectID, err := quota.GetProjectID(logger, anotherSpec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				projid, err := ioutil.ReadFile(filepath.Join(storePath, store.MetaDirName, overlayxfs.ProjidFileName))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.Split(strings.TrimSpace(string(projid)), "\n")).To(ConsistOf(
+					fmt.Sprintf("%s:%d", filepath.Base(spec.ImagePath), projectID),
+					fmt.Sprintf("another-image:%d", anotherProjectID),
+				))
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+				projid, err = ioutil.ReadFile(filepath.Join(storePath, store.MetaDirName, overlayxfs.ProjidFileName))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(projid)).To(Equal(fmt.Sprintf("another-image:%d\n", anotherProjectID)))
+				projects, err := ioutil.ReadFile(filepath.Join(storePath, store.MetaDirName, overlayxfs.ProjectsFileName))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(projects)).To(Equal(fmt.Sprintf("%d:%s\n", anotherProjectID, anotherSpec.ImagePath)))
+			})
+
+			It("can overwrite files from the lowerdirs", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+				imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+				dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file", imageRootfsPath), "count=5", "bs=1M")
+				sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sess).Should(gexec.Exit(0))
+			})
+
+			It("allows images to have independent quotas", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+				imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+				dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=6", "bs=1M")
+				sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sess).Should(gexec.Exit(0))
+
+				anotherSpec := spec
+				anotherImagePath, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "another-image")
+				Expect(err).NotTo(HaveOccurred())
+				anotherSpec.ImagePath = anotherImagePath
+				_, err = driver.CreateImage(logger, anotherSpec)
+				Expect(err).ToNot(HaveOccurred())
+				anotherImageRootfsPath := filepath.Join(anotherImagePath, overlayxfs.RootfsDir)
+
+				dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", anotherImageRootfsPath), "count=6", "bs=1M")
+				sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sess).Should(gexec.Exit(0))
+			})
+
+			Context("inclusive quota", func() {
+				BeforeEach(func() {
+					spec.ExclusiveDiskLimit = false
+				})
+
+				It("enforces the quota in the image", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+					imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=5", "bs=1M")
+					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess).Should(gexec.Exit(0))
+
+					dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=4", "bs=1M")
+					sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
+					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+				})
+
+				It("counts the base files copied up on top of the base volumes", func() {
+					writeBaseFile()
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+					copyUpBaseFile()
+
+					// 7MB are left for the image, 3 of which went to the copy up
+					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)), "count=5", "bs=1M")
+					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
+					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+				})
+
+				It("creates a image quota file containing the requested quota", func() {
+					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+
+					ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_quota"), 10*mb-3145728)
+				})
+
+				Context("when the DiskLimit is smaller than VolumeSize", func() {
+					It("returns an error", func() {
+						spec.DiskLimit = 4000
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).To(MatchError(ContainSubstring("disk limit is smaller than volume size")))
+					})
+				})
+
+				Context("when the DiskLimit is less than the minimum quota (1024*256 bytes) after accounting for the VolumeSize", func() {
+					BeforeEach(func() {
+						volumeSize := int64(128 * kb)
+						layerID := randVolumeID()
+						_ = createVolume(storePath, driver, "", layerID, volumeSize)
+
+						spec.BaseVolumeIDs = []string{layerID}
+						spec.DiskLimit = volumeSize + (128 * kb)
+					})
+
+					It("enforces the minimum required quota in the image", func() {
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).ToNot(HaveOccurred())
+						imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+						dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=1", "bs=128K")
+						sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+						Expect(err).NotTo(HaveOccurred())
+						Eventually(sess).Should(gexec.Exit(0))
+
+						dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=1", "bs=128K")
+						sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+						Expect(err).NotTo(HaveOccurred())
+						Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
+						Eventually(sess.Err).Should(gbytes.Say("No space left"))
+					})
+				})
+			})
+
+			Context("exclusive quota", func() {
+				BeforeEach(func() {
+					spec.ExclusiveDiskLimit = true
+				})
+
+				Context("when the DiskLimit is smaller than VolumeSize", func() {
+					It("succeeds", func() {
+						spec.DiskLimit = 3 * mb
+						_, err := driver.CreateImage(logger, spec)
+						Expect(err).ToNot(HaveOccurred())
+					})
+				})
+
+				It("enforces the quota in the image", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+					imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=8", "bs=1M")
+					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess).Should(gexec.Exit(0))
+
+					dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=8", "bs=1M")
+					sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
+					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+				})
+
+				It("does not count the base volumes until their files are copied up", func() {
+					writeBaseFile()
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+					imageRootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+
+					dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-1", imageRootfsPath), "count=8", "bs=1M")
+					sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess).Should(gexec.Exit(0))
+					Expect(os.Remove(filepath.Join(imageRootfsPath, "file-1"))).To(Succeed())
+
+					copyUpBaseFile()
+
+					dd = exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/file-2", imageRootfsPath), "count=8", "bs=1M")
+					sess, err = gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sess, 5*time.Second).Should(gexec.Exit(1))
+					Eventually(sess.Err).Should(gbytes.Say("No space left on device"))
+				})
+
+				It("creates a image quota file containing the requested quota", func() {
+					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).ToNot(HaveOccurred())
+
+					ensureQuotaMatches(filepath.Join(spec.ImagePath, "image_quota"), 10*mb)
+				})
+			})
+
+			Context("when tardis is not in the path", func() {
+				BeforeEach(func() {
+					driver = overlayxfs.NewDriver(storePath, "/bin/bananas", unmounter, directIO).WithSkipXFSCheck(true)
+				})
+
+				It("returns an error", func() {
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).To(MatchError(ContainSubstring("tardis was not found in the $PATH")))
+				})
+
+				It("does not write quota info", func() {
+					_, _ = driver.CreateImage(logger, spec)
+					Expect(filepath.Join(spec.ImagePath, "image_quota")).ToNot(BeAnExistingFile())
+				})
+			})
+		})
+
+		Context("when base volume folder does not exist", func() {
+			BeforeEach(func() {
+				testhelpers.UnsuidBinary(tardisBinPath)
+			})
+
+			It("returns an error", func() {
+				spec.BaseVolumeIDs = []string{"not-real"}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("base volume path does not exist")))
+			})
+
+			It("names the missing volume when it is one of several layers", func() {
+				volumeID := randVolumeID()
+				createVolume(storePath, driver, "", volumeID, 1*mb)
+
+				spec.BaseVolumeIDs = []string{volumeID, "not-real"}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("base volume path does not exist")))
+				Expect(err).To(MatchError(ContainSubstring(filepath.Join(storePath, store.VolumesDirName, "not-real"))))
+			})
+		})
+
+		Context("when the image path would reach outside of the directory it names", func() {
+			It("refuses it", func() {
+				imagesPath := filepath.Join(storePath, store.ImageDirName)
+				for _, imagePath := range []string{
+					imagesPath + "/../../escaped-image",
+					imagesPath + "/..",
+					imagesPath + "/image\x00id",
+				} {
+					spec.ImagePath = imagePath
+					_, err := driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrInvalidImagePath)).To(BeTrue(), imagePath)
+				}
+				Expect(filepath.Join(filepath.Dir(storePath), "escaped-image")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when a base volume id would reach outside of the volumes directory", func() {
+			It("refuses it", func() {
+				spec.BaseVolumeIDs = []string{"../" + store.ImageDirName}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrInvalidVolumeID)).To(BeTrue())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when image path folder doesn't exist", func() {
+			It("returns an error", func() {
+				spec.ImagePath = "/not-real"
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("image path does not exist")))
+			})
+		})
+
+		Context("when the context is done", func() {
+			It("returns the context error without creating the image", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				spec.BaseVolumeIDs = []string{layer1ID}
+				_, err := driver.CreateImageContext(ctx, logger, spec)
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when creating the upper folder fails", func() {
+			It("returns an error", func() {
+				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.UpperDir), 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("creating upperdir folder")))
+			})
+		})
+
+		Context("when creating the workdir folder fails", func() {
+			It("returns an error", func() {
+				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.WorkDir), 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("creating workdir folder")))
+			})
+		})
+
+		Context("when creating the rootfs folder fails", func() {
+			It("returns an error", func() {
+				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError(ContainSubstring("creating rootfs folder")))
+			})
+		})
+	})
+
+	Describe("DestroyImage", func() {
+		JustBeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3145728)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("unmounts the rootfs dir", func() {
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			Expect(unmounter.UnmountCallCount()).To(Equal(1))
+			_, unmountPath, _ := unmounter.UnmountArgsForCall(0)
+			Expect(unmountPath).To(Equal(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)))
+		})
+
+		It("removes upper, work and rootfs dir from the image path", func() {
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).To(BeADirectory())
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).To(BeADirectory())
+
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).ToNot(BeAnExistingFile())
+		})
+
+		Context("projectids", func() {
+			BeforeEach(func() {
+				spec.DiskLimit = 1000000000
+			})
+
+			It("removes the projectid directory for that image", func() {
+				projectidsDir := filepath.Join(storePath, overlayxfs.IDDir)
+				ids, err := ioutil.ReadDir(projectidsDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids).To(HaveLen(1))
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+				ids, err = ioutil.ReadDir(projectidsDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids).To(BeEmpty())
+			})
+
+			It("stops accounting the image files to its project", func() {
+				statfs := syscall.Statfs_t{}
+				Expect(syscall.Statfs(storePath, &statfs)).To(Succeed())
+				if statfs.Type != filesystems.XfsType {
+					Skip("project quotas require the store to be on XFS")
+				}
+
+				Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file"), make([]byte, 1024*1024), 0644)).To(Succeed())
+				projectID, err := quota.GetProjectID(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(projectID).NotTo(BeZero())
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+				// The usage of a project can only be read through a path in it
+				probePath := filepath.Join(storePath, "probe")
+				Expect(os.Mkdir(probePath, 0755)).To(Succeed())
+				Expect(quota.Set(logger, projectID, probePath, 1024*1024*1024)).To(Succeed())
+				projectQuota, err := quota.Get(logger, probePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(projectQuota.BCount).To(BeZero())
+			})
+		})
+
+		Context("when no unmounter is given", func() {
+			BeforeEach(func() {
+				driver = overlayxfs.NewDriver(storePath, tardisBinPath, nil, directIO).
+					WithSkipXFSCheck(true)
+			})
+
+			It("unmounts the rootfs dir with umount2", func() {
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).ToNot(BeAnExistingFile())
+			})
+		})
+
+		Context("when it fails to unmount the rootfs", func() {
+			JustBeforeEach(func() {
+				unmounter.UnmountReturns(errors.New("unmount-failed"))
+			})
+
+			It("returns an error", func() {
+				err := driver.DestroyImage(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("deleting image path")))
+			})
+
+			It("does not delete the image directory", func() {
+				err := driver.DestroyImage(logger, spec.ImagePath)
+				Expect(err).To(HaveOccurred())
+
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+
+				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				rootfsContent, err := ioutil.ReadDir(rootfsPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rootfsContent).NotTo(BeEmpty())
+
+			})
+		})
+
+		Context("when the rootfs is not mounted", func() {
+			JustBeforeEach(func() {
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0)).To(Succeed())
+			})
+
+			It("ignores the EINVAL from the unmounter and deletes the image", func() {
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+			})
+		})
+
+		It("unmounts the rootfs normally by default", func() {
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			Expect(unmounter.UnmountCallCount()).To(Equal(1))
+			_, _, flags := unmounter.UnmountArgsForCall(0)
+			Expect(flags).To(BeZero())
+		})
+
+		Context("when the rootfs is busy", func() {
+			var busyFile *os.File
+
+			JustBeforeEach(func() {
+				var err error
+				busyFile, err = os.Create(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "busy-file"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(busyFile.Close()).To(Succeed())
+			})
+
+			AfterEach(func() {
+				_ = unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), unix.MNT_DETACH)
+			})
+
+			It("returns the busy error", func() {
+				err := driver.DestroyImage(logger, spec.ImagePath)
+				Expect(errors.Is(err, unix.EBUSY)).To(BeTrue())
+				Expect(unmounter.UnmountCallCount()).To(Equal(1))
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+			})
+
+			Context("and detached unmounts are allowed", func() {
+				BeforeEach(func() {
+					driver.WithDestroyOptions(overlayxfs.DestroyOptions{AllowDetachedUnmount: true})
+				})
+
+				It("falls back to a lazy unmount", func() {
+					Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+					Expect(unmounter.UnmountCallCount()).To(Equal(2))
+					_, _, flags := unmounter.UnmountArgsForCall(0)
+					Expect(flags).To(BeZero())
+					_, _, flags = unmounter.UnmountArgsForCall(1)
+					Expect(flags).To(Equal(unix.MNT_DETACH))
+					Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+					Expect(logger).To(gbytes.Say("rootfs-busy-falling-back-to-lazy-unmount"))
+				})
+			})
+		})
+
+		Context("when waiting for the unmount to complete", func() {
+			var (
+				clock         *fakes.FakeClock
+				mountInfoPath string
+			)
+
+			BeforeEach(func() {
+				mountInfo, err := ioutil.TempFile("", "mountinfo")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = fmt.Fprintf(mountInfo, "1 0 0:1 / %s rw - overlay overlay rw\n", filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountInfo.Close()).To(Succeed())
+				mountInfoPath = mountInfo.Name()
+				driver.WithMountInfoPath(mountInfoPath)
+
+				clock = new(fakes.FakeClock)
+				driver.WithClock(clock).WithDestroyOptions(overlayxfs.DestroyOptions{WaitForUnmount: true, WaitForUnmountTimeout: time.Second})
+			})
+
+			AfterEach(func() {
+				Expect(os.Remove(mountInfoPath)).To(Succeed())
+			})
+
+			It("polls mountinfo until the rootfs is gone", func() {
+				polls := 0
+				clock.AfterStub = func(d time.Duration) <-chan time.Time {
+					if d == time.Second {
+						return make(chan time.Time)
+					}
+
+					// The unmount completes on the second poll
+					polls++
+					if polls == 2 {
+						Expect(ioutil.WriteFile(mountInfoPath, []byte{}, 0644)).To(Succeed())
+					}
+					elapsed := make(chan time.Time)
+					close(elapsed)
+					return elapsed
+				}
+
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(polls).To(Equal(2))
+				Expect(spec.ImagePath).NotTo(BeAnExistingFile())
+			})
+
+			Context("when the rootfs does not go away in time", func() {
+				It("returns ErrUnmountTimeout and keeps the image", func() {
+					clock.AfterStub = func(d time.Duration) <-chan time.Time {
+						if d == time.Second {
+							timedOut := make(chan time.Time)
+							close(timedOut)
+							return timedOut
+						}
+						return make(chan time.Time)
+					}
+
+					err := driver.DestroyImage(logger, spec.ImagePath)
+					Expect(errors.Is(err, overlayxfs.ErrUnmountTimeout)).To(BeTrue())
+					Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+				})
+			})
+		})
+
+		Context("when a lazy unmount is requested", func() {
+			BeforeEach(func() {
+				driver.WithDestroyOptions(overlayxfs.DestroyOptions{UnmountFlags: unix.MNT_DETACH})
+			})
+
+			It("detaches the rootfs", func() {
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(unmounter.UnmountCallCount()).To(Equal(1))
+				_, _, flags := unmounter.UnmountArgsForCall(0)
+				Expect(flags).To(Equal(unix.MNT_DETACH))
+			})
+		})
+
+		Context("when a forced unmount is requested", func() {
+			BeforeEach(func() {
+				driver.WithDestroyOptions(overlayxfs.DestroyOptions{UnmountFlags: unix.MNT_FORCE, AllowDetachedUnmount: true})
+				unmounter.UnmountStub = func(_ lager.Logger, path string, flags int) error {
+					if flags&unix.MNT_DETACH == 0 {
+						return unix.EBUSY
+					}
+					return unix.Unmount(path, flags)
+				}
+			})
+
+			It("forces the unmount", func() {
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				_, _, flags := unmounter.UnmountArgsForCall(0)
+				Expect(flags).To(Equal(unix.MNT_FORCE))
+			})
+
+			It("keeps forcing when falling back to a lazy unmount", func() {
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(unmounter.UnmountCallCount()).To(Equal(2))
+				_, _, flags := unmounter.UnmountArgsForCall(1)
+				Expect(flags).To(Equal(unix.MNT_FORCE | unix.MNT_DETACH))
+			})
+		})
+
+		Context("when there is a very long file path in the rootfs", func() {
+			It("successfully removes the rootfs", func() {
+				Expect(createVeryLongFilePath(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))).To(Succeed())
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Describe("WithMetricsEmitter", func() {
+		var metricsEmitter *fakes.FakeMetricsEmitter
+
+		emittedDurations := func() []string {
+			names := []string{}
+			for i := 0; i < metricsEmitter.TryEmitDurationFromCallCount(); i++ {
+				_, name, _ := metricsEmitter.TryEmitDurationFromArgsForCall(i)
+				names = append(names, name)
+			}
+			return names
+		}
+
+		BeforeEach(func() {
+			metricsEmitter = new(fakes.FakeMetricsEmitter)
+			driver.WithMetricsEmitter(metricsEmitter)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3145728)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("reports how long creating and destroying an image and its mount take", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(emittedDurations()).To(Equal([]string{overlayxfs.MetricMountTime, overlayxfs.MetricCreateImageTime}))
+
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			Expect(emittedDurations()).To(Equal([]string{
+				overlayxfs.MetricMountTime, overlayxfs.MetricCreateImageTime,
+				overlayxfs.MetricUnmountTime, overlayxfs.MetricDestroyImageTime,
+			}))
+
+			Expect(metricsEmitter.TryIncrementCounterCallCount()).To(BeZero())
+		})
+
+		It("counts the images that fail to be created", func() {
+			spec.BaseVolumeIDs = []string{"not-real"}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).To(HaveOccurred())
+
+			Expect(metricsEmitter.TryIncrementCounterCallCount()).To(Equal(1))
+			_, name := metricsEmitter.TryIncrementCounterArgsForCall(0)
+			Expect(name).To(Equal(overlayxfs.MetricCreateImageFailures))
+			Expect(emittedDurations()).To(ContainElement(overlayxfs.MetricCreateImageTime))
+		})
+
+		It("counts the images that fail to be destroyed", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			unmounter.UnmountReturns(errors.New("unmount-failed"))
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).NotTo(Succeed())
+
+			Expect(metricsEmitter.TryIncrementCounterCallCount()).To(Equal(1))
+			_, name := metricsEmitter.TryIncrementCounterArgsForCall(0)
+			Expect(name).To(Equal(overlayxfs.MetricDestroyImageFailures))
+		})
+	})
+
+	Describe("DestroyImageDryRun", func() {
+		var rootfsPath string
+
+		JustBeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 3145728)
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "protected-file"), []byte("protected"), 0644)).To(Succeed())
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+			rootfsPath = filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+		})
+
+		It("reports the rootfs and the image path without touching them", func() {
+			plan, err := driver.DestroyImageDryRun(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Unmounts).To(Equal([]string{rootfsPath}))
+			Expect(plan.Removals).To(ContainElement(spec.ImagePath))
+
+			Expect(unmounter.UnmountCallCount()).To(BeZero())
+			Expect(driver.IsImageMounted(logger, spec.ImagePath)).To(BeTrue())
+			Expect(filepath.Join(rootfsPath, "protected-file")).To(BeAnExistingFile())
+		})
+
+		Context("when the image has protected paths", func() {
+			BeforeEach(func() {
+				spec.ProtectedPaths = []string{"/protected-file"}
+			})
+
+			AfterEach(func() {
+				// The binds are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			It("reports them before the rootfs", func() {
+				plan, err := driver.DestroyImageDryRun(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan.Unmounts).To(Equal([]string{filepath.Join(rootfsPath, "protected-file"), rootfsPath}))
+			})
+		})
+
+		Context("when the image is not mounted", func() {
+			BeforeEach(func() {
+				spec.Mount = false
+			})
+
+			It("reports nothing to unmount", func() {
+				plan, err := driver.DestroyImageDryRun(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan.Unmounts).To(BeEmpty())
+				Expect(plan.Removals).To(ContainElement(spec.ImagePath))
+			})
+		})
+
+		Context("when the image does not exist", func() {
+			It("reports nothing", func() {
+				plan, err := driver.DestroyImageDryRun(logger, filepath.Join(storePath, store.ImageDirName, "not-there"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(plan.Unmounts).To(BeEmpty())
+				Expect(plan.Removals).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("MountImage", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 1000)
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "file-hello"), []byte("hello"), 0755)).To(Succeed())
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.Mount = false
+			spec.MountSource = randomImageID
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("mounts the image rootfs", func() {
+			Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file-hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(BeEquivalentTo("hello"))
+		})
+
+		It("uses the mount source the image was created with", func() {
+			Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+
+			mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounts).To(HaveLen(1))
+			Expect(mounts[0].Source).To(Equal(randomImageID))
+		})
+
+		Context("when the image is already mounted", func() {
+			BeforeEach(func() {
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			It("does not mount it again", func() {
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+
+				mounts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounts).To(HaveLen(1))
+			})
+		})
+
+		Context("when the image metadata is missing", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(spec.ImagePath, "metadata.json"))).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(MatchError(ContainSubstring("reading image metadata")))
+			})
+		})
+	})
+
+	Describe("RemountAllImages", func() {
+		var otherImagePath string
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			otherImagePath = filepath.Join(storePath, store.ImageDirName, "other-image")
+			Expect(os.Mkdir(otherImagePath, 0755)).To(Succeed())
+			_, err = driver.CreateImage(logger, image_manager.ImageDriverSpec{
+				ImagePath:     otherImagePath,
+				BaseVolumeIDs: []string{volumeID},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("mounts all the images", func() {
+			Expect(driver.RemountAllImages(logger)).To(Succeed())
+
+			for _, imagePath := range []string{spec.ImagePath, otherImagePath} {
+				mounted, err := mountinfo.Mounted(filepath.Join(imagePath, overlayxfs.RootfsDir))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeTrue())
+			}
+		})
+
+		Context("when an image fails to mount", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(otherImagePath, "metadata.json"))).To(Succeed())
+			})
+
+			It("mounts the other images and reports the failed one", func() {
+				err := driver.RemountAllImages(logger)
+				Expect(err).To(MatchError(ContainSubstring("failed to remount images: other-image")))
+
+				mounted, err := mountinfo.Mounted(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeTrue())
+			})
+
+			Context("when quarantining is enabled", func() {
+				BeforeEach(func() {
+					driver.WithQuarantine(true)
+				})
+
+				It("quarantines the failed image and mounts the others", func() {
+					Expect(driver.RemountAllImages(logger)).To(Succeed())
+
+					mounted, err := mountinfo.Mounted(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mounted).To(BeTrue())
+
+					Expect(otherImagePath).NotTo(BeADirectory())
+					Expect(filepath.Join(storePath, overlayxfs.QuarantineDirName, "other-image", overlayxfs.UpperDir)).To(BeADirectory())
+					Expect(driver.ListQuarantined(logger)).To(ConsistOf("other-image"))
+
+					images, err := driver.Images(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(images).To(ConsistOf(randomImageID))
+				})
+
+				It("keeps images quarantined before under a different name", func() {
+					Expect(os.MkdirAll(filepath.Join(storePath, overlayxfs.QuarantineDirName, "other-image"), 0700)).To(Succeed())
+
+					Expect(driver.RemountAllImages(logger)).To(Succeed())
+
+					quarantined, err := driver.ListQuarantined(logger)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(quarantined).To(HaveLen(2))
+					Expect(quarantined[1]).To(HavePrefix("other-image-"))
+				})
+			})
+		})
+	})
+
+	Describe("CleanStagingDirs", func() {
+		var (
+			abandonedVolumePath string
+			recentVolumePath    string
+			userImagePath       string
+		)
+
+		BeforeEach(func() {
+			longAgo := time.Now().Add(-2 * overlayxfs.DefaultStagingGracePeriod)
+
+			abandonedVolumePath = createVolume(storePath, driver, "", "layer-incomplete-1-2", 10)
+			Expect(os.Chtimes(abandonedVolumePath, longAgo, longAgo)).To(Succeed())
+			recentVolumePath = createVolume(storePath, driver, "", "layer-incomplete-3-4", 10)
+
+			userImagePath = filepath.Join(storePath, store.ImageDirName, "x-incomplete-y")
+			Expect(os.MkdirAll(filepath.Join(userImagePath, overlayxfs.UpperDir), 0755)).To(Succeed())
+			Expect(os.Chtimes(userImagePath, longAgo, longAgo)).To(Succeed())
+		})
+
+		It("removes the staging volumes older than the grace period", func() {
+			cleaned, err := driver.CleanStagingDirs(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cleaned).To(ConsistOf(abandonedVolumePath))
+
+			Expect(abandonedVolumePath).NotTo(BeADirectory())
+			Expect(filepath.Join(storePath, overlayxfs.LinksDirName, "layer-incomplete-1-2")).NotTo(BeAnExistingFile())
+			Expect(recentVolumePath).To(BeADirectory())
+			Expect(spec.ImagePath).To(BeADirectory())
+		})
+
+		Context("when an image is based on a staging volume", func() {
+			It("keeps the volume", func() {
+				spec.BaseVolumeIDs = []string{"layer-incomplete-1-2"}
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				cleaned, err := driver.CleanStagingDirs(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cleaned).To(BeEmpty())
+				Expect(abandonedVolumePath).To(BeADirectory())
+			})
+		})
+
+		It("leaves user images whose id contains the staging infix alone", func() {
+			cleaned, err := driver.CleanStagingDirs(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cleaned).NotTo(ContainElement(userImagePath))
+			Expect(filepath.Join(userImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+		})
+	})
+
+	Describe("ListQuarantined", func() {
+		It("returns an empty list when nothing was quarantined", func() {
+			Expect(driver.ListQuarantined(logger)).To(BeEmpty())
+		})
+	})
+
+	Describe("CompressIdleUpper", func() {
+		var upperDir string
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			upperDir = filepath.Join(spec.ImagePath, overlayxfs.UpperDir)
+			Expect(os.Mkdir(filepath.Join(upperDir, "a-folder"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(upperDir, "a-folder", "zeros"), make([]byte, mb), 0644)).To(Succeed())
+			Expect(os.Chown(filepath.Join(upperDir, "a-folder", "zeros"), 1000, 1000)).To(Succeed())
+		})
+
+		It("replaces the upperdir with an archive and reports the bytes saved", func() {
+			saved, err := driver.CompressIdleUpper(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(saved).To(BeNumerically(">", 0))
+
+			Expect(upperDir).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(spec.ImagePath, "diff.tar.gz")).To(BeAnExistingFile())
+		})
+
+		It("restores the upperdir when the image is mounted", func() {
+			_, err := driver.CompressIdleUpper(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+			Expect(filepath.Join(spec.ImagePath, "diff.tar.gz")).NotTo(BeAnExistingFile())
+
+			stat, err := os.Stat(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "a-folder", "zeros"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Size()).To(Equal(mb))
+			uid, gid := getUidAndGid(stat)
+			Expect(uid).To(Equal(1000))
+			Expect(gid).To(Equal(1000))
+
+			stat, err = os.Stat(upperDir)
+			Expect(err).NotTo(HaveOccurred())
+			uid, gid = getUidAndGid(stat)
+			Expect(uid).To(Equal(123))
+			Expect(gid).To(Equal(456))
+		})
+
+		Context("when the image is mounted", func() {
+			BeforeEach(func() {
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+			})
+
+			It("refuses to compress the upperdir", func() {
+				_, err := driver.CompressIdleUpper(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("is mounted, refusing to compress its upperdir")))
+				Expect(filepath.Join(upperDir, "a-folder", "zeros")).To(BeAnExistingFile())
+				Expect(filepath.Join(spec.ImagePath, "diff.tar.gz")).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Describe("UpdateDiskLimit", func() {
+		var (
+			quotaManager *fakes.FakeQuotaManager
+			usage        int64
+			limit        int64
+		)
+
+		BeforeEach(func() {
+			// Models a container writing to the image: usage grows by 1mb every
+			// time it is read, but never beyond the limit in place
+			usage = 10 * mb
+			limit = 20 * mb
+			quotaManager = new(fakes.FakeQuotaManager)
+			quotaManager.UsageStub = func(_ lager.Logger, _ string) (int64, error) {
+				current := usage
+				if usage+mb <= limit {
+					usage += mb
+				}
+				return current, nil
+			}
+			quotaManager.SetLimitStub = func(_ lager.Logger, _ string, newLimit int64) error {
+				limit = newLimit
+				return nil
+			}
+			driver.WithQuotaManager(quotaManager)
+
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, "image_quota"), []byte(strconv.FormatInt(limit, 10)), 0600)).To(Succeed())
+		})
+
+		It("applies the new limit", func() {
+			Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 15*mb)).To(Succeed())
+
+			Expect(quotaManager.SetLimitCallCount()).To(Equal(1))
+			_, imagePath, newLimit := quotaManager.SetLimitArgsForCall(0)
+			Expect(imagePath).To(Equal(spec.ImagePath))
+			Expect(newLimit).To(Equal(15 * mb))
+
+			contents, err := ioutil.ReadFile(filepath.Join(spec.ImagePath, "image_quota"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(strconv.FormatInt(15*mb, 10)))
+		})
+
+		It("enforces the minimum quota", func() {
+			quotaManager.UsageStub = nil
+			Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 1024)).To(Succeed())
+			Expect(limit).To(Equal(int64(overlayxfs.MinQuota)))
+		})
+
+		It("rejects non positive limits", func() {
+			Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 0)).To(MatchError(ContainSubstring("invalid disk limit")))
+			Expect(quotaManager.SetLimitCallCount()).To(BeZero())
+		})
+
+		Context("when the new limit is below the usage", func() {
+			It("refuses it and keeps the current limit", func() {
+				err := driver.UpdateDiskLimit(logger, spec.ImagePath, 5*mb)
+				Expect(errors.Is(err, overlayxfs.ErrDiskLimitBelowUsage)).To(BeTrue())
+
+				Expect(quotaManager.SetLimitCallCount()).To(BeZero())
+				Expect(limit).To(Equal(20 * mb))
+				contents, err := ioutil.ReadFile(filepath.Join(spec.ImagePath, "image_quota"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal(strconv.FormatInt(20*mb, 10)))
+			})
+
+			Context("and the shrink policy is to clamp", func() {
+				BeforeEach(func() {
+					driver.WithDiskLimitShrinkPolicy(overlayxfs.ClampDiskLimitToUsage)
+				})
+
+				It("never applies a limit below the usage", func() {
+					Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 5*mb)).To(Succeed())
+
+					Expect(limit).To(BeNumerically(">=", usage))
+					for i := 0; i < quotaManager.SetLimitCallCount(); i++ {
+						_, _, appliedLimit := quotaManager.SetLimitArgsForCall(i)
+						Expect(appliedLimit).To(BeNumerically(">=", 10*mb))
+					}
+
+					contents, err := ioutil.ReadFile(filepath.Join(spec.ImagePath, "image_quota"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal(strconv.FormatInt(limit, 10)))
+				})
+			})
+		})
+
+		Context("when the usage grows past the new limit while it is applied", func() {
+			BeforeEach(func() {
+				usage = 15*mb - 1
+			})
+
+			It("restores the previous limit and refuses the new one", func() {
+				err := driver.UpdateDiskLimit(logger, spec.ImagePath, 15*mb)
+				Expect(errors.Is(err, overlayxfs.ErrDiskLimitBelowUsage)).To(BeTrue())
+
+				Expect(quotaManager.SetLimitCallCount()).To(Equal(2))
+				_, _, restoredLimit := quotaManager.SetLimitArgsForCall(1)
+				Expect(restoredLimit).To(Equal(20 * mb))
+				Expect(limit).To(Equal(20 * mb))
+			})
+
+			Context("and the shrink policy is to clamp", func() {
+				BeforeEach(func() {
+					driver.WithDiskLimitShrinkPolicy(overlayxfs.ClampDiskLimitToUsage)
+				})
+
+				It("raises the limit to follow the usage", func() {
+					Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 15*mb)).To(Succeed())
+
+					Expect(quotaManager.SetLimitCallCount()).To(Equal(2))
+					_, _, raisedLimit := quotaManager.SetLimitArgsForCall(1)
+					Expect(raisedLimit).To(Equal(16*mb - 1))
+					Expect(usage).To(BeNumerically("<=", limit))
+				})
+			})
+		})
+
+		Context("when reading the usage fails", func() {
+			BeforeEach(func() {
+				quotaManager.UsageReturns(0, errors.New("failed to read usage"))
+				quotaManager.UsageStub = nil
+			})
+
+			It("returns an error without touching the limit", func() {
+				Expect(driver.UpdateDiskLimit(logger, spec.ImagePath, 15*mb)).To(MatchError(ContainSubstring("failed to read usage")))
+				Expect(quotaManager.SetLimitCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Describe("SetMaintenanceMode", func() {
+		var volumeID string
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000000)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.DiskLimit = 10 * mb
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+
+			driver.SetMaintenanceMode(true)
+		})
+
+		It("blocks creating volumes", func() {
+			_, err := driver.CreateVolume(logger, "", randVolumeID())
+			Expect(err).To(MatchError(overlayxfs.ErrMaintenanceMode))
+		})
+
+		It("blocks creating images", func() {
+			newImagePath := filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+			Expect(os.Mkdir(newImagePath, 0755)).To(Succeed())
+			spec.ImagePath = newImagePath
+
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).To(MatchError(overlayxfs.ErrMaintenanceMode))
+			Expect(filepath.Join(newImagePath, overlayxfs.RootfsDir)).NotTo(BeADirectory())
+		})
+
+		It("blocks destroying volumes", func() {
+			Expect(driver.DestroyVolume(logger, volumeID)).To(MatchError(overlayxfs.ErrMaintenanceMode))
+			Expect(filepath.Join(storePath, store.VolumesDirName, volumeID)).To(BeADirectory())
+		})
+
+		It("blocks destroying images", func() {
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(MatchError(overlayxfs.ErrMaintenanceMode))
+			Expect(spec.ImagePath).To(BeADirectory())
+			Expect(unmounter.UnmountCallCount()).To(BeZero())
+		})
+
+		It("still allows listing volumes and images", func() {
+			Expect(driver.Volumes(logger)).To(ConsistOf(volumeID))
+			Expect(driver.Images(logger)).To(ConsistOf(filepath.Base(spec.ImagePath)))
+		})
+
+		It("still allows fetching stats", func() {
+			_, err := driver.FetchStats(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		Context("when maintenance mode is turned off", func() {
+			BeforeEach(func() {
+				driver.SetMaintenanceMode(false)
+			})
+
+			It("allows writes again", func() {
+				_, err := driver.CreateVolume(logger, "", randVolumeID())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			})
+		})
+
+		It("can be toggled concurrently with other operations", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					driver.SetMaintenanceMode(i%2 == 0)
+				}
+			}()
+
+			for i := 0; i < 100; i++ {
+				_, err := driver.CreateVolume(logger, "", randVolumeID())
+				if err != nil {
+					Expect(err).To(MatchError(overlayxfs.ErrMaintenanceMode))
+				}
+			}
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	Describe("IsImageMounted", func() {
+		var mountInfoPath string
+
+		BeforeEach(func() {
+			mountInfoPath = filepath.Join(storePath, "mountinfo")
+			driver.WithMountInfoPath(mountInfoPath)
+			mountInfoLine := fmt.Sprintf("1 0 0:1 / %s rw - overlay overlay rw\n", filepath.Join(storePath, store.ImageDirName, "mounted-image", overlayxfs.RootfsDir))
+			Expect(ioutil.WriteFile(mountInfoPath, []byte(mountInfoLine), 0644)).To(Succeed())
+		})
+
+		It("returns true when the image rootfs is mounted", func() {
+			mounted, err := driver.IsImageMounted(logger, filepath.Join(storePath, store.ImageDirName, "mounted-image"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounted).To(BeTrue())
+		})
+
+		It("returns false when the image rootfs is not mounted", func() {
+			mounted, err := driver.IsImageMounted(logger, filepath.Join(storePath, store.ImageDirName, "unmounted-image"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounted).To(BeFalse())
+		})
+
+		Context("when the path is not an image of the store", func() {
+			It("returns an error", func() {
+				_, err := driver.IsImageMounted(logger, "/tmp/not-an-image")
+				Expect(err).To(MatchError(ContainSubstring("is not an image of the store")))
+			})
+		})
+
+		Context("when mountinfo cannot be read", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(mountInfoPath)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.IsImageMounted(logger, filepath.Join(storePath, store.ImageDirName, "mounted-image"))
+				Expect(err).To(MatchError(ContainSubstring("opening mountinfo")))
+			})
+		})
+	})
+
+	Describe("DestroyStore", func() {
+		var quotaManager *fakes.FakeQuotaManager
+
+		BeforeEach(func() {
+			quotaManager = new(fakes.FakeQuotaManager)
+			driver.WithQuotaManager(quotaManager)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.DiskLimit = 10 * mb
+			spec.ExclusiveDiskLimit = true
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("unmounts the images and removes the store", func() {
+			summary, err := driver.DestroyStore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.DestroyedImages).To(ConsistOf(filepath.Base(spec.ImagePath)))
+			Expect(summary.StuckImages).To(BeEmpty())
+
+			Expect(storePath).NotTo(BeAnExistingFile())
+			mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(storePath))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounts).To(BeEmpty())
+		})
+
+		It("destroys the images that are not mounted", func() {
+			unmountedSpec := spec
+			unmountedSpec.DiskLimit = 0
+			unmountedSpec.Mount = false
+			unmountedSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "unmounted-image")
+			Expect(os.Mkdir(unmountedSpec.ImagePath, 0755)).To(Succeed())
+			_, err := driver.CreateImage(logger, unmountedSpec)
+			Expect(err).NotTo(HaveOccurred())
+
+			summary, err := driver.DestroyStore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.DestroyedImages).To(ConsistOf(filepath.Base(spec.ImagePath), "unmounted-image"))
+			Expect(storePath).NotTo(BeAnExistingFile())
+		})
+
+		It("lifts the disk limits of the images before removing them", func() {
+			unlimitedSpec := spec
+			unlimitedSpec.DiskLimit = 0
+			unlimitedSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "unlimited-image")
+			Expect(os.Mkdir(unlimitedSpec.ImagePath, 0755)).To(Succeed())
+			_, err := driver.CreateImage(logger, unlimitedSpec)
+			Expect(err).NotTo(HaveOccurred())
+
+			quotaManager.SetLimitStub = func(_ lager.Logger, imagePath string, _ int64) error {
+				Expect(imagePath).To(BeADirectory())
+				return nil
+			}
+
+			_, err = driver.DestroyStore(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(quotaManager.SetLimitCallCount()).To(Equal(2))
+			_, imagePath, limit := quotaManager.SetLimitArgsForCall(1)
+			Expect(imagePath).To(Equal(spec.ImagePath))
+			Expect(limit).To(BeZero())
+		})
+
+		Context("when an image has extra mounts and protected paths", func() {
+			var sourcePath string
+
+			BeforeEach(func() {
+				var err error
+				sourcePath, err = ioutil.TempDir("", "extra-mount")
+				Expect(err).NotTo(HaveOccurred())
+
+				volumeID := randVolumeID()
+				volumePath := createVolume(storePath, driver, "", volumeID, 1000)
+				Expect(ioutil.WriteFile(filepath.Join(volumePath, "protected-file"), []byte("protected"), 0644)).To(Succeed())
+
+				mountsSpec := spec
+				mountsSpec.BaseVolumeIDs = []string{volumeID}
+				mountsSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "mounts-image")
+				mountsSpec.ProtectedPaths = []string{"/protected-file"}
+				mountsSpec.ExtraMounts = []image_manager.Mount{{Source: sourcePath, Destination: "data/shared"}}
+				Expect(os.Mkdir(mountsSpec.ImagePath, 0755)).To(Succeed())
+				_, err = driver.CreateImage(logger, mountsSpec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(sourcePath)).To(Succeed())
+			})
+
+			It("unmounts them and removes the store", func() {
+				summary, err := driver.DestroyStore(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(summary.DestroyedImages).To(ConsistOf(filepath.Base(spec.ImagePath), "mounts-image"))
+
+				// Unmounting them first spares the rootfs the lazy unmount
+				for i := 0; i < unmounter.UnmountCallCount(); i++ {
+					_, _, flags := unmounter.UnmountArgsForCall(i)
+					Expect(flags & unix.MNT_DETACH).To(BeZero())
+				}
+
+				Expect(storePath).NotTo(BeAnExistingFile())
+				mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(storePath))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounts).To(BeEmpty())
+			})
+		})
+
+		Context("when an image cannot be unmounted", func() {
+			BeforeEach(func() {
+				unmounter.UnmountReturns(errors.New("device busy"))
+			})
+
+			It("returns an error without removing the store", func() {
+				_, err := driver.DestroyStore(logger)
+				Expect(err).To(MatchError(ContainSubstring("device busy")))
+				Expect(spec.ImagePath).To(BeADirectory())
+			})
+		})
+
+		Context("when a mount is left under the store", func() {
+			BeforeEach(func() {
+				unmounter.UnmountReturns(nil)
+			})
+
+			AfterEach(func() {
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0)).To(Succeed())
+			})
+
+			It("refuses to remove the store, listing the mounts", func() {
+				_, err := driver.DestroyStore(logger)
+				Expect(errors.Is(err, overlayxfs.ErrStoreStillMounted)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))))
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).To(BeADirectory())
+			})
+		})
+
+		Context("when an image stays busy", func() {
+			var (
+				busyImagePath string
+				clock         *fakes.FakeClock
+			)
+
+			BeforeEach(func() {
+				clock = new(fakes.FakeClock)
+				after := make(chan time.Time)
+				close(after)
+				clock.AfterReturns(after)
+				driver.WithClock(clock).WithUnmountRetries(3, time.Second)
+
+				busySpec := spec
+				busySpec.DiskLimit = 0
+				busySpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "busy-image")
+				Expect(os.Mkdir(busySpec.ImagePath, 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, busySpec)
+				Expect(err).NotTo(HaveOccurred())
+				busyImagePath = busySpec.ImagePath
+
+				busyRootfs := filepath.Join(busyImagePath, overlayxfs.RootfsDir)
+				unmounter.UnmountStub = func(_ lager.Logger, path string, flags int) error {
+					if path == busyRootfs {
+						return unix.EBUSY
+					}
+					return unix.Unmount(path, flags)
+				}
+			})
+
+			AfterEach(func() {
+				Expect(unix.Unmount(filepath.Join(busyImagePath, overlayxfs.RootfsDir), 0)).To(Succeed())
+			})
+
+			It("destroys the other images and reports the stuck one in the summary", func() {
+				summary, err := driver.DestroyStore(logger)
+				Expect(err).To(MatchError(ContainSubstring("busy-image")))
+				Expect(summary.DestroyedImages).To(ConsistOf(filepath.Base(spec.ImagePath)))
+				Expect(summary.StuckImages).To(HaveLen(1))
+				Expect(summary.StuckImages).To(HaveKeyWithValue("busy-image", ContainSubstring("device or resource busy")))
+
+				Expect(storePath).To(BeADirectory())
+				mounted, err := driver.IsImageMounted(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounted).To(BeFalse())
+			})
+
+			busyRootfsUnmountFlags := func() []int {
+				busyRootfs := filepath.Join(busyImagePath, overlayxfs.RootfsDir)
+				flags := []int{}
+				for i := 0; i < unmounter.UnmountCallCount(); i++ {
+					_, path, flag := unmounter.UnmountArgsForCall(i)
+					if path == busyRootfs {
+						flags = append(flags, flag)
+					}
+				}
+				return flags
+			}
+
+			It("retries before giving up", func() {
+				_, err := driver.DestroyStore(logger)
+				Expect(err).To(HaveOccurred())
+
+				Expect(busyRootfsUnmountFlags()).To(Equal([]int{0, 0, 0}))
+				Expect(clock.AfterCallCount()).To(Equal(2))
+			})
+
+			Context("and detached unmounts are allowed", func() {
+				BeforeEach(func() {
+					driver.WithDestroyOptions(overlayxfs.DestroyOptions{AllowDetachedUnmount: true})
+				})
+
+				It("retries before falling back to a lazy unmount", func() {
+					_, err := driver.DestroyStore(logger)
+					Expect(err).To(HaveOccurred())
+
+					Expect(busyRootfsUnmountFlags()).To(Equal([]int{0, 0, 0, unix.MNT_DETACH}))
+					Expect(clock.AfterCallCount()).To(Equal(2))
+				})
+			})
+		})
+
+		Context("when lifting a disk limit fails", func() {
+			BeforeEach(func() {
+				quotaManager.SetLimitReturns(errors.New("quotactl failed"))
+			})
+
+			It("returns an error without removing the store", func() {
+				_, err := driver.DestroyStore(logger)
+				Expect(err).To(MatchError(ContainSubstring("quotactl failed")))
+				Expect(spec.ImagePath).To(BeADirectory())
+			})
+		})
+	})
+
+	Describe("Shutdown", func() {
+		It("makes new creates fail", func() {
+			summary, err := driver.Shutdown(context.Background(), logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.InFlight).To(BeZero())
+
+			_, err = driver.CreateVolume(logger, "", randVolumeID())
+			Expect(errors.Is(err, overlayxfs.ErrShuttingDown)).To(BeTrue())
+		})
+
+		Context("when an operation is in flight", func() {
+			var (
+				quotaManager *fakes.FakeQuotaManager
+				release      chan struct{}
+				createDone   chan struct{}
+			)
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+				quotaManager = new(fakes.FakeQuotaManager)
+				quotaManager.SetLimitStub = func(lager.Logger, string, int64) error {
+					<-release
+					return nil
+				}
+				driver.WithQuotaManager(quotaManager)
+
+				volumeID := randVolumeID()
+				createVolume(storePath, driver, "", volumeID, 1000)
+				spec.BaseVolumeIDs = []string{volumeID}
+				spec.Mount = false
+				spec.DiskLimit = 10 * mb
+				spec.ExclusiveDiskLimit = true
+
+				createDone = make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					defer close(createDone)
+					_, err := driver.CreateImage(logger, spec)
+					Expect(err).NotTo(HaveOccurred())
+				}()
+				Eventually(quotaManager.SetLimitCallCount).Should(Equal(1))
+			})
+
+			AfterEach(func() {
+				select {
+				case <-release:
+				default:
+					close(release)
+				}
+				Eventually(createDone).Should(BeClosed())
+			})
+
+			It("waits for it to finish while refusing new ones", func() {
+				shutdownDone := make(chan struct{})
+				var summary overlayxfs.ShutdownSummary
+				go func() {
+					defer GinkgoRecover()
+					defer close(shutdownDone)
+					var err error
+					summary, err = driver.Shutdown(context.Background(), logger)
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				Eventually(logger).Should(gbytes.Say("waiting-for-in-flight-operations"))
+				_, err := driver.CreateVolume(logger, "", randVolumeID())
+				Expect(errors.Is(err, overlayxfs.ErrShuttingDown)).To(BeTrue())
+				Consistently(shutdownDone, 200*time.Millisecond).ShouldNot(BeClosed())
+
+				close(release)
+				Eventually(shutdownDone).Should(BeClosed())
+				Eventually(createDone).Should(BeClosed())
+				Expect(summary).To(Equal(overlayxfs.ShutdownSummary{InFlight: 1}))
+			})
+
+			It("returns the context error when it does not finish in time", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+
+				summary, err := driver.Shutdown(ctx, logger)
+				Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+				Expect(summary).To(Equal(overlayxfs.ShutdownSummary{InFlight: 1, Unfinished: 1}))
+			})
+		})
+	})
+
+	Describe("ImageLayerCount", func() {
+		BeforeEach(func() {
+			spec.BaseVolumeIDs = []string{}
+			for i := 0; i < 3; i++ {
+				volumeID := randVolumeID()
+				createVolume(storePath, driver, "", volumeID, 10)
+				spec.BaseVolumeIDs = append(spec.BaseVolumeIDs, volumeID)
+			}
+		})
+
+		It("returns the number of base volumes of the image", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(driver.ImageLayerCount(logger, spec.ImagePath)).To(Equal(3))
+		})
+
+		Context("when the image has no metadata", func() {
+			It("returns an error", func() {
+				_, err := driver.ImageLayerCount(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("reading image metadata")))
+			})
+		})
+
+		Context("when a maximum number of layers is set", func() {
+			It("creates images within the maximum", func() {
+				driver.WithMaxLayers(3)
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("refuses to create images over the maximum", func() {
+				driver.WithMaxLayers(2)
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrTooManyLayers)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("3 layers, at most 2 allowed")))
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeAnExistingFile())
+			})
+		})
+	})
+
+	Describe("ImageInfo", func() {
+		var (
+			clock     *fakes.FakeClock
+			createdAt time.Time
+		)
+
+		BeforeEach(func() {
+			createdAt = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+			clock = new(fakes.FakeClock)
+			clock.NowReturns(createdAt)
+			driver.WithClock(clock)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("returns when the image was created and mounted", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := driver.ImageInfo(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.CreatedAt).To(BeTemporally("==", createdAt))
+			Expect(info.LastMountedAt).To(BeTemporally("==", createdAt))
+			Expect(info.DiskUsage.TotalBytesUsed).To(BeNumerically("~", 3000000, 100))
+		})
+
+		Context("when the image is not mounted on creation", func() {
+			BeforeEach(func() {
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("has no last mount time", func() {
+				info, err := driver.ImageInfo(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.CreatedAt).To(BeTemporally("==", createdAt))
+				Expect(info.LastMountedAt).To(BeZero())
+			})
+
+			It("records the last mount time on MountImage", func() {
+				mountedAt := createdAt.Add(time.Hour)
+				clock.NowReturns(mountedAt)
+				Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+
+				info, err := driver.ImageInfo(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.CreatedAt).To(BeTemporally("==", createdAt))
+				Expect(info.LastMountedAt).To(BeTemporally("==", mountedAt))
+			})
+		})
+
+		Context("when the image has no metadata", func() {
+			It("returns an error", func() {
+				_, err := driver.ImageInfo(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("reading image metadata")))
+			})
+		})
+	})
+
+	Describe("ImageStatuses", func() {
+		var (
+			quotaManager      *fakes.FakeQuotaManager
+			unmountedImageID  string
+			unmountedImageDir string
+		)
+
+		BeforeEach(func() {
+			quotaManager = new(fakes.FakeQuotaManager)
+			quotaManager.UsageReturns(3000, nil)
+			driver.WithQuotaManager(quotaManager)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.DiskLimit = 10 * 1024 * 1024
+			spec.ExclusiveDiskLimit = true
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			unmountedImageID = "unmounted-image"
+			unmountedImageDir = filepath.Join(storePath, store.ImageDirName, unmountedImageID)
+			Expect(os.Mkdir(unmountedImageDir, 0755)).To(Succeed())
+			unmountedSpec := spec
+			unmountedSpec.ImagePath = unmountedImageDir
+			unmountedSpec.Mount = false
+			unmountedSpec.DiskLimit = 0
+			_, err = driver.CreateImage(logger, unmountedSpec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports the mount status and usage of every image", func() {
+			statuses, err := driver.ImageStatuses(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(ConsistOf(
+				overlayxfs.ImageStatus{ID: randomImageID, Mounted: true, UsedBytes: 3000, LimitBytes: 10 * 1024 * 1024},
+				overlayxfs.ImageStatus{ID: unmountedImageID, Mounted: false},
+			))
+		})
+
+		Context("when the usage of an image cannot be read", func() {
+			It("reports the error for that image only", func() {
+				quotaManager.UsageReturns(0, errors.New("tardis failed"))
+
+				statuses, err := driver.ImageStatuses(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(statuses).To(HaveLen(2))
+				for _, status := range statuses {
+					if status.ID == randomImageID {
+						Expect(status.Mounted).To(BeTrue())
+						Expect(status.Err).To(MatchError(ContainSubstring("tardis failed")))
+					} else {
+						Expect(status.Err).NotTo(HaveOccurred())
+					}
+				}
+			})
+		})
+	})
+
+	Describe("WithUpperDevicePath", func() {
+		var (
+			upperDevicePath string
+			deviceImagePath string
+		)
+
+		BeforeEach(func() {
+			var err error
+			upperDevicePath, err = ioutil.TempDir("", "upper-device")
+			Expect(err).NotTo(HaveOccurred())
+			deviceImagePath = filepath.Join(upperDevicePath, randomImageID)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			driver.WithUpperDevicePath(upperDevicePath)
+		})
+
+		AfterEach(func() {
+			for _, dir := range []string{overlayxfs.RootfsDir, overlayxfs.UpperDir, overlayxfs.WorkDir} {
+				_ = unix.Unmount(filepath.Join(spec.ImagePath, dir), 0)
+			}
+			Expect(os.RemoveAll(upperDevicePath)).To(Succeed())
+		})
+
+		It("keeps the writes of the image on the upper device", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"), []byte("hello"), 0644)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(deviceImagePath, overlayxfs.UpperDir, "written"))).To(Equal([]byte("hello")))
+			Expect(ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "written"))).To(Equal([]byte("hello")))
+		})
+
+		It("binds the upper device dirs again when remounting the image", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"), []byte("hello"), 0644)).To(Succeed())
+
+			// As after a reboot
+			for _, dir := range []string{overlayxfs.RootfsDir, overlayxfs.UpperDir, overlayxfs.WorkDir} {
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, dir), 0)).To(Succeed())
+			}
+
+			Expect(driver.MountImage(logger, spec.ImagePath)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"))).To(Equal([]byte("hello")))
+			Expect(ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "written"))).To(Equal([]byte("hello")))
+		})
+
+		It("removes the upper device dirs when destroying the image", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The driver the image was created with might have been reconfigured
+			driver.WithUpperDevicePath("")
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+
+			Expect(deviceImagePath).NotTo(BeADirectory())
+			Expect(spec.ImagePath).NotTo(BeADirectory())
+		})
+
+		It("refuses to compress the upperdir of the image", func() {
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(deviceImagePath, overlayxfs.UpperDir, "written"), []byte("hello"), 0644)).To(Succeed())
+
+			_, err = driver.CompressIdleUpper(logger, spec.ImagePath)
+			Expect(err).To(MatchError(ContainSubstring("refusing to compress")))
+			Expect(filepath.Join(spec.ImagePath, "diff.tar.gz")).NotTo(BeAnExistingFile())
+			Expect(ioutil.ReadFile(filepath.Join(deviceImagePath, overlayxfs.UpperDir, "written"))).To(Equal([]byte("hello")))
+		})
+
+		It("moves the upper device dirs along when renaming the image", func() {
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"), []byte("hello"), 0644)).To(Succeed())
+
+			Expect(driver.RenameImage(logger, randomImageID, "renamed-image")).To(Succeed())
+			newImagePath := filepath.Join(storePath, store.ImageDirName, "renamed-image")
+			newDeviceImagePath := filepath.Join(upperDevicePath, "renamed-image")
+			// The binds are not overlay mounts, which the suite cleans up
+			defer func() {
+				Expect(driver.DestroyImage(logger, newImagePath)).To(Succeed())
+			}()
+
+			Expect(deviceImagePath).NotTo(BeADirectory())
+			Expect(ioutil.ReadFile(filepath.Join(newImagePath, overlayxfs.RootfsDir, "written"))).To(Equal([]byte("hello")))
+			Expect(ioutil.WriteFile(filepath.Join(newImagePath, overlayxfs.RootfsDir, "renamed"), []byte("hello"), 0644)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(newDeviceImagePath, overlayxfs.UpperDir, "renamed"))).To(Equal([]byte("hello")))
+			Expect(ioutil.ReadFile(filepath.Join(newImagePath, overlayxfs.UpperDir, "renamed"))).To(Equal([]byte("hello")))
+		})
+
+		It("removes the upper device dirs when destroying the store", func() {
+			driver.WithQuotaManager(new(fakes.FakeQuotaManager))
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = driver.DestroyStore(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(deviceImagePath).NotTo(BeADirectory())
+			Expect(storePath).NotTo(BeAnExistingFile())
+			mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(storePath))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mounts).To(BeEmpty())
+		})
+
+		Context("when creating the image fails", func() {
+			It("removes the upper device dirs", func() {
+				shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, spec.BaseVolumeIDs[0]))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.Remove(filepath.Join(storePath, overlayxfs.LinksDirName, string(shortID)))).To(Succeed())
+
+				_, err = driver.CreateImage(logger, spec)
+				Expect(err).To(HaveOccurred())
+
+				Expect(deviceImagePath).NotTo(BeADirectory())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Describe("RenameImage", func() {
+		var newImagePath string
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"), []byte("hello"), 0644)).To(Succeed())
+
+			newImagePath = filepath.Join(storePath, store.ImageDirName, "renamed-image")
+			unmounter.UnmountReturns(nil)
+		})
+
+		AfterEach(func() {
+			_ = unix.Unmount(filepath.Join(newImagePath, overlayxfs.RootfsDir), 0)
+		})
+
+		It("moves the image to the new id and mounts it there", func() {
+			Expect(driver.RenameImage(logger, randomImageID, "renamed-image")).To(Succeed())
+
+			Expect(spec.ImagePath).NotTo(BeADirectory())
+			Expect(driver.IsImageMounted(logger, newImagePath)).To(BeTrue())
+			Expect(ioutil.ReadFile(filepath.Join(newImagePath, overlayxfs.RootfsDir, "written"))).To(Equal([]byte("hello")))
+
+			images, err := driver.Images(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(images).To(ConsistOf("renamed-image"))
+		})
+
+		Context("when the new id is taken", func() {
+			BeforeEach(func() {
+				Expect(os.Mkdir(newImagePath, 0755)).To(Succeed())
+			})
+
+			It("returns ErrImageAlreadyExists and leaves the image in place", func() {
+				err := driver.RenameImage(logger, randomImageID, "renamed-image")
+				Expect(errors.Is(err, overlayxfs.ErrImageAlreadyExists)).To(BeTrue())
+
+				Expect(driver.IsImageMounted(logger, spec.ImagePath)).To(BeTrue())
+				Expect(ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "written"))).To(Equal([]byte("hello")))
+				Expect(ioutil.ReadDir(newImagePath)).To(BeEmpty())
+			})
+		})
+
+		Context("when the id is not a plain name", func() {
+			It("returns an error", func() {
+				err := driver.RenameImage(logger, randomImageID, "../escaped")
+				Expect(err).To(MatchError(ContainSubstring("invalid image id")))
+			})
+		})
+	})
+
+	Describe("BackingDeviceIOInfo", func() {
+		var (
+			sysfsPath  string
+			deviceLink string
+		)
+
+		BeforeEach(func() {
+			var err error
+			sysfsPath, err = ioutil.TempDir("", "sysfs")
+			Expect(err).NotTo(HaveOccurred())
+
+			diskPath := filepath.Join(sysfsPath, "devices", "virtual", "block", "sda")
+			Expect(os.MkdirAll(filepath.Join(diskPath, "queue"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(diskPath, "queue", "scheduler"), []byte("[mq-deadline] kyber none\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(diskPath, "queue", "nr_requests"), []byte("64\n"), 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(diskPath, "sda1"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(diskPath, "sda1", "partition"), []byte("1\n"), 0644)).To(Succeed())
+
+			var stat unix.Stat_t
+			Expect(unix.Stat(storePath, &stat)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(sysfsPath, "dev", "block"), 0755)).To(Succeed())
+			deviceLink = filepath.Join(sysfsPath, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev))))
+
+			driver.WithSysBlockDevicesPath(filepath.Join(sysfsPath, "dev", "block"))
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(sysfsPath)).To(Succeed())
+		})
+
+		It("reports the scheduler and queue depth of the store device", func() {
+			Expect(os.Symlink("../../devices/virtual/block/sda", deviceLink)).To(Succeed())
+
+			info, err := driver.BackingDeviceIOInfo(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).To(Equal(overlayxfs.IOInfo{
+				Device:              "sda",
+				Scheduler:           "mq-deadline",
+				AvailableSchedulers: []string{"mq-deadline", "kyber", "none"},
+				QueueDepth:          64,
+			}))
+		})
+
+		Context("when the store is on a partition", func() {
+			It("reports the queue of the disk", func() {
+				Expect(os.Symlink("../../devices/virtual/block/sda/sda1", deviceLink)).To(Succeed())
+
+				info, err := driver.BackingDeviceIOInfo(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Device).To(Equal("sda"))
+				Expect(info.QueueDepth).To(Equal(64))
+			})
+		})
+
+		Context("when the device is not a block device", func() {
+			It("returns an error", func() {
+				_, err := driver.BackingDeviceIOInfo(logger)
+				Expect(err).To(MatchError(ContainSubstring("resolving block device")))
+			})
+		})
+	})
+
+	Describe("TouchImage", func() {
+		var (
+			clock     *fakes.FakeClock
+			createdAt time.Time
+		)
+
+		BeforeEach(func() {
+			createdAt = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+			clock = new(fakes.FakeClock)
+			clock.NowReturns(createdAt)
+			driver.WithClock(clock)
+
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("advances the last used time of the image", func() {
+			info, err := driver.ImageInfo(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeZero())
+
+			usedAt := createdAt.Add(time.Hour)
+			clock.NowReturns(usedAt)
+			Expect(driver.TouchImage(logger, spec.ImagePath)).To(Succeed())
+
+			info, err = driver.ImageInfo(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeTemporally("==", usedAt))
+			Expect(info.CreatedAt).To(BeTemporally("==", createdAt))
+
+			clock.NowReturns(usedAt.Add(time.Hour))
+			Expect(driver.TouchImage(logger, spec.ImagePath)).To(Succeed())
+
+			info, err = driver.ImageInfo(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeTemporally("==", usedAt.Add(time.Hour)))
+		})
+
+		It("updates the access time of the image directory", func() {
+			usedAt := time.Now().Add(time.Hour).Truncate(time.Second)
+			clock.NowReturns(usedAt)
+			Expect(driver.TouchImage(logger, spec.ImagePath)).To(Succeed())
+
+			var stat unix.Stat_t
+			Expect(unix.Stat(spec.ImagePath, &stat)).To(Succeed())
+			Expect(time.Unix(stat.Atim.Unix())).To(BeTemporally("==", usedAt))
+		})
+
+		Context("when the image has no metadata", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(spec.ImagePath, "metadata.json"))).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				Expect(driver.TouchImage(logger, spec.ImagePath)).To(MatchError(ContainSubstring("reading image metadata")))
+			})
+		})
+	})
+
+	Describe("TouchVolume", func() {
+		var (
+			clock    *fakes.FakeClock
+			volumeID string
+			now      time.Time
+		)
+
+		BeforeEach(func() {
+			now = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+			clock = new(fakes.FakeClock)
+			clock.NowReturns(now)
+			driver.WithClock(clock)
+
+			volumeID = randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+		})
+
+		It("advances the last used time of the volume", func() {
+			info, err := driver.VolumeInfo(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeZero())
+			Expect(info.Size).To(BeEquivalentTo(1000))
+
+			Expect(driver.TouchVolume(logger, volumeID)).To(Succeed())
+			info, err = driver.VolumeInfo(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeTemporally("==", now))
+
+			clock.NowReturns(now.Add(time.Hour))
+			Expect(driver.TouchVolume(logger, volumeID)).To(Succeed())
+			info, err = driver.VolumeInfo(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.LastUsedAt).To(BeTemporally("==", now.Add(time.Hour)))
+		})
+
+		It("is called by CreateImage for each layer", func() {
+			otherVolumeID := randVolumeID()
+			createVolume(storePath, driver, "", otherVolumeID, 1000)
+
+			spec.BaseVolumeIDs = []string{volumeID, otherVolumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, id := range []string{volumeID, otherVolumeID} {
+				info, err := driver.VolumeInfo(logger, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.LastUsedAt).To(BeTemporally("==", now))
+			}
+		})
+
+		It("does not list the last used time as a volume and removes it with the volume", func() {
+			Expect(driver.TouchVolume(logger, volumeID)).To(Succeed())
+			Expect(driver.Volumes(logger)).To(ConsistOf(volumeID))
+
+			Expect(driver.DestroyVolume(logger, volumeID)).To(Succeed())
+			Expect(volumeMetaPath(storePath, volumeID) + ".last-used").NotTo(BeAnExistingFile())
+		})
+
+		Context("when the volume cannot be touched", func() {
+			BeforeEach(func() {
+				lastUsedPath := volumeMetaPath(storePath, volumeID) + ".last-used"
+				Expect(os.Symlink(lastUsedPath, lastUsedPath)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				Expect(driver.TouchVolume(logger, volumeID)).To(MatchError(ContainSubstring("updating volume last used time")))
+			})
+
+			It("still creates images using it", func() {
+				spec.BaseVolumeIDs = []string{volumeID}
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger).To(gbytes.Say("touching-volume-failed"))
+			})
+		})
+	})
+
+	Describe("HasWrites", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns false for an empty upperdir", func() {
+			Expect(driver.HasWrites(logger, spec.ImagePath)).To(BeFalse())
+		})
+
+		It("returns true when the upperdir has entries", func() {
+			nestedDir := filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "a", "b")
+			Expect(os.MkdirAll(nestedDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(nestedDir, "file"), []byte("hello"), 0644)).To(Succeed())
+
+			Expect(driver.HasWrites(logger, spec.ImagePath)).To(BeTrue())
+		})
+
+		It("returns true when the upperdir is compressed", func() {
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "file"), []byte("hello"), 0644)).To(Succeed())
+			_, err := driver.CompressIdleUpper(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(driver.HasWrites(logger, spec.ImagePath)).To(BeTrue())
+		})
+
+		Context("when the image is read-only", func() {
+			It("returns false", func() {
+				readOnlySpec := spec
+				readOnlySpec.ReadOnly = true
+				readOnlySpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "read-only-image")
+				Expect(os.Mkdir(readOnlySpec.ImagePath, 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, readOnlySpec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.HasWrites(logger, readOnlySpec.ImagePath)).To(BeFalse())
+			})
+		})
+
+		Context("when the upperdir cannot be walked", func() {
+			It("returns an error", func() {
+				Expect(os.RemoveAll(filepath.Join(spec.ImagePath, overlayxfs.UpperDir))).To(Succeed())
+
+				_, err := driver.HasWrites(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("walking upperdir")))
+			})
+		})
+	})
+
+	Describe("ImageAnnotations", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("returns the annotations the image was created with", func() {
+			spec.Annotations = map[string]string{
+				"pod-id":         "my-pod",
+				"container-name": "my-container",
+				"empty":          "",
+			}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			annotations, err := driver.ImageAnnotations(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(annotations).To(Equal(map[string]string{
+				"pod-id":         "my-pod",
+				"container-name": "my-container",
+				"empty":          "",
+			}))
+		})
+
+		Context("when the image has no annotations", func() {
+			It("returns an empty map", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				annotations, err := driver.ImageAnnotations(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(annotations).NotTo(BeNil())
+				Expect(annotations).To(BeEmpty())
+			})
+		})
+
+		Context("when the annotations are empty", func() {
+			It("returns an empty map", func() {
+				spec.Annotations = map[string]string{}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				annotations, err := driver.ImageAnnotations(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(annotations).To(BeEmpty())
+			})
+		})
+
+		Context("when the image has no metadata", func() {
+			It("returns an error", func() {
+				_, err := driver.ImageAnnotations(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("reading image metadata")))
+			})
+		})
+	})
+
+	Describe("ImagesByAnnotation", func() {
+		var volumeID string
+
+		createAnnotatedImage := func(annotations map[string]string) string {
+			imagePath := filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+			Expect(os.Mkdir(imagePath, 0755)).To(Succeed())
+
+			imageSpec := spec
+			imageSpec.ImagePath = imagePath
+			imageSpec.Mount = false
+			imageSpec.Annotations = annotations
+			_, err := driver.CreateImage(logger, imageSpec)
+			Expect(err).NotTo(HaveOccurred())
+
+			return filepath.Base(imagePath)
+		}
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("returns the images with a matching annotation", func() {
+			podAImage1 := createAnnotatedImage(map[string]string{"pod-id": "a", "container-name": "one"})
+			podAImage2 := createAnnotatedImage(map[string]string{"pod-id": "a", "container-name": "two"})
+			createAnnotatedImage(map[string]string{"pod-id": "b", "container-name": "one"})
+			createAnnotatedImage(map[string]string{"container-name": "a"})
+			createAnnotatedImage(nil)
+
+			Expect(driver.ImagesByAnnotation(logger, "pod-id", "a")).To(ConsistOf(podAImage1, podAImage2))
+		})
+
+		It("matches empty values only for annotations that are present", func() {
+			withEmptyValue := createAnnotatedImage(map[string]string{"pod-id": ""})
+			createAnnotatedImage(map[string]string{"other": ""})
+
+			Expect(driver.ImagesByAnnotation(logger, "pod-id", "")).To(ConsistOf(withEmptyValue))
+		})
+
+		It("returns an empty list when nothing matches", func() {
+			createAnnotatedImage(map[string]string{"pod-id": "a"})
+
+			images, err := driver.ImagesByAnnotation(logger, "pod-id", "c")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(images).To(BeEmpty())
+		})
+
+		Context("when some images have missing or corrupt metadata", func() {
+			It("skips them", func() {
+				matching := createAnnotatedImage(map[string]string{"pod-id": "a"})
+				corrupt := createAnnotatedImage(map[string]string{"pod-id": "a"})
+				Expect(ioutil.WriteFile(filepath.Join(storePath, store.ImageDirName, corrupt, "metadata.json"), []byte("{not-json"), 0600)).To(Succeed())
+
+				Expect(driver.ImagesByAnnotation(logger, "pod-id", "a")).To(ConsistOf(matching))
+				Expect(logger).To(gbytes.Say("skipping-image-without-readable-metadata"))
+			})
+		})
+	})
+
+	Describe("DestroyImagesByAnnotation", func() {
+		createAnnotatedImage := func(annotations map[string]string) string {
+			imagePath := filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+			Expect(os.Mkdir(imagePath, 0755)).To(Succeed())
+
+			imageSpec := spec
+			imageSpec.ImagePath = imagePath
+			imageSpec.Annotations = annotations
+			_, err := driver.CreateImage(logger, imageSpec)
+			Expect(err).NotTo(HaveOccurred())
+
+			return filepath.Base(imagePath)
+		}
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("destroys only the images with a matching annotation", func() {
+			podAImage1 := createAnnotatedImage(map[string]string{"pod-id": "a"})
+			podAImage2 := createAnnotatedImage(map[string]string{"pod-id": "a"})
+			podBImage := createAnnotatedImage(map[string]string{"pod-id": "b"})
+			unannotatedImage := createAnnotatedImage(nil)
+
+			destroyed, err := driver.DestroyImagesByAnnotation(logger, "pod-id", "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(destroyed).To(ConsistOf(podAImage1, podAImage2))
+
+			Expect(filepath.Join(storePath, store.ImageDirName, podAImage1)).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(storePath, store.ImageDirName, podAImage2)).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(storePath, store.ImageDirName, podBImage, overlayxfs.RootfsDir)).To(BeADirectory())
+			Expect(filepath.Join(storePath, store.ImageDirName, unannotatedImage, overlayxfs.RootfsDir)).To(BeADirectory())
+		})
+
+		Context("when an image fails to be destroyed", func() {
+			It("destroys the others and lists it in the error", func() {
+				image1 := createAnnotatedImage(map[string]string{"pod-id": "a"})
+				image2 := createAnnotatedImage(map[string]string{"pod-id": "a"})
+
+				unmounter.UnmountStub = func(_ lager.Logger, path string, flags int) error {
+					if strings.Contains(path, image1) {
+						return errors.New("unmount-failed")
+					}
+					return unix.Unmount(path, flags)
+				}
+
+				destroyed, err := driver.DestroyImagesByAnnotation(logger, "pod-id", "a")
+				Expect(err).To(MatchError(ContainSubstring("failed to destroy images: %s (", image1)))
+				Expect(err).To(MatchError(ContainSubstring("unmount-failed")))
+				Expect(destroyed).To(ConsistOf(image2))
+			})
+		})
+	})
+
+	Describe("FindDuplicateImages", func() {
+		var volumeIDs []string
+
+		createImage := func(baseVolumeIDs ...string) string {
+			imagePath := filepath.Join(storePath, store.ImageDirName, testhelpers.NewRandomID())
+			Expect(os.Mkdir(imagePath, 0755)).To(Succeed())
+
+			imageSpec := spec
+			imageSpec.ImagePath = imagePath
+			imageSpec.Mount = false
+			imageSpec.BaseVolumeIDs = baseVolumeIDs
+			_, err := driver.CreateImage(logger, imageSpec)
+			Expect(err).NotTo(HaveOccurred())
+
+			return filepath.Base(imagePath)
+		}
+
+		BeforeEach(func() {
+			volumeIDs = []string{randVolumeID(), randVolumeID()}
+			for _, volumeID := range volumeIDs {
+				createVolume(storePath, driver, "", volumeID, 1000)
+			}
+		})
+
+		It("groups the images with the same lower volumes", func() {
+			duplicate1 := createImage(volumeIDs[0], volumeIDs[1])
+			duplicate2 := createImage(volumeIDs[0], volumeIDs[1])
+			createImage(volumeIDs[1], volumeIDs[0])
+			createImage(volumeIDs[0])
+
+			duplicates, err := driver.FindDuplicateImages(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(duplicates).To(HaveLen(1))
+			Expect(duplicates[0]).To(ConsistOf(duplicate1, duplicate2))
+		})
+
+		It("returns no groups when all images are unique", func() {
+			createImage(volumeIDs[0])
+			createImage(volumeIDs[1])
+
+			duplicates, err := driver.FindDuplicateImages(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(duplicates).To(BeEmpty())
+		})
+	})
+
+	Describe("ImageQuotaUsage", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("reads the usage and the limit from the project quota", func() {
+			statfs := syscall.Statfs_t{}
+			Expect(syscall.Statfs(storePath, &statfs)).To(Succeed())
+			if statfs.Type != filesystems.XfsType {
+				Skip("project quotas require the store to be on XFS")
+			}
+
+			spec.DiskLimit = 10 * mb
+			spec.ExclusiveDiskLimit = true
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file"), make([]byte, 2*mb), 0644)).To(Succeed())
+			unix.Sync()
+
+			usage, hasQuota, err := driver.ImageQuotaUsage(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hasQuota).To(BeTrue())
+			Expect(usage.LimitBytes).To(Equal(10 * mb))
+			Expect(usage.UsedBytes).To(BeNumerically(">=", 2*mb))
+		})
+
+		It("reads the usage through the quota manager", func() {
+			quotaManager := new(fakes.FakeQuotaManager)
+			quotaManager.UsageReturns(2*mb, nil)
+			driver.WithQuotaManager(quotaManager)
+
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, "image_quota"), []byte(strconv.FormatInt(10*mb, 10)), 0600)).To(Succeed())
+
+			usage, hasQuota, err := driver.ImageQuotaUsage(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hasQuota).To(BeTrue())
+			Expect(usage).To(Equal(overlayxfs.QuotaUsage{UsedBytes: 2 * mb, LimitBytes: 10 * mb}))
+
+			Expect(quotaManager.UsageCallCount()).To(Equal(1))
+			_, imagePath := quotaManager.UsageArgsForCall(0)
+			Expect(imagePath).To(Equal(spec.ImagePath))
+		})
+
+		Context("when the image has no disk limit", func() {
+			It("reports it has no quota", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, hasQuota, err := driver.ImageQuotaUsage(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hasQuota).To(BeFalse())
+			})
+		})
+
+		Context("when the image is read-only", func() {
+			It("reports it has no quota", func() {
+				spec.ReadOnly = true
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, hasQuota, err := driver.ImageQuotaUsage(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hasQuota).To(BeFalse())
+			})
+		})
+
+		Context("when the path is not an image", func() {
+			It("returns an error", func() {
+				_, _, err := driver.ImageQuotaUsage(logger, filepath.Join(storePath, "not-an-image"))
+				Expect(err).To(MatchError(ContainSubstring("doesn't exist")))
+			})
+		})
+	})
+
+	Describe("FetchStats", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000000)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			spec.DiskLimit = 10 * mb
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+
+			dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/rootfs/file-1", spec.ImagePath), "count=4", "bs=1M")
+			sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(sess).Should(gexec.Exit(0))
+		})
+
+		It("reports the image usage correctly", func() {
+			stats, err := driver.FetchStats(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(stats.DiskUsage.ExclusiveBytesUsed).To(Equal(int64(4202496)))
+			Expect(stats.DiskUsage.TotalBytesUsed).To(Equal(int64(3000000 + 4202496)))
+		})
+
+		Context("when the context is done", func() {
+			It("returns the context error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := driver.FetchStatsContext(ctx, logger, spec.ImagePath)
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			})
+		})
+
+		Context("when path does not exist", func() {
+			var imagePath string
+
+			BeforeEach(func() {
+				imagePath = "/tmp/not-here"
+			})
+
+			It("returns an error", func() {
+				_, err := driver.FetchStats(logger, imagePath)
+				Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("image path (%s) doesn't exist", imagePath))))
+			})
+		})
+
+		Context("when the path doesn't have a quota", func() {
+			BeforeEach(func() {
+				tmpDir, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "")
+				Expect(err).NotTo(HaveOccurred())
+				spec.DiskLimit = 0
+				spec.ImagePath = tmpDir
+				_, err = driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns the exclusive bytes used as 0", func() {
+				volumeStats, err := driver.FetchStats(logger, spec.ImagePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(volumeStats.DiskUsage.ExclusiveBytesUsed).To(Equal(int64(0)))
+				Expect(volumeStats.DiskUsage.TotalBytesUsed).To(BeNumerically("~", 3000000, 100))
+			})
+
+			It("measures the upperdir once written to", func() {
+				Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file"), bytes.Repeat([]byte("a"), int(mb)), 0644)).To(Succeed())
+
+				volumeStats, err := driver.FetchStats(logger, spec.ImagePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(volumeStats.DiskUsage.ExclusiveBytesUsed).To(BeNumerically(">=", mb))
+				Expect(volumeStats.DiskUsage.TotalBytesUsed).To(Equal(3000000 + volumeStats.DiskUsage.ExclusiveBytesUsed))
+				Expect(volumeStats.DiskUsage.QuotaSizeBytes).To(BeZero())
+			})
+
+			Context("and it doesn't have an `image_info` file", func() {
+				It("returns an error", func() {
+					Expect(os.Remove(filepath.Join(spec.ImagePath, "image_info"))).To(Succeed())
+					_, err := driver.FetchStats(logger, spec.ImagePath)
+					Expect(err).To(MatchError(ContainSubstring("reading image info")))
+				})
+			})
+		})
+
+		Context("when the image is read-only", func() {
+			BeforeEach(func() {
+				tmpDir, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "")
+				Expect(err).NotTo(HaveOccurred())
+				spec.DiskLimit = 0
+				spec.ReadOnly = true
+				spec.Mount = false
+				spec.ImagePath = tmpDir
+				_, err = driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("reports the base volumes only", func() {
+				volumeStats, err := driver.FetchStatsContext(context.Background(), logger, spec.ImagePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(volumeStats.DiskUsage.ExclusiveBytesUsed).To(BeZero())
+				Expect(volumeStats.DiskUsage.TotalBytesUsed).To(BeNumerically("~", 3000000, 100))
+			})
+		})
+
+		Context("when the upperdir is compressed", func() {
+			BeforeEach(func() {
+				tmpDir, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "")
+				Expect(err).NotTo(HaveOccurred())
+				spec.DiskLimit = 0
+				spec.Mount = false
+				spec.ImagePath = tmpDir
+				_, err = driver.CreateImage(logger, spec)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.UpperDir, "file"), []byte("hello"), 0644)).To(Succeed())
+				_, err = driver.CompressIdleUpper(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("measures the archive", func() {
+				volumeStats, err := driver.FetchStats(logger, spec.ImagePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(volumeStats.DiskUsage.ExclusiveBytesUsed).To(BeNumerically(">", 0))
+				Expect(volumeStats.DiskUsage.TotalBytesUsed).To(Equal(3000000 + volumeStats.DiskUsage.ExclusiveBytesUsed))
+			})
+		})
+
+		Context("when the path doesn't have an `image_info` file", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(spec.ImagePath, "image_info"))).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.FetchStats(logger, spec.ImagePath)
+				Expect(err).To(MatchError(ContainSubstring("reading image info")))
+			})
+		})
+
+		Context("when the path is not an image", func() {
+			It("returns an error", func() {
+				_, err := driver.FetchStats(logger, "/proc")
+				Expect(err).To(MatchError(ContainSubstring("/proc is not an image: rootfs is missing")))
+			})
+		})
+	})
+
+	Describe("UpperGrowthSince", func() {
+		var baseline int64
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000000)
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+
+			baseline, err = driver.UpperBaseline(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("returns how much the upperdir grew since the baseline", func() {
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file-1"), bytes.Repeat([]byte{1}, 2*int(mb)), 0644)).To(Succeed())
+
+			growth, err := driver.UpperGrowthSince(logger, spec.ImagePath, baseline)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(growth).To(BeNumerically(">=", 2*mb))
+			Expect(growth).To(BeNumerically("<", 3*mb))
+		})
+
+		It("measures from the given baseline", func() {
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file-1"), bytes.Repeat([]byte{1}, int(mb)), 0644)).To(Succeed())
+			midway, err := driver.UpperBaseline(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file-2"), bytes.Repeat([]byte{1}, int(mb)), 0644)).To(Succeed())
+
+			growth, err := driver.UpperGrowthSince(logger, spec.ImagePath, midway)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(growth).To(BeNumerically("~", mb, 64*1024))
+		})
+
+		It("does not count the base volumes", func() {
+			growth, err := driver.UpperGrowthSince(logger, spec.ImagePath, baseline)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(growth).To(BeZero())
+		})
+
+		Context("when the image is read-only", func() {
+			It("reports no growth", func() {
+				readOnlySpec := spec
+				readOnlySpec.ReadOnly = true
+				readOnlySpec.Mount = false
+				readOnlySpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "read-only-image")
+				Expect(os.Mkdir(readOnlySpec.ImagePath, 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, readOnlySpec)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.UpperBaseline(logger, readOnlySpec.ImagePath)).To(BeZero())
+				Expect(driver.UpperGrowthSince(logger, readOnlySpec.ImagePath, 0)).To(BeZero())
+			})
+		})
+
+		Context("when the upperdir is compressed", func() {
+			It("measures the archive", func() {
+				compressedSpec := spec
+				compressedSpec.Mount = false
+				compressedSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "compressed-image")
+				Expect(os.Mkdir(compressedSpec.ImagePath, 0755)).To(Succeed())
+				_, err := driver.CreateImage(logger, compressedSpec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(compressedSpec.ImagePath, overlayxfs.UpperDir, "file"), []byte("hello"), 0644)).To(Succeed())
+				_, err = driver.CompressIdleUpper(logger, compressedSpec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.UpperBaseline(logger, compressedSpec.ImagePath)).To(BeNumerically(">", 0))
+			})
+		})
+
+		Context("when the path is not an image", func() {
+			It("returns an error", func() {
+				_, err := driver.UpperBaseline(logger, "/proc")
+				Expect(err).To(MatchError("/proc is not an image: rootfs is missing"))
+			})
+		})
+	})
+
+	Describe("MeasureStore", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 0)
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "contents"), bytes.Repeat([]byte{1}, int(mb)), 0644)).To(Succeed())
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "file-1"), bytes.Repeat([]byte{1}, 2*int(mb)), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+		})
+
+		It("adds up the usage of the volumes and the images", func() {
+			usage, err := driver.MeasureStore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usage.VolumesBytes).To(BeNumerically("~", mb, 64*1024))
+			Expect(usage.ImagesBytes).To(BeNumerically("~", 2*mb, 64*1024))
+			Expect(usage.TotalBytes).To(Equal(usage.VolumesBytes + usage.ImagesBytes))
+		})
+
+		Context("when an image has no upperdir", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(storePath, store.ImageDirName, "read-only-image", overlayxfs.RootfsDir), 0755)).To(Succeed())
+			})
+
+			It("counts it as using nothing", func() {
+				usage, err := driver.MeasureStore(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(usage.ImagesBytes).To(BeNumerically("~", 2*mb, 64*1024))
+			})
+		})
+
+		Context("when the context is done", func() {
+			It("stops measuring and returns the context error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := driver.MeasureStoreContext(ctx, logger)
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("VolumePath", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(filepath.Join(storePath, store.VolumesDirName, randomID), 0755)).To(Succeed())
+		})
+
+		It("returns the volume path when it exists", func() {
+			retVolPath, err := driver.VolumePath(logger, randomID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retVolPath).To(Equal(filepath.Join(storePath, store.VolumesDirName, randomID)))
+		})
+
+		Context("when the volume does not exist", func() {
+			It("returns an error", func() {
+				_, err := driver.VolumePath(logger, "non-existent-id")
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+			})
+		})
+
+		Context("when the id would reach outside of the volumes directory", func() {
+			It("refuses it", func() {
+				Expect(os.Mkdir(filepath.Join(storePath, "outside"), 0755)).To(Succeed())
+
+				for _, id := range []string{"../outside", "../" + store.VolumesDirName + "/" + randomID, "vol\x00ume"} {
+					_, err := driver.VolumePath(logger, id)
+					Expect(errors.Is(err, overlayxfs.ErrInvalidVolumeID)).To(BeTrue(), id)
+				}
+			})
+		})
+
+		Context("when the cache is enabled", func() {
+			var volumePath string
+
+			BeforeEach(func() {
+				driver.WithVolumePathCache(true)
+				volumePath = filepath.Join(storePath, store.VolumesDirName, randomID)
+
+				_, err := driver.VolumePath(logger, randomID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.RemoveAll(volumePath)).To(Succeed())
+			})
+
+			It("does not look the volumes it found up again", func() {
+				Expect(driver.VolumePath(logger, randomID)).To(Equal(volumePath))
+			})
+
+			It("looks them up again once invalidated", func() {
+				driver.InvalidateVolumeCache(randomID)
+				_, err := driver.VolumePath(logger, randomID)
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+			})
+
+			It("forgets the volumes that are destroyed", func() {
+				Expect(driver.DestroyVolume(logger, randomID)).To(Succeed())
+				_, err := driver.VolumePath(logger, randomID)
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+			})
+
+			It("forgets the volumes once an image is created", func() {
+				_, err := driver.CreateImage(logger, image_manager.ImageDriverSpec{
+					BaseVolumeIDs: []string{randomID},
+					ImagePath:     filepath.Join(storePath, store.ImageDirName, "image-id"),
+				})
+				Expect(err).To(HaveOccurred())
+
+				_, err = driver.VolumePath(logger, randomID)
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+			})
+
+			It("does not remember volumes that do not exist", func() {
+				_, err := driver.VolumePath(logger, "created-later")
+				Expect(err).To(HaveOccurred())
+
+				Expect(os.Mkdir(filepath.Join(storePath, store.VolumesDirName, "created-later"), 0755)).To(Succeed())
+				_, err = driver.VolumePath(logger, "created-later")
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("WithStorePath", func() {
+		var (
+			otherStorePath string
+			otherDriver    *overlayxfs.Driver
+		)
+
+		BeforeEach(func() {
+			var err error
+			otherStorePath, err = ioutil.TempDir(StorePath, "")
+			Expect(err).NotTo(HaveOccurred())
+			for _, dir := range []string{store.VolumesDirName, store.MetaDirName, store.ImageDirName, overlayxfs.LinksDirName} {
+				Expect(os.MkdirAll(filepath.Join(otherStorePath, dir), 0777)).To(Succeed())
+			}
+
+			otherDriver = driver.WithVolumeDirMode(0750).WithStorePath(otherStorePath)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(otherStorePath)).To(Succeed())
+		})
+
+		It("targets the other store with the same configuration", func() {
+			volumePath, err := otherDriver.CreateVolume(logger, "", randomID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumePath).To(Equal(filepath.Join(otherStorePath, store.VolumesDirName, randomID)))
+			Expect(filepath.Join(storePath, store.VolumesDirName, randomID)).NotTo(BeAnExistingFile())
+
+			stat, err := os.Stat(volumePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0750)))
+		})
+
+		It("leaves the original driver on its store", func() {
+			volumePath, err := driver.CreateVolume(logger, "", randomID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumePath).To(Equal(filepath.Join(storePath, store.VolumesDirName, randomID)))
+		})
+
+		It("does not share the maintenance mode", func() {
+			driver.SetMaintenanceMode(true)
+			defer driver.SetMaintenanceMode(false)
+
+			_, err := otherDriver.CreateVolume(logger, "", randomID)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("ConfigureStore", func() {
+		const (
+			currentUID = 2001
+			currentGID = 2002
+		)
+
+		var (
+			backingStorePath string
+		)
+
+		BeforeEach(func() {
+			var err error
+			storePath, err = ioutil.TempDir(storePath, "configure-store-test")
+			Expect(err).ToNot(HaveOccurred())
+
+			backingStoreFile, err := ioutil.TempFile(storePath, "backing-store-test")
+			Expect(err).ToNot(HaveOccurred())
+
+			backingStorePath = backingStoreFile.Name()
+		})
+
+		Context("when the store is not on XFS", func() {
+			var tmpfsPath string
+
+			BeforeEach(func() {
+				tmpfsPath = filepath.Join(storePath, "tmpfs-store")
+				Expect(os.Mkdir(tmpfsPath, 0755)).To(Succeed())
+				Expect(unix.Mount("tmpfs", tmpfsPath, "tmpfs", 0, "")).To(Succeed())
+
+				driver.WithSkipXFSCheck(false)
+			})
+
+			AfterEach(func() {
+				Expect(unix.Unmount(tmpfsPath, 0)).To(Succeed())
+			})
+
+			It("returns an error naming the filesystem", func() {
+				err := driver.ConfigureStore(logger, tmpfsPath, backingStorePath, currentUID, currentGID)
+				Expect(errors.Is(err, overlayxfs.ErrNotXFS)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("%s is on tmpfs", tmpfsPath)))
+				Expect(filepath.Join(tmpfsPath, overlayxfs.LinksDirName)).NotTo(BeAnExistingFile())
+			})
+
+			It("configures it anyway when the check is skipped", func() {
+				driver.WithSkipXFSCheck(true)
+				Expect(driver.ConfigureStore(logger, tmpfsPath, backingStorePath, currentUID, currentGID)).To(Succeed())
+			})
+		})
+
+		It("creates a links directory", func() {
+			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+			stat, err := os.Stat(filepath.Join(storePath, overlayxfs.LinksDirName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.IsDir()).To(BeTrue())
+			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(currentUID)))
+			Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(currentGID)))
+		})
+
+		It("creates a meta directory", func() {
+			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+			stat, err := os.Stat(filepath.Join(storePath, store.MetaDirName))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.IsDir()).To(BeTrue())
+			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(currentUID)))
+		})
+
+		It("creates a whiteout device", func() {
+			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+
+			stat, err := os.Stat(filepath.Join(storePath, overlayxfs.WhiteoutDevice))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(currentUID)))
+			Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(currentGID)))
+		})
+
+		It("enables direct IO on the loopback device", func() {
+			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+			Expect(directIO.ConfigureCallCount()).To(Equal(1))
+			actualDirectIOPath := directIO.ConfigureArgsForCall(0)
+			Expect(actualDirectIOPath).To(Equal(backingStorePath))
+		})
+
+		Context("when the backing store path does not exist", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(backingStorePath)).To(Succeed())
+			})
+
+			It("does not attempt to configure direct io", func() {
+				Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+				Expect(directIO.ConfigureCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the whiteout 'device' is not a device", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(storePath, 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(storePath, overlayxfs.WhiteoutDevice), []byte{}, 0755)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				err := driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)
+				Expect(err).To(MatchError(ContainSubstring("the whiteout device file is not a valid device")))
+			})
+		})
+
+		Context("when enabling direct IO fails", func() {
+			BeforeEach(func() {
+				directIO.ConfigureReturns(errors.New("lo-error"))
+			})
+
+			It("returns the error", func() {
+				err := driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)
+				Expect(err).To(MatchError(ContainSubstring("lo-error")))
+			})
+		})
+	})
+
+	Describe("ValidateFileSystem", func() {
+		Context("when storepath is a XFS mount", func() {
+			It("returns no error", func() {
+				Expect(driver.ValidateFileSystem(logger, storePath)).To(Succeed())
+			})
+		})
+
+		Context("when storepath is not a XFS mount", func() {
+			It("returns an error", func() {
+				err := driver.ValidateFileSystem(logger, "/mnt/ext4")
+				Expect(err).To(MatchError(ContainSubstring("Store path filesystem (/mnt/ext4) is incompatible with native driver (must be XFS mountpoint)")))
+			})
+		})
+	})
+
+	Describe("CreateVolume", func() {
+		It("creates a volume", func() {
+			expectedVolumePath := filepath.Join(storePath, store.VolumesDirName, randomID)
+			Expect(expectedVolumePath).NotTo(BeAnExistingFile())
+
+			volumePath, err := driver.CreateVolume(logger, "", randomID)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(expectedVolumePath).To(BeADirectory())
+			Expect(volumePath).To(Equal(expectedVolumePath))
+
+			linkFile := filepath.Join(storePath, overlayxfs.LinksDirName, randomID)
+			_, err = os.Stat(linkFile)
+			Expect(err).ToNot(HaveOccurred(), "volume link file has not been created")
+
+			linkName, err := ioutil.ReadFile(linkFile)
+			Expect(err).ToNot(HaveOccurred(), "failed to read volume link file")
+
+			link := filepath.Join(storePath, overlayxfs.LinksDirName, string(linkName))
+			linkStat, err := os.Lstat(link)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(linkStat.Mode()&os.ModeSymlink).ToNot(
+				BeZero(),
+				fmt.Sprintf("Volume link %s is not a symlink", link),
+			)
+			Expect(os.Readlink(link)).To(Equal(volumePath), "Volume link does not point to volume")
+		})
+
+		It("creates the volume directory with the default mode", func() {
+			volumePath, err := driver.CreateVolume(logger, "", randomID)
+			Expect(err).NotTo(HaveOccurred())
+
+			stat, err := os.Stat(volumePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(overlayxfs.DefaultDirMode))
+		})
+
+		Context("when a volume directory mode is set", func() {
+			It("creates the volume directory with it", func() {
+				driver.WithVolumeDirMode(0750)
+				volumePath, err := driver.CreateVolume(logger, "", randomID)
+				Expect(err).NotTo(HaveOccurred())
+
+				stat, err := os.Stat(volumePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0750)))
+			})
+		})
+
+		It("accepts generated volume ids", func() {
+			volumeID, err := overlayxfs.GenerateVolumeID(digestpkg.FromString("layer"), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = driver.CreateVolume(logger, "", volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(storePath, store.VolumesDirName, volumeID)).To(BeADirectory())
+		})
+
+		Context("when the id would reach outside of the volumes directory", func() {
+			It("refuses it", func() {
+				for _, id := range []string{"../escaped", "../../escaped", "nested/volume", "..", "volume..", "", "vol\x00ume"} {
+					_, err := driver.CreateVolume(logger, "", id)
+					Expect(errors.Is(err, overlayxfs.ErrInvalidVolumeID)).To(BeTrue(), id)
+				}
+				Expect(filepath.Join(storePath, "escaped")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(filepath.Dir(storePath), "escaped")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the parent volume exists", func() {
+			It("creates the volume", func() {
+				parentID := randVolumeID()
+				createVolume(storePath, driver, "", parentID, 10)
+
+				_, err := driver.CreateVolume(logger, parentID, randomID)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("when the parent volume is missing", func() {
+			It("returns ErrParentNotFound without creating the volume", func() {
+				_, err := driver.CreateVolume(logger, "missing-parent", randomID)
+				Expect(errors.Is(err, overlayxfs.ErrParentNotFound)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("missing-parent")))
+				Expect(filepath.Join(storePath, store.VolumesDirName, randomID)).NotTo(BeAnExistingFile())
+			})
+
+			Context("and the policy is lenient", func() {
+				BeforeEach(func() {
+					driver.WithMissingParentPolicy(overlayxfs.LenientMissingParent)
+				})
+
+				It("logs and creates an empty volume", func() {
+					volumePath, err := driver.CreateVolume(logger, "missing-parent", randomID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(volumePath).To(BeADirectory())
+					Expect(ioutil.ReadDir(volumePath)).To(BeEmpty())
+					Expect(logger).To(gbytes.Say("parent-volume-not-found-creating-empty-volume"))
+				})
+			})
+		})
+
+		Context("when volume dir doesn't exist", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName))).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.CreateVolume(logger, "", randomID)
+				Expect(err).To(MatchError(ContainSubstring("creating volume")))
+			})
+		})
+
+		Context("when the volume has already been created", func() {
+			var volumePath string
+
+			BeforeEach(func() {
+				var err error
+				volumePath, err = driver.CreateVolume(logger, "", randomID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(volumePath, "contents"), []byte("layer"), 0644)).To(Succeed())
+			})
+
+			It("returns the existing volume", func() {
+				path, err := driver.CreateVolume(logger, "", randomID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).To(Equal(volumePath))
+				Expect(filepath.Join(path, "contents")).To(BeARegularFile())
+
+				linkFiles, err := filepath.Glob(filepath.Join(storePath, overlayxfs.LinksDirName, "*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(linkFiles).To(HaveLen(2))
+			})
+
+			Context("and it is moved", func() {
+				It("is still reused under its new id", func() {
+					newID := randVolumeID()
+					Expect(driver.MoveVolume(logger, volumePath, filepath.Join(storePath, store.VolumesDirName, newID))).To(Succeed())
+
+					_, err := driver.CreateVolume(logger, "", newID)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("and it is destroyed", func() {
+				It("creates it again from scratch", func() {
+					Expect(driver.DestroyVolume(logger, randomID)).To(Succeed())
+
+					path, err := driver.CreateVolume(logger, "", randomID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.ReadDir(path)).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the volume directory was left incomplete", func() {
+			BeforeEach(func() {
+				Expect(os.Mkdir(filepath.Join(storePath, store.VolumesDirName, randomID), 0755)).To(Succeed())
+			})
+
+			It("returns ErrIncompleteVolume", func() {
+				_, err := driver.CreateVolume(logger, "", randomID)
+				Expect(errors.Is(err, overlayxfs.ErrIncompleteVolume)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring("creating volume")))
+			})
+		})
+
+		Context("when the volume was created before the complete markers", func() {
+			BeforeEach(func() {
+				createVolume(storePath, driver, "", randomID, 10)
+				Expect(os.Remove(filepath.Join(storePath, store.MetaDirName, fmt.Sprintf("volume-%s.complete", randomID)))).To(Succeed())
+			})
+
+			It("reuses the volume", func() {
+				path, err := driver.CreateVolume(logger, "", randomID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(path).To(Equal(filepath.Join(storePath, store.VolumesDirName, randomID)))
+			})
+		})
+
+		Context("when the volume path exists but is not a directory", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(storePath, store.VolumesDirName, randomID), []byte{}, 0644)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.CreateVolume(logger, "", randomID)
+				Expect(err).To(MatchError(ContainSubstring("is not a directory")))
+			})
+		})
+
+		Context("when the create rate is limited", func() {
+			var (
+				clock *fakes.FakeClock
+				now   time.Time
+			)
+
+			BeforeEach(func() {
+				now = time.Now()
+				clock = new(fakes.FakeClock)
+				clock.NowReturns(now)
+				driver.WithClock(clock)
+			})
+
+			Context("and the policy is to reject", func() {
+				BeforeEach(func() {
+					driver.WithCreateRateLimit(1, 2, overlayxfs.RejectWhenRateLimited)
+				})
+
+				It("allows bursts and then returns ErrRateLimited until the rate allows more", func() {
+					_, err := driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+					_, err = driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+
+					volumeID := randVolumeID()
+					_, err = driver.CreateVolume(logger, "", volumeID)
+					Expect(errors.Is(err, overlayxfs.ErrRateLimited)).To(BeTrue())
+					Expect(filepath.Join(storePath, store.VolumesDirName, volumeID)).NotTo(BeADirectory())
+
+					clock.NowReturns(now.Add(time.Second))
+					_, err = driver.CreateVolume(logger, "", volumeID)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("limits image creation too", func() {
+					_, err := driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+					_, err = driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = driver.CreateImage(logger, spec)
+					Expect(errors.Is(err, overlayxfs.ErrRateLimited)).To(BeTrue())
+				})
+			})
+
+			Context("and the policy is to block", func() {
+				BeforeEach(func() {
+					driver.WithCreateRateLimit(5, 1, overlayxfs.BlockWhenRateLimited)
+				})
+
+				It("waits for the rate to allow the create", func() {
+					after := make(chan time.Time)
+					close(after)
+					clock.AfterReturns(after)
+
+					_, err := driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(clock.AfterCallCount()).To(BeZero())
+
+					_, err = driver.CreateVolume(logger, "", randVolumeID())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(clock.AfterCallCount()).To(Equal(1))
+					Expect(clock.AfterArgsForCall(0)).To(Equal(200 * time.Millisecond))
+				})
+			})
+		})
+	})
+
+	Describe("ImportVolumes", func() {
+		var sources map[string]io.Reader
+
+		BeforeEach(func() {
+			sources = map[string]io.Reader{}
+			for i := 0; i < 6; i++ {
+				contents := fmt.Sprintf("layer %d", i)
+				sources[fmt.Sprintf("volume-%d", i)] = bytes.NewReader(layerTarball(map[string]string{
+					"etc/layer":               contents,
+					fmt.Sprintf("file-%d", i): contents,
+				}, i%2 == 0))
+			}
+		})
+
+		It("imports all the volumes", func() {
+			volumePaths, err := driver.ImportVolumes(logger, sources, 3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumePaths).To(HaveLen(6))
+
+			for i := 0; i < 6; i++ {
+				id := fmt.Sprintf("volume-%d", i)
+				Expect(volumePaths[id]).To(Equal(filepath.Join(storePath, store.VolumesDirName, id)))
+
+				contents, err := ioutil.ReadFile(filepath.Join(volumePaths[id], "etc", "layer"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal(fmt.Sprintf("layer %d", i)))
+				Expect(filepath.Join(volumePaths[id], fmt.Sprintf("file-%d", i))).To(BeAnExistingFile())
+
+				Expect(filepath.Join(storePath, overlayxfs.LinksDirName, id)).To(BeAnExistingFile())
+				size, err := driver.VolumeSize(logger, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(size).To(BeNumerically(">", 0))
+			}
+
+			Expect(driver.Volumes(logger)).To(HaveLen(6))
+		})
+
+		It("can use the imported volumes as image layers", func() {
+			_, err := driver.ImportVolumes(logger, sources, 2)
+			Expect(err).NotTo(HaveOccurred())
+
+			spec.BaseVolumeIDs = []string{"volume-0", "volume-1"}
+			_, err = driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "etc", "layer"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("layer 1"))
+		})
+
+		It("converts the whiteouts of the layers", func() {
+			Expect(unix.Mknod(filepath.Join(storePath, overlayxfs.WhiteoutDevice), unix.S_IFCHR, 0)).To(Succeed())
+			sources = map[string]io.Reader{
+				"whiteouts": bytes.NewReader(layerTarball(map[string]string{
+					".wh.deleted":              "",
+					"opaque/.wh..wh..opq":      "",
+					"opaque/file":              "kept",
+					"nested/dir/.wh.also-gone": "",
+				}, false)),
+			}
+
+			volumePaths, err := driver.ImportVolumes(logger, sources, 1)
+			Expect(err).NotTo(HaveOccurred())
+			volumePath := volumePaths["whiteouts"]
+
+			for _, path := range []string{"deleted", "nested/dir/also-gone"} {
+				var stat unix.Stat_t
+				Expect(unix.Lstat(filepath.Join(volumePath, path), &stat)).To(Succeed())
+				Expect(stat.Mode & unix.S_IFMT).To(BeEquivalentTo(unix.S_IFCHR))
+				Expect(stat.Rdev).To(BeZero())
+			}
+			Expect(filepath.Join(volumePath, ".wh.deleted")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(volumePath, "nested/dir/.wh.also-gone")).NotTo(BeAnExistingFile())
+
+			Expect(filepath.Join(volumePath, "opaque/.wh..wh..opq")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(volumePath, "opaque/file")).To(BeAnExistingFile())
+			xattr, err := system.Lgetxattr(filepath.Join(volumePath, "opaque"), "trusted.overlay.opaque")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(xattr)).To(Equal("y"))
+		})
+
+		Context("when another import of the same volume finishes first", func() {
+			var existingPath string
+
+			BeforeEach(func() {
+				existingPath = filepath.Join(storePath, store.VolumesDirName, "volume-0")
+				sources["volume-0"] = &eofHook{
+					Reader: sources["volume-0"],
+					onEOF: func() {
+						Expect(os.MkdirAll(existingPath, 0755)).To(Succeed())
+						Expect(ioutil.WriteFile(filepath.Join(existingPath, "existing"), []byte{}, 0644)).To(Succeed())
+					},
+				}
+			})
+
+			It("keeps the existing volume and destroys its own", func() {
+				volumePaths, err := driver.ImportVolumes(logger, sources, 1)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(volumePaths["volume-0"]).To(Equal(existingPath))
+				Expect(filepath.Join(existingPath, "existing")).To(BeAnExistingFile())
+
+				volumes, err := driver.Volumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				for _, volume := range volumes {
+					Expect(volume).NotTo(ContainSubstring("incomplete"))
+				}
+			})
+		})
+
+		Context("when some of the layers fail to import", func() {
+			BeforeEach(func() {
+				sources["broken"] = bytes.NewReader([]byte("not a tarball"))
+				createVolume(storePath, driver, "", "volume-0", 10)
+			})
+
+			It("imports the others and reports the failures", func() {
+				volumePaths, err := driver.ImportVolumes(logger, sources, 4)
+				Expect(err).To(MatchError(ContainSubstring("broken: ")))
+				Expect(err).To(MatchError(ContainSubstring("volume-0: volume volume-0 already exists")))
+				Expect(volumePaths).To(HaveLen(5))
+				Expect(volumePaths).NotTo(HaveKey("broken"))
+				Expect(volumePaths).NotTo(HaveKey("volume-0"))
+			})
+
+			It("does not leave incomplete volumes behind", func() {
+				_, err := driver.ImportVolumes(logger, sources, 4)
+				Expect(err).To(HaveOccurred())
+
+				volumes, err := driver.Volumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				for _, volume := range volumes {
+					Expect(volume).NotTo(ContainSubstring("incomplete"))
+				}
+			})
+		})
+		Context("when the layers do not fit in the store", func() {
+			var fsOperations *fakes.FakeFSOperations
+
+			BeforeEach(func() {
+				fsOperations = new(fakes.FakeFSOperations)
+				fsOperations.StatfsReturns(unix.Statfs_t{Bsize: 4096, Bavail: 1024}, nil)
+				driver = driver.WithFSOperations(fsOperations).WithImportReserve(0)
+			})
+
+			It("refuses to import layers whose headers are larger than the free space", func() {
+				sources = map[string]io.Reader{
+					"big": bytes.NewReader(layerTarball(map[string]string{"file": strings.Repeat("a", 5*1024*1024)}, false)),
+				}
+
+				_, err := driver.ImportVolumes(logger, sources, 1)
+				Expect(errors.Is(err, overlayxfs.ErrInsufficientSpace)).To(BeTrue())
+				Expect(fsOperations.MkdirCallCount()).To(BeZero())
+			})
+
+			It("refuses to import layers whose estimate is larger than the free space", func() {
+				sources["estimated"] = overlayxfs.EstimatedLayer{
+					Reader: bytes.NewBufferString("not read"),
+					Size:   5 * 1024 * 1024,
+				}
+
+				_, err := driver.ImportVolumes(logger, sources, 1)
+				Expect(errors.Is(err, overlayxfs.ErrInsufficientSpace)).To(BeTrue())
+
+				volumes, err := driver.Volumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(volumes).To(BeEmpty())
+			})
+
+			It("keeps the reserve free", func() {
+				driver = driver.WithImportReserve(4 * 1024 * 1024)
+
+				_, err := driver.ImportVolumes(logger, sources, 1)
+				Expect(errors.Is(err, overlayxfs.ErrInsufficientSpace)).To(BeTrue())
+			})
+		})
+
+		Context("when a layer has a large run of zeros", func() {
+			var contents string
+
+			BeforeEach(func() {
+				contents = "head" + strings.Repeat("\x00", 8*1024*1024) + "tail"
+				sources = map[string]io.Reader{
+					"sparse": bytes.NewReader(layerTarball(map[string]string{"disk.img": contents}, true)),
+				}
+			})
+
+			It("imports the file sparse", func() {
+				volumePaths, err := driver.ImportVolumes(logger, sources, 1)
+				Expect(err).NotTo(HaveOccurred())
+
+				filePath := filepath.Join(volumePaths["sparse"], "disk.img")
+				imported, err := ioutil.ReadFile(filePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(imported) == contents).To(BeTrue(), "imported contents differ")
+
+				var stat unix.Stat_t
+				Expect(unix.Stat(filePath, &stat)).To(Succeed())
+				Expect(stat.Blocks * 512).To(BeNumerically("<", stat.Size/2))
+			})
+
+			Context("and sparse imports are disabled", func() {
+				It("imports the file dense", func() {
+					driver.WithSparseThreshold(0)
+					volumePaths, err := driver.ImportVolumes(logger, sources, 1)
+					Expect(err).NotTo(HaveOccurred())
+
+					var stat unix.Stat_t
+					Expect(unix.Stat(filepath.Join(volumePaths["sparse"], "disk.img"), &stat)).To(Succeed())
+					Expect(stat.Blocks * 512).To(BeNumerically(">=", stat.Size))
+				})
+			})
+		})
+	})
+
+	Describe("GarbageCollectDryRun", func() {
+		var bigVolumeID, smallVolumeID string
+
+		writeFile := func(path string, size int64, sparseSize int64) {
+			file, err := os.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			_, err = io.CopyN(file, rand.New(rand.NewSource(0)), size)
+			Expect(err).NotTo(HaveOccurred())
+			if sparseSize > 0 {
+				Expect(file.Truncate(sparseSize)).To(Succeed())
+			}
+			Expect(file.Sync()).To(Succeed())
+		}
+
+		freeBytes := func() int64 {
+			var stat unix.Statfs_t
+			Expect(unix.Statfs(storePath, &stat)).To(Succeed())
+			return int64(stat.Bfree) * stat.Bsize
+		}
+
+		BeforeEach(func() {
+			bigVolumeID = randVolumeID()
+			bigVolumePath, err := driver.CreateVolume(logger, "", bigVolumeID)
+			Expect(err).NotTo(HaveOccurred())
+			writeFile(filepath.Join(bigVolumePath, "data"), 4*mb, 0)
+			writeFile(filepath.Join(bigVolumePath, "sparse"), 4*kb, 100*mb)
+			Expect(os.Link(filepath.Join(bigVolumePath, "data"), filepath.Join(bigVolumePath, "hardlink"))).To(Succeed())
+			Expect(driver.WriteVolumeMeta(logger, bigVolumeID, base_image_puller.VolumeMeta{})).To(Succeed())
+			Expect(driver.MarkVolumeArtifacts(logger, bigVolumeID)).To(Succeed())
+
+			smallVolumeID = randVolumeID()
+			smallVolumePath, err := driver.CreateVolume(logger, "", smallVolumeID)
+			Expect(err).NotTo(HaveOccurred())
+			writeFile(filepath.Join(smallVolumePath, "data"), mb, 0)
+			Expect(driver.WriteVolumeMeta(logger, smallVolumeID, base_image_puller.VolumeMeta{})).To(Succeed())
+			Expect(driver.MarkVolumeArtifacts(logger, smallVolumeID)).To(Succeed())
+
+			createVolume(storePath, driver, "", randVolumeID(), 10*mb)
+		})
+
+		It("reports the volumes marked for collection, biggest first", func() {
+			reclaimable, err := driver.GarbageCollectDryRun(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimable).To(HaveLen(2))
+			Expect(reclaimable[0].ID).To(Equal("gc." + bigVolumeID))
+			Expect(reclaimable[1].ID).To(Equal("gc." + smallVolumeID))
+		})
+
+		It("counts the allocated blocks rather than the apparent size", func() {
+			reclaimable, err := driver.GarbageCollectDryRun(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimable[0].Bytes).To(BeNumerically(">=", 4*mb+4*kb))
+			Expect(reclaimable[0].Bytes).To(BeNumerically("<", 5*mb))
+		})
+
+		It("does not destroy anything", func() {
+			_, err := driver.GarbageCollectDryRun(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(storePath, store.VolumesDirName, "gc."+bigVolumeID)).To(BeADirectory())
+			Expect(filepath.Join(storePath, store.VolumesDirName, "gc."+smallVolumeID)).To(BeADirectory())
+		})
+
+		It("matches the space actually freed by destroying the volumes", func() {
+			reclaimable, err := driver.GarbageCollectDryRun(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, volume := range reclaimable {
+				freeBefore := freeBytes()
+				Expect(driver.DestroyVolume(logger, volume.ID)).To(Succeed())
+				unix.Sync()
+				Eventually(func() int64 { return freeBytes() - freeBefore }).Should(BeNumerically("~", volume.Bytes, 256*kb))
+			}
+		})
+	})
+
+	Describe("BranchVolume", func() {
+		var (
+			srcID   string
+			srcPath string
+			dstID   string
+		)
+
+		BeforeEach(func() {
+			srcID = randVolumeID()
+			dstID = randVolumeID()
+			srcPath = createVolume(storePath, driver, "", srcID, 3000)
+			Expect(os.MkdirAll(filepath.Join(srcPath, "etc"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(srcPath, "etc", "config"), []byte("original"), 0644)).To(Succeed())
+			Expect(os.Symlink("etc/config", filepath.Join(srcPath, "config-link"))).To(Succeed())
+		})
+
+		itBranchesTheVolume := func() {
+			It("creates a volume with the contents of the source", func() {
+				dstPath, err := driver.BranchVolume(logger, srcID, dstID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dstPath).To(Equal(filepath.Join(storePath, store.VolumesDirName, dstID)))
+
+				contents, err := ioutil.ReadFile(filepath.Join(dstPath, "etc", "config"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("original"))
+				Expect(os.Readlink(filepath.Join(dstPath, "config-link"))).To(Equal("etc/config"))
+
+				Expect(filepath.Join(storePath, overlayxfs.LinksDirName, dstID)).To(BeAnExistingFile())
+				Expect(driver.VolumeSize(logger, dstID)).To(Equal(int64(3000)))
+			})
+
+			It("does not affect the source when the branch is modified", func() {
+				dstPath, err := driver.BranchVolume(logger, srcID, dstID)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.WriteFile(filepath.Join(dstPath, "etc", "config"), []byte("modified"), 0644)).To(Succeed())
+				Expect(os.Remove(filepath.Join(dstPath, "config-link"))).To(Succeed())
+
+				contents, err := ioutil.ReadFile(filepath.Join(srcPath, "etc", "config"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("original"))
+				Expect(filepath.Join(srcPath, "config-link")).To(BeAnExistingFile())
+			})
+		}
+
+		Context("when the filesystem supports reflinks", func() {
+			BeforeEach(func() {
+				probe := filepath.Join(storePath, "reflink-probe")
+				Expect(ioutil.WriteFile(probe, []byte("probe"), 0644)).To(Succeed())
+				if exec.Command("cp", "--reflink=always", probe, probe+"-copy").Run() != nil {
+					Skip("the store filesystem does not support reflinks")
+				}
+			})
+
+			itBranchesTheVolume()
+
+			It("shares the data blocks with the source", func() {
+				dstPath, err := driver.BranchVolume(logger, srcID, dstID)
+				Expect(err).NotTo(HaveOccurred())
+
+				output, err := exec.Command("filefrag", "-v", filepath.Join(dstPath, "etc", "config")).CombinedOutput()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(output)).To(ContainSubstring("shared"))
+			})
+		})
+
+		Context("when reflinks are not supported", func() {
+			BeforeEach(func() {
+				driver.WithReflinkCopy(func(src, dst string) error {
+					Expect(ioutil.WriteFile(filepath.Join(dst, "partial"), []byte{}, 0644)).To(Succeed())
+					return errors.New("Operation not supported")
+				})
+			})
+
+			itBranchesTheVolume()
+
+			It("falls back to a regular copy", func() {
+				dstPath, err := driver.BranchVolume(logger, srcID, dstID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(dstPath, "partial")).NotTo(BeAnExistingFile())
+				Expect(logger).To(gbytes.Say("reflink-copy-failed-falling-back-to-copy"))
+			})
+		})
+
+		Context("when the source volume does not exist", func() {
+			It("returns an error", func() {
+				_, err := driver.BranchVolume(logger, "not-here", dstID)
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+				Expect(filepath.Join(storePath, store.VolumesDirName, dstID)).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when two branches to the same volume run concurrently", func() {
+			var (
+				clock   *fakes.FakeClock
+				release chan time.Time
+			)
+
+			BeforeEach(func() {
+				// Holds both branches in the create rate limit, past the check
+				// for an existing destination, until both got there
+				release = make(chan time.Time)
+				clock = new(fakes.FakeClock)
+				clock.NowReturns(time.Now())
+				clock.AfterReturns(release)
+				driver.WithClock(clock).WithCreateRateLimit(1, 0, overlayxfs.BlockWhenRateLimited)
+			})
+
+			It("only lets one of them create it", func() {
+				errs := make(chan error, 2)
+				for i := 0; i < 2; i++ {
+					go func() {
+						defer GinkgoRecover()
+						_, err := driver.BranchVolume(logger, srcID, dstID)
+						errs <- err
+					}()
+				}
+
+				Eventually(func() int {
+					return clock.AfterCallCount()
+				}).Should(Equal(2))
+				close(release)
+
+				failures := 0
+				for i := 0; i < 2; i++ {
+					if err := <-errs; err != nil {
+						Expect(err).To(MatchError(ContainSubstring("already exists")))
+						failures++
+					}
+				}
+				Expect(failures).To(Equal(1))
+
+				contents, err := ioutil.ReadFile(filepath.Join(storePath, store.VolumesDirName, dstID, "etc", "config"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("original"))
+				Expect(filepath.Glob(filepath.Join(storePath, store.VolumesDirName, "*-incomplete-*"))).To(BeEmpty())
+			})
+		})
+
+		Context("when the destination volume already exists", func() {
+			BeforeEach(func() {
+				createVolume(storePath, driver, "", dstID, 10)
+			})
+
+			It("returns an error", func() {
+				_, err := driver.BranchVolume(logger, srcID, dstID)
+				Expect(err).To(MatchError(ContainSubstring("already exists")))
+			})
+		})
+	})
+
+	Describe("VolumeDigest", func() {
+		var volumeID string
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 3000)
+			Expect(os.MkdirAll(filepath.Join(volumePath, "etc"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "etc", "config"), []byte("contents"), 0644)).To(Succeed())
+			Expect(os.Symlink("etc/config", filepath.Join(volumePath, "config-link"))).To(Succeed())
+		})
+
+		It("uses sha256 by default", func() {
+			digest, err := driver.VolumeDigest(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest.Algorithm()).To(Equal(digestpkg.SHA256))
+			Expect(digest.Validate()).To(Succeed())
+		})
+
+		It("returns distinct, stable digests for each algorithm", func() {
+			sha256Digest, err := driver.VolumeDigest(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(driver.VolumeDigest(logger, volumeID)).To(Equal(sha256Digest))
+
+			driver.WithDigestAlgorithm(digestpkg.SHA512)
+			sha512Digest, err := driver.VolumeDigest(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sha512Digest.Algorithm()).To(Equal(digestpkg.SHA512))
+			Expect(sha512Digest.Validate()).To(Succeed())
+			Expect(driver.VolumeDigest(logger, volumeID)).To(Equal(sha512Digest))
+
+			Expect(sha512Digest).NotTo(Equal(sha256Digest))
+		})
+
+		It("changes with the contents of the volume", func() {
+			digest, err := driver.VolumeDigest(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+
+			volumePath := filepath.Join(storePath, store.VolumesDirName, volumeID)
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "etc", "config"), []byte("modified"), 0644)).To(Succeed())
+			Expect(driver.VolumeDigest(logger, volumeID)).NotTo(Equal(digest))
+		})
+
+		It("matches the digest of a branch of the volume", func() {
+			digest, err := driver.VolumeDigest(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+
+			branchID := randVolumeID()
+			_, err = driver.BranchVolume(logger, volumeID, branchID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(driver.VolumeDigest(logger, branchID)).To(Equal(digest))
+		})
+
+		Context("when the algorithm is not available", func() {
+			It("returns an error", func() {
+				driver.WithDigestAlgorithm(digestpkg.Algorithm("blake3"))
+				_, err := driver.VolumeDigest(logger, volumeID)
+				Expect(err).To(MatchError(ContainSubstring(`digest algorithm "blake3" is not available`)))
+			})
+		})
+	})
+
+	Describe("CheckOverlaySupport", func() {
+		var filesystemsPath string
+
+		fakeFilesystems := func(contents string) {
+			filesystemsFile, err := ioutil.TempFile("", "filesystems")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = filesystemsFile.WriteString(contents)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filesystemsFile.Close()).To(Succeed())
+			filesystemsPath = filesystemsFile.Name()
+			driver.WithFilesystemsPath(filesystemsPath)
+		}
+
+		AfterEach(func() {
+			Expect(os.Remove(filesystemsPath)).To(Succeed())
+		})
+
+		It("succeeds when the kernel lists overlay", func() {
+			fakeFilesystems("nodev\tsysfs\nnodev\toverlay\n\txfs\n")
+			Expect(driver.CheckOverlaySupport(logger)).To(Succeed())
+		})
+
+		It("returns ErrOverlayNotSupported otherwise", func() {
+			fakeFilesystems("nodev\tsysfs\n\text4\n\txfs\n")
+			err := driver.CheckOverlaySupport(logger)
+			Expect(errors.Is(err, overlayxfs.ErrOverlayNotSupported)).To(BeTrue())
+		})
+	})
+
+	Describe("WarmVolume", func() {
+		var volumeID string
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 10)
+			Expect(os.Mkdir(filepath.Join(volumePath, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "bin", "binary"), bytes.Repeat([]byte{1}, int(mb)), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "empty"), []byte{}, 0644)).To(Succeed())
+			Expect(os.Symlink("bin/binary", filepath.Join(volumePath, "link"))).To(Succeed())
+		})
+
+		It("warms the files of the volume", func() {
+			Expect(driver.WarmVolume(logger, volumeID)).To(Succeed())
+		})
+
+		Context("when the volume does not exist", func() {
+			It("returns an error", func() {
+				err := driver.WarmVolume(logger, "not-a-volume")
+				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+			})
+		})
+	})
+
+	Describe("ResolveVolumeDigest", func() {
+		var digest digestpkg.Digest
+
+		BeforeEach(func() {
+			digest = digestpkg.FromString(randVolumeID())
+		})
+
+		Context("when a volume is named after the digest", func() {
+			BeforeEach(func() {
+				createVolume(storePath, driver, "", digest.Encoded(), 10)
+			})
+
+			It("resolves it and links it under the volumes directory", func() {
+				volumeID, err := driver.ResolveVolumeDigest(logger, digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(volumeID).To(Equal(digest.Encoded()))
+
+				linkPath := filepath.Join(storePath, store.VolumesDirName, "sha256", digest.Encoded())
+				Expect(filepath.EvalSymlinks(linkPath)).To(Equal(filepath.Join(storePath, store.VolumesDirName, volumeID)))
+			})
+
+			It("does not list the links as volumes", func() {
+				_, err := driver.ResolveVolumeDigest(logger, digest)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(driver.Volumes(logger)).To(ConsistOf(digest.Encoded()))
+			})
+		})
+
+		Context("when the digest was linked to a volume", func() {
+			var volumeID string
+
+			BeforeEach(func() {
+				volumeID = randVolumeID()
+				createVolume(storePath, driver, "", volumeID, 10)
+				Expect(driver.LinkVolumeDigest(logger, volumeID, digest)).To(Succeed())
+			})
+
+			It("resolves it to that volume", func() {
+				Expect(driver.ResolveVolumeDigest(logger, digest)).To(Equal(volumeID))
+			})
+
+			It("stops resolving it once the volume is destroyed", func() {
+				Expect(driver.DestroyVolume(logger, volumeID)).To(Succeed())
+
+				_, err := driver.ResolveVolumeDigest(logger, digest)
+				Expect(errors.Is(err, overlayxfs.ErrVolumeDigestNotFound)).To(BeTrue())
+			})
+		})
+
+		Context("when no volume has the digest", func() {
+			It("returns ErrVolumeDigestNotFound", func() {
+				_, err := driver.ResolveVolumeDigest(logger, digest)
+				Expect(errors.Is(err, overlayxfs.ErrVolumeDigestNotFound)).To(BeTrue())
+				Expect(err).To(MatchError(ContainSubstring(digest.String())))
+			})
+		})
+
+		Context("when the digest is invalid", func() {
+			It("returns an error", func() {
+				_, err := driver.ResolveVolumeDigest(logger, digestpkg.Digest("sha256:../../etc"))
+				Expect(err).To(MatchError(ContainSubstring("invalid digest")))
+			})
+		})
+
+		Context("when creating an image by digest", func() {
+			BeforeEach(func() {
+				volumePath := createVolume(storePath, driver, "", digest.Encoded(), 10)
+				Expect(ioutil.WriteFile(filepath.Join(volumePath, "from-the-digest"), []byte{}, 0644)).To(Succeed())
+				spec.BaseVolumeDigests = []digestpkg.Digest{digest}
+			})
+
+			It("mounts the volumes the digests resolve to", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "from-the-digest")).To(BeAnExistingFile())
+			})
+
+			It("fails when a digest cannot be resolved", func() {
+				spec.BaseVolumeDigests = append(spec.BaseVolumeDigests, digestpkg.FromString("missing"))
+				_, err := driver.CreateImage(logger, spec)
+				Expect(errors.Is(err, overlayxfs.ErrVolumeDigestNotFound)).To(BeTrue())
+			})
+
+			It("fails when volume ids are given too", func() {
+				spec.BaseVolumeIDs = []string{digest.Encoded()}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).To(MatchError("base volumes must be given either by id or by digest"))
+			})
+		})
+	})
+
+	Describe("ProbeRootfsLatency", func() {
+		var clock *fakes.FakeClock
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 10)
+			Expect(os.Mkdir(filepath.Join(volumePath, "etc"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "etc", "os-release"), []byte("ID=test"), 0644)).To(Succeed())
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			clock = new(fakes.FakeClock)
+			clock.NowReturnsOnCall(0, start)
+			clock.NowReturnsOnCall(1, start.Add(15*time.Millisecond))
+			driver.WithClock(clock)
+		})
+
+		It("returns how long reading through the rootfs took", func() {
+			latency, err := driver.ProbeRootfsLatency(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(latency).To(Equal(15 * time.Millisecond))
+			Expect(clock.NowCallCount()).To(Equal(2))
+		})
+
+		Context("when the probe file is an absolute symlink", func() {
+			var (
+				rootfsPath string
+				hostFile   string
+			)
+
+			BeforeEach(func() {
+				rootfsPath = filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+				hostFile = filepath.Join(storePath, "host-os-release")
+				Expect(ioutil.WriteFile(hostFile, []byte("ID=host"), 0644)).To(Succeed())
+				Expect(os.Remove(filepath.Join(rootfsPath, "etc", "os-release"))).To(Succeed())
+			})
+
+			It("resolves it inside the rootfs", func() {
+				Expect(os.MkdirAll(filepath.Join(rootfsPath, filepath.Dir(hostFile)), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(rootfsPath, hostFile), []byte("ID=test"), 0644)).To(Succeed())
+				Expect(os.Symlink(hostFile, filepath.Join(rootfsPath, "etc", "os-release"))).To(Succeed())
+
+				_, err := driver.ProbeRootfsLatency(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger).To(gbytes.Say(regexp.QuoteMeta(fmt.Sprintf(`"probePath":"%s"`, filepath.Join(rootfsPath, "etc", "os-release")))))
+			})
+
+			It("does not read the host file it points to", func() {
+				Expect(os.Symlink(hostFile, filepath.Join(rootfsPath, "etc", "os-release"))).To(Succeed())
+
+				_, err := driver.ProbeRootfsLatency(logger, spec.ImagePath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger).To(gbytes.Say(regexp.QuoteMeta(fmt.Sprintf(`"probePath":"%s"`, rootfsPath))))
+			})
+		})
+
+		Context("when the image is not mounted", func() {
+			BeforeEach(func() {
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0)).To(Succeed())
+			})
+
+			It("returns an error", func() {
+				_, err := driver.ProbeRootfsLatency(logger, spec.ImagePath)
+				Expect(errors.Is(err, overlayxfs.ErrImageNotMounted)).To(BeTrue())
+				Expect(clock.NowCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Describe("StreamMergedRootfs", func() {
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 10)
+			Expect(os.Mkdir(filepath.Join(volumePath, "proc"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "lower-file"), []byte("from the lower"), 0644)).To(Succeed())
+
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("streams the lowers and the upper combined", func() {
+			rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "upper-file"), []byte("from the upper"), 0644)).To(Succeed())
+			Expect(unix.Mount("tmpfs", filepath.Join(rootfsPath, "proc"), "tmpfs", 0, "")).To(Succeed())
+			defer func() {
+				Expect(unix.Unmount(filepath.Join(rootfsPath, "proc"), 0)).To(Succeed())
+			}()
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "proc", "pseudo-file"), []byte{}, 0644)).To(Succeed())
+
+			buffer := new(bytes.Buffer)
+			Expect(driver.StreamMergedRootfs(logger, spec.ImagePath, buffer)).To(Succeed())
+
+			files := map[string]string{}
+			tarReader := tar.NewReader(buffer)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadAll(tarReader)
+				Expect(err).NotTo(HaveOccurred())
+				files[filepath.Clean(header.Name)] = string(contents)
+			}
+
+			Expect(files).To(HaveKeyWithValue("lower-file", "from the lower"))
+			Expect(files).To(HaveKeyWithValue("upper-file", "from the upper"))
+			Expect(files).To(HaveKey("proc"))
+			Expect(files).NotTo(HaveKey("proc/pseudo-file"))
 		})
 
-		Context("when base volume folder does not exist", func() {
-			BeforeEach(func() {
-				testhelpers.UnsuidBinary(tardisBinPath)
-			})
+		Context("when the image is not mounted", func() {
+			It("returns ErrImageNotMounted", func() {
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0)).To(Succeed())
 
-			It("returns an error", func() {
-				spec.BaseVolumeIDs = []string{"not-real"}
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).To(MatchError(ContainSubstring("base volume path does not exist")))
+				err := driver.StreamMergedRootfs(logger, spec.ImagePath, ioutil.Discard)
+				Expect(errors.Is(err, overlayxfs.ErrImageNotMounted)).To(BeTrue())
 			})
 		})
+	})
 
-		Context("when image path folder doesn't exist", func() {
-			It("returns an error", func() {
-				spec.ImagePath = "/not-real"
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).To(MatchError(ContainSubstring("image path does not exist")))
-			})
+	Describe("KernelOverlaySupport", func() {
+		var kernelReleasePath string
+
+		fakeKernelRelease := func(release string) {
+			Expect(ioutil.WriteFile(kernelReleasePath, []byte(release+"\n"), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			releaseFile, err := ioutil.TempFile("", "osrelease")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(releaseFile.Close()).To(Succeed())
+
+			kernelReleasePath = releaseFile.Name()
+			driver.WithKernelReleasePath(kernelReleasePath)
 		})
 
-		Context("when creating the upper folder fails", func() {
-			It("returns an error", func() {
-				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.UpperDir), 0755)).To(Succeed())
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).To(MatchError(ContainSubstring("creating upperdir folder")))
-			})
+		AfterEach(func() {
+			Expect(os.Remove(kernelReleasePath)).To(Succeed())
 		})
 
-		Context("when creating the workdir folder fails", func() {
-			It("returns an error", func() {
-				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.WorkDir), 0755)).To(Succeed())
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).To(MatchError(ContainSubstring("creating workdir folder")))
-			})
+		It("reports the release of the kernel", func() {
+			fakeKernelRelease("5.15.0-91-generic")
+			kernelInfo, err := driver.KernelOverlaySupport(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kernelInfo.Release).To(Equal("5.15.0-91-generic"))
+			Expect(kernelInfo.Major).To(Equal(5))
+			Expect(kernelInfo.Minor).To(Equal(15))
 		})
 
-		Context("when creating the rootfs folder fails", func() {
+		It("derives the supported features from the release", func() {
+			expected := map[string]overlayxfs.KernelInfo{
+				"4.4.0-210-generic": {},
+				"4.15.0":            {Index: true, RedirectDirNoFollow: true},
+				"4.19.0":            {Index: true, RedirectDirNoFollow: true, Metacopy: true},
+				"5.4.0-150-generic": {Index: true, RedirectDirNoFollow: true, Metacopy: true},
+				"5.10.0-generic":    {Index: true, RedirectDirNoFollow: true, Metacopy: true, Volatile: true},
+				"6.1.0":             {Index: true, RedirectDirNoFollow: true, Metacopy: true, Volatile: true},
+			}
+
+			for release, features := range expected {
+				fakeKernelRelease(release)
+				kernelInfo, err := driver.KernelOverlaySupport(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(kernelInfo.Index).To(Equal(features.Index), release)
+				Expect(kernelInfo.RedirectDirNoFollow).To(Equal(features.RedirectDirNoFollow), release)
+				Expect(kernelInfo.Metacopy).To(Equal(features.Metacopy), release)
+				Expect(kernelInfo.Volatile).To(Equal(features.Volatile), release)
+			}
+		})
+
+		Context("when the release cannot be parsed", func() {
 			It("returns an error", func() {
-				Expect(os.MkdirAll(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir), 0755)).To(Succeed())
-				_, err := driver.CreateImage(logger, spec)
-				Expect(err).To(MatchError(ContainSubstring("creating rootfs folder")))
+				fakeKernelRelease("not-a-release")
+				_, err := driver.KernelOverlaySupport(logger)
+				Expect(err).To(MatchError(ContainSubstring(`parsing kernel release "not-a-release"`)))
 			})
 		})
 	})
 
-	Describe("DestroyImage", func() {
-		JustBeforeEach(func() {
-			volumeID := randVolumeID()
-			createVolume(storePath, driver, "parent-id", volumeID, 3145728)
+	Describe("GenerateVolumeID", func() {
+		var (
+			diffID        digestpkg.Digest
+			anotherDiffID digestpkg.Digest
+		)
 
-			spec.BaseVolumeIDs = []string{volumeID}
-			_, err := driver.CreateImage(logger, spec)
-			Expect(err).ToNot(HaveOccurred())
+		BeforeEach(func() {
+			diffID = digestpkg.FromString("layer")
+			anotherDiffID = digestpkg.FromString("another-layer")
 		})
 
-		It("unmounts the rootfs dir", func() {
-			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
-			Expect(unmounter.UnmountCallCount()).To(Equal(1))
-			_, unmountPath := unmounter.UnmountArgsForCall(0)
-			Expect(unmountPath).To(Equal(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)))
+		It("uses the diff id of a bottom layer", func() {
+			Expect(overlayxfs.GenerateVolumeID(diffID, "")).To(Equal(diffID.Encoded()))
 		})
 
-		It("removes upper, work and rootfs dir from the image path", func() {
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).To(BeADirectory())
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).To(BeADirectory())
+		It("chains the diff id of a layer with the id of its parent", func() {
+			parentID, err := overlayxfs.GenerateVolumeID(anotherDiffID, "")
+			Expect(err).NotTo(HaveOccurred())
 
-			Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+			volumeID, err := overlayxfs.GenerateVolumeID(diffID, parentID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumeID).To(Equal(digestpkg.FromString(parentID + " " + diffID.Encoded()).Encoded()))
+			Expect(overlayxfs.GenerateVolumeID(diffID, parentID)).To(Equal(volumeID))
+		})
 
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).ToNot(BeAnExistingFile())
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.WorkDir)).ToNot(BeAnExistingFile())
-			Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).ToNot(BeAnExistingFile())
+		It("gives the same layer on top of different parents different ids", func() {
+			volumeID, err := overlayxfs.GenerateVolumeID(diffID, "parent-a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(overlayxfs.GenerateVolumeID(diffID, "parent-b")).NotTo(Equal(volumeID))
 		})
 
-		Context("projectids", func() {
-			BeforeEach(func() {
-				spec.DiskLimit = 1000000000
-			})
+		It("rejects an invalid diff id", func() {
+			_, err := overlayxfs.GenerateVolumeID("sha256:../../etc", "")
+			Expect(err).To(MatchError(ContainSubstring("invalid diff id")))
+		})
 
-			It("removes the projectid directory for that image", func() {
-				projectidsDir := filepath.Join(storePath, overlayxfs.IDDir)
-				ids, err := ioutil.ReadDir(projectidsDir)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(ids).To(HaveLen(1))
+		It("rejects an invalid parent id", func() {
+			_, err := overlayxfs.GenerateVolumeID(diffID, "../parent")
+			Expect(errors.Is(err, overlayxfs.ErrInvalidVolumeID)).To(BeTrue())
+		})
+	})
 
-				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+	Describe("Volumes", func() {
+		var volumesPath string
+		BeforeEach(func() {
+			volumesPath = filepath.Join(storePath, store.VolumesDirName)
+			Expect(os.Mkdir(filepath.Join(volumesPath, "sha256:vol-a"), 0777)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(volumesPath, "sha256:vol-b"), 0777)).To(Succeed())
+		})
 
-				ids, err = ioutil.ReadDir(projectidsDir)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(ids).To(BeEmpty())
-			})
+		AfterEach(func() {
+			Expect(os.RemoveAll(volumesPath)).To(Succeed())
 		})
 
-		Context("when it fails to unmount the rootfs", func() {
-			JustBeforeEach(func() {
-				unmounter.UnmountReturns(errors.New("unmount-failed"))
-			})
+		It("returns a list with existing volumes id", func() {
+			volumes, err := driver.Volumes(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(volumes)).To(Equal(2), "incorrect number of volumes")
+			Expect(volumes).To(ContainElement("sha256:vol-a"))
+			Expect(volumes).To(ContainElement("sha256:vol-b"))
+		})
 
-			It("returns an error", func() {
-				err := driver.DestroyImage(logger, spec.ImagePath)
-				Expect(err).To(MatchError(ContainSubstring("deleting image path")))
+		It("skips the entries that are not volumes", func() {
+			Expect(ioutil.WriteFile(filepath.Join(volumesPath, "stray-file"), []byte{}, 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(volumesPath, ".hidden-tmp"), 0755)).To(Succeed())
+
+			volumes, err := driver.Volumes(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumes).To(ConsistOf("sha256:vol-a", "sha256:vol-b"))
+		})
+
+		Context("when the meta directory has a custom name", func() {
+			var metaPath string
+
+			BeforeEach(func() {
+				metaPath = filepath.Join(storePath, "custom-meta")
+				driver.WithMetaDirName("custom-meta")
+				Expect(driver.ConfigureStore(logger, storePath, filepath.Join(storePath, "no-backing-store"), 0, 0)).To(Succeed())
 			})
 
-			It("does not delete the image directory", func() {
-				err := driver.DestroyImage(logger, spec.ImagePath)
-				Expect(err).To(HaveOccurred())
+			It("keeps the metadata there, out of the volume and image listings", func() {
+				Expect(driver.WriteVolumeMeta(logger, "sha256:vol-a", base_image_puller.VolumeMeta{Size: 1024})).To(Succeed())
+				Expect(filepath.Join(metaPath, "volume-sha256:vol-a")).To(BeAnExistingFile())
+				Expect(filepath.Join(storePath, store.MetaDirName, "volume-sha256:vol-a")).NotTo(BeAnExistingFile())
 
-				Expect(filepath.Join(spec.ImagePath, overlayxfs.UpperDir)).To(BeADirectory())
+				volumes, err := driver.Volumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(volumes).To(ConsistOf("sha256:vol-a", "sha256:vol-b"))
 
-				rootfsPath := filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
-				rootfsContent, err := ioutil.ReadDir(rootfsPath)
+				images, err := driver.Images(logger)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(rootfsContent).NotTo(BeEmpty())
+				Expect(images).NotTo(ContainElement("custom-meta"))
+			})
+		})
+
+		Context("when there are no volumes", func() {
+			It("returns an empty list", func() {
+				Expect(os.RemoveAll(volumesPath)).To(Succeed())
+				Expect(os.Mkdir(volumesPath, 0755)).To(Succeed())
 
+				volumes, err := driver.Volumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(volumes).NotTo(BeNil())
+				Expect(volumes).To(BeEmpty())
 			})
 		})
 
-		Context("when there is a very long file path in the rootfs", func() {
-			It("successfully removes the rootfs", func() {
-				Expect(createVeryLongFilePath(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir))).To(Succeed())
-				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
-				Expect(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)).NotTo(BeADirectory())
+		Context("when fails to list volumes", func() {
+			It("returns an error", func() {
+				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName))).To(Succeed())
+				_, err := driver.Volumes(logger)
+				Expect(err).To(MatchError(ContainSubstring("failed to list volumes")))
 			})
 		})
 	})
 
-	Describe("FetchStats", func() {
-		BeforeEach(func() {
+	Describe("StoreSnapshot", func() {
+		It("lists the volumes and the images with the size of their base volumes", func() {
 			volumeID := randVolumeID()
-			createVolume(storePath, driver, "parent-id", volumeID, 3000000)
+			createVolume(storePath, driver, "", volumeID, 1000)
 
 			spec.BaseVolumeIDs = []string{volumeID}
-			spec.DiskLimit = 10 * mb
+			spec.Mount = false
 			_, err := driver.CreateImage(logger, spec)
-			Expect(err).ToNot(HaveOccurred())
+			Expect(err).NotTo(HaveOccurred())
 
-			dd := exec.Command("dd", "if=/dev/zero", fmt.Sprintf("of=%s/rootfs/file-1", spec.ImagePath), "count=4", "bs=1M")
-			sess, err := gexec.Start(dd, GinkgoWriter, GinkgoWriter)
+			snapshot, err := driver.StoreSnapshot(logger)
 			Expect(err).NotTo(HaveOccurred())
-			Eventually(sess).Should(gexec.Exit(0))
+			Expect(snapshot.VolumeIDs).To(ContainElement(volumeID))
+			Expect(snapshot.Images).To(ContainElement(overlayxfs.ImageSnapshot{ID: randomImageID, BaseVolumesSize: 1000}))
 		})
 
-		It("reports the image usage correctly", func() {
-			stats, err := driver.FetchStats(logger, spec.ImagePath)
+		It("waits for the operations of other processes holding the store lock", func() {
+			Expect(os.MkdirAll(filepath.Join(storePath, store.LocksDirName), 0755)).To(Succeed())
+			lockFile, err := os.OpenFile(filepath.Join(storePath, store.LocksDirName, overlayxfs.StoreLockFileName), os.O_CREATE|os.O_RDONLY, 0600)
 			Expect(err).NotTo(HaveOccurred())
+			defer lockFile.Close()
+			Expect(unix.Flock(int(lockFile.Fd()), unix.LOCK_SH)).To(Succeed())
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := driver.StoreSnapshot(logger)
+				Expect(err).NotTo(HaveOccurred())
+			}()
 
-			Expect(stats.DiskUsage.ExclusiveBytesUsed).To(Equal(int64(4202496)))
-			Expect(stats.DiskUsage.TotalBytesUsed).To(Equal(int64(3000000 + 4202496)))
+			Consistently(done, "200ms").ShouldNot(BeClosed())
+			Expect(unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)).To(Succeed())
+			Eventually(done).Should(BeClosed())
 		})
 
-		Context("when path does not exist", func() {
-			var imagePath string
+		It("never shows an image without its volume while images are being created", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+
+				for i := 0; i < 10; i++ {
+					volumeID := randVolumeID()
+					createVolume(storePath, driver, "", volumeID, 1000)
+
+					imageSpec := spec
+					imageSpec.BaseVolumeIDs = []string{volumeID}
+					imageSpec.Mount = false
+					imageSpec.ImagePath = filepath.Join(storePath, store.ImageDirName, "image-"+volumeID)
+					Expect(os.Mkdir(imageSpec.ImagePath, 0755)).To(Succeed())
+					_, err := driver.CreateImage(logger, imageSpec)
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}()
+
+			for {
+				snapshot, err := driver.StoreSnapshot(logger)
+				Expect(err).NotTo(HaveOccurred())
+				for _, image := range snapshot.Images {
+					if strings.HasPrefix(image.ID, "image-") {
+						Expect(snapshot.VolumeIDs).To(ContainElement(strings.TrimPrefix(image.ID, "image-")))
+					}
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		})
 
+		Context("when the volumes cannot be listed", func() {
 			BeforeEach(func() {
-				imagePath = "/tmp/not-here"
+				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName))).To(Succeed())
 			})
 
 			It("returns an error", func() {
-				_, err := driver.FetchStats(logger, imagePath)
-				Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("image path (%s) doesn't exist", imagePath))))
+				_, err := driver.StoreSnapshot(logger)
+				Expect(err).To(MatchError(ContainSubstring("failed to list volumes")))
 			})
 		})
+	})
 
-		Context("when the path doesn't have a quota", func() {
-			BeforeEach(func() {
-				tmpDir, err := ioutil.TempDir(filepath.Join(storePath, store.ImageDirName), "")
-				Expect(err).NotTo(HaveOccurred())
-				spec.DiskLimit = 0
-				spec.ImagePath = tmpDir
-				_, err = driver.CreateImage(logger, spec)
-				Expect(err).ToNot(HaveOccurred())
-			})
+	Describe("OrphanVolumes", func() {
+		var (
+			mountedVolumeID   string
+			unmountedVolumeID string
+			orphanVolumeID    string
+		)
 
-			It("returns the exclusive bytes used as 0", func() {
-				volumeStats, err := driver.FetchStats(logger, spec.ImagePath)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(volumeStats.DiskUsage.ExclusiveBytesUsed).To(Equal(int64(0)))
-				Expect(volumeStats.DiskUsage.TotalBytesUsed).To(BeNumerically("~", 3000000, 100))
+		BeforeEach(func() {
+			mountedVolumeID = randVolumeID() + "-mounted"
+			createVolume(storePath, driver, "", mountedVolumeID, 1000)
+			unmountedVolumeID = randVolumeID() + "-unmounted"
+			createVolume(storePath, driver, "", unmountedVolumeID, 1000)
+			orphanVolumeID = randVolumeID() + "-orphan"
+			createVolume(storePath, driver, "", orphanVolumeID, 1000)
+
+			spec.BaseVolumeIDs = []string{mountedVolumeID}
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
+
+			unmountedImagePath := filepath.Join(storePath, store.ImageDirName, "unmounted-image")
+			Expect(os.Mkdir(unmountedImagePath, 0755)).To(Succeed())
+			_, err = driver.CreateImage(logger, image_manager.ImageDriverSpec{
+				ImagePath:     unmountedImagePath,
+				BaseVolumeIDs: []string{unmountedVolumeID},
 			})
+			Expect(err).NotTo(HaveOccurred())
 		})
 
-		Context("when the path doesn't have an `image_info` file", func() {
+		It("returns only the volumes not referenced by any image", func() {
+			orphans, err := driver.OrphanVolumes(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orphans).To(ConsistOf(orphanVolumeID))
+		})
+
+		It("does not delete any volume", func() {
+			_, err := driver.OrphanVolumes(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(storePath, store.VolumesDirName, orphanVolumeID)).To(BeADirectory())
+		})
+
+		Context("when a volume is only referenced by a mount", func() {
+			var mountInfoPath string
+
 			BeforeEach(func() {
-				Expect(os.Remove(filepath.Join(spec.ImagePath, "image_info"))).To(Succeed())
-			})
+				shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, orphanVolumeID))
+				Expect(err).NotTo(HaveOccurred())
 
-			It("returns an error", func() {
-				_, err := driver.FetchStats(logger, spec.ImagePath)
-				Expect(err).To(MatchError(ContainSubstring("reading image info")))
+				mountInfo, err := ioutil.TempFile("", "mountinfo")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = fmt.Fprintf(mountInfo,
+					"100 20 0:50 / %s rw,relatime - overlay overlay rw,lowerdir=%s,upperdir=/upper,workdir=/work\n",
+					filepath.Join(storePath, store.ImageDirName, "other-image", overlayxfs.RootfsDir),
+					filepath.Join(overlayxfs.LinksDirName, string(shortID)),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountInfo.Close()).To(Succeed())
+
+				mountInfoPath = mountInfo.Name()
+				driver.WithMountInfoPath(mountInfoPath)
 			})
-		})
 
-		Context("when it fails to fetch XFS project ID", func() {
-			It("returns an error", func() {
-				_, err := driver.FetchStats(logger, "/proc")
-				Expect(err).To(MatchError(ContainSubstring("inappropriate ioctl for device")))
+			AfterEach(func() {
+				Expect(os.Remove(mountInfoPath)).To(Succeed())
 			})
-		})
-	})
 
-	Describe("VolumePath", func() {
-		BeforeEach(func() {
-			Expect(os.MkdirAll(filepath.Join(storePath, store.VolumesDirName, randomID), 0755)).To(Succeed())
+			It("does not report it as orphan", func() {
+				orphans, err := driver.OrphanVolumes(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(orphans).To(BeEmpty())
+			})
 		})
 
-		It("returns the volume path when it exists", func() {
-			retVolPath, err := driver.VolumePath(logger, randomID)
-			Expect(err).NotTo(HaveOccurred())
-			Expect(retVolPath).To(Equal(filepath.Join(storePath, store.VolumesDirName, randomID)))
-		})
+		Context("when an image metadata file is corrupt", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(spec.ImagePath, "metadata.json"), []byte("{not-json"), 0600)).To(Succeed())
+			})
 
-		Context("when the volume does not exist", func() {
 			It("returns an error", func() {
-				_, err := driver.VolumePath(logger, "non-existent-id")
-				Expect(err).To(MatchError(ContainSubstring("volume does not exist")))
+				_, err := driver.OrphanVolumes(logger)
+				Expect(err).To(MatchError(ContainSubstring("decoding image metadata")))
 			})
 		})
 	})
 
-	Describe("ConfigureStore", func() {
-		const (
-			currentUID = 2001
-			currentGID = 2002
-		)
-
+	Describe("GCReasons", func() {
 		var (
-			backingStorePath string
+			keptVolumeID       string
+			referencedVolumeID string
+			orphanVolumeID     string
 		)
 
 		BeforeEach(func() {
-			var err error
-			storePath, err = ioutil.TempDir(storePath, "configure-store-test")
-			Expect(err).ToNot(HaveOccurred())
-
-			backingStoreFile, err := ioutil.TempFile(storePath, "backing-store-test")
-			Expect(err).ToNot(HaveOccurred())
-
-			backingStorePath = backingStoreFile.Name()
+			keptVolumeID = randVolumeID() + "-kept"
+			createVolume(storePath, driver, "", keptVolumeID, 1000)
+			referencedVolumeID = randVolumeID() + "-referenced"
+			createVolume(storePath, driver, "", referencedVolumeID, 1000)
+			orphanVolumeID = randVolumeID() + "-orphan"
+			createVolume(storePath, driver, "", orphanVolumeID, 1000)
+			createVolume(storePath, driver, "", "gc."+randVolumeID(), 1000)
+
+			spec.BaseVolumeIDs = []string{referencedVolumeID}
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
 		})
 
-		It("creates a links directory", func() {
-			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
-			stat, err := os.Stat(filepath.Join(storePath, overlayxfs.LinksDirName))
+		It("reports the volumes in the keep list", func() {
+			reasons, err := driver.GCReasons(logger, []string{keptVolumeID})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(stat.IsDir()).To(BeTrue())
-			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(currentUID)))
-			Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(currentGID)))
+			Expect(reasons).To(HaveKeyWithValue(keptVolumeID, overlayxfs.GCReasonInKeepList))
 		})
 
-		It("creates a whiteout device", func() {
-			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
+		It("reports the volumes an image is based on along with the image", func() {
+			reasons, err := driver.GCReasons(logger, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reasons).To(HaveKeyWithValue(referencedVolumeID, "referenced-by-image-"+filepath.Base(spec.ImagePath)))
+		})
 
-			stat, err := os.Stat(filepath.Join(storePath, overlayxfs.WhiteoutDevice))
+		It("does not report the volumes that would be collected", func() {
+			reasons, err := driver.GCReasons(logger, []string{keptVolumeID})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(stat.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(currentUID)))
-			Expect(stat.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(currentGID)))
+			Expect(reasons).To(HaveLen(2))
+			Expect(reasons).NotTo(HaveKey(orphanVolumeID))
 		})
 
-		It("enables direct IO on the loopback device", func() {
-			Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
-			Expect(directIO.ConfigureCallCount()).To(Equal(1))
-			actualDirectIOPath := directIO.ConfigureArgsForCall(0)
-			Expect(actualDirectIOPath).To(Equal(backingStorePath))
-		})
+		Context("when a volume is only referenced by a mount", func() {
+			var mountInfoPath string
 
-		Context("when the backing store path does not exist", func() {
 			BeforeEach(func() {
-				Expect(os.Remove(backingStorePath)).To(Succeed())
-			})
+				shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, orphanVolumeID))
+				Expect(err).NotTo(HaveOccurred())
 
-			It("does not attempt to configure direct io", func() {
-				Expect(driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)).To(Succeed())
-				Expect(directIO.ConfigureCallCount()).To(Equal(0))
+				mountInfo, err := ioutil.TempFile("", "mountinfo")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = fmt.Fprintf(mountInfo,
+					"100 20 0:50 / %s rw,relatime - overlay overlay rw,lowerdir=%s,upperdir=/upper,workdir=/work\n",
+					filepath.Join(storePath, store.ImageDirName, "other-image", overlayxfs.RootfsDir),
+					filepath.Join(overlayxfs.LinksDirName, string(shortID)),
+				)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mountInfo.Close()).To(Succeed())
+
+				mountInfoPath = mountInfo.Name()
+				driver.WithMountInfoPath(mountInfoPath)
 			})
-		})
 
-		Context("when the whiteout 'device' is not a device", func() {
-			BeforeEach(func() {
-				Expect(os.MkdirAll(storePath, 0755)).To(Succeed())
-				Expect(ioutil.WriteFile(filepath.Join(storePath, overlayxfs.WhiteoutDevice), []byte{}, 0755)).To(Succeed())
+			AfterEach(func() {
+				Expect(os.Remove(mountInfoPath)).To(Succeed())
 			})
 
-			It("returns an error", func() {
-				err := driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)
-				Expect(err).To(MatchError(ContainSubstring("the whiteout device file is not a valid device")))
+			It("reports the mounted image", func() {
+				reasons, err := driver.GCReasons(logger, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reasons).To(HaveKeyWithValue(orphanVolumeID, "referenced-by-image-other-image"))
 			})
 		})
 
-		Context("when enabling direct IO fails", func() {
-			BeforeEach(func() {
-				directIO.ConfigureReturns(errors.New("lo-error"))
-			})
+		Context("when there are staging volumes", func() {
+			It("reports only the ones younger than the grace period", func() {
+				createVolume(storePath, driver, "", "layer-incomplete-1-2", 10)
+				abandonedVolumePath := createVolume(storePath, driver, "", "layer-incomplete-3-4", 10)
+				longAgo := time.Now().Add(-2 * overlayxfs.DefaultStagingGracePeriod)
+				Expect(os.Chtimes(abandonedVolumePath, longAgo, longAgo)).To(Succeed())
 
-			It("returns the error", func() {
-				err := driver.ConfigureStore(logger, storePath, backingStorePath, currentUID, currentGID)
-				Expect(err).To(MatchError(ContainSubstring("lo-error")))
+				reasons, err := driver.GCReasons(logger, nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reasons).To(HaveKeyWithValue("layer-incomplete-1-2", overlayxfs.GCReasonTooRecent))
+				Expect(reasons).NotTo(HaveKey("layer-incomplete-3-4"))
 			})
 		})
 	})
 
-	Describe("ValidateFileSystem", func() {
-		Context("when storepath is a XFS mount", func() {
-			It("returns no error", func() {
-				Expect(driver.ValidateFileSystem(logger, storePath)).To(Succeed())
-			})
+	Describe("ImagesWithDeletedLowers", func() {
+		var mountInfoPath string
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 1000)
+			shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, volumeID))
+			Expect(err).NotTo(HaveOccurred())
+			lowerDir := filepath.Join(overlayxfs.LinksDirName, string(shortID))
+
+			mountInfo, err := ioutil.TempFile("", "mountinfo")
+			Expect(err).NotTo(HaveOccurred())
+			for imageID, lowerDirs := range map[string]string{
+				"healthy-image": lowerDir,
+				"deleted-image": lowerDir + ":" + filepath.Join(storePath, store.VolumesDirName, "gone") + `\040(deleted)`,
+				"missing-image": filepath.Join(overlayxfs.LinksDirName, "missing") + ":" + lowerDir,
+			} {
+				_, err = fmt.Fprintf(mountInfo,
+					"100 20 0:50 / %s rw,relatime - overlay overlay rw,lowerdir=%s,upperdir=/upper,workdir=/work\n",
+					filepath.Join(storePath, store.ImageDirName, imageID, overlayxfs.RootfsDir), lowerDirs,
+				)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(mountInfo.Close()).To(Succeed())
+
+			mountInfoPath = mountInfo.Name()
+			driver.WithMountInfoPath(mountInfoPath)
 		})
 
-		Context("when storepath is not a XFS mount", func() {
-			It("returns an error", func() {
-				err := driver.ValidateFileSystem(logger, "/mnt/ext4")
-				Expect(err).To(MatchError(ContainSubstring("Store path filesystem (/mnt/ext4) is incompatible with native driver (must be XFS mountpoint)")))
-			})
+		AfterEach(func() {
+			Expect(os.Remove(mountInfoPath)).To(Succeed())
+		})
+
+		It("returns the images with a lowerdir marked as deleted or missing", func() {
+			imageIDs, err := driver.ImagesWithDeletedLowers(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(imageIDs).To(Equal([]string{"deleted-image", "missing-image"}))
 		})
 	})
 
-	Describe("CreateVolume", func() {
-		It("creates a volume", func() {
-			expectedVolumePath := filepath.Join(storePath, store.VolumesDirName, randomID)
-			Expect(expectedVolumePath).NotTo(BeAnExistingFile())
+	Describe("ExportDiff", func() {
+		var rootfsPath string
+
+		BeforeEach(func() {
+			volumeID := randVolumeID()
+			volumePath := createVolume(storePath, driver, "", volumeID, 1000)
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "file-hello"), []byte("hello"), 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(volumePath, "a-folder"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(volumePath, "a-folder", "folder-file"), []byte("in-a-folder"), 0644)).To(Succeed())
 
-			volumePath, err := driver.CreateVolume(logger, "parent-id", randomID)
+			spec.BaseVolumeIDs = []string{volumeID}
+			_, err := driver.CreateImage(logger, spec)
 			Expect(err).NotTo(HaveOccurred())
+			rootfsPath = filepath.Join(spec.ImagePath, overlayxfs.RootfsDir)
+		})
 
-			Expect(expectedVolumePath).To(BeADirectory())
-			Expect(volumePath).To(Equal(expectedVolumePath))
+		readDiff := func() map[string]string {
+			diff, err := driver.ExportDiff(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			defer diff.Close()
+
+			entries := map[string]string{}
+			tarReader := tar.NewReader(diff)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				contents, err := ioutil.ReadAll(tarReader)
+				Expect(err).NotTo(HaveOccurred())
+				entries[header.Name] = string(contents)
+			}
+			return entries
+		}
 
-			linkFile := filepath.Join(storePath, overlayxfs.LinksDirName, randomID)
-			_, err = os.Stat(linkFile)
-			Expect(err).ToNot(HaveOccurred(), "volume link file has not been created")
+		It("exports the files written to the image", func() {
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "new-file"), []byte("new"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "a-folder", "folder-file"), []byte("changed"), 0644)).To(Succeed())
 
-			linkName, err := ioutil.ReadFile(linkFile)
-			Expect(err).ToNot(HaveOccurred(), "failed to read volume link file")
+			Expect(readDiff()).To(Equal(map[string]string{
+				"new-file":             "new",
+				"a-folder/":            "",
+				"a-folder/folder-file": "changed",
+			}))
+		})
 
-			link := filepath.Join(storePath, overlayxfs.LinksDirName, string(linkName))
-			linkStat, err := os.Lstat(link)
-			Expect(err).ToNot(HaveOccurred())
-			Expect(linkStat.Mode()&os.ModeSymlink).ToNot(
-				BeZero(),
-				fmt.Sprintf("Volume link %s is not a symlink", link),
-			)
-			Expect(os.Readlink(link)).To(Equal(volumePath), "Volume link does not point to volume")
+		It("exports deleted files as whiteouts", func() {
+			Expect(os.Remove(filepath.Join(rootfsPath, "file-hello"))).To(Succeed())
+
+			Expect(readDiff()).To(Equal(map[string]string{".wh.file-hello": ""}))
 		})
 
-		Context("when volume dir doesn't exist", func() {
-			BeforeEach(func() {
-				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName))).To(Succeed())
-			})
+		It("exports directories replacing a lower one as opaque", func() {
+			Expect(os.RemoveAll(filepath.Join(rootfsPath, "a-folder"))).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(rootfsPath, "a-folder"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "a-folder", "other-file"), []byte("other"), 0644)).To(Succeed())
 
-			It("returns an error", func() {
-				_, err := driver.CreateVolume(logger, "parent-id", randomID)
-				Expect(err).To(MatchError(ContainSubstring("creating volume")))
-			})
+			Expect(readDiff()).To(Equal(map[string]string{
+				"a-folder/":             "",
+				"a-folder/.wh..wh..opq": "",
+				"a-folder/other-file":   "other",
+			}))
 		})
 
-		Context("when volume already exists", func() {
+		It("stops producing the diff once closed", func() {
+			Expect(ioutil.WriteFile(filepath.Join(rootfsPath, "big-file"), make([]byte, 10*1024*1024), 0644)).To(Succeed())
+
+			diff, err := driver.ExportDiff(logger, spec.ImagePath)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tar.NewReader(diff).Next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(diff.Close()).To(Succeed())
+		})
+
+		Context("when the image is read-only", func() {
 			BeforeEach(func() {
-				Expect(os.Mkdir(filepath.Join(storePath, store.VolumesDirName, randomID), 0755)).To(Succeed())
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
+				Expect(os.Mkdir(spec.ImagePath, 0755)).To(Succeed())
+				spec.ReadOnly = true
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				// Bind mounts are not overlay mounts, which the suite cleans up
+				Expect(driver.DestroyImage(logger, spec.ImagePath)).To(Succeed())
 			})
 
 			It("returns an error", func() {
-				_, err := driver.CreateVolume(logger, "parent-id", randomID)
-				Expect(err).To(MatchError(ContainSubstring("creating volume")))
+				_, err := driver.ExportDiff(logger, spec.ImagePath)
+				Expect(err).To(MatchError("read-only images have no diff"))
 			})
 		})
 	})
 
-	Describe("Volumes", func() {
-		var volumesPath string
+	Describe("ValidateImage", func() {
+		var volumeIDs []string
+
 		BeforeEach(func() {
-			volumesPath = filepath.Join(storePath, store.VolumesDirName)
-			Expect(os.Mkdir(filepath.Join(volumesPath, "sha256:vol-a"), 0777)).To(Succeed())
-			Expect(os.Mkdir(filepath.Join(volumesPath, "sha256:vol-b"), 0777)).To(Succeed())
+			volumeIDs = []string{randVolumeID(), randVolumeID(), randVolumeID()}
+			for _, id := range volumeIDs {
+				createVolume(storePath, driver, "", id, 1000)
+			}
+
+			spec.BaseVolumeIDs = volumeIDs
+			spec.Mount = false
+			_, err := driver.CreateImage(logger, spec)
+			Expect(err).NotTo(HaveOccurred())
 		})
 
-		AfterEach(func() {
-			Expect(os.RemoveAll(volumesPath)).To(Succeed())
+		It("succeeds when all the base volumes are present", func() {
+			Expect(driver.ValidateImage(logger, spec.ImagePath)).To(Succeed())
 		})
 
-		It("returns a list with existing volumes id", func() {
-			volumes, err := driver.Volumes(logger)
-			Expect(err).NotTo(HaveOccurred())
-			Expect(len(volumes)).To(Equal(2), "incorrect number of volumes")
-			Expect(volumes).To(ContainElement("sha256:vol-a"))
-			Expect(volumes).To(ContainElement("sha256:vol-b"))
+		Context("when base volumes are gone", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName, volumeIDs[0]))).To(Succeed())
+				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName, volumeIDs[2]))).To(Succeed())
+			})
+
+			It("returns the missing volumes", func() {
+				err := driver.ValidateImage(logger, spec.ImagePath)
+				var missingErr *overlayxfs.MissingVolumesError
+				Expect(errors.As(err, &missingErr)).To(BeTrue())
+				Expect(missingErr.ImagePath).To(Equal(spec.ImagePath))
+				Expect(missingErr.VolumeIDs).To(Equal([]string{volumeIDs[0], volumeIDs[2]}))
+			})
 		})
 
-		Context("when fails to list volumes", func() {
+		Context("when the link of a base volume is gone", func() {
+			BeforeEach(func() {
+				shortID, err := ioutil.ReadFile(filepath.Join(storePath, overlayxfs.LinksDirName, volumeIDs[1]))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.Remove(filepath.Join(storePath, overlayxfs.LinksDirName, string(shortID)))).To(Succeed())
+			})
+
+			It("returns the volume as missing", func() {
+				err := driver.ValidateImage(logger, spec.ImagePath)
+				var missingErr *overlayxfs.MissingVolumesError
+				Expect(errors.As(err, &missingErr)).To(BeTrue())
+				Expect(missingErr.VolumeIDs).To(Equal([]string{volumeIDs[1]}))
+			})
+		})
+
+		Context("when the image has no metadata", func() {
 			It("returns an error", func() {
-				Expect(os.RemoveAll(filepath.Join(storePath, store.VolumesDirName))).To(Succeed())
-				_, err := driver.Volumes(logger)
-				Expect(err).To(MatchError(ContainSubstring("failed to list volumes")))
+				Expect(driver.ValidateImage(logger, filepath.Join(storePath, store.ImageDirName, "not-an-image"))).To(MatchError(ContainSubstring("reading image metadata")))
 			})
 		})
 	})
@@ -1325,6 +6890,15 @@ var _ = Describe("Driver", func() {
 		})
 	})
 
+	Describe("ImagePaths", func() {
+		It("returns the directories of the image", func() {
+			paths := driver.ImagePaths(spec.ImagePath)
+			Expect(paths.Rootfs).To(Equal(filepath.Join(spec.ImagePath, "rootfs")))
+			Expect(paths.UpperDir).To(Equal(filepath.Join(spec.ImagePath, "diff")))
+			Expect(paths.WorkDir).To(Equal(filepath.Join(spec.ImagePath, "workdir")))
+		})
+	})
+
 	Describe("WriteVolumeMeta", func() {
 		It("creates the correct metadata file", func() {
 			err := driver.WriteVolumeMeta(logger, "1234", base_image_puller.VolumeMeta{Size: kb})
@@ -1341,6 +6915,50 @@ var _ = Describe("Driver", func() {
 		})
 	})
 
+	Describe("ReadVolumeMeta", func() {
+		var volumeID string
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000)
+		})
+
+		It("returns the metadata written for the volume", func() {
+			createdAt := time.Now().UTC().Truncate(time.Second)
+			written := base_image_puller.VolumeMeta{Size: 4000, OriginDigest: "sha256:layer", CreatedAt: createdAt}
+			Expect(driver.WriteVolumeMeta(logger, volumeID, written)).To(Succeed())
+
+			metadata, err := driver.ReadVolumeMeta(logger, volumeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata).To(Equal(written))
+		})
+
+		It("is not listed as a volume", func() {
+			volumes, err := driver.Volumes(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumes).To(ConsistOf(volumeID))
+		})
+
+		It("is removed with the volume", func() {
+			Expect(driver.DestroyVolume(logger, volumeID)).To(Succeed())
+
+			_, err := driver.ReadVolumeMeta(logger, volumeID)
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		Context("when the metadata does not match its checksum", func() {
+			BeforeEach(func() {
+				Expect(driver.WriteVolumeMeta(logger, volumeID, base_image_puller.VolumeMeta{Size: 4000})).To(Succeed())
+				tamperWith(volumeMetaPath(storePath, volumeID), `"Size":4000`, `"Size":1`)
+			})
+
+			It("returns an error", func() {
+				_, err := driver.ReadVolumeMeta(logger, volumeID)
+				Expect(err).To(MatchError(ContainSubstring(volumeID)))
+			})
+		})
+	})
+
 	Describe("VolumeSize", func() {
 		var (
 			volumeID string
@@ -1350,7 +6968,7 @@ var _ = Describe("Driver", func() {
 
 		BeforeEach(func() {
 			volumeID = randVolumeID()
-			createVolume(storePath, driver, "parent-id", volumeID, 3000)
+			createVolume(storePath, driver, "", volumeID, 3000)
 		})
 
 		JustBeforeEach(func() {
@@ -1371,6 +6989,144 @@ var _ = Describe("Driver", func() {
 				Expect(os.IsNotExist(sizeErr)).To(BeTrue())
 			})
 		})
+
+		Context("when the metadata has a checksum", func() {
+			BeforeEach(func() {
+				Expect(driver.WriteVolumeMeta(logger, volumeID, base_image_puller.VolumeMeta{Size: 4000})).To(Succeed())
+				Expect(ioutil.ReadFile(volumeMetaPath(storePath, volumeID))).To(ContainSubstring(`"sha256":`))
+			})
+
+			It("returns the volume size", func() {
+				Expect(sizeErr).NotTo(HaveOccurred())
+				Expect(size).To(BeEquivalentTo(4000))
+			})
+
+			Context("and the metadata was tampered with", func() {
+				BeforeEach(func() {
+					tamperWith(volumeMetaPath(storePath, volumeID), `"Size":4000`, `"Size":5000`)
+				})
+
+				It("returns ErrMetadataCorrupt", func() {
+					Expect(errors.Is(sizeErr, overlayxfs.ErrMetadataCorrupt)).To(BeTrue())
+				})
+			})
+		})
+	})
+
+	Describe("RepairMetadata", func() {
+		var volumeID string
+
+		BeforeEach(func() {
+			volumeID = randVolumeID()
+			createVolume(storePath, driver, "", volumeID, 3000)
+			spec.BaseVolumeIDs = []string{volumeID}
+		})
+
+		It("adds the missing checksums", func() {
+			repaired, err := driver.RepairMetadata(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(repaired).To(ContainElement(volumeMetaPath(storePath, volumeID)))
+			Expect(ioutil.ReadFile(volumeMetaPath(storePath, volumeID))).To(ContainSubstring(`"sha256":`))
+			Expect(driver.VolumeSize(logger, volumeID)).To(BeEquivalentTo(3000))
+		})
+
+		Context("when the volume metadata was tampered with", func() {
+			BeforeEach(func() {
+				Expect(driver.WriteVolumeMeta(logger, volumeID, base_image_puller.VolumeMeta{Size: 3000})).To(Succeed())
+				tamperWith(volumeMetaPath(storePath, volumeID), `"Size":3000`, `"Size":1`)
+			})
+
+			It("measures the volume again", func() {
+				_, err := driver.RepairMetadata(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(driver.VolumeSize(logger, volumeID)).To(BeNumerically(">=", 3000))
+			})
+		})
+
+		Context("when the metadata of a mounted image was tampered with", func() {
+			It("recovers the base volumes from the mount", func() {
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				metadataPath := filepath.Join(spec.ImagePath, "metadata.json")
+				tamperWith(metadataPath, volumeID, "garbage")
+
+				_, err = driver.ImageAnnotations(logger, spec.ImagePath)
+				Expect(errors.Is(err, overlayxfs.ErrMetadataCorrupt)).To(BeTrue())
+
+				repaired, err := driver.RepairMetadata(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(repaired).To(ContainElement(metadataPath))
+
+				contents, err := ioutil.ReadFile(metadataPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(ContainSubstring(fmt.Sprintf(`"base_volume_ids":["%s"]`, volumeID)))
+				Expect(driver.ImageAnnotations(logger, spec.ImagePath)).To(BeEmpty())
+			})
+		})
+
+		Context("when the metadata of an unmounted image was tampered with", func() {
+			It("returns an error naming the image", func() {
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				tamperWith(filepath.Join(spec.ImagePath, "metadata.json"), volumeID, "garbage")
+
+				_, err = driver.RepairMetadata(logger)
+				Expect(err).To(MatchError(ContainSubstring(filepath.Base(spec.ImagePath))))
+			})
+
+			It("quarantines the image when quarantining is enabled", func() {
+				driver = driver.WithQuarantine(true)
+				spec.Mount = false
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				tamperWith(filepath.Join(spec.ImagePath, "metadata.json"), volumeID, "garbage")
+
+				_, err = driver.RepairMetadata(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(driver.ListQuarantined(logger)).To(Equal([]string{filepath.Base(spec.ImagePath)}))
+			})
+		})
+
+		Context("when the metadata of a mounted read-only image was tampered with", func() {
+			It("keeps the image read-only", func() {
+				otherVolumeID := randVolumeID()
+				createVolume(storePath, driver, "", otherVolumeID, 3000)
+				spec.BaseVolumeIDs = []string{volumeID, otherVolumeID}
+				spec.ReadOnly = true
+				spec.MountSource = "read-only-image"
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				metadataPath := filepath.Join(spec.ImagePath, "metadata.json")
+				tamperWith(metadataPath, volumeID, "garbage")
+
+				_, err = driver.RepairMetadata(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(metadataPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(ContainSubstring(fmt.Sprintf(`"base_volume_ids":["%s","%s"]`, volumeID, otherVolumeID)))
+				Expect(string(contents)).To(ContainSubstring(`"read_only":true`))
+				Expect(string(contents)).To(ContainSubstring(`"mount_source":"read-only-image"`))
+			})
+		})
+
+		Context("when the metadata of a mounted image with protected paths was tampered with", func() {
+			It("does not repair it", func() {
+				volumePath := filepath.Join(storePath, store.VolumesDirName, volumeID)
+				Expect(ioutil.WriteFile(filepath.Join(volumePath, "protected"), []byte("protected"), 0644)).To(Succeed())
+				spec.ProtectedPaths = []string{"/protected"}
+				_, err := driver.CreateImage(logger, spec)
+				Expect(err).NotTo(HaveOccurred())
+				tamperWith(filepath.Join(spec.ImagePath, "metadata.json"), volumeID, "garbage")
+
+				_, err = driver.RepairMetadata(logger)
+				Expect(err).To(MatchError(ContainSubstring(filepath.Base(spec.ImagePath))))
+
+				// The binds are not overlay mounts, which the suite cleans up
+				Expect(unix.Unmount(filepath.Join(spec.ImagePath, overlayxfs.RootfsDir, "protected"), 0)).To(Succeed())
+			})
+		})
 	})
 
 	Describe("GenerateVolumeMeta", func() {
@@ -1395,7 +7151,7 @@ var _ = Describe("Driver", func() {
 
 		Context("when the volume exists", func() {
 			BeforeEach(func() {
-				createVolume(storePath, driver, "parent-id", volumeID, 3000)
+				createVolume(storePath, driver, "", volumeID, 3000)
 			})
 
 			It("succeeds", func() {
@@ -1457,6 +7213,50 @@ func createVolume(storePath string, driver *overlayxfs.Driver, parentID, id stri
 	return path
 }
 
+func layerTarball(files map[string]string, gzipped bool) []byte {
+	buffer := new(bytes.Buffer)
+	var writer io.Writer = buffer
+	var gzipWriter *gzip.Writer
+	if gzipped {
+		gzipWriter = gzip.NewWriter(buffer)
+		writer = gzipWriter
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	for name, contents := range files {
+		Expect(tarWriter.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+		})).To(Succeed())
+		_, err := tarWriter.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tarWriter.Close()).To(Succeed())
+
+	if gzipped {
+		Expect(gzipWriter.Close()).To(Succeed())
+	}
+
+	return buffer.Bytes()
+}
+
+// eofHook calls onEOF, once, when its reader is exhausted.
+type eofHook struct {
+	io.Reader
+	onEOF func()
+}
+
+func (h *eofHook) Read(p []byte) (int, error) {
+	n, err := h.Reader.Read(p)
+	if err == io.EOF && h.onEOF != nil {
+		h.onEOF()
+		h.onEOF = nil
+	}
+	return n, err
+}
+
 func ensureQuotaMatches(fileName string, expectedQuota int64) {
 	Expect(fileName).To(BeAnExistingFile())
 
@@ -1524,3 +7324,11 @@ func getUidAndGid(fileInfo os.FileInfo) (int, int) {
 
 	return int(unixFileInfo.Uid), int(unixFileInfo.Gid)
 }
+
+// tamperWith changes a metadata file behind the back of its checksum.
+func tamperWith(path, old, new string) {
+	contents, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(string(contents)).To(ContainSubstring(old))
+	Expect(ioutil.WriteFile(path, []byte(strings.Replace(string(contents), old, new, 1)), 0644)).To(Succeed())
+}
@@ -0,0 +1,177 @@
+package overlayxfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+)
+
+// ExportDiff streams what was written to the image as a tar layer, e.g. to
+// commit it as a base volume. Deleted paths, which overlay records as
+// whiteout devices and opaque directories, are exported as OCI whiteouts.
+// The tar is produced as it is read, and reading stops it.
+//
+// Images mounted with redirect_dir or metacopy cannot be exported, as their
+// upperdir refers to the lower layers.
+func (d *Driver) ExportDiff(logger lager.Logger, imagePath string) (io.ReadCloser, error) {
+	logger = logger.Session("overlayxfs-exporting-diff", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return nil, err
+	}
+	if metadata.ReadOnly {
+		return nil, errorspkg.New("read-only images have no diff")
+	}
+	for _, option := range []string{"redirect_dir=on", "metacopy=on"} {
+		if containsString(metadata.MountOptions, option) {
+			return nil, errorspkg.Errorf("images mounted with %s cannot be exported", option)
+		}
+	}
+
+	upperDir, _ := overlayUpperDirs(imagePath, metadata.UpperDevicePath)
+	if _, err := os.Stat(upperDir); err != nil {
+		return nil, errorspkg.Wrap(err, "stat upperdir")
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := writeDiff(upperDir, writer)
+		if err != nil && err != io.ErrClosedPipe {
+			logger.Error("writing-diff-failed", err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader, nil
+}
+
+func writeDiff(upperDir string, writer io.Writer) error {
+	tarWriter := tar.NewWriter(writer)
+	// Hard links of the upperdir are exported as links to their first path
+	links := map[uint64]string{}
+
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upperDir {
+			return nil
+		}
+
+		name, err := filepath.Rel(upperDir, path)
+		if err != nil {
+			return err
+		}
+
+		if isWhiteout(info) {
+			return tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(name), whiteoutPrefix+info.Name()),
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+			})
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errorspkg.Wrapf(err, "creating tar header for %s", name)
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := links[stat.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[stat.Ino] = name
+			}
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			opaque, err := isOpaque(path)
+			if err != nil {
+				return err
+			}
+			if opaque {
+				return tarWriter.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     filepath.Join(name, opaqueWhiteout),
+					Mode:     0600,
+					ModTime:  info.ModTime(),
+				})
+			}
+			return nil
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+// isWhiteout tells whether the file is how overlay records a deleted path: a
+// character device with device number 0/0.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(dir string) (bool, error) {
+	value := make([]byte, 1)
+	size, err := unix.Lgetxattr(dir, opaqueXattr, value)
+	if err != nil {
+		if err == unix.ENODATA || err == unix.ENOTSUP || err == unix.ERANGE {
+			return false, nil
+		}
+		return false, errorspkg.Wrapf(err, "reading opaque xattr of %s", dir)
+	}
+	return size == 1 && value[0] == 'y', nil
+}
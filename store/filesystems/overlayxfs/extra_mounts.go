@@ -0,0 +1,179 @@
+package overlayxfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/store/image_manager"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var ErrMountDestinationOutsideRootfs = errorspkg.New("mount destination is outside of the rootfs")
+
+// checkExtraMounts refuses the mounts of the spec that cannot be mounted
+// before anything is created. Symlinks are only checked when mounting, as
+// the image is not there yet.
+func checkExtraMounts(rootfsDir string, mounts []image_manager.Mount) error {
+	for _, mount := range mounts {
+		if !filepath.IsAbs(mount.Source) {
+			return errorspkg.Errorf("mount source %s is not absolute", mount.Source)
+		}
+		if !isWithinDir(rootfsDir, filepath.Join(rootfsDir, mount.Destination)) {
+			return errorspkg.Wrapf(ErrMountDestinationOutsideRootfs, "destination %s", mount.Destination)
+		}
+	}
+
+	return nil
+}
+
+// mountExtraMounts bind mounts the extra mounts into the rootfs, creating
+// their destinations if needed. The ones already mounted are unmounted if
+// one fails.
+func (d *Driver) mountExtraMounts(logger lager.Logger, rootfsDir string, mounts []image_manager.Mount) error {
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	logger = logger.Session("mounting-extra-mounts", lager.Data{"rootfsDir": rootfsDir, "mounts": mounts})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	for i, mount := range mounts {
+		if err := d.mountExtraMount(logger, rootfsDir, mount); err != nil {
+			logger.Error("mounting-extra-mount-failed", err, lager.Data{"destination": mount.Destination})
+			d.unmountExtraMounts(logger, rootfsDir, mounts[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) mountExtraMount(logger lager.Logger, rootfsDir string, mount image_manager.Mount) error {
+	sourceInfo, err := os.Stat(mount.Source)
+	if err != nil {
+		return errorspkg.Wrapf(err, "mount source %s", mount.Source)
+	}
+
+	target, err := createMountDestination(rootfsDir, mount.Destination, sourceInfo.IsDir())
+	if err != nil {
+		return err
+	}
+
+	if err := d.mounter.Mount(logger, mount.Source, target, "", unix.MS_BIND, ""); err != nil {
+		return errorspkg.Wrapf(err, "bind mounting %s to %s", mount.Source, mount.Destination)
+	}
+
+	if mount.ReadOnly {
+		if err := d.mounter.Mount(logger, "", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			if unmountErr := d.unmounter.Unmount(logger, target, 0); unmountErr != nil {
+				logger.Error("cleaning-up-mount-failed", unmountErr)
+			}
+			return errorspkg.Wrapf(err, "making mount %s read-only", mount.Destination)
+		}
+	}
+
+	return nil
+}
+
+// createMountDestination creates the destination of a mount in the rootfs,
+// refusing symlinks that lead out of it, as the bind would then cover a path
+// of the host.
+func createMountDestination(rootfsDir, destination string, isDir bool) (string, error) {
+	resolvedRootfs, err := filepath.EvalSymlinks(rootfsDir)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "resolving rootfs path")
+	}
+
+	// Nothing is created before the existing part of the destination is
+	// known to be in the rootfs
+	target := filepath.Join(rootfsDir, destination)
+	existing := target
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == rootfsDir || existing == filepath.Dir(existing) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if err := checkResolvesWithin(resolvedRootfs, existing, destination); err != nil {
+		return "", err
+	}
+
+	if isDir {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644); err == nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return "", errorspkg.Wrapf(err, "creating mount destination %s", destination)
+	}
+
+	if err := checkResolvesWithin(resolvedRootfs, target, destination); err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(target)
+}
+
+func checkResolvesWithin(resolvedRootfs, path, destination string) error {
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return errorspkg.Wrapf(err, "resolving mount destination %s", destination)
+	}
+	if !isWithinDir(resolvedRootfs, resolvedPath) && resolvedPath != resolvedRootfs {
+		return errorspkg.Wrapf(ErrMountDestinationOutsideRootfs, "destination %s resolves to %s", destination, resolvedPath)
+	}
+
+	return nil
+}
+
+// unmountExtraMounts unmounts the extra mounts in reverse order, so that
+// the rootfs is not kept busy by them. Mounts whose destination the workload
+// removed or turned into a path out of the rootfs are skipped, whatever is
+// left mounted under the rootfs is unmounted by unmountLeftoverSubmounts.
+func (d *Driver) unmountExtraMounts(logger lager.Logger, rootfsDir string, mounts []image_manager.Mount) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		target, err := extraMountTarget(rootfsDir, mounts[i].Destination)
+		if err != nil {
+			logger.Info("skipping-extra-mount", lager.Data{"destination": mounts[i].Destination, "error": err.Error()})
+			continue
+		}
+
+		err = d.unmounter.Unmount(logger, target, unix.UMOUNT_NOFOLLOW)
+		if err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+			logger.Error("unmounting-extra-mount-failed", err, lager.Data{"destination": mounts[i].Destination})
+		}
+	}
+}
+
+// extraMountTarget resolves where the mount was made. The rootfs is writable
+// by the workload, which could have replaced a parent of the destination
+// with a symlink to a path of the host, so the target must still resolve
+// into the rootfs.
+func extraMountTarget(rootfsDir, destination string) (string, error) {
+	resolvedRootfs, err := filepath.EvalSymlinks(rootfsDir)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "resolving rootfs path")
+	}
+
+	target, err := filepath.EvalSymlinks(filepath.Join(rootfsDir, destination))
+	if err != nil {
+		return "", errorspkg.Wrapf(err, "resolving mount destination %s", destination)
+	}
+	if !isWithinDir(resolvedRootfs, target) {
+		return "", errorspkg.Wrapf(ErrMountDestinationOutsideRootfs, "destination %s resolves to %s", destination, target)
+	}
+
+	return target, nil
+}
+
+func isWithinDir(dir, path string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
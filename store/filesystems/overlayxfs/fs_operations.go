@@ -0,0 +1,67 @@
+package overlayxfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FSOperations are the filesystem and mount calls the driver relies on, so
+// that its logic can be exercised without root and reused by other
+// backends.
+//
+//go:generate counterfeiter . FSOperations
+type FSOperations interface {
+	Mkdir(path string, perm os.FileMode) error
+	Chmod(path string, perm os.FileMode) error
+	Chown(path string, uid, gid int) error
+	Stat(path string) (os.FileInfo, error)
+	RemoveAll(path string) error
+	Mount(source, target, fstype string, flags uintptr, data string) error
+	Unmount(target string, flags int) error
+	Statfs(path string) (unix.Statfs_t, error)
+}
+
+// OSFSOperations performs the operations against the host.
+type OSFSOperations struct{}
+
+func (OSFSOperations) Mkdir(path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+func (OSFSOperations) Chmod(path string, perm os.FileMode) error {
+	return os.Chmod(path, perm)
+}
+
+func (OSFSOperations) Chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
+
+func (OSFSOperations) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OSFSOperations) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFSOperations) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return unix.Mount(source, target, fstype, flags, data)
+}
+
+func (OSFSOperations) Unmount(target string, flags int) error {
+	return unix.Unmount(target, flags)
+}
+
+func (OSFSOperations) Statfs(path string) (unix.Statfs_t, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	return stat, err
+}
+
+// WithFSOperations replaces the operations the driver performs against the
+// host.
+func (d *Driver) WithFSOperations(fsOperations FSOperations) *Driver {
+	d.fsOperations = fsOperations
+	return d
+}
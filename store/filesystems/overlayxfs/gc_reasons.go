@@ -0,0 +1,126 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	// GCReasonInKeepList is reported for volumes the caller asked to keep.
+	GCReasonInKeepList = "in-keep-list"
+	// GCReasonTooRecent is reported for staging volumes younger than the
+	// staging grace period, as they may still be being imported.
+	GCReasonTooRecent = "too-recent"
+	// GCReasonReferencedByImagePrefix is followed by the id of an image based
+	// on, or mounted from, the volume.
+	GCReasonReferencedByImagePrefix = "referenced-by-image-"
+)
+
+// GCReasons explains why a garbage collection keeping keepIDs would skip
+// each of the volumes it skips, keyed by volume id. Volumes missing from the
+// result would be collected. It does not touch any volume.
+func (d *Driver) GCReasons(logger lager.Logger, keepIDs []string) (map[string]string, error) {
+	logger = logger.Session("overlayxfs-gc-reasons", lager.Data{"keepIDs": keepIDs})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	referencingImages, err := d.referencingImages(logger)
+	if err != nil {
+		logger.Error("listing-referencing-images-failed", err)
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+	for _, id := range keepIDs {
+		keep[id] = true
+	}
+
+	now := d.clock.Now()
+	reasons := map[string]string{}
+	for _, volumeID := range volumeIDs {
+		if strings.HasPrefix(volumeID, "gc.") {
+			continue
+		}
+
+		if keep[volumeID] {
+			reasons[volumeID] = GCReasonInKeepList
+			continue
+		}
+
+		if imageID, ok := referencingImages[volumeID]; ok {
+			reasons[volumeID] = GCReasonReferencedByImagePrefix + imageID
+			continue
+		}
+
+		if strings.Contains(volumeID, stagingInfix) {
+			info, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, volumeID))
+			if err != nil {
+				return nil, errorspkg.Wrapf(err, "stat volume %s", volumeID)
+			}
+			if now.Sub(info.ModTime()) < d.stagingGracePeriod {
+				reasons[volumeID] = GCReasonTooRecent
+			}
+		}
+	}
+
+	logger.Debug("gc-reasons", lager.Data{"reasons": reasons})
+	return reasons, nil
+}
+
+// referencingImages maps the volumes in use to the id of one of the images
+// using them, the same way referencedVolumes finds them.
+func (d *Driver) referencingImages(logger lager.Logger) (map[string]string, error) {
+	referencingImages := map[string]string{}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imageID := range imageIDs {
+		metadata, err := d.readImageMetadata(d.imagePath(imageID))
+		if err != nil {
+			if os.IsNotExist(errorspkg.Cause(err)) {
+				logger.Debug("image-metadata-not-found", lager.Data{"imageID": imageID})
+				continue
+			}
+			return nil, err
+		}
+
+		for _, volumeID := range metadata.BaseVolumeIDs {
+			if _, ok := referencingImages[volumeID]; !ok {
+				referencingImages[volumeID] = imageID
+			}
+		}
+	}
+
+	mounts, err := d.imageOverlayMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mount := range mounts {
+		imageID := filepath.Base(filepath.Dir(mount.Mountpoint))
+		for _, lowerDir := range overlayLowerDirs(mount) {
+			volumeID, ok := d.volumeIDFromLowerDir(lowerDir)
+			if !ok {
+				continue
+			}
+			if _, ok := referencingImages[volumeID]; !ok {
+				referencingImages[volumeID] = imageID
+			}
+		}
+	}
+
+	return referencingImages, nil
+}
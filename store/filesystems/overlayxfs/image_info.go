@@ -0,0 +1,78 @@
+package overlayxfs
+
+import (
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+type ImageInfo struct {
+	CreatedAt time.Time
+	// LastMountedAt is zero when the driver never mounted the image itself,
+	// i.e. it was created without mounting and MountImage was never called.
+	LastMountedAt time.Time
+	// LastUsedAt is when TouchImage was last called for the image, or zero.
+	LastUsedAt time.Time
+	DiskUsage  groot.DiskUsage
+}
+
+// ImageInfo returns when the image was created and last mounted, along with
+// its disk usage, e.g. to pick images to evict.
+func (d *Driver) ImageInfo(logger lager.Logger, imagePath string) (ImageInfo, error) {
+	logger = logger.Session("overlayxfs-image-info", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return ImageInfo{}, err
+	}
+
+	stats, err := d.FetchStats(logger, imagePath)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	return ImageInfo{
+		CreatedAt:     metadata.CreatedAt,
+		LastMountedAt: metadata.LastMountedAt,
+		LastUsedAt:    metadata.LastUsedAt,
+		DiskUsage:     stats.DiskUsage,
+	}, nil
+}
+
+// TouchImage records that the image is being used, e.g. by a container
+// starting, for garbage collection to evict the least recently used images
+// first. The access time of the image directory is updated too.
+func (d *Driver) TouchImage(logger lager.Logger, imagePath string) error {
+	logger = logger.Session("overlayxfs-touching-image", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return err
+	}
+
+	now := d.clock.Now()
+	metadata.LastUsedAt = now
+	if err := d.writeImageMetadata(imagePath, metadata); err != nil {
+		logger.Error("writing-image-metadata-failed", err)
+		return err
+	}
+
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return errorspkg.Wrap(err, "stat image directory")
+	}
+	if err := os.Chtimes(imagePath, now, info.ModTime()); err != nil {
+		return errorspkg.Wrap(err, "updating image directory access time")
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package overlayxfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/grootfs/store/image_manager"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+const imageMetadataName = "metadata.json"
+
+type imageMetadata struct {
+	BaseVolumeIDs []string          `json:"base_volume_ids"`
+	MountSource   string            `json:"mount_source"`
+	MountOptions  []string          `json:"mount_options"`
+	CreatedAt     time.Time         `json:"created_at"`
+	LastMountedAt time.Time         `json:"last_mounted_at"`
+	LastUsedAt    time.Time         `json:"last_used_at"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	// UpperDevicePath is where the upperdir and workdir of the image are
+	// kept, if not in the image path.
+	UpperDevicePath string `json:"upper_device_path,omitempty"`
+	// ProtectedPaths are bind mounted read-only over themselves whenever the
+	// image is mounted.
+	ProtectedPaths []string `json:"protected_paths,omitempty"`
+	// ExtraMounts are bind mounted into the rootfs, after the protected
+	// paths, whenever the image is mounted.
+	ExtraMounts []image_manager.Mount `json:"extra_mounts,omitempty"`
+	// ReadOnly images have no upperdir and workdir.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+func (d *Driver) writeImageMetadata(imagePath string, metadata imageMetadata) error {
+	contents, err := json.Marshal(metadata)
+	if err != nil {
+		return errorspkg.Wrap(err, "encoding image metadata")
+	}
+
+	metadataPath := filepath.Join(imagePath, imageMetadataName)
+	if err := writeChecksummedFile(metadataPath, contents, 0600); err != nil {
+		return errorspkg.Wrapf(err, "writing image metadata %s", metadataPath)
+	}
+
+	return nil
+}
+
+func (d *Driver) readImageMetadata(imagePath string) (imageMetadata, error) {
+	metadataPath := filepath.Join(imagePath, imageMetadataName)
+	contents, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		return imageMetadata{}, errorspkg.Wrapf(err, "reading image metadata %s", metadataPath)
+	}
+
+	var metadata imageMetadata
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return imageMetadata{}, errorspkg.Wrapf(err, "decoding image metadata %s", metadataPath)
+	}
+
+	if err := verifyChecksum(metadataPath, contents); err != nil {
+		return imageMetadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// ImageAnnotations returns the annotations the image was created with.
+func (d *Driver) ImageAnnotations(logger lager.Logger, imagePath string) (map[string]string, error) {
+	logger = logger.Session("overlayxfs-image-annotations", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return nil, err
+	}
+
+	if metadata.Annotations == nil {
+		return map[string]string{}, nil
+	}
+
+	return metadata.Annotations, nil
+}
+
+// ImagesByAnnotation returns the ids of the images annotated with the given
+// key and value. Images whose metadata cannot be read are skipped.
+func (d *Driver) ImagesByAnnotation(logger lager.Logger, key, value string) ([]string, error) {
+	logger = logger.Session("overlayxfs-images-by-annotation", lager.Data{"key": key, "value": value})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, imageID := range imageIDs {
+		metadata, err := d.readImageMetadata(d.imagePath(imageID))
+		if err != nil {
+			logger.Debug("skipping-image-without-readable-metadata", lager.Data{"imageID": imageID, "error": err.Error()})
+			continue
+		}
+
+		if annotation, ok := metadata.Annotations[key]; ok && annotation == value {
+			images = append(images, imageID)
+		}
+	}
+
+	return images, nil
+}
+
+// DestroyImagesByAnnotation destroys the images annotated with the given key
+// and value, e.g. all the images of a removed pod. It carries on when an image
+// fails to be destroyed, returning the ids of the images it destroyed along
+// with an error listing the ones it could not.
+func (d *Driver) DestroyImagesByAnnotation(logger lager.Logger, key, value string) ([]string, error) {
+	logger = logger.Session("overlayxfs-destroying-images-by-annotation", lager.Data{"key": key, "value": value})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	imageIDs, err := d.ImagesByAnnotation(logger, key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	destroyed := []string{}
+	failed := []string{}
+	for _, imageID := range imageIDs {
+		if err := d.DestroyImage(logger, d.imagePath(imageID)); err != nil {
+			logger.Error("destroying-image-failed", err, lager.Data{"imageID": imageID})
+			failed = append(failed, fmt.Sprintf("%s (%s)", imageID, err))
+			continue
+		}
+		destroyed = append(destroyed, imageID)
+	}
+
+	if len(failed) > 0 {
+		return destroyed, errorspkg.Errorf("failed to destroy images: %s", strings.Join(failed, ", "))
+	}
+
+	return destroyed, nil
+}
+
+// FindDuplicateImages groups the images created from the same volumes, in
+// the same order, returning only the groups with more than one image.
+func (d *Driver) FindDuplicateImages(logger lager.Logger) ([][]string, error) {
+	logger = logger.Session("overlayxfs-find-duplicate-images")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	imagesByLowers := map[string][]string{}
+	for _, imageID := range imageIDs {
+		metadata, err := d.readImageMetadata(d.imagePath(imageID))
+		if err != nil {
+			logger.Debug("skipping-image-without-readable-metadata", lager.Data{"imageID": imageID, "error": err.Error()})
+			continue
+		}
+
+		lowers := strings.Join(metadata.BaseVolumeIDs, "\x00")
+		imagesByLowers[lowers] = append(imagesByLowers[lowers], imageID)
+	}
+
+	duplicates := [][]string{}
+	for _, images := range imagesByLowers {
+		if len(images) > 1 {
+			duplicates = append(duplicates, images)
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i][0] < duplicates[j][0]
+	})
+
+	return duplicates, nil
+}
+
+// Images lists the ids of the images in the store.
+func (d *Driver) Images(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-list-images")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	return d.imageIDs()
+}
+
+// imageIDs lists the ids of the images in the store.
+func (d *Driver) imageIDs() ([]string, error) {
+	images := []string{}
+
+	existingImages, err := ioutil.ReadDir(filepath.Join(d.storePath, store.ImageDirName))
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "failed to list images")
+	}
+
+	for _, imageInfo := range existingImages {
+		if imageInfo.IsDir() {
+			images = append(images, imageInfo.Name())
+		}
+	}
+
+	return images, nil
+}
+
+func (d *Driver) imagePath(id string) string {
+	return filepath.Join(d.storePath, store.ImageDirName, id)
+}
@@ -0,0 +1,18 @@
+package overlayxfs
+
+import (
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store/image_manager"
+)
+
+// ImagePaths returns where CreateImage lays the image out, so that callers do
+// not depend on the names of its directories. Read-only images have no
+// upperdir nor workdir.
+func (d *Driver) ImagePaths(imagePath string) image_manager.ImagePaths {
+	return image_manager.ImagePaths{
+		Rootfs:   filepath.Join(imagePath, RootfsDir),
+		UpperDir: filepath.Join(imagePath, UpperDir),
+		WorkDir:  filepath.Join(imagePath, WorkDir),
+	}
+}
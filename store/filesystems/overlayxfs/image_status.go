@@ -0,0 +1,96 @@
+package overlayxfs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// imageStatusConcurrency bounds the quota queries ImageStatuses runs at once.
+const imageStatusConcurrency = 8
+
+type ImageStatus struct {
+	ID      string
+	Mounted bool
+	// UsedBytes and LimitBytes are only reported for images with a disk
+	// limit.
+	UsedBytes  int64
+	LimitBytes int64
+	// Err is set when the usage of the image could not be read.
+	Err error
+}
+
+// ImageStatuses reports whether each image of the store is mounted along with
+// its disk usage. The mounts are all read at once, so that the statuses are
+// consistent with each other. An image failing to report its usage does not
+// fail the others.
+func (d *Driver) ImageStatuses(logger lager.Logger) ([]ImageStatus, error) {
+	logger = logger.Session("overlayxfs-image-statuses")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := d.imageOverlayMounts()
+	if err != nil {
+		logger.Error("reading-mounts-failed", err)
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, mount := range mounts {
+		mountPoints[mount.Mountpoint] = true
+	}
+
+	var (
+		wg       sync.WaitGroup
+		workers  = make(chan struct{}, imageStatusConcurrency)
+		statuses = make([]ImageStatus, len(imageIDs))
+	)
+
+	for i, imageID := range imageIDs {
+		imagePath := d.imagePath(imageID)
+		statuses[i] = ImageStatus{
+			ID:      imageID,
+			Mounted: mountPoints[filepath.Join(imagePath, RootfsDir)],
+		}
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(status *ImageStatus) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			status.UsedBytes, status.LimitBytes, status.Err = d.imageUsage(logger, imagePath)
+			if status.Err != nil {
+				logger.Error("reading-image-usage-failed", status.Err, lager.Data{"imageID": status.ID})
+			}
+		}(&statuses[i])
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
+
+func (d *Driver) imageUsage(logger lager.Logger, imagePath string) (int64, int64, error) {
+	limit, err := readImageQuota(imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 {
+		return 0, 0, nil
+	}
+
+	usage, err := d.quotaManager.Usage(logger, imagePath)
+	if err != nil {
+		return 0, limit, errorspkg.Wrap(err, "reading usage")
+	}
+
+	return usage, limit, nil
+}
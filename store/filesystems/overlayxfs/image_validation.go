@@ -0,0 +1,92 @@
+package overlayxfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// MissingVolumesError is returned by ValidateImage when base volumes of the
+// image are gone, e.g. garbage collected while the image was still using
+// them.
+type MissingVolumesError struct {
+	ImagePath string
+	// VolumeIDs are ordered bottom layer first, as the image records them.
+	VolumeIDs []string
+}
+
+func (e *MissingVolumesError) Error() string {
+	return fmt.Sprintf("image %s is missing base volumes: %s", e.ImagePath, strings.Join(e.VolumeIDs, ", "))
+}
+
+// ValidateImage checks that the base volumes of the image are all still in the
+// store, together with the links its overlay uses as lowerdirs. A mounted
+// image keeps working off deleted volumes until unmounted, so this is meant
+// for health checks to catch them before the image is mounted again.
+func (d *Driver) ValidateImage(logger lager.Logger, imagePath string) error {
+	logger = logger.Session("overlayxfs-validating-image", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return err
+	}
+
+	missing := []string{}
+	for _, id := range metadata.BaseVolumeIDs {
+		present, err := d.isBaseVolumePresent(id)
+		if err != nil {
+			logger.Error("checking-base-volume-failed", err, lager.Data{"volumeID": id})
+			return errorspkg.Wrapf(err, "checking base volume %s", id)
+		}
+		if !present {
+			logger.Info("base-volume-missing", lager.Data{"volumeID": id})
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		return &MissingVolumesError{ImagePath: imagePath, VolumeIDs: missing}
+	}
+
+	return nil
+}
+
+func (d *Driver) isBaseVolumePresent(id string) (bool, error) {
+	if err := validateVolumeID(id); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, id)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	shortID, err := ioutil.ReadFile(filepath.Join(d.storePath, LinksDirName, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// The link is followed, a dangling one being as good as no volume
+	if _, err := os.Stat(filepath.Join(d.storePath, LinksDirName, string(shortID))); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,171 @@
+package overlayxfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/grootfs/base_image_puller"
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// ImportVolumes creates a volume out of each of the given layer tarballs,
+// keyed by volume id, importing up to concurrency of them at a time. The
+// tarballs, optionally gzipped, have their whiteouts converted as when
+// pulling layers, and long runs of zeros are turned into holes; see
+// WithSparseThreshold. It returns the paths of the imported volumes, along
+// with an error naming every volume that failed to import. It fails with
+// ErrInsufficientSpace, without importing anything, if the layers clearly do
+// not fit in the store; see EstimatedLayer for layers of unknown size.
+func (d *Driver) ImportVolumes(logger lager.Logger, sources map[string]io.Reader, concurrency int) (map[string]string, error) {
+	logger = logger.Session("overlayxfs-importing-volumes", lager.Data{"count": len(sources), "concurrency": concurrency})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	if err := d.checkImportSpace(logger, sources); err != nil {
+		return nil, err
+	}
+
+	var (
+		mutex       sync.Mutex
+		wg          sync.WaitGroup
+		volumePaths = map[string]string{}
+		failures    = []string{}
+		workers     = make(chan struct{}, concurrency)
+	)
+
+	for id, source := range sources {
+		wg.Add(1)
+		workers <- struct{}{}
+
+		go func(id string, source io.Reader) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			volumePath, err := d.importVolume(logger, id, source)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logger.Error("importing-volume-failed", err, lager.Data{"volumeID": id})
+				failures = append(failures, fmt.Sprintf("%s: %s", id, err))
+				return
+			}
+			volumePaths[id] = volumePath
+		}(id, source)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return volumePaths, errorspkg.Errorf("failed to import volumes: %s", strings.Join(failures, "; "))
+	}
+
+	return volumePaths, nil
+}
+
+// importVolume extracts the layer into a volume with a temporary id, so that
+// a partially imported volume is never visible under its final id.
+func (d *Driver) importVolume(logger lager.Logger, id string, source io.Reader) (string, error) {
+	if _, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, id)); err == nil {
+		return "", errorspkg.Errorf("volume %s already exists", id)
+	}
+
+	tempID := stagingVolumeID(id)
+	tempPath, err := d.CreateVolume(logger, "", tempID)
+	if err != nil {
+		return "", err
+	}
+
+	volumePath, err := d.populateVolume(logger, tempID, tempPath, id, source)
+	if err != nil {
+		if destroyErr := d.DestroyVolume(logger, tempID); destroyErr != nil {
+			logger.Error("destroying-incomplete-volume-failed", destroyErr, lager.Data{"volumeID": tempID})
+		}
+		return "", err
+	}
+
+	return volumePath, nil
+}
+
+func (d *Driver) populateVolume(logger lager.Logger, tempID, tempPath, id string, source io.Reader) (string, error) {
+	layer, err := decompressedLayer(source)
+	if err != nil {
+		return "", err
+	}
+
+	if err := runTarWithInput(logger, layer, "--extract", "--same-owner", "--file", "-", "--directory", tempPath); err != nil {
+		return "", errorspkg.Wrap(err, "extracting layer")
+	}
+
+	if err := d.convertWhiteouts(logger, tempID, tempPath); err != nil {
+		return "", errorspkg.Wrap(err, "converting whiteouts")
+	}
+
+	if err := d.sparsifyVolume(logger, tempPath); err != nil {
+		return "", errorspkg.Wrap(err, "sparsifying volume")
+	}
+
+	size, err := calculatePathSize(logger, tempPath)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "calculating volume size")
+	}
+
+	if err := d.WriteVolumeMeta(logger, tempID, base_image_puller.VolumeMeta{Size: size}); err != nil {
+		return "", err
+	}
+
+	volumePath := filepath.Join(filepath.Dir(tempPath), id)
+	if err := d.MoveVolume(logger, tempPath, volumePath); err != nil {
+		return "", err
+	}
+
+	// MoveVolume leaves the volume in place when another import of the same
+	// id got there first
+	if _, err := os.Stat(tempPath); err == nil {
+		logger.Info("volume-already-exists", lager.Data{"volumeID": id})
+		if err := d.DestroyVolume(logger, tempID); err != nil {
+			return "", err
+		}
+		return volumePath, nil
+	}
+
+	if err := d.moveVolumeMeta(tempID, id); err != nil {
+		return "", errorspkg.Wrap(err, "moving volume metadata")
+	}
+
+	return volumePath, nil
+}
+
+// decompressedLayer transparently gunzips gzipped layers.
+func decompressedLayer(source io.Reader) (io.Reader, error) {
+	bufferedSource := bufio.NewReader(source)
+	magic, err := bufferedSource.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, errorspkg.Wrap(err, "reading layer")
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(bufferedSource)
+		if err != nil {
+			return nil, errorspkg.Wrap(err, "decompressing layer")
+		}
+		return gzipReader, nil
+	}
+
+	return bufferedSource, nil
+}
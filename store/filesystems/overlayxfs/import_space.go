@@ -0,0 +1,127 @@
+package overlayxfs
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"io"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DefaultImportReserve is the free space ImportVolumes leaves untouched in the
+// store on top of the size of the layers.
+const DefaultImportReserve = 64 * 1024 * 1024
+
+var ErrInsufficientSpace = errorspkg.New("not enough free space in the store")
+
+// EstimatedLayer is a layer source along with an estimate of its extracted
+// size, for sources the size cannot be read from, e.g. network streams.
+type EstimatedLayer struct {
+	io.Reader
+	Size int64
+}
+
+// WithImportReserve sets the free space ImportVolumes keeps in the store. The
+// default is DefaultImportReserve.
+func (d *Driver) WithImportReserve(reserve int64) *Driver {
+	d.importReserve = reserve
+	return d
+}
+
+// checkImportSpace fails with ErrInsufficientSpace if the layers are known
+// not to fit in the store. Layers of unknown size are not accounted for.
+func (d *Driver) checkImportSpace(logger lager.Logger, sources map[string]io.Reader) error {
+	var required int64
+	for _, source := range sources {
+		required += layerSize(source)
+	}
+	if required == 0 {
+		return nil
+	}
+
+	stat, err := d.fsOperations.Statfs(d.storePath)
+	if err != nil {
+		return errorspkg.Wrap(err, "statfs store")
+	}
+	available := int64(stat.Bavail) * stat.Bsize
+
+	if required+d.importReserve > available {
+		err := errorspkg.Wrapf(ErrInsufficientSpace, "layers need %d bytes plus %d reserved, %d available", required, d.importReserve, available)
+		logger.Error("insufficient-space", err)
+		return err
+	}
+
+	return nil
+}
+
+// layerSize returns the extracted size of the layer, or 0 if it is unknown.
+// Seekable layers are rewound after reading their headers. Malformed layers
+// are left for the extraction to report.
+func layerSize(source io.Reader) int64 {
+	if estimated, ok := source.(EstimatedLayer); ok {
+		return estimated.Size
+	}
+
+	seeker, ok := source.(io.ReadSeeker)
+	if !ok {
+		return 0
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	defer seeker.Seek(start, io.SeekStart)
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(seeker, magic); err != nil {
+		return 0
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzipLayerSize(seeker, start)
+	}
+
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return 0
+	}
+	return tarLayerSize(seeker)
+}
+
+// gzipLayerSize reads the uncompressed size from the gzip trailer. It is
+// stored modulo 4GiB, so it is only trusted when larger than the compressed
+// size.
+func gzipLayerSize(seeker io.ReadSeeker, start int64) int64 {
+	end, err := seeker.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(seeker, trailer); err != nil {
+		return 0
+	}
+
+	size := int64(binary.LittleEndian.Uint32(trailer))
+	if size < end+4-start {
+		return 0
+	}
+	return size
+}
+
+// tarLayerSize adds up the sizes in the tar headers, seeking over the file
+// contents.
+func tarLayerSize(source io.Reader) int64 {
+	var size int64
+	tarReader := tar.NewReader(source)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return size
+		}
+		if err != nil {
+			return 0
+		}
+		size += header.Size
+	}
+}
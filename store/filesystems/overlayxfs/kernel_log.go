@@ -0,0 +1,142 @@
+package overlayxfs
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxKernelLogMessages is how many of the most recent overlay kernel messages
+// are attached to a mount error.
+const maxKernelLogMessages = 10
+
+// capSyslog is CAP_SYSLOG, required to read the kernel log when
+// kernel.dmesg_restrict is set.
+const capSyslog = 34
+
+// WithKernelLogReader replaces the reader used to fetch kernel log context
+// for failed mounts.
+func (d *Driver) WithKernelLogReader(kernelLogReader KernelLogReader) *Driver {
+	d.kernelLogReader = kernelLogReader
+	return d
+}
+
+// withKernelLogContext adds the overlay messages the kernel logged since the
+// mount started to a mount error, as that is often the only place the reason
+// for the failure is given. Messages without a timestamp cannot be told apart
+// from older ones and are left out. It is best effort: the error is returned
+// as is when the kernel log cannot be read.
+func (d *Driver) withKernelLogContext(logger lager.Logger, err error, since time.Duration) error {
+	lines, readErr := d.kernelLogReader.ReadKernelLog()
+	if readErr != nil {
+		logger.Debug("reading-kernel-log-failed", lager.Data{"error": readErr.Error()})
+		return err
+	}
+
+	messages := []string{}
+	for _, line := range lines {
+		if !strings.Contains(line, "overlay") {
+			continue
+		}
+		if timestamp, ok := kernelLogTimestamp(line); ok && timestamp >= since {
+			messages = append(messages, strings.TrimSpace(line))
+		}
+	}
+	if len(messages) == 0 {
+		return err
+	}
+	if len(messages) > maxKernelLogMessages {
+		messages = messages[len(messages)-maxKernelLogMessages:]
+	}
+
+	return errorspkg.WithMessagef(err, "kernel log: %s", strings.Join(messages, "; "))
+}
+
+// kernelLogTimestamp parses the timestamp of a kernel log line, e.g.
+// "<4>[   12.345678] overlayfs: ...".
+func kernelLogTimestamp(line string) (time.Duration, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "<") {
+		end := strings.Index(line, ">")
+		if end < 0 {
+			return 0, false
+		}
+		line = line[end+1:]
+	}
+	if !strings.HasPrefix(line, "[") {
+		return 0, false
+	}
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return 0, false
+	}
+
+	timestamp, err := time.ParseDuration(strings.TrimSpace(line[1:end]) + "s")
+	if err != nil {
+		return 0, false
+	}
+	return timestamp, true
+}
+
+// klogctlReader reads the kernel ring buffer through syslog(2).
+type klogctlReader struct{}
+
+// Timestamp reads the monotonic clock, which the kernel log timestamps are
+// taken from.
+func (klogctlReader) Timestamp() (time.Duration, error) {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return 0, errorspkg.Wrap(err, "reading the monotonic clock")
+	}
+	return time.Duration(now.Nano()), nil
+}
+
+func (klogctlReader) ReadKernelLog() ([]string, error) {
+	if !canReadKernelLog() {
+		return nil, errorspkg.New("not permitted to read the kernel log")
+	}
+
+	size, err := unix.Klogctl(unix.SYSLOG_ACTION_SIZE_BUFFER, nil)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "getting kernel log size")
+	}
+
+	buffer := make([]byte, size)
+	n, err := unix.Klogctl(unix.SYSLOG_ACTION_READ_ALL, buffer)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "reading kernel log")
+	}
+
+	return strings.Split(strings.TrimSpace(string(buffer[:n])), "\n"), nil
+}
+
+// canReadKernelLog avoids calling syslog(2) when it would be denied, as
+// denials can be audited.
+func canReadKernelLog() bool {
+	restrict, err := ioutil.ReadFile("/proc/sys/kernel/dmesg_restrict")
+	if err == nil && strings.TrimSpace(string(restrict)) == "0" {
+		return true
+	}
+
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(status)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapEff:" {
+			capabilities, err := strconv.ParseUint(fields[1], 16, 64)
+			return err == nil && capabilities&(1<<capSyslog) != 0
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package overlayxfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DefaultOverlayModuleParametersPath is where the overlay kernel module
+// exposes its parameters.
+const DefaultOverlayModuleParametersPath = "/sys/module/overlay/parameters"
+
+// WithOverlayModuleParametersPath replaces where the parameters of the
+// overlay kernel module are read from, e.g. for tests to fake other kernels.
+func (d *Driver) WithOverlayModuleParametersPath(path string) *Driver {
+	d.overlayModuleParametersPath = path
+	return d
+}
+
+var ErrRedirectDirNoFollowNotSupported = errorspkg.New("overlay redirect_dir=nofollow is not supported by the running kernel")
+
+// redirect_dir=nofollow was introduced in the same kernel release (4.15) as
+// the redirect_always_follow module parameter, so the presence of the latter
+// is used to detect support for the former.
+func (d *Driver) supportsRedirectDirNoFollow() bool {
+	_, err := os.Stat(filepath.Join(d.overlayModuleParametersPath, "redirect_always_follow"))
+	return err == nil
+}
+
+// DefaultKernelReleasePath is where the release of the running kernel is read
+// from.
+const DefaultKernelReleasePath = "/proc/sys/kernel/osrelease"
+
+// WithKernelReleasePath replaces where the release of the running kernel is
+// read from, e.g. for tests to fake older or newer kernels.
+func (d *Driver) WithKernelReleasePath(path string) *Driver {
+	d.kernelReleasePath = path
+	return d
+}
+
+// The volatile overlay option was introduced in 5.10.
+func (d *Driver) supportsVolatile() bool {
+	release, err := d.readKernelRelease()
+	if err != nil {
+		return false
+	}
+
+	return release.atLeast(5, 10)
+}
+
+type KernelInfo struct {
+	// Release is the release of the running kernel, as in uname -r.
+	Release string
+	Major   int
+	Minor   int
+	// The overlay features below are derived from the release the kernel
+	// introduced them in.
+	Index               bool
+	RedirectDirNoFollow bool
+	Metacopy            bool
+	Volatile            bool
+}
+
+// KernelOverlaySupport reports the release of the running kernel along with
+// the overlay features it supports, e.g. for deployments to check the kernel
+// is recent enough before using the store.
+func (d *Driver) KernelOverlaySupport(logger lager.Logger) (KernelInfo, error) {
+	logger = logger.Session("overlayxfs-kernel-overlay-support")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	release, err := d.readKernelRelease()
+	if err != nil {
+		logger.Error("reading-kernel-release-failed", err)
+		return KernelInfo{}, err
+	}
+
+	return KernelInfo{
+		Release:             release.release,
+		Major:               release.major,
+		Minor:               release.minor,
+		Index:               release.atLeast(4, 13),
+		RedirectDirNoFollow: release.atLeast(4, 15),
+		Metacopy:            release.atLeast(4, 19),
+		Volatile:            release.atLeast(5, 10),
+	}, nil
+}
+
+type kernelRelease struct {
+	release      string
+	major, minor int
+}
+
+func (r kernelRelease) atLeast(major, minor int) bool {
+	return r.major > major || (r.major == major && r.minor >= minor)
+}
+
+func (d *Driver) readKernelRelease() (kernelRelease, error) {
+	contents, err := ioutil.ReadFile(d.kernelReleasePath)
+	if err != nil {
+		return kernelRelease{}, errorspkg.Wrap(err, "reading kernel release")
+	}
+
+	release := kernelRelease{release: strings.TrimSpace(string(contents))}
+	if _, err := fmt.Sscanf(release.release, "%d.%d", &release.major, &release.minor); err != nil {
+		return kernelRelease{}, errorspkg.Wrapf(err, "parsing kernel release %q", release.release)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,99 @@
+package overlayxfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// latencyProbeFiles are small files most images have, in the order they are
+// tried. Images with none of them are probed by listing the root of the
+// rootfs.
+var latencyProbeFiles = []string{"etc/os-release", "etc/passwd", "etc/hostname"}
+
+// latencyProbeSize is how much of the probe file is read.
+const latencyProbeSize = 4096
+
+// ProbeRootfsLatency times looking up and reading a small file through the
+// rootfs of a mounted image, as a health check of its lower layers: a volume
+// on a slow or misbehaving filesystem, e.g. NFS, shows up as a high latency.
+func (d *Driver) ProbeRootfsLatency(logger lager.Logger, imagePath string) (time.Duration, error) {
+	logger = logger.Session("overlayxfs-probing-rootfs-latency", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	mounted, err := d.IsImageMounted(logger, imagePath)
+	if err != nil {
+		return 0, err
+	}
+	if !mounted {
+		return 0, errorspkg.Wrap(ErrImageNotMounted, imagePath)
+	}
+
+	// Looking the probe file up goes through the lower layers too
+	start := d.clock.Now()
+	rootfsPath := filepath.Join(imagePath, RootfsDir)
+	probePath, err := probeRootfs(rootfsPath)
+	if err != nil {
+		logger.Error("reading-probe-failed", err, lager.Data{"probePath": probePath})
+		return 0, errorspkg.Wrapf(err, "probing %s", probePath)
+	}
+	latency := d.clock.Now().Sub(start)
+
+	logger.Debug("probed", lager.Data{"probePath": probePath, "latency": latency.String()})
+	return latency, nil
+}
+
+// probeRootfs reads the first probe file found in the rootfs, or lists the
+// rootfs when there is none, and returns the path it probed. The probe files
+// are resolved inside the rootfs, as symlinks in the image, e.g.
+// /etc/os-release -> /usr/lib/os-release, point into it rather than the host.
+func probeRootfs(rootfsPath string) (string, error) {
+	root, err := os.Open(rootfsPath)
+	if err != nil {
+		return rootfsPath, err
+	}
+	defer root.Close()
+
+	for _, file := range latencyProbeFiles {
+		probe, err := openInRoot(root, file)
+		if err != nil {
+			continue
+		}
+		info, err := probe.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			probe.Close()
+			continue
+		}
+		defer probe.Close()
+
+		probePath := filepath.Join(rootfsPath, file)
+		_, err = io.CopyN(ioutil.Discard, probe, latencyProbeSize)
+		if err == io.EOF {
+			return probePath, nil
+		}
+		return probePath, err
+	}
+
+	_, err = root.Readdirnames(-1)
+	return rootfsPath, err
+}
+
+// openInRoot opens a file of the rootfs without following symlinks out of
+// it. It does not block on FIFOs, and fails on kernels without openat2.
+func openInRoot(root *os.File, path string) (*os.File, error) {
+	fd, err := unix.Openat2(int(root.Fd()), path, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_NONBLOCK | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
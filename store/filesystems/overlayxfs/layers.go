@@ -0,0 +1,39 @@
+package overlayxfs
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrTooManyLayers = errorspkg.New("image has too many layers")
+
+// WithMaxLayers caps the number of base volumes images can be created from,
+// as deep stacks of lowerdirs slow the mounts down. There is no cap by
+// default.
+func (d *Driver) WithMaxLayers(maxLayers int) *Driver {
+	d.maxLayers = maxLayers
+	return d
+}
+
+func (d *Driver) checkLayerCount(count int) error {
+	if d.maxLayers > 0 && count > d.maxLayers {
+		return errorspkg.Wrapf(ErrTooManyLayers, "%d layers, at most %d allowed", count, d.maxLayers)
+	}
+	return nil
+}
+
+// ImageLayerCount returns the number of base volumes of an image, as recorded
+// when it was created.
+func (d *Driver) ImageLayerCount(logger lager.Logger, imagePath string) (int, error) {
+	logger = logger.Session("overlayxfs-image-layer-count", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return 0, err
+	}
+
+	return len(metadata.BaseVolumeIDs), nil
+}
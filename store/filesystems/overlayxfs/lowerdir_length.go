@@ -0,0 +1,47 @@
+package overlayxfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// WithPathMax replaces the longest path the kernel resolves, PATH_MAX by
+// default, e.g. for tests to hit the limit with short paths.
+func (d *Driver) WithPathMax(pathMax int) *Driver {
+	d.pathMax = pathMax
+	return d
+}
+
+var ErrLowerDirTooLong = errorspkg.New("lowerdir path is too long")
+
+// validateLowerDirLength checks that the lowerdir, relative to the store, is
+// within PATH_MAX both as passed to the kernel and once its links are
+// resolved, as the kernel fails on either with an unhelpful ENAMETOOLONG.
+func (d *Driver) validateLowerDirLength(lowerDir string) error {
+	absolutePath := filepath.Join(d.storePath, lowerDir)
+	if len(absolutePath) >= d.pathMax {
+		return errorspkg.Wrapf(ErrLowerDirTooLong, "%s is %d bytes long, the limit is %d", absolutePath, len(absolutePath), d.pathMax-1)
+	}
+
+	resolvedPath, err := filepath.EvalSymlinks(absolutePath)
+	if errors.Is(err, unix.ENAMETOOLONG) {
+		return errorspkg.Wrapf(ErrLowerDirTooLong, "resolving %s", absolutePath)
+	}
+	if err != nil {
+		// Missing links are reported when mounting
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errorspkg.Wrapf(err, "resolving %s", absolutePath)
+	}
+
+	if len(resolvedPath) >= d.pathMax {
+		return errorspkg.Wrapf(ErrLowerDirTooLong, "%s resolves to %s, which is %d bytes long, the limit is %d", absolutePath, resolvedPath, len(resolvedPath), d.pathMax-1)
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package overlayxfs
+
+import (
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrMaintenanceMode = errorspkg.New("store is in maintenance mode")
+
+// SetMaintenanceMode turns the store read-only: while on, volumes and images
+// can still be listed and inspected, but creating or destroying them fails
+// with ErrMaintenanceMode. It is safe to call concurrently with any other
+// driver operation.
+func (d *Driver) SetMaintenanceMode(on bool) {
+	d.maintenanceMode.Store(on)
+}
+
+func (d *Driver) checkMaintenanceMode() error {
+	if d.maintenanceMode.Load() {
+		return ErrMaintenanceMode
+	}
+	return nil
+}
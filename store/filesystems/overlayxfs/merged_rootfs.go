@@ -0,0 +1,35 @@
+package overlayxfs
+
+import (
+	"io"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrImageNotMounted = errorspkg.New("image is not mounted")
+
+// StreamMergedRootfs writes a tar of the rootfs of a mounted image to w, as
+// the container sees it: the lowers and the upperdir combined. Mounts inside
+// the rootfs, e.g. proc or bind mounts, are not descended into.
+func (d *Driver) StreamMergedRootfs(logger lager.Logger, imagePath string, w io.Writer) error {
+	logger = logger.Session("overlayxfs-streaming-merged-rootfs", lager.Data{"imagePath": imagePath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	mounted, err := d.IsImageMounted(logger, imagePath)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return errorspkg.Wrap(ErrImageNotMounted, imagePath)
+	}
+
+	rootfsPath := filepath.Join(imagePath, RootfsDir)
+	if err := runTarWithIO(logger, nil, w, "--create", "--one-file-system", "--file", "-", "--directory", rootfsPath, "."); err != nil {
+		return errorspkg.Wrap(err, "streaming merged rootfs")
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package overlayxfs
+
+import (
+	"path/filepath"
+)
+
+// WithMetaDirName sets the name of the store subdirectory holding the
+// metadata and lock files of the driver: the volume metadata and the project
+// mapping files. It is created by ConfigureStore, next to the volumes and
+// images directories rather than inside them, so it is never listed as
+// either. The default is store.MetaDirName.
+func (d *Driver) WithMetaDirName(name string) *Driver {
+	d.metaDirName = name
+	return d
+}
+
+// metaPath is the path of a file in the meta directory of the store.
+func (d *Driver) metaPath(elem ...string) string {
+	return filepath.Join(append([]string{d.storePath, d.metaDirName}, elem...)...)
+}
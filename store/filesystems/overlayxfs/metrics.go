@@ -0,0 +1,127 @@
+package overlayxfs
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+const (
+	// DefaultQuotaThreshold is the share of its disk limit an image has to use
+	// to be reported as over the threshold.
+	DefaultQuotaThreshold = 0.9
+	// DefaultMetricsCacheTTL is how long GatherMetrics reuses its result.
+	DefaultMetricsCacheTTL = 5 * time.Second
+)
+
+type StoreMetrics struct {
+	ImageCount  int
+	VolumeCount int
+	// UsedBytes and FreeBytes are the space used in the store filesystem and
+	// the space left for the driver to use.
+	UsedBytes  int64
+	FreeBytes  int64
+	FreeInodes uint64
+	// ImagesOverQuotaThreshold is the number of images using more than the
+	// quota threshold of their disk limit.
+	ImagesOverQuotaThreshold int
+	OrphanVolumeCount        int
+}
+
+type metricsCache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	threshold  float64
+	metrics    StoreMetrics
+	gatheredAt time.Time
+}
+
+// WithQuotaThreshold sets the share of their disk limit images have to use to
+// count towards ImagesOverQuotaThreshold. The default is
+// DefaultQuotaThreshold.
+func (d *Driver) WithQuotaThreshold(threshold float64) *Driver {
+	d.metricsCache.threshold = threshold
+	return d
+}
+
+// WithMetricsCacheTTL sets how long GatherMetrics reuses its result. The
+// default is DefaultMetricsCacheTTL; 0 disables the cache.
+func (d *Driver) WithMetricsCacheTTL(ttl time.Duration) *Driver {
+	d.metricsCache.ttl = ttl
+	return d
+}
+
+// GatherMetrics reports the state of the store at once, e.g. for a metrics
+// exporter to scrape. Only images with a disk limit have their usage read.
+func (d *Driver) GatherMetrics(logger lager.Logger) (StoreMetrics, error) {
+	logger = logger.Session("overlayxfs-gathering-metrics")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	cache := &d.metricsCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := d.clock.Now()
+	if !cache.gatheredAt.IsZero() && now.Sub(cache.gatheredAt) < cache.ttl {
+		logger.Debug("using-cached-metrics", lager.Data{"gatheredAt": cache.gatheredAt})
+		return cache.metrics, nil
+	}
+
+	stat, err := d.fsOperations.Statfs(d.storePath)
+	if err != nil {
+		logger.Error("statfs-store-failed", err)
+		return StoreMetrics{}, errorspkg.Wrap(err, "statfs store")
+	}
+
+	metrics := StoreMetrics{
+		UsedBytes:  int64(stat.Blocks-stat.Bfree) * stat.Bsize,
+		FreeBytes:  int64(stat.Bavail) * stat.Bsize,
+		FreeInodes: stat.Ffree,
+	}
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return StoreMetrics{}, err
+	}
+	metrics.VolumeCount = len(volumeIDs)
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return StoreMetrics{}, err
+	}
+	metrics.ImageCount = len(imageIDs)
+
+	for _, imageID := range imageIDs {
+		imagePath := d.imagePath(imageID)
+		limit, err := readImageQuota(imagePath)
+		if err != nil {
+			return StoreMetrics{}, err
+		}
+		if limit == 0 {
+			continue
+		}
+
+		usage, err := d.quotaManager.Usage(logger, imagePath)
+		if err != nil {
+			logger.Error("reading-image-usage-failed", err, lager.Data{"imageID": imageID})
+			return StoreMetrics{}, errorspkg.Wrapf(err, "reading usage of image %s", imageID)
+		}
+		if float64(usage) >= cache.threshold*float64(limit) {
+			metrics.ImagesOverQuotaThreshold++
+		}
+	}
+
+	orphans, err := d.OrphanVolumes(logger)
+	if err != nil {
+		return StoreMetrics{}, err
+	}
+	metrics.OrphanVolumeCount = len(orphans)
+
+	cache.metrics = metrics
+	cache.gatheredAt = now
+
+	return metrics, nil
+}
@@ -0,0 +1,35 @@
+package overlayxfs
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const (
+	MetricCreateImageTime      = "OverlayxfsCreateImageTime"
+	MetricCreateImageFailures  = "OverlayxfsCreateImageFailures"
+	MetricDestroyImageTime     = "OverlayxfsDestroyImageTime"
+	MetricDestroyImageFailures = "OverlayxfsDestroyImageFailures"
+	MetricMountTime            = "OverlayxfsMountTime"
+	MetricUnmountTime          = "OverlayxfsUnmountTime"
+)
+
+//go:generate counterfeiter . MetricsEmitter
+type MetricsEmitter interface {
+	TryEmitDurationFrom(logger lager.Logger, name string, from time.Time)
+	TryIncrementCounter(logger lager.Logger, name string)
+}
+
+// WithMetricsEmitter sets where the driver reports how long creating and
+// destroying images, and mounting and unmounting their rootfs, takes, and how
+// often creating and destroying them fails. Nothing is reported by default.
+func (d *Driver) WithMetricsEmitter(emitter MetricsEmitter) *Driver {
+	d.metricsEmitter = emitter
+	return d
+}
+
+type noopMetricsEmitter struct{}
+
+func (noopMetricsEmitter) TryEmitDurationFrom(lager.Logger, string, time.Time) {}
+func (noopMetricsEmitter) TryIncrementCounter(lager.Logger, string)            {}
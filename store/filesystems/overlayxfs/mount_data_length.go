@@ -0,0 +1,28 @@
+package overlayxfs
+
+import (
+	errorspkg "github.com/pkg/errors"
+)
+
+// WithMountDataMax replaces the size of the buffer the kernel copies mount
+// data into, a page by default, e.g. for tests to hit the limit with fewer
+// layers. It holds the terminating NUL too.
+func (d *Driver) WithMountDataMax(mountDataMax int) *Driver {
+	d.mountDataMax = mountDataMax
+	return d
+}
+
+var ErrMountDataTooLong = errorspkg.New("overlay mount data is too long")
+
+// validateMountDataLength checks that the mount data fits in a page, as the
+// kernel truncates it otherwise and fails the mount with an unhelpful EINVAL.
+// The lowerdirs of images with many layers are what usually exceeds it.
+func (d *Driver) validateMountDataLength(mountData string) error {
+	if len(mountData) < d.mountDataMax {
+		return nil
+	}
+
+	return errorspkg.Wrapf(ErrMountDataTooLong,
+		"%d bytes long, the limit is %d: the image has too many layers, they need to be squashed into fewer",
+		len(mountData), d.mountDataMax-1)
+}
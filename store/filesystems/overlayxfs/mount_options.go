@@ -0,0 +1,154 @@
+package overlayxfs
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"code.cloudfoundry.org/grootfs/store/image_manager"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrOptionNotAllowed = errorspkg.New("overlay option is not allowed")
+
+var ErrInvalidMountOption = errorspkg.New("invalid overlay mount option")
+
+// extraMountOptionValues are the overlay options callers can set through the
+// spec, with their valid values. The directory options are set by the driver
+// and must not be overridden, and volatile is chosen through the durability
+// policy.
+var extraMountOptionValues = map[string][]string{
+	"redirect_dir": {"on", "off", "follow", "nofollow"},
+	"metacopy":     {"on", "off"},
+	"index":        {"on", "off"},
+	"xino":         {"on", "off", "auto"},
+}
+
+// WithAllowedOverlayOptions restricts the overlay options images can be
+// mounted with, e.g. to forbid volatile. Options are named without their
+// value, e.g. "redirect_dir". By default all options are allowed.
+func (d *Driver) WithAllowedOverlayOptions(options ...string) *Driver {
+	d.allowedOverlayOptions = map[string]bool{}
+	for _, option := range options {
+		d.allowedOverlayOptions[option] = true
+	}
+	return d
+}
+
+func (d *Driver) checkOverlayOptionAllowed(option string) error {
+	if d.allowedOverlayOptions == nil {
+		return nil
+	}
+
+	name := strings.SplitN(option, "=", 2)[0]
+	if !d.allowedOverlayOptions[name] {
+		return errorspkg.Wrap(ErrOptionNotAllowed, name)
+	}
+
+	return nil
+}
+
+// overlayMountOptions returns the overlay options requested by the spec, on
+// top of the lowerdir, upperdir and workdir ones.
+func (d *Driver) overlayMountOptions(logger lager.Logger, spec image_manager.ImageDriverSpec) ([]string, error) {
+	options := []string{}
+
+	if spec.RedirectDirNoFollow {
+		if err := d.checkOverlayOptionAllowed("redirect_dir=nofollow"); err != nil {
+			logger.Error("overlay-option-not-allowed", err)
+			return nil, err
+		}
+		if !d.supportsRedirectDirNoFollow() {
+			logger.Error("redirect-dir-nofollow-not-supported", ErrRedirectDirNoFollowNotSupported)
+			return nil, ErrRedirectDirNoFollowNotSupported
+		}
+		options = append(options, "redirect_dir=nofollow")
+	}
+
+	extraOptions, err := d.extraMountOptions(spec)
+	if err != nil {
+		logger.Error("invalid-mount-options", err)
+		return nil, err
+	}
+	options = append(options, extraOptions...)
+
+	switch spec.Durability {
+	case "", image_manager.DurabilitySafe:
+	case image_manager.DurabilityFast:
+		if err := d.checkOverlayOptionAllowed("volatile"); err != nil {
+			logger.Error("overlay-option-not-allowed", err)
+			return nil, err
+		}
+		if d.supportsVolatile() {
+			options = append(options, "volatile")
+		} else {
+			logger.Info("volatile-not-supported-falling-back-to-safe-durability")
+		}
+	default:
+		return nil, errorspkg.Errorf("invalid durability policy %q", spec.Durability)
+	}
+
+	return options, nil
+}
+
+// extraMountOptions validates the mount options of the spec and formats them,
+// sorted so that the mount data is stable.
+func (d *Driver) extraMountOptions(spec image_manager.ImageDriverSpec) ([]string, error) {
+	names := []string{}
+	for name := range spec.MountOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := []string{}
+	for _, name := range names {
+		value := spec.MountOptions[name]
+		validValues, known := extraMountOptionValues[name]
+		if !known {
+			return nil, errorspkg.Wrapf(ErrInvalidMountOption, "%q cannot be set", name)
+		}
+		if !containsString(validValues, value) {
+			return nil, errorspkg.Wrapf(ErrInvalidMountOption, "%s=%q, must be one of %s", name, value, strings.Join(validValues, ", "))
+		}
+		if name == "redirect_dir" && spec.RedirectDirNoFollow {
+			return nil, errorspkg.Wrap(ErrInvalidMountOption, "redirect_dir conflicts with RedirectDirNoFollow")
+		}
+
+		option := name + "=" + value
+		if err := d.checkOverlayOptionAllowed(option); err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+
+	return options, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultMountSource = "overlay"
+
+// overlayMountSource returns the source of the overlay mount. Whitespace,
+// backslashes and non-printable characters are rejected, as they would be
+// escaped in mountinfo and break naive parsers of it.
+func overlayMountSource(spec image_manager.ImageDriverSpec) (string, error) {
+	if spec.MountSource == "" {
+		return defaultMountSource, nil
+	}
+
+	for _, r := range spec.MountSource {
+		if r == '\\' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return "", errorspkg.Errorf("invalid mount source %q: must not contain whitespace, backslashes or non-printable characters", spec.MountSource)
+		}
+	}
+
+	return spec.MountSource, nil
+}
@@ -0,0 +1,48 @@
+package overlayxfs
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var ErrMountTimeout = errorspkg.New("mount timed out")
+
+// WithMountTimeout makes CreateImage and MountImage give up on overlay mounts
+// taking longer than timeout, e.g. because a lowerdir lives on an
+// unresponsive NFS share. There is no timeout by default.
+func (d *Driver) WithMountTimeout(timeout time.Duration) *Driver {
+	d.mountTimeout = timeout
+	return d
+}
+
+// mountOverlay mounts the overlay, waiting at most for the mount timeout.
+// mount(2) cannot be interrupted, so a mount that times out is left running
+// and detached as soon as it completes.
+func (d *Driver) mountOverlay(logger lager.Logger, source, rootfsDir, mountData string) error {
+	if d.mountTimeout == 0 {
+		return d.mounter.Mount(logger, source, rootfsDir, "overlay", 0, mountData)
+	}
+
+	mountResult := make(chan error, 1)
+	go func() {
+		mountResult <- d.mounter.Mount(logger, source, rootfsDir, "overlay", 0, mountData)
+	}()
+
+	select {
+	case err := <-mountResult:
+		return err
+	case <-d.clock.After(d.mountTimeout):
+		logger.Info("mount-timed-out", lager.Data{"timeout": d.mountTimeout.String()})
+		go func() {
+			if err := <-mountResult; err == nil {
+				if err := d.unmounter.Unmount(logger, rootfsDir, unix.MNT_DETACH); err != nil {
+					logger.Error("detaching-timed-out-mount-failed", err)
+				}
+			}
+		}()
+		return errorspkg.Wrapf(ErrMountTimeout, "giving up after %s", d.mountTimeout)
+	}
+}
@@ -0,0 +1,29 @@
+package overlayxfs
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// Mounter mounts the rootfs of the images, mirroring Unmounter.
+//
+//go:generate counterfeiter . Mounter
+type Mounter interface {
+	Mount(logger lager.Logger, source, target, fsType string, flags uintptr, data string) error
+}
+
+// fsOperationsMounter is the default mounter. It goes through the filesystem
+// operations of the driver, mount(2) unless they are replaced.
+type fsOperationsMounter struct {
+	driver *Driver
+}
+
+func (m *fsOperationsMounter) Mount(logger lager.Logger, source, target, fsType string, flags uintptr, data string) error {
+	return m.driver.fsOperations.Mount(source, target, fsType, flags, data)
+}
+
+// WithMounter replaces how CreateImage and MountImage mount the rootfs of the
+// images.
+func (d *Driver) WithMounter(mounter Mounter) *Driver {
+	d.mounter = mounter
+	return d
+}
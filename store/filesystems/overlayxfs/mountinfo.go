@@ -0,0 +1,193 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/moby/sys/mountinfo"
+	errorspkg "github.com/pkg/errors"
+)
+
+// DefaultMountInfoPath is the mount table consulted to find the image
+// overlay mounts.
+const DefaultMountInfoPath = "/proc/self/mountinfo"
+
+// WithMountInfoPath replaces the mount table the driver reads its mounts
+// from, e.g. for tests to provide a synthetic one.
+func (d *Driver) WithMountInfoPath(path string) *Driver {
+	d.mountInfoPath = path
+	return d
+}
+
+// imageOverlayMounts returns the overlay mounts whose mount point lives under
+// the images directory of the store.
+func (d *Driver) imageOverlayMounts() ([]*mountinfo.Info, error) {
+	mountInfoFile, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "opening mountinfo")
+	}
+	defer mountInfoFile.Close()
+
+	imagesPath := filepath.Join(d.storePath, store.ImageDirName) + "/"
+	mounts, err := mountinfo.GetMountsFromReader(mountInfoFile, func(info *mountinfo.Info) (bool, bool) {
+		return info.FSType != "overlay" || !strings.HasPrefix(info.Mountpoint, imagesPath), false
+	})
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "parsing mountinfo")
+	}
+
+	return mounts, nil
+}
+
+// storeMounts returns the mount points under the store, not counting the
+// store itself, which is usually the mount of its backing filesystem.
+func (d *Driver) storeMounts() ([]string, error) {
+	return d.mountsUnder(d.storePath)
+}
+
+// mountsUnder returns the sorted mount points under the directory, not
+// counting the directory itself.
+func (d *Driver) mountsUnder(dir string) ([]string, error) {
+	mountInfoFile, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "opening mountinfo")
+	}
+	defer mountInfoFile.Close()
+
+	prefix := filepath.Clean(dir) + "/"
+	mounts, err := mountinfo.GetMountsFromReader(mountInfoFile, func(info *mountinfo.Info) (bool, bool) {
+		return !strings.HasPrefix(info.Mountpoint, prefix), false
+	})
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "parsing mountinfo")
+	}
+
+	mountPoints := []string{}
+	for _, mount := range mounts {
+		mountPoints = append(mountPoints, mount.Mountpoint)
+	}
+	sort.Strings(mountPoints)
+
+	return mountPoints, nil
+}
+
+// overlayLowerDirs returns the lowerdir paths of an overlay mount, as they
+// were passed to the kernel.
+func overlayLowerDirs(mount *mountinfo.Info) []string {
+	for _, option := range strings.Split(mount.VFSOptions, ",") {
+		if strings.HasPrefix(option, "lowerdir=") {
+			return strings.Split(strings.TrimPrefix(option, "lowerdir="), ":")
+		}
+	}
+
+	return []string{}
+}
+
+// volumeIDFromLowerDir maps a lowerdir, which is usually a link relative to
+// the store path, back to the id of the volume it points to.
+func (d *Driver) volumeIDFromLowerDir(lowerDir string) (string, bool) {
+	if !filepath.IsAbs(lowerDir) {
+		lowerDir = filepath.Join(d.storePath, lowerDir)
+	}
+
+	if target, err := os.Readlink(lowerDir); err == nil {
+		lowerDir = target
+	}
+
+	if filepath.Dir(lowerDir) != filepath.Join(d.storePath, store.VolumesDirName) {
+		return "", false
+	}
+
+	return filepath.Base(lowerDir), true
+}
+
+// WithSkipMountVerification disables looking the overlay up in mountinfo
+// after mounting it, saving parsing the mount table on kernels whose mounts
+// are known to be reliable.
+func (d *Driver) WithSkipMountVerification(skip bool) *Driver {
+	d.skipMountVerification = skip
+	return d
+}
+
+// verifyOverlayMount checks that the rootfs is an overlay mount carrying the
+// requested options, as mount(2) succeeding has been seen not to guarantee a
+// usable mount.
+func (d *Driver) verifyOverlayMount(source, rootfsDir, mountData string) error {
+	mountInfoFile, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return errorspkg.Wrap(err, "opening mountinfo")
+	}
+	defer mountInfoFile.Close()
+
+	mounts, err := mountinfo.GetMountsFromReader(mountInfoFile, mountinfo.SingleEntryFilter(rootfsDir))
+	if err != nil {
+		return errorspkg.Wrap(err, "parsing mountinfo")
+	}
+	if len(mounts) == 0 {
+		return errorspkg.Errorf("overlay mount on %s not found in mountinfo after mounting", rootfsDir)
+	}
+
+	mount := mounts[len(mounts)-1]
+	if mount.FSType != "overlay" || mount.Source != source {
+		return errorspkg.Errorf("expected an overlay mount from %s on %s, found a %s mount from %s", source, rootfsDir, mount.FSType, mount.Source)
+	}
+
+	mountedOptions := map[string]bool{}
+	mountedOptionNames := map[string]bool{}
+	for _, option := range strings.Split(mount.VFSOptions, ",") {
+		mountedOptions[option] = true
+		mountedOptionNames[strings.SplitN(option, "=", 2)[0]] = true
+	}
+
+	for _, option := range strings.Split(mountData, ",") {
+		name := strings.SplitN(option, "=", 2)[0]
+		switch name {
+		case "lowerdir", "upperdir", "workdir":
+			// The kernel may show these differently from how they were passed
+			continue
+		}
+
+		if mountedOptions[option] {
+			continue
+		}
+		// The kernel only shows these when they differ from its defaults,
+		// which depend on its config and the overlay module parameters. xino=auto
+		// is shown as what it resolved to.
+		if _, defaulted := extraMountOptionValues[name]; defaulted && (!mountedOptionNames[name] || option == "xino=auto") {
+			continue
+		}
+		return errorspkg.Errorf("overlay mount on %s is missing option %s", rootfsDir, option)
+	}
+
+	return nil
+}
+
+// IsImageMounted checks whether the rootfs of the image is currently a mount
+// point.
+func (d *Driver) IsImageMounted(logger lager.Logger, imagePath string) (bool, error) {
+	logger = logger.Session("overlayxfs-is-image-mounted", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if filepath.Dir(filepath.Clean(imagePath)) != filepath.Join(d.storePath, store.ImageDirName) {
+		return false, errorspkg.Errorf("%s is not an image of the store %s", imagePath, d.storePath)
+	}
+
+	mountInfoFile, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return false, errorspkg.Wrap(err, "opening mountinfo")
+	}
+	defer mountInfoFile.Close()
+
+	mounts, err := mountinfo.GetMountsFromReader(mountInfoFile, mountinfo.SingleEntryFilter(filepath.Join(imagePath, RootfsDir)))
+	if err != nil {
+		logger.Error("parsing-mountinfo-failed", err)
+		return false, errorspkg.Wrap(err, "parsing mountinfo")
+	}
+
+	return len(mounts) > 0, nil
+}
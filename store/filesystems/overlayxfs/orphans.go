@@ -0,0 +1,77 @@
+package overlayxfs
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// OrphanVolumes returns the ids of the volumes that are neither a lowerdir of
+// a mounted image nor recorded as a base volume in any image metadata. It
+// does not delete anything: it reports what a garbage collection could
+// reclaim.
+func (d *Driver) OrphanVolumes(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-orphan-volumes")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumes, err := d.Volumes(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	referencedVolumes, err := d.referencedVolumes(logger)
+	if err != nil {
+		logger.Error("listing-referenced-volumes-failed", err)
+		return nil, err
+	}
+
+	orphans := []string{}
+	for _, volumeID := range volumes {
+		if !referencedVolumes[volumeID] {
+			orphans = append(orphans, volumeID)
+		}
+	}
+
+	return orphans, nil
+}
+
+func (d *Driver) referencedVolumes(logger lager.Logger) (map[string]bool, error) {
+	referencedVolumes := map[string]bool{}
+
+	mounts, err := d.imageOverlayMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mount := range mounts {
+		for _, lowerDir := range overlayLowerDirs(mount) {
+			if volumeID, ok := d.volumeIDFromLowerDir(lowerDir); ok {
+				referencedVolumes[volumeID] = true
+			}
+		}
+	}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imageID := range imageIDs {
+		metadata, err := d.readImageMetadata(d.imagePath(imageID))
+		if err != nil {
+			if os.IsNotExist(errorspkg.Cause(err)) {
+				logger.Debug("image-metadata-not-found", lager.Data{"imageID": imageID})
+				continue
+			}
+			return nil, err
+		}
+
+		for _, volumeID := range metadata.BaseVolumeIDs {
+			referencedVolumes[volumeID] = true
+		}
+	}
+
+	return referencedVolumes, nil
+}
@@ -0,0 +1,72 @@
+package overlayxfs
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var ErrOverlayNotSupported = errorspkg.New("overlay is not supported by the running kernel")
+
+// DefaultFilesystemsPath lists the filesystems the running kernel supports.
+const DefaultFilesystemsPath = "/proc/filesystems"
+
+// WithFilesystemsPath replaces where the filesystems the kernel supports are
+// read from, e.g. for tests to fake kernels without overlay.
+func (d *Driver) WithFilesystemsPath(path string) *Driver {
+	d.filesystemsPath = path
+	return d
+}
+
+// CheckOverlaySupport returns ErrOverlayNotSupported when the kernel does not
+// list overlay among its filesystems. The overlay module is not loaded here,
+// so a kernel that has not loaded it yet is reported too: InitFilesystem only
+// warns about it, the kernel loading the module on the first mount.
+func (d *Driver) CheckOverlaySupport(logger lager.Logger) error {
+	logger = logger.Session("overlayxfs-checking-overlay-support")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	supported, err := d.overlayListed()
+	if err != nil {
+		return err
+	}
+	if !supported {
+		logger.Error("overlay-not-supported", ErrOverlayNotSupported)
+		return ErrOverlayNotSupported
+	}
+
+	return nil
+}
+
+func (d *Driver) overlayListed() (bool, error) {
+	file, err := os.Open(d.filesystemsPath)
+	if err != nil {
+		return false, errorspkg.Wrap(err, "reading supported filesystems")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return true, nil
+		}
+	}
+
+	return false, errorspkg.Wrap(scanner.Err(), "reading supported filesystems")
+}
+
+// overlayMountError tells a kernel without overlay, which fails the mount
+// with ENODEV, apart from other mount failures.
+func overlayMountError(err error) error {
+	if errors.Is(err, unix.ENODEV) {
+		return errorspkg.Wrap(ErrOverlayNotSupported, err.Error())
+	}
+	return err
+}
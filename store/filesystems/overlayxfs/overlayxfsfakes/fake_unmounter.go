@@ -9,11 +9,12 @@ import (
 )
 
 type FakeUnmounter struct {
-	UnmountStub        func(lager.Logger, string) error
+	UnmountStub        func(lager.Logger, string, int) error
 	unmountMutex       sync.RWMutex
 	unmountArgsForCall []struct {
 		arg1 lager.Logger
 		arg2 string
+		arg3 int
 	}
 	unmountReturns struct {
 		result1 error
@@ -25,19 +26,20 @@ type FakeUnmounter struct {
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeUnmounter) Unmount(arg1 lager.Logger, arg2 string) error {
+func (fake *FakeUnmounter) Unmount(arg1 lager.Logger, arg2 string, arg3 int) error {
 	fake.unmountMutex.Lock()
 	ret, specificReturn := fake.unmountReturnsOnCall[len(fake.unmountArgsForCall)]
 	fake.unmountArgsForCall = append(fake.unmountArgsForCall, struct {
 		arg1 lager.Logger
 		arg2 string
-	}{arg1, arg2})
+		arg3 int
+	}{arg1, arg2, arg3})
 	stub := fake.UnmountStub
 	fakeReturns := fake.unmountReturns
-	fake.recordInvocation("Unmount", []interface{}{arg1, arg2})
+	fake.recordInvocation("Unmount", []interface{}{arg1, arg2, arg3})
 	fake.unmountMutex.Unlock()
 	if stub != nil {
-		return stub(arg1, arg2)
+		return stub(arg1, arg2, arg3)
 	}
 	if specificReturn {
 		return ret.result1
@@ -51,17 +53,17 @@ func (fake *FakeUnmounter) UnmountCallCount() int {
 	return len(fake.unmountArgsForCall)
 }
 
-func (fake *FakeUnmounter) UnmountCalls(stub func(lager.Logger, string) error) {
+func (fake *FakeUnmounter) UnmountCalls(stub func(lager.Logger, string, int) error) {
 	fake.unmountMutex.Lock()
 	defer fake.unmountMutex.Unlock()
 	fake.UnmountStub = stub
 }
 
-func (fake *FakeUnmounter) UnmountArgsForCall(i int) (lager.Logger, string) {
+func (fake *FakeUnmounter) UnmountArgsForCall(i int) (lager.Logger, string, int) {
 	fake.unmountMutex.RLock()
 	defer fake.unmountMutex.RUnlock()
 	argsForCall := fake.unmountArgsForCall[i]
-	return argsForCall.arg1, argsForCall.arg2
+	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3
 }
 
 func (fake *FakeUnmounter) UnmountReturns(result1 error) {
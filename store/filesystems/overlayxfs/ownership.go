@@ -0,0 +1,53 @@
+package overlayxfs
+
+import (
+	"syscall"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// ensureUpperDirsOwnership checks that the upperdir and workdir are owned by
+// the image owner before mounting, fixing them if they are not. Overlay fails
+// with a bare EINVAL on a workdir it cannot use, e.g. when a user namespace
+// mapping does not cover its owner.
+func (d *Driver) ensureUpperDirsOwnership(logger lager.Logger, upperDir, workDir string, ownerUID, ownerGID int) error {
+	for _, dir := range []string{upperDir, workDir} {
+		uid, gid, err := d.dirOwner(dir)
+		if err != nil {
+			return err
+		}
+		if uid == ownerUID && gid == ownerGID {
+			continue
+		}
+
+		logger.Info("fixing-ownership", lager.Data{"dir": dir, "uid": uid, "gid": gid, "ownerUID": ownerUID, "ownerGID": ownerGID})
+		if err := d.fsOperations.Chown(dir, ownerUID, ownerGID); err != nil {
+			return errorspkg.Wrapf(err, "%s is owned by %d:%d instead of the image owner %d:%d, chowning it", dir, uid, gid, ownerUID, ownerGID)
+		}
+
+		uid, gid, err = d.dirOwner(dir)
+		if err != nil {
+			return err
+		}
+		if uid != ownerUID || gid != ownerGID {
+			return errorspkg.Errorf("%s is owned by %d:%d instead of the image owner %d:%d, check the uid and gid mappings of the image", dir, uid, gid, ownerUID, ownerGID)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) dirOwner(dir string) (int, int, error) {
+	info, err := d.fsOperations.Stat(dir)
+	if err != nil {
+		return 0, 0, errorspkg.Wrapf(err, "stat %s", dir)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, errorspkg.Errorf("reading the owner of %s", dir)
+	}
+
+	return int(stat.Uid), int(stat.Gid), nil
+}
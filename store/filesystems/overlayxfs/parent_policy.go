@@ -0,0 +1,55 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrParentNotFound = errorspkg.New("parent volume not found")
+
+// MissingParentPolicy decides what CreateVolume does when the parent volume
+// it is given does not exist.
+type MissingParentPolicy int
+
+const (
+	// StrictMissingParent fails with ErrParentNotFound, e.g. for layer build
+	// pipelines where a missing parent means the layers are out of order.
+	StrictMissingParent MissingParentPolicy = iota
+	// LenientMissingParent logs the missing parent and creates the volume
+	// anyway, e.g. for best-effort caches.
+	LenientMissingParent
+)
+
+// WithMissingParentPolicy sets the policy used by CreateVolume. The default is
+// StrictMissingParent.
+func (d *Driver) WithMissingParentPolicy(policy MissingParentPolicy) *Driver {
+	d.missingParentPolicy = policy
+	return d
+}
+
+// checkParentVolume applies the missing parent policy. Volumes without a
+// parent are always allowed.
+func (d *Driver) checkParentVolume(logger lager.Logger, parentID string) error {
+	if parentID == "" {
+		return nil
+	}
+
+	_, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, parentID))
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return errorspkg.Wrapf(err, "checking parent volume %s", parentID)
+	}
+
+	if d.missingParentPolicy == LenientMissingParent {
+		logger.Info("parent-volume-not-found-creating-empty-volume", lager.Data{"parentID": parentID})
+		return nil
+	}
+
+	return errorspkg.Wrap(ErrParentNotFound, parentID)
+}
@@ -0,0 +1,103 @@
+package overlayxfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	fsIOCFSGetXattr    = 0x801C581F
+	fsIOCFSSetXattr    = 0x401C5820
+	fsXflagProjInherit = 0x00000200
+)
+
+// fsxattr mirrors struct fsxattr from linux/fs.h.
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	_          [8]byte
+}
+
+// ensureProjectInheritance makes sure files created under the image directory
+// inherit its project id. Without the flag they are not accounted to the
+// project and the image quota is silently under-enforced.
+func ensureProjectInheritance(logger lager.Logger, imagePath string) error {
+	dir, err := os.Open(imagePath)
+	if err != nil {
+		return errorspkg.Wrap(err, "opening image directory")
+	}
+	defer dir.Close()
+
+	var attr fsxattr
+	if err := fsxattrIoctl(dir, fsIOCFSGetXattr, &attr); err != nil {
+		return errorspkg.Wrapf(err, "getting extended attributes for %s", imagePath)
+	}
+
+	if attr.Xflags&fsXflagProjInherit != 0 {
+		return nil
+	}
+
+	logger.Info("project-inheritance-missing-setting-it", lager.Data{"projectID": attr.Projid})
+	attr.Xflags |= fsXflagProjInherit
+	if err := fsxattrIoctl(dir, fsIOCFSSetXattr, &attr); err != nil {
+		return errorspkg.Wrapf(err, "setting the project inheritance flag on %s, files in the image would not count towards its quota", imagePath)
+	}
+
+	return nil
+}
+
+// clearProjectIDs moves the files and directories of the image back to
+// project 0, so that XFS stops accounting them to the image project right
+// away rather than as they are removed. Symlinks and special files, such as
+// whiteouts, cannot be opened for the ioctl and are left as they are.
+func clearProjectIDs(logger lager.Logger, imagePath string) error {
+	logger = logger.Session("clearing-project-ids", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	return filepath.WalkDir(imagePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+
+		file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return errorspkg.Wrapf(err, "opening %s", path)
+		}
+		defer file.Close()
+
+		var attr fsxattr
+		if err := fsxattrIoctl(file, fsIOCFSGetXattr, &attr); err != nil {
+			return errorspkg.Wrapf(err, "getting extended attributes for %s", path)
+		}
+		if attr.Projid == 0 && attr.Xflags&fsXflagProjInherit == 0 {
+			return nil
+		}
+
+		attr.Projid = 0
+		attr.Xflags &^= fsXflagProjInherit
+		if err := fsxattrIoctl(file, fsIOCFSSetXattr, &attr); err != nil {
+			return errorspkg.Wrapf(err, "clearing the project id of %s", path)
+		}
+		return nil
+	})
+}
+
+func fsxattrIoctl(file *os.File, request uintptr, attr *fsxattr) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
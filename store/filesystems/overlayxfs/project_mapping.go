@@ -0,0 +1,125 @@
+package overlayxfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The project mapping files follow the format of /etc/projects and
+// /etc/projid, so that the XFS tools can report quotas by image id, e.g.
+// `xfs_quota -x -D <store>/meta/projects -P <store>/meta/projid -c 'report -p'`.
+const (
+	ProjectsFileName = "projects"
+	ProjidFileName   = "projid"
+)
+
+// recordImageProject adds the project id of the image to the mapping files.
+func (d *Driver) recordImageProject(logger lager.Logger, imagePath string, projectID uint32) error {
+	return d.updateProjectMapping(logger, func(projectIDs map[string]uint32) {
+		projectIDs[filepath.Base(imagePath)] = projectID
+	})
+}
+
+// forgetImageProject removes the image from the mapping files.
+func (d *Driver) forgetImageProject(logger lager.Logger, imagePath string) error {
+	return d.updateProjectMapping(logger, func(projectIDs map[string]uint32) {
+		delete(projectIDs, filepath.Base(imagePath))
+	})
+}
+
+// updateProjectMapping rewrites both mapping files from the image id to
+// project id map in projid, holding a lock as other grootfs processes might
+// be creating or destroying images at the same time.
+func (d *Driver) updateProjectMapping(logger lager.Logger, update func(map[string]uint32)) error {
+	logger = logger.Session("updating-project-mapping")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := os.MkdirAll(d.metaPath(), 0755); err != nil {
+		return errorspkg.Wrap(err, "creating meta directory")
+	}
+
+	lockFile, err := os.OpenFile(d.metaPath(ProjidFileName+".lock"), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errorspkg.Wrap(err, "opening project mapping lock")
+	}
+	defer lockFile.Close()
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return errorspkg.Wrap(err, "locking project mapping")
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	projectIDs, err := d.readProjectIDs()
+	if err != nil {
+		logger.Error("reading-projid-failed", err)
+		return err
+	}
+
+	update(projectIDs)
+
+	imageIDs := []string{}
+	for imageID := range projectIDs {
+		imageIDs = append(imageIDs, imageID)
+	}
+	sort.Strings(imageIDs)
+
+	var projects, projid strings.Builder
+	for _, imageID := range imageIDs {
+		fmt.Fprintf(&projects, "%d:%s\n", projectIDs[imageID], d.imagePath(imageID))
+		fmt.Fprintf(&projid, "%s:%d\n", imageID, projectIDs[imageID])
+	}
+
+	if err := replaceFile(d.metaPath(ProjectsFileName), []byte(projects.String()), 0644); err != nil {
+		logger.Error("writing-projects-failed", err)
+		return errorspkg.Wrap(err, "writing projects")
+	}
+	if err := replaceFile(d.metaPath(ProjidFileName), []byte(projid.String()), 0644); err != nil {
+		logger.Error("writing-projid-failed", err)
+		return errorspkg.Wrap(err, "writing projid")
+	}
+
+	return nil
+}
+
+func (d *Driver) readProjectIDs() (map[string]uint32, error) {
+	projectIDs := map[string]uint32{}
+
+	projidFile, err := os.Open(d.metaPath(ProjidFileName))
+	if os.IsNotExist(err) {
+		return projectIDs, nil
+	}
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "opening projid")
+	}
+	defer projidFile.Close()
+
+	scanner := bufio.NewScanner(projidFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.LastIndex(line, ":")
+		if separator < 0 {
+			return nil, errorspkg.Errorf("malformed projid line %q", line)
+		}
+		projectID, err := strconv.ParseUint(line[separator+1:], 10, 32)
+		if err != nil {
+			return nil, errorspkg.Wrapf(err, "malformed projid line %q", line)
+		}
+
+		projectIDs[line[:separator]] = uint32(projectID)
+	}
+
+	return projectIDs, errorspkg.Wrap(scanner.Err(), "reading projid")
+}
@@ -0,0 +1,96 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// protectPaths bind mounts the paths of the rootfs read-only over themselves,
+// so that no write can go through to the upperdir and shadow them. A bind is
+// used rather than the immutable flag as it leaves the upperdir untouched and
+// goes away with the mount. The paths must exist in the image.
+func (d *Driver) protectPaths(logger lager.Logger, rootfsDir string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	logger = logger.Session("protecting-paths", lager.Data{"rootfsDir": rootfsDir, "paths": paths})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	protected := []string{}
+	for _, path := range paths {
+		if err := d.protectPath(logger, rootfsDir, path); err != nil {
+			logger.Error("protecting-path-failed", err, lager.Data{"path": path})
+			d.unprotectPaths(logger, rootfsDir, protected)
+			return err
+		}
+		protected = append(protected, path)
+	}
+
+	return nil
+}
+
+func (d *Driver) protectPath(logger lager.Logger, rootfsDir, path string) error {
+	target, err := protectedPathTarget(rootfsDir, path)
+	if err != nil {
+		return err
+	}
+
+	if err := d.mounter.Mount(logger, target, target, "", unix.MS_BIND, ""); err != nil {
+		return errorspkg.Wrapf(err, "bind mounting protected path %s", path)
+	}
+
+	if err := d.mounter.Mount(logger, "", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		if unmountErr := d.unmounter.Unmount(logger, target, 0); unmountErr != nil {
+			logger.Error("cleaning-up-mount-failed", unmountErr)
+		}
+		return errorspkg.Wrapf(err, "making protected path %s read-only", path)
+	}
+
+	return nil
+}
+
+// unprotectPaths unmounts the binds of protectPaths, which would otherwise
+// keep the rootfs busy.
+func (d *Driver) unprotectPaths(logger lager.Logger, rootfsDir string, paths []string) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		target, err := protectedPathTarget(rootfsDir, paths[i])
+		if err != nil {
+			target = filepath.Join(rootfsDir, filepath.Clean("/"+paths[i]))
+		}
+		if err := d.fsOperations.Unmount(target, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			logger.Error("unmounting-protected-path-failed", err, lager.Data{"path": paths[i]})
+		}
+	}
+}
+
+// protectedPathTarget resolves a path of the rootfs, refusing symlinks that
+// lead out of it, as the bind would then protect a path of the host.
+func protectedPathTarget(rootfsDir, path string) (string, error) {
+	target := filepath.Join(rootfsDir, filepath.Clean("/"+path))
+
+	resolvedRootfs, err := filepath.EvalSymlinks(rootfsDir)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "resolving rootfs path")
+	}
+
+	resolvedTarget, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errorspkg.Errorf("protected path %s does not exist in the image", path)
+		}
+		return "", errorspkg.Wrapf(err, "resolving protected path %s", path)
+	}
+
+	if resolvedTarget != resolvedRootfs && !strings.HasPrefix(resolvedTarget, resolvedRootfs+string(filepath.Separator)) {
+		return "", errorspkg.Errorf("protected path %s resolves outside of the rootfs", path)
+	}
+
+	return resolvedTarget, nil
+}
@@ -0,0 +1,84 @@
+package overlayxfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// QuarantineDirName is the directory of the store corrupt images are moved
+// to when quarantining is enabled.
+const QuarantineDirName = "quarantine"
+
+// WithQuarantine makes RemountAllImages move the images it fails to mount out
+// of the images directory instead of failing, so that the rest of the store
+// keeps working after e.g. an unclean shutdown corrupted some of them. It is
+// disabled by default.
+func (d *Driver) WithQuarantine(enabled bool) *Driver {
+	d.quarantine = enabled
+	return d
+}
+
+// ListQuarantined returns the names of the quarantined images, for operators
+// to inspect under the quarantine directory of the store.
+func (d *Driver) ListQuarantined(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-listing-quarantined")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	entries, err := ioutil.ReadDir(filepath.Join(d.storePath, QuarantineDirName))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, errorspkg.Wrap(err, "reading quarantine directory")
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// quarantineImage moves the image to the quarantine directory, under a
+// unique name if an image with the same id was quarantined before.
+func (d *Driver) quarantineImage(logger lager.Logger, imageID string) error {
+	logger = logger.Session("quarantining-image", lager.Data{"imageID": imageID})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	quarantinePath := filepath.Join(d.storePath, QuarantineDirName)
+	if err := os.MkdirAll(quarantinePath, 0700); err != nil {
+		return errorspkg.Wrap(err, "creating quarantine directory")
+	}
+
+	imagePath := d.imagePath(imageID)
+	if mounted, err := d.IsImageMounted(logger, imagePath); err == nil && mounted {
+		if err := d.unmountRootfs(logger, filepath.Join(imagePath, RootfsDir)); err != nil {
+			return errorspkg.Wrap(err, "unmounting rootfs")
+		}
+	}
+
+	target := filepath.Join(quarantinePath, imageID)
+	err := unix.Renameat2(unix.AT_FDCWD, imagePath, unix.AT_FDCWD, target, unix.RENAME_NOREPLACE)
+	if errors.Is(err, unix.EEXIST) {
+		target = fmt.Sprintf("%s-%d", target, d.clock.Now().UnixNano())
+		err = unix.Renameat2(unix.AT_FDCWD, imagePath, unix.AT_FDCWD, target, unix.RENAME_NOREPLACE)
+	}
+	if err != nil {
+		return errorspkg.Wrapf(err, "moving image %s to quarantine", imageID)
+	}
+
+	logger.Info("image-quarantined", lager.Data{"path": target})
+	return nil
+}
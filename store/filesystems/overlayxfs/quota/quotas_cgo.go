@@ -147,6 +147,48 @@ func Set(logger lager.Logger, projectID uint32, path string, quotaSize uint64) e
 	return nil
 }
 
+// SetInodeLimit caps the number of inodes of the project, leaving its block
+// limits as they are.
+func SetInodeLimit(logger lager.Logger, projectID uint32, path string, inodes uint64) error {
+	logger = logger.Session("set-inode-limit", lager.Data{"projectID": projectID})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := setProjectID(projectID, path); err != nil {
+		logger.Error("setting-project-id-failed", err)
+		return err
+	}
+
+	storeDevicePath, err := getStoreDevicePath(path)
+	if err != nil {
+		logger.Error("ensuring-backing-fs-device-failed", err)
+		return err
+	}
+
+	var d C.fs_disk_quota_t
+	d.d_version = C.FS_DQUOT_VERSION
+	d.d_id = C.__u32(projectID)
+	d.d_flags = C.XFS_PROJ_QUOTA
+
+	d.d_fieldmask = C.FS_DQ_IHARD | C.FS_DQ_ISOFT
+	d.d_ino_hardlimit = C.__u64(inodes)
+	d.d_ino_softlimit = d.d_ino_hardlimit
+
+	var cs = C.CString(storeDevicePath)
+	defer C.free(unsafe.Pointer(cs))
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XSETPQLIM,
+		uintptr(unsafe.Pointer(cs)), uintptr(d.d_id),
+		uintptr(unsafe.Pointer(&d)), 0, 0)
+	if errno != 0 {
+		logger.Error("setting-inode-limit-to-project-id-failed", errno)
+		return errors.Errorf("setting inode limit for projid %d: %v",
+			projectID, errno.Error())
+	}
+
+	return nil
+}
+
 func GetProjectID(logger lager.Logger, path string) (uint32, error) {
 	logger = logger.Session("get-projectid", lager.Data{"path": path})
 	logger.Debug("starting")
@@ -17,6 +17,11 @@ func Set(logger lager.Logger, projectID uint32, path string, quotaSize uint64) e
 	return nil
 }
 
+func SetInodeLimit(logger lager.Logger, projectID uint32, path string, inodes uint64) error {
+	logger.Fatal("running-without-cgo-support", errors.New("can't run without cgo support"))
+	return nil
+}
+
 func GetProjectID(logger lager.Logger, path string) (uint32, error) {
 	logger.Fatal("running-without-cgo-support", errors.New("can't run without cgo support"))
 	return 0, nil
@@ -59,6 +59,17 @@ var _ = Describe("Quotas", func() {
 		})
 	})
 
+	Describe("SetInodeLimit", func() {
+		It("limits the number of files in the path", func() {
+			Expect(quota.Set(logger, 500, directory, 1024*1024)).To(Succeed())
+			Expect(quota.SetInodeLimit(logger, 500, directory, 2)).To(Succeed())
+
+			Expect(ioutil.WriteFile(filepath.Join(directory, "file-1"), []byte("1"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(directory, "file-2"), []byte("2"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(directory, "file-3"), []byte("3"), 0644)).To(MatchError(ContainSubstring("disk quota exceeded")))
+		})
+	})
+
 	Describe("Get", func() {
 		BeforeEach(func() {
 			err := quota.Set(logger, 500, directory, 10*1024*1024)
@@ -0,0 +1,44 @@
+package overlayxfs
+
+import (
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// QuotaUsage is the state of the project quota of an image.
+type QuotaUsage struct {
+	UsedBytes  int64
+	LimitBytes int64
+}
+
+// ImageQuotaUsage reads how many bytes an image uses from its XFS project
+// quota, through the quota manager, which for large images is much faster
+// than walking them. The limit is the one last applied to the image. It
+// returns false when the image has no project quota, e.g. as it was created
+// without a disk limit.
+func (d *Driver) ImageQuotaUsage(logger lager.Logger, imagePath string) (QuotaUsage, bool, error) {
+	logger = logger.Session("overlayxfs-image-quota-usage", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := d.validateImagePath(imagePath); err != nil {
+		return QuotaUsage{}, false, err
+	}
+
+	limit, err := readImageQuota(imagePath)
+	if err != nil {
+		logger.Error("reading-image-quota-failed", err)
+		return QuotaUsage{}, false, err
+	}
+	if limit == 0 {
+		return QuotaUsage{}, false, nil
+	}
+
+	usage, err := d.quotaManager.Usage(logger, imagePath)
+	if err != nil {
+		logger.Error("reading-usage-failed", err)
+		return QuotaUsage{}, false, errorspkg.Wrapf(err, "reading usage of %s", imagePath)
+	}
+
+	return QuotaUsage{UsedBytes: usage, LimitBytes: limit}, true, nil
+}
@@ -0,0 +1,94 @@
+package overlayxfs
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// RateLimitPolicy decides what CreateImage and CreateVolume do when they are
+// called faster than the configured rate.
+type RateLimitPolicy int
+
+const (
+	// BlockWhenRateLimited waits for the rate to allow the call.
+	BlockWhenRateLimited RateLimitPolicy = iota
+	// RejectWhenRateLimited fails the call with ErrRateLimited.
+	RejectWhenRateLimited
+)
+
+var ErrRateLimited = errorspkg.New("create rate limit exceeded")
+
+// WithCreateRateLimit limits CreateImage and CreateVolume to createsPerSecond
+// calls, allowing bursts of up to burst calls. There is no limit by default.
+func (d *Driver) WithCreateRateLimit(createsPerSecond float64, burst int, policy RateLimitPolicy) *Driver {
+	d.createRateLimiter = &tokenBucket{
+		rate:   createsPerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		policy: policy,
+	}
+	return d
+}
+
+// waitForCreateRate applies the create rate limit, if any.
+func (d *Driver) waitForCreateRate(logger lager.Logger) error {
+	if d.createRateLimiter == nil {
+		return nil
+	}
+
+	wait, err := d.createRateLimiter.take(d.clock.Now())
+	if err != nil {
+		logger.Error("create-rate-limited", err)
+		return err
+	}
+
+	if wait > 0 {
+		logger.Info("create-rate-limited-waiting", lager.Data{"wait": wait.String()})
+		<-d.clock.After(wait)
+	}
+
+	return nil
+}
+
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	policy RateLimitPolicy
+}
+
+// take removes a token from the bucket and returns how long to wait for it
+// to be available. When blocking, the token is reserved right away so that
+// concurrent callers queue up behind each other.
+func (b *tokenBucket) take(now time.Time) (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+
+	if b.policy == RejectWhenRateLimited {
+		return 0, ErrRateLimited
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	b.tokens--
+	return wait, nil
+}
@@ -0,0 +1,73 @@
+package overlayxfs
+
+import (
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/grootfs/store/image_manager"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// checkReadOnlySpec checks that a read-only image can be created from the
+// spec: it has nothing to write to, so nothing to limit either.
+func checkReadOnlySpec(spec image_manager.ImageDriverSpec) error {
+	if len(spec.BaseVolumeIDs) == 0 && len(spec.BaseVolumeDigests) == 0 {
+		return errorspkg.New("read-only images need at least one base volume")
+	}
+	if spec.DiskLimit > 0 {
+		return errorspkg.New("read-only images cannot have a disk limit")
+	}
+
+	return nil
+}
+
+// mountReadOnlyImage mounts the base volumes of an image without an upperdir.
+// Overlay needs two lowerdirs at least without one, so a single base volume
+// is bind mounted read-only instead.
+func (d *Driver) mountReadOnlyImage(logger lager.Logger, source, rootfsDir string, lowerDirs, options []string) error {
+	if len(lowerDirs) > 1 {
+		return d.mountImage(logger, source, rootfsDir, d.formatMountData(lowerDirs, "", "", false, options))
+	}
+
+	logger = logger.Session("bind-mounting-volume-to-rootfs", lager.Data{"lowerDir": lowerDirs[0], "rootfsDir": rootfsDir})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	volumePath := filepath.Join(d.storePath, lowerDirs[0])
+	if err := d.mounter.Mount(logger, volumePath, rootfsDir, "", unix.MS_BIND, ""); err != nil {
+		logger.Error("bind-mounting-failed", err)
+		return errorspkg.Wrapf(err, "bind mounting %s", volumePath)
+	}
+
+	if err := d.mounter.Mount(logger, "", rootfsDir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		logger.Error("remounting-read-only-failed", err)
+		if unmountErr := d.unmounter.Unmount(logger, rootfsDir, 0); unmountErr != nil {
+			logger.Error("cleaning-up-mount-failed", unmountErr)
+		}
+		return errorspkg.Wrapf(err, "remounting %s read-only", rootfsDir)
+	}
+
+	return nil
+}
+
+// readOnlyMountInfo describes the mount of a read-only image for callers
+// mounting it themselves.
+func (d *Driver) readOnlyMountInfo(source string, lowerDirs, options []string) groot.MountInfo {
+	if len(lowerDirs) > 1 {
+		return groot.MountInfo{
+			Destination: "/",
+			Source:      source,
+			Type:        "overlay",
+			Options:     []string{d.formatMountData(lowerDirs, "", "", true, options)},
+		}
+	}
+
+	return groot.MountInfo{
+		Destination: "/",
+		Source:      filepath.Join(d.storePath, lowerDirs[0]),
+		Type:        "bind",
+		Options:     []string{"bind", "ro"},
+	}
+}
@@ -0,0 +1,164 @@
+package overlayxfs
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type ReclaimableVolume struct {
+	ID string
+	// Bytes is a lower bound of the space destroying the volume would free,
+	// see reclaimableBytes.
+	Bytes int64
+}
+
+// GarbageCollectDryRun reports at least how many bytes destroying each of the
+// volumes marked for garbage collection would free, biggest first, without
+// touching them.
+func (d *Driver) GarbageCollectDryRun(logger lager.Logger) ([]ReclaimableVolume, error) {
+	logger = logger.Session("overlayxfs-garbage-collect-dry-run")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	reclaimableVolumes := []ReclaimableVolume{}
+	for _, volumeID := range volumeIDs {
+		if !strings.HasPrefix(volumeID, "gc.") {
+			continue
+		}
+
+		reclaimable, err := reclaimableBytes(filepath.Join(d.storePath, store.VolumesDirName, volumeID))
+		if err != nil {
+			logger.Error("measuring-volume-failed", err, lager.Data{"volumeID": volumeID})
+			return nil, errorspkg.Wrapf(err, "measuring volume %s", volumeID)
+		}
+
+		reclaimableVolumes = append(reclaimableVolumes, ReclaimableVolume{ID: volumeID, Bytes: reclaimable})
+	}
+
+	sort.SliceStable(reclaimableVolumes, func(i, j int) bool {
+		return reclaimableVolumes[i].Bytes > reclaimableVolumes[j].Bytes
+	})
+
+	return reclaimableVolumes, nil
+}
+
+// reclaimableBytes returns a lower bound of the space removing path would
+// free: the blocks actually allocated to it, so that holes in sparse files are
+// not counted, minus the extents shared through reflinks. FIEMAP only tells
+// an extent is shared, not with which files, so shared extents are left out
+// even when every file sharing them is under path and would be freed with it.
+// Hard links are counted once.
+func reclaimableBytes(path string) (int64, error) {
+	var total int64
+	seenInodes := map[uint64]bool{}
+
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if seenInodes[stat.Ino] {
+			return nil
+		}
+		seenInodes[stat.Ino] = true
+
+		allocated := stat.Blocks * 512
+		if info.Mode().IsRegular() && allocated > 0 {
+			// Filesystems without FIEMAP support have no reflinks either
+			if shared, err := sharedExtentBytes(filePath); err == nil {
+				allocated -= shared
+			}
+		}
+
+		if allocated > 0 {
+			total += allocated
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+const (
+	fsIOCFiemap        = 0xC020660B
+	fiemapFlagSync     = 0x1
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+	fiemapBatchSize    = 64
+)
+
+// fiemap mirrors struct fiemap from linux/fiemap.h, with room for a batch of
+// extents.
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	_             uint32
+	Extents       [fiemapBatchSize]fiemapExtent
+}
+
+type fiemapExtent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	_        [2]uint64
+	Flags    uint32
+	_        [3]uint32
+}
+
+func sharedExtentBytes(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var shared int64
+	var start uint64
+	for {
+		request := fiemap{
+			Start:       start,
+			Length:      math.MaxUint64 - start,
+			Flags:       fiemapFlagSync,
+			ExtentCount: fiemapBatchSize,
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), fsIOCFiemap, uintptr(unsafe.Pointer(&request))); errno != 0 {
+			return 0, errno
+		}
+
+		if request.MappedExtents == 0 {
+			return shared, nil
+		}
+
+		for _, extent := range request.Extents[:request.MappedExtents] {
+			if extent.Flags&fiemapExtentShared != 0 {
+				shared += int64(extent.Length)
+			}
+			if extent.Flags&fiemapExtentLast != 0 {
+				return shared, nil
+			}
+			start = extent.Logical + extent.Length
+		}
+	}
+}
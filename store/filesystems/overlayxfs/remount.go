@@ -0,0 +1,139 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// MountImage mounts the rootfs of an existing image, using the base volumes
+// and mount options recorded when the image was created. It does nothing if
+// the image is already mounted.
+func (d *Driver) MountImage(logger lager.Logger, imagePath string) error {
+	logger = logger.Session("overlayxfs-mounting-image", lager.Data{"imagePath": imagePath})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	mounted, err := d.IsImageMounted(logger, imagePath)
+	if err != nil {
+		logger.Error("checking-if-image-is-mounted-failed", err)
+		return err
+	}
+	if mounted {
+		logger.Debug("image-already-mounted")
+		return nil
+	}
+
+	metadata, err := d.readImageMetadata(imagePath)
+	if err != nil {
+		logger.Error("reading-image-metadata-failed", err)
+		return err
+	}
+
+	// Before binding, so that it never removes through the binds
+	if err := d.decompressUpper(logger, imagePath); err != nil {
+		logger.Error("decompressing-upperdir-failed", err)
+		return errorspkg.Wrap(err, "decompressing upperdir")
+	}
+
+	// The binds are gone after a reboot
+	if metadata.UpperDevicePath != "" {
+		if err := d.bindDeviceUpperDirs(logger, imagePath, metadata.UpperDevicePath); err != nil {
+			return err
+		}
+	}
+
+	// The kernel leaves this behind after a volatile mount, and refuses to
+	// mount the upperdir again as it cannot tell whether it was synced
+	if _, err := os.Stat(filepath.Join(imagePath, WorkDir, "work", "incompat", "volatile")); err == nil {
+		return errorspkg.Errorf("image %s was mounted with the fast durability policy and cannot be mounted again", imagePath)
+	}
+
+	baseVolumePaths, _, err := d.getLowerDirs(logger, metadata.BaseVolumeIDs)
+	if err != nil {
+		logger.Error("generating-lowerdir-paths-failed", err)
+		return errorspkg.Wrap(err, "generating lowerdir paths failed")
+	}
+
+	if err := os.Chdir(d.storePath); err != nil {
+		return errorspkg.Wrap(err, "failed to change directory to the store path")
+	}
+
+	mountSource := metadata.MountSource
+	if mountSource == "" {
+		mountSource = defaultMountSource
+	}
+
+	rootfsDir := filepath.Join(imagePath, RootfsDir)
+	if metadata.ReadOnly {
+		err = d.mountReadOnlyImage(logger, mountSource, rootfsDir, baseVolumePaths, metadata.MountOptions)
+	} else {
+		upperDir, workDir := overlayUpperDirs(imagePath, metadata.UpperDevicePath)
+		err = d.mountImage(logger, mountSource, rootfsDir, d.formatMountData(baseVolumePaths, workDir, upperDir, false, metadata.MountOptions))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.protectPaths(logger, rootfsDir, metadata.ProtectedPaths); err != nil {
+		if unmountErr := d.unmounter.Unmount(logger, rootfsDir, 0); unmountErr != nil {
+			logger.Error("cleaning-up-mount-failed", unmountErr)
+		}
+		return err
+	}
+
+	if err := d.mountExtraMounts(logger, rootfsDir, metadata.ExtraMounts); err != nil {
+		d.unprotectPaths(logger, rootfsDir, metadata.ProtectedPaths)
+		if unmountErr := d.unmounter.Unmount(logger, rootfsDir, 0); unmountErr != nil {
+			logger.Error("cleaning-up-mount-failed", unmountErr)
+		}
+		return err
+	}
+
+	metadata.LastMountedAt = d.clock.Now()
+	if err := d.writeImageMetadata(imagePath, metadata); err != nil {
+		logger.Error("writing-image-metadata-failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// RemountAllImages mounts every image of the store that is not mounted, e.g.
+// after a reboot. It carries on when an image fails to mount and returns an
+// error listing all the images that could not be mounted, unless quarantining
+// is enabled, in which case they are quarantined instead.
+func (d *Driver) RemountAllImages(logger lager.Logger) error {
+	logger = logger.Session("overlayxfs-remounting-all-images")
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return err
+	}
+
+	failedImages := []string{}
+	for _, imageID := range imageIDs {
+		if err := d.MountImage(logger, d.imagePath(imageID)); err != nil {
+			logger.Error("mounting-image-failed", err, lager.Data{"imageID": imageID})
+			if d.quarantine {
+				quarantineErr := d.quarantineImage(logger, imageID)
+				if quarantineErr == nil {
+					continue
+				}
+				logger.Error("quarantining-image-failed", quarantineErr, lager.Data{"imageID": imageID})
+			}
+			failedImages = append(failedImages, imageID)
+		}
+	}
+
+	if len(failedImages) > 0 {
+		return errorspkg.Errorf("failed to remount images: %s", strings.Join(failedImages, ", "))
+	}
+
+	return nil
+}
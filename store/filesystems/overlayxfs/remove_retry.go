@@ -0,0 +1,49 @@
+package overlayxfs
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultRemoveAttempts is how many times DestroyImage tries to remove the
+	// image directory.
+	DefaultRemoveAttempts = 5
+	// DefaultRemoveBackoff is the wait before the first retry, doubled on
+	// every retry after it.
+	DefaultRemoveBackoff = 50 * time.Millisecond
+)
+
+// WithRemoveRetries sets how many times DestroyImage tries to remove the
+// image directory when it fails with ENOTEMPTY, which happens when a
+// container is still writing to it as it exits, and how long it waits before
+// the first retry.
+func (d *Driver) WithRemoveRetries(attempts int, backoff time.Duration) *Driver {
+	d.removeAttempts = attempts
+	d.removeBackoff = backoff
+	return d
+}
+
+// removeAllWithRetries removes the path, retrying with a backoff on the errors
+// that are expected to go away. Any other error, e.g. EPERM, fails right away.
+func (d *Driver) removeAllWithRetries(logger lager.Logger, path string) error {
+	backoff := d.removeBackoff
+	for attempt := 1; ; attempt++ {
+		err := d.fsOperations.RemoveAll(path)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, unix.ENOTEMPTY) || attempt >= d.removeAttempts {
+			return errorspkg.Wrapf(err, "removing %s after %d attempts", path, attempt)
+		}
+
+		logger.Info("removing-failed-retrying", lager.Data{"path": path, "attempt": attempt, "backoff": backoff.String(), "error": err.Error()})
+		<-d.clock.After(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,155 @@
+package overlayxfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	quotapkg "code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs/quota"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var ErrImageAlreadyExists = errorspkg.New("image already exists")
+
+// RenameImage changes the id of an image without recreating it. A mounted
+// image is unmounted and mounted again under its new path. The image
+// directory is renamed in a single step, so that a crash leaves the image
+// under either its old or its new id. The directory of an image on the upper
+// device is renamed along with it, and bound again.
+func (d *Driver) RenameImage(logger lager.Logger, oldID, newID string) error {
+	logger = logger.Session("overlayxfs-renaming-image", lager.Data{"oldID": oldID, "newID": newID})
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	for _, id := range []string{oldID, newID} {
+		if id == "" || id == "." || id == ".." || strings.ContainsRune(id, filepath.Separator) {
+			return errorspkg.Errorf("invalid image id %q", id)
+		}
+	}
+
+	finishOperation, err := d.startOperation()
+	if err != nil {
+		logger.Error("driver-shutting-down", err)
+		return err
+	}
+	defer finishOperation()
+
+	unlockStore, err := d.lockStore(unix.LOCK_SH)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return err
+	}
+	defer unlockStore()
+
+	if err := d.checkMaintenanceMode(); err != nil {
+		logger.Error("store-in-maintenance-mode", err)
+		return err
+	}
+
+	oldPath := d.imagePath(oldID)
+	newPath := d.imagePath(newID)
+
+	if _, err := os.Stat(oldPath); err != nil {
+		return errorspkg.Wrapf(err, "image %s", oldID)
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return errorspkg.Wrapf(ErrImageAlreadyExists, "renaming image %s to %s", oldID, newID)
+	}
+
+	// Images that failed to be created might not have metadata
+	upperDevicePath := ""
+	if metadata, err := d.readImageMetadata(oldPath); err == nil {
+		upperDevicePath = metadata.UpperDevicePath
+	}
+
+	mounted, err := d.IsImageMounted(logger, oldPath)
+	if err != nil {
+		logger.Error("checking-if-image-is-mounted-failed", err)
+		return err
+	}
+	if mounted {
+		if err := d.unmountRootfs(logger, filepath.Join(oldPath, RootfsDir)); err != nil {
+			logger.Error("unmounting-rootfs-failed", err)
+			return errorspkg.Wrap(err, "unmounting rootfs")
+		}
+	}
+
+	// restore puts the image back the way it was under path
+	restore := func(path string) {
+		if mounted {
+			// Mounting binds the upper device dirs too
+			if err := d.MountImage(logger, path); err != nil {
+				logger.Error("remounting-image-failed", err)
+			}
+		} else if upperDevicePath != "" {
+			if err := d.bindDeviceUpperDirs(logger, path, upperDevicePath); err != nil {
+				logger.Error("binding-upper-device-dirs-failed", err)
+			}
+		}
+	}
+
+	if upperDevicePath != "" {
+		if err := d.unbindDeviceUpperDirs(logger, oldPath); err != nil {
+			logger.Error("unbinding-upper-device-dirs-failed", err)
+			restore(oldPath)
+			return err
+		}
+
+		if err := moveDeviceUpperDirs(upperDevicePath, oldID, newID); err != nil {
+			logger.Error("moving-upper-device-dirs-failed", err)
+			restore(oldPath)
+			return err
+		}
+	}
+
+	// RENAME_NOREPLACE closes the gap between the check above and the rename
+	if err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			err = errorspkg.Wrapf(ErrImageAlreadyExists, "renaming image %s to %s", oldID, newID)
+		} else {
+			err = errorspkg.Wrapf(err, "renaming image %s to %s", oldID, newID)
+		}
+		logger.Error("renaming-image-directory-failed", err)
+
+		if upperDevicePath != "" {
+			if moveErr := moveDeviceUpperDirs(upperDevicePath, newID, oldID); moveErr != nil {
+				logger.Error("moving-upper-device-dirs-back-failed", moveErr)
+			}
+		}
+		restore(oldPath)
+		return err
+	}
+
+	// The project id is set on the image directory itself, so it moves along
+	projectID, err := quotapkg.GetProjectID(logger, newPath)
+	if err != nil {
+		logger.Error("fetching-project-id-failed", err)
+		logger.Info("skipping-project-mapping-update")
+	}
+	if projectID != 0 {
+		if err := d.updateProjectMapping(logger, func(projectIDs map[string]uint32) {
+			delete(projectIDs, oldID)
+			projectIDs[newID] = projectID
+		}); err != nil {
+			logger.Error("updating-project-mapping-failed", err)
+			return err
+		}
+	}
+
+	if mounted {
+		if err := d.MountImage(logger, newPath); err != nil {
+			logger.Error("remounting-image-failed", err)
+			return errorspkg.Wrap(err, "mounting renamed image")
+		}
+	} else if upperDevicePath != "" {
+		if err := d.bindDeviceUpperDirs(logger, newPath, upperDevicePath); err != nil {
+			logger.Error("binding-upper-device-dirs-failed", err)
+			return errorspkg.Wrap(err, "binding upper device dirs of renamed image")
+		}
+	}
+
+	return nil
+}
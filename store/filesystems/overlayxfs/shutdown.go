@@ -0,0 +1,101 @@
+package overlayxfs
+
+import (
+	"context"
+	"sync"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrShuttingDown = errorspkg.New("driver is shutting down")
+
+type ShutdownSummary struct {
+	// InFlight is the number of operations running when Shutdown was called.
+	InFlight int
+	// Unfinished is the number of them still running when Shutdown returned.
+	Unfinished int
+}
+
+// Shutdown makes creating and destroying volumes and images fail with
+// ErrShuttingDown, then waits for the ones already running to finish, e.g.
+// before the store device is unmounted. It returns the context error if the
+// context is done first. The driver cannot be used after Shutdown.
+func (d *Driver) Shutdown(ctx context.Context, logger lager.Logger) (ShutdownSummary, error) {
+	logger = logger.Session("overlayxfs-shutdown")
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	inFlight, idle := d.operations.close()
+	summary := ShutdownSummary{InFlight: inFlight}
+	logger.Info("waiting-for-in-flight-operations", lager.Data{"inFlight": inFlight})
+
+	select {
+	case <-idle:
+		return summary, nil
+	case <-ctx.Done():
+		summary.Unfinished = d.operations.running()
+		logger.Error("in-flight-operations-did-not-finish", ctx.Err(), lager.Data{"unfinished": summary.Unfinished})
+		return summary, errorspkg.Wrap(ctx.Err(), "waiting for in-flight operations")
+	}
+}
+
+// startOperation registers an operation Shutdown has to wait for. The
+// returned function must be called once the operation is over.
+func (d *Driver) startOperation() (func(), error) {
+	if !d.operations.start() {
+		return nil, ErrShuttingDown
+	}
+	return d.operations.finish, nil
+}
+
+type operationTracker struct {
+	mutex    sync.Mutex
+	closed   bool
+	inFlight int
+	idle     chan struct{}
+}
+
+func (t *operationTracker) start() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.inFlight++
+	return true
+}
+
+func (t *operationTracker) finish() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.inFlight--
+	if t.closed && t.inFlight == 0 {
+		close(t.idle)
+	}
+}
+
+func (t *operationTracker) running() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.inFlight
+}
+
+// close stops new operations from starting. It returns how many are running
+// and a channel closed once they are all done.
+func (t *operationTracker) close() (int, <-chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		t.idle = make(chan struct{})
+		if t.inFlight == 0 {
+			close(t.idle)
+		}
+	}
+	return t.inFlight, t.idle
+}
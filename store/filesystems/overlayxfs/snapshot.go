@@ -0,0 +1,80 @@
+package overlayxfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type StoreSnapshot struct {
+	VolumeIDs []string
+	Images    []ImageSnapshot
+}
+
+type ImageSnapshot struct {
+	ID string
+	// BaseVolumesSize is the size of the volumes the image is based on. It is
+	// 0 for images that are still being created.
+	BaseVolumesSize int64
+}
+
+// StoreSnapshot lists the volumes and images of the store at once, so that no
+// image shows up without the volumes it was created from.
+func (d *Driver) StoreSnapshot(logger lager.Logger) (StoreSnapshot, error) {
+	logger = logger.Session("overlayxfs-store-snapshot")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	unlockStore, err := d.lockStore(unix.LOCK_EX)
+	if err != nil {
+		logger.Error("locking-store-failed", err)
+		return StoreSnapshot{}, err
+	}
+	defer unlockStore()
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return StoreSnapshot{}, err
+	}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return StoreSnapshot{}, err
+	}
+
+	images := []ImageSnapshot{}
+	for _, imageID := range imageIDs {
+		size, err := readBaseVolumesSize(d.imagePath(imageID))
+		if err != nil {
+			logger.Error("reading-image-info-failed", err, lager.Data{"imageID": imageID})
+			return StoreSnapshot{}, err
+		}
+
+		images = append(images, ImageSnapshot{ID: imageID, BaseVolumesSize: size})
+	}
+
+	return StoreSnapshot{VolumeIDs: volumeIDs, Images: images}, nil
+}
+
+func readBaseVolumesSize(imagePath string) (int64, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(imagePath, imageInfoName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "reading image info")
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, errorspkg.Wrap(err, "parsing image info")
+	}
+
+	return size, nil
+}
@@ -0,0 +1,132 @@
+package overlayxfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSparseThreshold is the shortest run of zeros ImportVolumes turns
+// into a hole.
+const DefaultSparseThreshold = 64 * 1024
+
+// sparseBlockSize is the granularity zero runs are detected at. Holes can only
+// be punched in whole filesystem blocks.
+const sparseBlockSize = 4096
+
+// WithSparseThreshold sets the shortest run of zeros ImportVolumes turns into
+// a hole in the extracted files, so that files that were sparse before being
+// archived do not take up their full size once imported. The default is
+// DefaultSparseThreshold; 0 disables it.
+func (d *Driver) WithSparseThreshold(threshold int64) *Driver {
+	d.sparseThreshold = threshold
+	return d
+}
+
+// sparsifyVolume punches holes in the runs of zeros of the files of the
+// volume. The files keep their modification time, as it is part of the
+// layer.
+func (d *Driver) sparsifyVolume(logger lager.Logger, volumePath string) error {
+	if d.sparseThreshold <= 0 {
+		return nil
+	}
+
+	var punched int64
+	err := filepath.Walk(volumePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() < d.sparseThreshold {
+			return nil
+		}
+
+		filePunched, err := punchZeroRuns(path, d.sparseThreshold)
+		if err != nil {
+			return errorspkg.Wrapf(err, "punching holes in %s", path)
+		}
+		if filePunched == 0 {
+			return nil
+		}
+		punched += filePunched
+
+		atime := info.ModTime()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			atime = time.Unix(stat.Atim.Unix())
+		}
+		return os.Chtimes(path, atime, info.ModTime())
+	})
+	if err != nil {
+		logger.Error("sparsifying-volume-failed", err)
+		return err
+	}
+
+	logger.Debug("sparsified-volume", lager.Data{"punchedBytes": punched})
+	return nil
+}
+
+// punchZeroRuns deallocates the block aligned runs of zeros of at least
+// threshold bytes in the file, keeping its size. It returns how many bytes it
+// punched.
+func punchZeroRuns(path string, threshold int64) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var (
+		punched  int64
+		offset   int64
+		runStart int64 = -1
+		block          = make([]byte, sparseBlockSize)
+		zeros          = make([]byte, sparseBlockSize)
+	)
+
+	punch := func(end int64) error {
+		if runStart < 0 || end-runStart < threshold {
+			return nil
+		}
+		if err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, runStart, end-runStart); err != nil {
+			return err
+		}
+		punched += end - runStart
+		return nil
+	}
+
+	for {
+		n, err := io.ReadFull(file, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return punched, err
+		}
+
+		// Only whole blocks can be punched, so a partial last block ends the
+		// run
+		if n == sparseBlockSize && bytes.Equal(block, zeros) {
+			if runStart < 0 {
+				runStart = offset
+			}
+		} else {
+			if err := punch(offset); err != nil {
+				return punched, err
+			}
+			runStart = -1
+		}
+		offset += int64(n)
+
+		if n < sparseBlockSize {
+			break
+		}
+	}
+
+	return punched, punch(offset)
+}
@@ -0,0 +1,98 @@
+package overlayxfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// stagingInfix marks the ids volumes are created under until they are
+// complete and moved to their final id, by ImportVolumes, BranchVolume and the
+// base image puller.
+const stagingInfix = "-incomplete-"
+
+// stagingVolumeID is a unique id to create the volume id under until it is
+// complete.
+func stagingVolumeID(id string) string {
+	return fmt.Sprintf("%s%s%d-%d", id, stagingInfix, time.Now().UnixNano(), rand.Int())
+}
+
+// DefaultStagingGracePeriod is how old a staging directory has to be for
+// CleanStagingDirs to consider it abandoned.
+const DefaultStagingGracePeriod = time.Hour
+
+// WithStagingGracePeriod sets how old staging directories have to be for
+// CleanStagingDirs to remove them. It should be longer than any import, as
+// imports running in other processes cannot be told apart from abandoned
+// ones otherwise. The default is DefaultStagingGracePeriod.
+func (d *Driver) WithStagingGracePeriod(gracePeriod time.Duration) *Driver {
+	d.stagingGracePeriod = gracePeriod
+	return d
+}
+
+// CleanStagingDirs removes the volumes left behind half created by a crash,
+// i.e. still under a staging id after the grace period, unless an image is
+// based on them. It returns the paths it removed. Images are not staged, so
+// image ids containing the staging infix are user images and left alone.
+func (d *Driver) CleanStagingDirs(logger lager.Logger) ([]string, error) {
+	logger = logger.Session("overlayxfs-cleaning-staging-dirs")
+	logger.Info("starting")
+	defer logger.Info("ending")
+
+	referencedVolumes, err := d.referencedVolumes(logger)
+	if err != nil {
+		logger.Error("listing-referenced-volumes-failed", err)
+		return nil, err
+	}
+
+	volumeIDs, err := d.abandonedStagingEntries(filepath.Join(d.storePath, store.VolumesDirName))
+	if err != nil {
+		return nil, err
+	}
+
+	cleaned := []string{}
+	for _, volumeID := range volumeIDs {
+		if referencedVolumes[volumeID] {
+			logger.Info("skipping-referenced-staging-volume", lager.Data{"volumeID": volumeID})
+			continue
+		}
+
+		if err := d.DestroyVolume(logger, volumeID); err != nil {
+			return cleaned, err
+		}
+		cleaned = append(cleaned, filepath.Join(d.storePath, store.VolumesDirName, volumeID))
+	}
+
+	logger.Info("cleaned-staging-dirs", lager.Data{"cleaned": cleaned})
+	return cleaned, nil
+}
+
+// abandonedStagingEntries returns the names of the staging directories in dir
+// older than the grace period.
+func (d *Driver) abandonedStagingEntries(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errorspkg.Wrapf(err, "listing %s", dir)
+	}
+
+	now := d.clock.Now()
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.Contains(entry.Name(), stagingInfix) {
+			continue
+		}
+		if now.Sub(entry.ModTime()) < d.stagingGracePeriod {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
@@ -0,0 +1,160 @@
+package overlayxfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/grootfs/groot"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// validateImagePath checks that the path holds an image, so that stats are
+// not reported for arbitrary directories.
+func (d *Driver) validateImagePath(imagePath string) error {
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		return errorspkg.Wrapf(err, "image path (%s) doesn't exist", imagePath)
+	}
+
+	if _, err := os.Stat(filepath.Join(imagePath, RootfsDir)); err != nil {
+		return errorspkg.Errorf("%s is not an image: %s is missing", imagePath, RootfsDir)
+	}
+
+	if d.isReadOnlyImage(imagePath) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(imagePath, UpperDir)); err != nil {
+		// The upperdir might have been compressed by CompressIdleUpper
+		if _, err := os.Stat(filepath.Join(imagePath, compressedUpperName)); err == nil {
+			return nil
+		}
+		return errorspkg.Errorf("%s is not an image: %s is missing", imagePath, UpperDir)
+	}
+
+	return nil
+}
+
+// isReadOnlyImage tells whether the image was created read-only, without an
+// upperdir to measure.
+func (d *Driver) isReadOnlyImage(imagePath string) bool {
+	metadata, err := d.readImageMetadata(imagePath)
+	return err == nil && metadata.ReadOnly
+}
+
+// upperDirStats reports the usage of an image without a quota to read it
+// from, by walking its upperdir.
+func (d *Driver) upperDirStats(ctx context.Context, logger lager.Logger, imagePath string) (groot.VolumeStats, error) {
+	logger = logger.Session("walking-upperdir", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	contents, err := ioutil.ReadFile(filepath.Join(imagePath, imageInfoName))
+	if err != nil {
+		return groot.VolumeStats{}, errorspkg.Wrapf(err, "reading image info %s", imagePath)
+	}
+	volumeSize, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return groot.VolumeStats{}, errorspkg.Wrapf(err, "parsing image info %s", imagePath)
+	}
+
+	exclusiveSize, err := d.upperAllocatedBytes(ctx, imagePath)
+	if err != nil {
+		logger.Error("measuring-upperdir-failed", err)
+		return groot.VolumeStats{}, errorspkg.Wrap(err, "measuring upperdir")
+	}
+
+	return groot.VolumeStats{
+		DiskUsage: groot.DiskUsage{
+			ExclusiveBytesUsed:  exclusiveSize,
+			TotalBytesUsed:      volumeSize + exclusiveSize,
+			CommittedSpaceBytes: volumeSize,
+		},
+	}, nil
+}
+
+// upperAllocatedBytes returns the bytes allocated to what the image wrote:
+// its upperdir, or the archive of a compressed upperdir. Read-only images
+// have written nothing.
+func (d *Driver) upperAllocatedBytes(ctx context.Context, imagePath string) (int64, error) {
+	if d.isReadOnlyImage(imagePath) {
+		return 0, nil
+	}
+
+	upperDir := filepath.Join(imagePath, UpperDir)
+	if _, err := os.Stat(upperDir); os.IsNotExist(err) {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(imagePath, compressedUpperName), &stat); err == nil {
+			return stat.Blocks * 512, nil
+		}
+	}
+
+	return allocatedBytes(ctx, upperDir)
+}
+
+// allocatedBytes adds up the blocks allocated to the contents of the
+// directory, counting hard links once. It stops walking once the context is
+// done.
+func allocatedBytes(ctx context.Context, dir string) (int64, error) {
+	var total int64
+	seenInodes := map[uint64]bool{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || seenInodes[stat.Ino] {
+			return nil
+		}
+		seenInodes[stat.Ino] = true
+
+		total += stat.Blocks * 512
+		return nil
+	})
+
+	return total, err
+}
+
+// UpperBaseline returns the bytes allocated to the upperdir of an image, to be
+// passed to UpperGrowthSince later on.
+func (d *Driver) UpperBaseline(logger lager.Logger, imagePath string) (int64, error) {
+	logger = logger.Session("overlayxfs-upper-baseline", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := d.validateImagePath(imagePath); err != nil {
+		return 0, err
+	}
+
+	size, err := d.upperAllocatedBytes(context.Background(), imagePath)
+	if err != nil {
+		logger.Error("measuring-upperdir-failed", err)
+		return 0, errorspkg.Wrap(err, "measuring upperdir")
+	}
+
+	return size, nil
+}
+
+// UpperGrowthSince returns how many bytes the upperdir of an image grew by
+// since the baseline was taken with UpperBaseline. It is negative when files
+// were removed from the upperdir in the meantime.
+func (d *Driver) UpperGrowthSince(logger lager.Logger, imagePath string, baseline int64) (int64, error) {
+	size, err := d.UpperBaseline(logger, imagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return size - baseline, nil
+}
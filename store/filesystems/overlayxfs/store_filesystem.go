@@ -0,0 +1,53 @@
+package overlayxfs
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/grootfs/store/filesystems"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrNotXFS = errorspkg.New("store is not on XFS")
+
+// filesystemNames names the filesystems stores are most often mistakenly
+// put on, by their statfs magic.
+var filesystemNames = map[int64]string{
+	0xEF53:     "ext4",
+	0x01021994: "tmpfs",
+	0x9123683E: "btrfs",
+	0x794C7630: "overlay",
+	0x6969:     "nfs",
+	0x2FC12FC1: "zfs",
+}
+
+// WithSkipXFSCheck disables checking that the store is on XFS before
+// configuring it and setting quotas, for stores that are intentionally used
+// without disk limits.
+func (d *Driver) WithSkipXFSCheck(skip bool) *Driver {
+	d.skipXFSCheck = skip
+	return d
+}
+
+// checkXFS fails with an error naming the filesystem the path is on unless it
+// is XFS, which project quotas require.
+func (d *Driver) checkXFS(path string) error {
+	if d.skipXFSCheck {
+		return nil
+	}
+
+	stat, err := d.fsOperations.Statfs(path)
+	if err != nil {
+		return errorspkg.Wrapf(err, "statfs %s", path)
+	}
+
+	fsType := int64(stat.Type)
+	if fsType == filesystems.XfsType {
+		return nil
+	}
+
+	name, ok := filesystemNames[fsType]
+	if !ok {
+		name = fmt.Sprintf("filesystem type 0x%x", fsType)
+	}
+	return errorspkg.Wrapf(ErrNotXFS, "%s is on %s, project quotas need XFS", path, name)
+}
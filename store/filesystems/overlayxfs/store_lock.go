@@ -0,0 +1,59 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// StoreLockFileName is the lock, in the locks directory of the store, taken
+// by the operations that need the store not to change under them. Each
+// grootfs command is a process of its own, hence a file lock.
+const StoreLockFileName = "store.lock"
+
+// CapacityLockFileName is the lock, in the locks directory of the store,
+// serializing the images checking their disk limit against the space left,
+// so that two creates cannot both commit the same space.
+const CapacityLockFileName = "capacity.lock"
+
+// lockStore flocks the store lock and returns the function releasing it.
+//
+// The operations adding or removing volumes and images take it shared, so
+// that they do not wait for each other. The ones reading the store as a
+// whole, e.g. StoreSnapshot, take it exclusive to see the store in between
+// them, as does DestroyStore.
+func (d *Driver) lockStore(how int) (func(), error) {
+	return d.lockFile(StoreLockFileName, how)
+}
+
+// lockCapacity flocks the capacity lock exclusively and returns the function
+// releasing it.
+func (d *Driver) lockCapacity() (func(), error) {
+	return d.lockFile(CapacityLockFileName, unix.LOCK_EX)
+}
+
+func (d *Driver) lockFile(name string, how int) (func(), error) {
+	locksPath := filepath.Join(d.storePath, store.LocksDirName)
+	// The store itself is not created here, it has to be initialized
+	if err := os.Mkdir(locksPath, 0755); err != nil && !os.IsExist(err) {
+		return nil, errorspkg.Wrap(err, "creating locks directory")
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(locksPath, name), os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, errorspkg.Wrapf(err, "opening lock %s", name)
+	}
+
+	if err := unix.Flock(int(lockFile.Fd()), how); err != nil {
+		lockFile.Close()
+		return nil, errorspkg.Wrapf(err, "locking %s", name)
+	}
+
+	return func() {
+		_ = unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
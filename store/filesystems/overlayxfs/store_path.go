@@ -0,0 +1,66 @@
+package overlayxfs
+
+// WithStorePath returns a driver for another store, configured like this one,
+// so that a process managing several stores does not have to build a driver
+// for each of them. Unlike the other options it leaves this driver untouched.
+//
+// The state of the drivers is per store: the maintenance mode, the caches and
+// the operations waited for by Shutdown are not shared. The create rate limit
+// is, as it protects the host rather than a store.
+func (d *Driver) WithStorePath(storePath string) *Driver {
+	driver := &Driver{
+		storePath:               storePath,
+		tardisBinPath:           d.tardisBinPath,
+		unmounter:               d.unmounter,
+		mounter:                 d.mounter,
+		directIO:                d.directIO,
+		quotaManager:            d.quotaManager,
+		diskLimitShrinkPolicy:   d.diskLimitShrinkPolicy,
+		diskLimitCapacityPolicy: d.diskLimitCapacityPolicy,
+		destroyOptions:          d.destroyOptions,
+		clock:                   d.clock,
+		fsOperations:            d.fsOperations,
+		kernelLogReader:         d.kernelLogReader,
+		cleanupOnError:          d.cleanupOnError,
+		createRateLimiter:       d.createRateLimiter,
+		mountTimeout:            d.mountTimeout,
+		importReserve:           d.importReserve,
+		inodeLimit:              d.inodeLimit,
+		upperDevicePath:         d.upperDevicePath,
+		quarantine:              d.quarantine,
+		stagingGracePeriod:      d.stagingGracePeriod,
+		removeAttempts:          d.removeAttempts,
+		removeBackoff:           d.removeBackoff,
+		unmountAttempts:         d.unmountAttempts,
+		unmountBackoff:          d.unmountBackoff,
+		digestAlgorithm:         d.digestAlgorithm,
+		missingParentPolicy:     d.missingParentPolicy,
+		sparseThreshold:         d.sparseThreshold,
+		allowedOverlayOptions:   d.allowedOverlayOptions,
+		maxLayers:               d.maxLayers,
+		skipXFSCheck:            d.skipXFSCheck,
+		skipMountVerification:   d.skipMountVerification,
+		metaDirName:             d.metaDirName,
+		metricsEmitter:          d.metricsEmitter,
+		volumeDirMode:           d.volumeDirMode,
+		imageDirMode:            d.imageDirMode,
+	}
+
+	d.metricsCache.mutex.Lock()
+	driver.metricsCache.ttl = d.metricsCache.ttl
+	driver.metricsCache.threshold = d.metricsCache.threshold
+	d.metricsCache.mutex.Unlock()
+
+	d.volumeCache.mutex.RLock()
+	driver.WithVolumePathCache(d.volumeCache.enabled)
+	d.volumeCache.mutex.RUnlock()
+
+	if _, ok := d.quotaManager.(*tardisQuotaManager); ok {
+		driver.quotaManager = &tardisQuotaManager{driver: driver}
+	}
+	if _, ok := d.mounter.(*fsOperationsMounter); ok {
+		driver.mounter = &fsOperationsMounter{driver: driver}
+	}
+
+	return driver
+}
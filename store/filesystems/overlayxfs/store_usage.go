@@ -0,0 +1,102 @@
+package overlayxfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// StoreUsage is how many bytes the volumes and the images of a store use.
+type StoreUsage struct {
+	VolumesBytes int64
+	// ImagesBytes only counts what the images wrote, their layers being
+	// counted in VolumesBytes.
+	ImagesBytes int64
+	TotalBytes  int64
+}
+
+// MeasureStore adds up the usage of every volume and image of the store, e.g.
+// for capacity planning. Images are measured from their project quota when
+// they have one, and by walking their upperdir otherwise. Volumes and images
+// destroyed while being measured are left out.
+func (d *Driver) MeasureStore(logger lager.Logger) (StoreUsage, error) {
+	return d.MeasureStoreContext(context.Background(), logger)
+}
+
+// MeasureStoreContext is MeasureStore giving up once the context is done.
+func (d *Driver) MeasureStoreContext(ctx context.Context, logger lager.Logger) (StoreUsage, error) {
+	logger = logger.Session("overlayxfs-measure-store")
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumeIDs, err := d.Volumes(logger)
+	if err != nil {
+		return StoreUsage{}, err
+	}
+
+	var usage StoreUsage
+	for _, id := range volumeIDs {
+		size, err := allocatedBytes(ctx, filepath.Join(d.storePath, store.VolumesDirName, id))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				logger.Debug("volume-vanished", lager.Data{"volumeID": id})
+				continue
+			}
+			logger.Error("measuring-volume-failed", err, lager.Data{"volumeID": id})
+			return StoreUsage{}, errorspkg.Wrapf(err, "measuring volume %s", id)
+		}
+		usage.VolumesBytes += size
+	}
+
+	imageIDs, err := d.imageIDs()
+	if err != nil {
+		return StoreUsage{}, err
+	}
+
+	for _, id := range imageIDs {
+		size, err := d.measureImage(ctx, logger, d.imagePath(id))
+		if err != nil {
+			if _, statErr := os.Stat(d.imagePath(id)); os.IsNotExist(statErr) {
+				logger.Debug("image-vanished", lager.Data{"imageID": id})
+				continue
+			}
+			logger.Error("measuring-image-failed", err, lager.Data{"imageID": id})
+			return StoreUsage{}, errorspkg.Wrapf(err, "measuring image %s", id)
+		}
+		usage.ImagesBytes += size
+	}
+
+	usage.TotalBytes = usage.VolumesBytes + usage.ImagesBytes
+	return usage, nil
+}
+
+// measureImage returns the bytes written to the image. Read-only images have
+// no upperdir and use none.
+func (d *Driver) measureImage(ctx context.Context, logger lager.Logger, imagePath string) (int64, error) {
+	upperDir := filepath.Join(imagePath, UpperDir)
+	if _, err := os.Stat(upperDir); err != nil {
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(imagePath); err != nil {
+				return 0, err
+			}
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	quotaUsage, hasQuota, err := d.ImageQuotaUsage(logger, imagePath)
+	if err != nil {
+		return 0, err
+	}
+	if hasQuota {
+		return quotaUsage.UsedBytes, nil
+	}
+
+	return allocatedBytes(ctx, upperDir)
+}
@@ -14,8 +14,8 @@ import (
 
 var LimitCommand = cli.Command{
 	Name:        "limit",
-	Usage:       "limit --disk-limit-bytes 102400 --image-path <path>",
-	Description: "Add disk limits to the volume.",
+	Usage:       "limit [--disk-limit-bytes 102400] [--inode-limit 1024] --image-path <path>",
+	Description: "Add disk and inode limits to the volume.",
 
 	Flags: []cli.Flag{
 		&cli.StringFlag{
@@ -26,6 +26,10 @@ var LimitCommand = cli.Command{
 			Name:  "disk-limit-bytes",
 			Usage: "Disk limit in bytes",
 		},
+		&cli.Uint64Flag{
+			Name:  "inode-limit",
+			Usage: "Maximum number of inodes",
+		},
 	},
 
 	Action: func(ctx *cli.Context) error {
@@ -39,11 +43,18 @@ var LimitCommand = cli.Command{
 		imagesPath := filepath.Dir(imagePath)
 
 		diskLimit := uint64(ctx.Int64("disk-limit-bytes"))
-		idDiscoverer := ids.NewDiscoverer(filepath.Join(filepath.Dir(imagesPath), overlayxfs.IDDir))
-		projectID, err := idDiscoverer.Alloc(logger)
-		if err != nil {
-			logger.Error("allocating-project-id", err)
-			return errorspkg.Wrap(err, "allocating project id")
+		inodeLimit := ctx.Uint64("inode-limit")
+
+		// Changing the limit of an image that already has a quota must keep its
+		// project id, otherwise the usage accounted so far would be lost
+		projectID, err := quotapkg.GetProjectID(logger, imagePath)
+		if err != nil || projectID == 0 {
+			idDiscoverer := ids.NewDiscoverer(filepath.Join(filepath.Dir(imagesPath), overlayxfs.IDDir))
+			projectID, err = idDiscoverer.Alloc(logger)
+			if err != nil {
+				logger.Error("allocating-project-id", err)
+				return errorspkg.Wrap(err, "allocating project id")
+			}
 		}
 
 		return func(logger lager.Logger) error {
@@ -51,9 +62,19 @@ var LimitCommand = cli.Command{
 			logger.Debug("starting")
 			defer logger.Debug("ending")
 
-			if err := quotapkg.Set(logger, projectID, imagePath, diskLimit); err != nil {
-				logger.Error("setting-quota-failed", err)
-				return errorspkg.Wrapf(err, "setting quota to %s", imagePath)
+			// Only the inode limit is changed when it is the only one given
+			if ctx.IsSet("disk-limit-bytes") || !ctx.IsSet("inode-limit") {
+				if err := quotapkg.Set(logger, projectID, imagePath, diskLimit); err != nil {
+					logger.Error("setting-quota-failed", err)
+					return errorspkg.Wrapf(err, "setting quota to %s", imagePath)
+				}
+			}
+
+			if ctx.IsSet("inode-limit") {
+				if err := quotapkg.SetInodeLimit(logger, projectID, imagePath, inodeLimit); err != nil {
+					logger.Error("setting-inode-limit-failed", err)
+					return errorspkg.Wrapf(err, "setting inode limit to %s", imagePath)
+				}
 			}
 			return nil
 		}(logger)
@@ -36,6 +36,13 @@ func VolumeStats(logger lager.Logger, imagePath string) (groot.VolumeStats, erro
 
 	logger.Debug("usage", lager.Data{"volumeSize": volumeSize, "exclusiveSize": exclusiveSize})
 
+	// XFS lets the usage of a project go slightly over its hard limit, e.g.
+	// with delayed allocations, but the image cannot be charged for more than
+	// its quota
+	if quotaSize > 0 && exclusiveSize > quotaSize {
+		exclusiveSize = quotaSize
+	}
+
 	return groot.VolumeStats{
 		DiskUsage: groot.DiskUsage{
 			ExclusiveBytesUsed:  exclusiveSize,
@@ -0,0 +1,135 @@
+package overlayxfs
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DestroyOptions control how DestroyImage tears the rootfs of an image down.
+// The zero value is a normal unmount, failing when the rootfs is busy.
+type DestroyOptions struct {
+	// UnmountFlags are passed to umount2, e.g. unix.MNT_DETACH or
+	// unix.MNT_FORCE.
+	UnmountFlags int
+	// AllowDetachedUnmount retries with MNT_DETACH when the unmount fails
+	// with EBUSY, so that the image is still removed. The rootfs is then only
+	// released once the processes using it are done, which can hide leaked
+	// mounts, so it is logged when it happens.
+	AllowDetachedUnmount bool
+	// WaitForUnmount makes DestroyImage wait for the rootfs to be gone from
+	// mountinfo before removing the image, e.g. for unmounters that return
+	// before the unmount completes. It waits for WaitForUnmountTimeout at
+	// most, DefaultWaitForUnmountTimeout if unset. A MNT_DETACH unmount,
+	// including the detached fallback, leaves mountinfo right away, so this does
+	// not wait for the overlay to be released by the processes still using
+	// it.
+	WaitForUnmount        bool
+	WaitForUnmountTimeout time.Duration
+}
+
+const (
+	DefaultWaitForUnmountTimeout = 5 * time.Second
+	waitForUnmountInterval       = 50 * time.Millisecond
+)
+
+var ErrUnmountTimeout = errorspkg.New("rootfs is still mounted")
+
+// WithDestroyOptions sets the options used by DestroyImage.
+func (d *Driver) WithDestroyOptions(options DestroyOptions) *Driver {
+	d.destroyOptions = options
+	return d
+}
+
+func (d *Driver) unmountRootfs(logger lager.Logger, rootfsPath string) error {
+	defer d.metricsEmitter.TryEmitDurationFrom(logger, MetricUnmountTime, time.Now())
+	options := d.destroyOptions
+
+	d.unmountRootfsSubmounts(logger, rootfsPath)
+
+	err := d.unmounter.Unmount(logger, rootfsPath, options.UnmountFlags)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+		// Unmounters returning the bare errno leave it to the caller to
+		// decide that a rootfs which is not mounted is fine
+		logger.Debug("rootfs-not-mounted", lager.Data{"rootfsPath": rootfsPath})
+		return nil
+	}
+	if err == nil || !errors.Is(err, unix.EBUSY) || !options.AllowDetachedUnmount || options.UnmountFlags&unix.MNT_DETACH != 0 {
+		return err
+	}
+
+	// A detached mount goes away once the last process using it is done,
+	// which is enough for the image directory to be removed
+	logger.Info("rootfs-busy-falling-back-to-lazy-unmount", lager.Data{"rootfsPath": rootfsPath})
+	return d.unmounter.Unmount(logger, rootfsPath, options.UnmountFlags|unix.MNT_DETACH)
+}
+
+// unmountRootfsSubmounts unmounts what the image mounted over its rootfs,
+// which would otherwise keep the rootfs busy.
+func (d *Driver) unmountRootfsSubmounts(logger lager.Logger, rootfsPath string) {
+	// Images that failed to be created might not have metadata
+	if metadata, err := d.readImageMetadata(filepath.Dir(rootfsPath)); err == nil {
+		d.unmountExtraMounts(logger, rootfsPath, metadata.ExtraMounts)
+		d.unprotectPaths(logger, rootfsPath, metadata.ProtectedPaths)
+	}
+
+	d.unmountLeftoverSubmounts(logger, rootfsPath)
+}
+
+// unmountLeftoverSubmounts unmounts what is still mounted under the rootfs,
+// e.g. extra mounts the workload moved, deepest first. Their mount points
+// come from mountinfo rather than from the rootfs, which the workload can
+// write to.
+func (d *Driver) unmountLeftoverSubmounts(logger lager.Logger, rootfsPath string) {
+	resolvedRootfs, err := filepath.EvalSymlinks(rootfsPath)
+	if err != nil {
+		return
+	}
+
+	mountPoints, err := d.mountsUnder(resolvedRootfs)
+	if err != nil {
+		logger.Error("listing-leftover-submounts-failed", err)
+		return
+	}
+
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		logger.Info("unmounting-leftover-submount", lager.Data{"mountPoint": mountPoints[i]})
+		err := d.unmounter.Unmount(logger, mountPoints[i], unix.UMOUNT_NOFOLLOW)
+		if err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+			logger.Error("unmounting-leftover-submount-failed", err, lager.Data{"mountPoint": mountPoints[i]})
+		}
+	}
+}
+
+// waitForUnmount polls mountinfo until the rootfs of the image is gone. A
+// detached mount is gone from mountinfo as soon as it is detached, while the
+// overlay and the space of its upperdir are only released once the last
+// process using it is done, which is not waited for.
+func (d *Driver) waitForUnmount(logger lager.Logger, imagePath string) error {
+	timeout := d.destroyOptions.WaitForUnmountTimeout
+	if timeout <= 0 {
+		timeout = DefaultWaitForUnmountTimeout
+	}
+	deadline := d.clock.After(timeout)
+
+	for {
+		mounted, err := d.IsImageMounted(logger, imagePath)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			return nil
+		}
+
+		select {
+		case <-deadline:
+			logger.Info("rootfs-still-mounted", lager.Data{"timeout": timeout.String()})
+			return errorspkg.Wrapf(ErrUnmountTimeout, "after waiting for %s", timeout)
+		case <-d.clock.After(waitForUnmountInterval):
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/moby/sys/mountinfo"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// WithUpperDevicePath places the upperdir and workdir of new images under
+// path, e.g. on a faster device than the one holding the volumes. They are
+// bind mounted into the image path, so that the image looks the same as one
+// kept entirely in the store. Disk limits only account for what is written
+// to the store, so they do not apply to images created this way.
+func (d *Driver) WithUpperDevicePath(path string) *Driver {
+	d.upperDevicePath = path
+	return d
+}
+
+// overlayUpperDirs returns the upperdir and workdir the overlay of the image
+// is mounted with. Overlay requires both to be under the same mount, so the
+// ones on the upper device are used directly rather than their binds.
+func overlayUpperDirs(imagePath, upperDevicePath string) (string, string) {
+	if upperDevicePath == "" {
+		return filepath.Join(imagePath, UpperDir), filepath.Join(imagePath, WorkDir)
+	}
+
+	deviceImagePath := filepath.Join(upperDevicePath, filepath.Base(imagePath))
+	return filepath.Join(deviceImagePath, UpperDir), filepath.Join(deviceImagePath, WorkDir)
+}
+
+// createDeviceUpperDirs creates the upperdir and workdir of the image on the
+// upper device and binds them into the image path.
+func (d *Driver) createDeviceUpperDirs(logger lager.Logger, imagePath string, ownerUID, ownerGID int) error {
+	logger = logger.Session("creating-upper-device-dirs", lager.Data{"upperDevicePath": d.upperDevicePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	upperDir, workDir := overlayUpperDirs(imagePath, d.upperDevicePath)
+	if err := d.fsOperations.Mkdir(filepath.Dir(upperDir), 0700); err != nil {
+		return errorspkg.Wrap(err, "creating image directory on the upper device")
+	}
+
+	if err := d.createImageDirectories(logger, map[string]string{"upperdir": upperDir, "workdir": workDir}, map[string]string{}, ownerUID, ownerGID); err != nil {
+		return err
+	}
+
+	if err := d.validateUpperDirsColocated(upperDir, workDir); err != nil {
+		logger.Error("validating-upper-dirs-failed", err)
+		return err
+	}
+
+	return d.bindDeviceUpperDirs(logger, imagePath, d.upperDevicePath)
+}
+
+// validateUpperDirsColocated checks that the upperdir and workdir are on the
+// same filesystem, as overlay refuses to mount them otherwise.
+func (d *Driver) validateUpperDirsColocated(upperDir, workDir string) error {
+	devices := []uint64{}
+	for _, dir := range []string{upperDir, workDir} {
+		info, err := d.fsOperations.Stat(dir)
+		if err != nil {
+			return errorspkg.Wrapf(err, "stat %s", dir)
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errorspkg.Errorf("reading the device of %s", dir)
+		}
+		devices = append(devices, uint64(stat.Dev))
+	}
+
+	if devices[0] != devices[1] {
+		return errorspkg.Errorf("upperdir %s and workdir %s are on different filesystems", upperDir, workDir)
+	}
+
+	return nil
+}
+
+// bindDeviceUpperDirs binds the upperdir and workdir on the upper device into
+// the image path, unless they already are, e.g. when remounting an image.
+func (d *Driver) bindDeviceUpperDirs(logger lager.Logger, imagePath, upperDevicePath string) error {
+	upperDir, workDir := overlayUpperDirs(imagePath, upperDevicePath)
+	binds := map[string]string{
+		upperDir: filepath.Join(imagePath, UpperDir),
+		workDir:  filepath.Join(imagePath, WorkDir),
+	}
+
+	for source, target := range binds {
+		bound, err := d.isMountPoint(target)
+		if err != nil {
+			return err
+		}
+		if bound {
+			continue
+		}
+
+		if err := d.mounter.Mount(logger, source, target, "", syscall.MS_BIND, ""); err != nil {
+			logger.Error("binding-upper-device-dir-failed", err, lager.Data{"source": source, "target": target})
+			return errorspkg.Wrapf(err, "binding %s to %s", source, target)
+		}
+	}
+
+	return nil
+}
+
+// removeDeviceUpperDirs undoes createDeviceUpperDirs. The overlay of the image
+// must be unmounted already.
+func (d *Driver) removeDeviceUpperDirs(logger lager.Logger, imagePath, upperDevicePath string) error {
+	logger = logger.Session("removing-upper-device-dirs", lager.Data{"upperDevicePath": upperDevicePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := d.unbindDeviceUpperDirs(logger, imagePath); err != nil {
+		return err
+	}
+
+	upperDir, _ := overlayUpperDirs(imagePath, upperDevicePath)
+	return errorspkg.Wrap(d.fsOperations.RemoveAll(filepath.Dir(upperDir)), "removing image directory on the upper device")
+}
+
+// unbindDeviceUpperDirs undoes bindDeviceUpperDirs. The overlay of the image
+// must be unmounted already.
+func (d *Driver) unbindDeviceUpperDirs(logger lager.Logger, imagePath string) error {
+	for _, target := range []string{filepath.Join(imagePath, UpperDir), filepath.Join(imagePath, WorkDir)} {
+		bound, err := d.isMountPoint(target)
+		if err != nil {
+			return err
+		}
+		if !bound {
+			continue
+		}
+
+		if err := d.unmounter.Unmount(logger, target, 0); err != nil {
+			logger.Error("unbinding-upper-device-dir-failed", err, lager.Data{"target": target})
+			return errorspkg.Wrapf(err, "unbinding %s", target)
+		}
+	}
+
+	return nil
+}
+
+// moveDeviceUpperDirs renames the directory of the image on the upper device
+// along with the image, as it is named after it.
+func moveDeviceUpperDirs(upperDevicePath, oldID, newID string) error {
+	oldPath := filepath.Join(upperDevicePath, oldID)
+	newPath := filepath.Join(upperDevicePath, newID)
+	if err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE); err != nil {
+		return errorspkg.Wrapf(err, "moving %s to %s", oldPath, newPath)
+	}
+
+	return nil
+}
+
+func (d *Driver) isMountPoint(path string) (bool, error) {
+	mountInfoFile, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return false, errorspkg.Wrap(err, "opening mountinfo")
+	}
+	defer mountInfoFile.Close()
+
+	mounts, err := mountinfo.GetMountsFromReader(mountInfoFile, mountinfo.SingleEntryFilter(path))
+	if err != nil {
+		return false, errorspkg.Wrap(err, "parsing mountinfo")
+	}
+
+	return len(mounts) > 0, nil
+}
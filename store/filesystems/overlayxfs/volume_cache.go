@@ -0,0 +1,61 @@
+package overlayxfs
+
+import "sync"
+
+// volumeCache remembers which volumes exist for the duration of a create, so
+// that resolving the paths of the many volumes of an image does not stat each
+// of them every time. Only existing volumes are remembered, so that new
+// volumes are seen right away.
+type volumeCache struct {
+	mutex   sync.RWMutex
+	enabled bool
+	volumes map[string]bool
+}
+
+// WithVolumePathCache makes VolumePath remember the volumes it found until an
+// image is created, so that pulling and creating an image stats each of its
+// volumes once. Volumes destroyed or moved are forgotten right away. It is
+// disabled by default, as volumes removed behind the back of the driver would
+// still be reported as existing.
+func (d *Driver) WithVolumePathCache(enabled bool) *Driver {
+	d.volumeCache.mutex.Lock()
+	defer d.volumeCache.mutex.Unlock()
+
+	d.volumeCache.enabled = enabled
+	d.volumeCache.volumes = map[string]bool{}
+	return d
+}
+
+// InvalidateVolumeCache makes VolumePath look the volume up again.
+func (d *Driver) InvalidateVolumeCache(id string) {
+	d.volumeCache.mutex.Lock()
+	defer d.volumeCache.mutex.Unlock()
+
+	delete(d.volumeCache.volumes, id)
+}
+
+func (c *volumeCache) exists(id string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.enabled && c.volumes[id]
+}
+
+func (c *volumeCache) add(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.enabled {
+		c.volumes[id] = true
+	}
+}
+
+// clear forgets every volume, once the create they were found for returns.
+func (c *volumeCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.enabled {
+		c.volumes = map[string]bool{}
+	}
+}
@@ -0,0 +1,82 @@
+package overlayxfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	errorspkg "github.com/pkg/errors"
+)
+
+// completeMarkerSuffix names the file CreateVolume writes in the meta
+// directory once a volume has been fully created.
+const completeMarkerSuffix = ".complete"
+
+// ErrIncompleteVolume is returned by CreateVolume when the volume directory
+// exists but was left half created, e.g. by an interrupted process. It has to
+// be destroyed before the volume can be created again.
+var ErrIncompleteVolume = errorspkg.New("volume exists but is incomplete")
+
+func (d *Driver) volumeCompleteMarkerPath(id string) string {
+	return d.volumeMetaFilePath(id) + completeMarkerSuffix
+}
+
+func (d *Driver) markVolumeComplete(id string) error {
+	if err := os.MkdirAll(d.metaPath(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.volumeCompleteMarkerPath(id), []byte{}, 0644)
+}
+
+// existingVolume checks the volume directory left by a previous create. It is
+// returned as is if that create completed.
+func (d *Driver) existingVolume(id, volumePath string) (string, error) {
+	stat, err := os.Stat(volumePath)
+	if err != nil {
+		return "", errorspkg.Wrap(err, "creating volume")
+	}
+	if !stat.IsDir() {
+		return "", errorspkg.Errorf("creating volume: %s exists and is not a directory", volumePath)
+	}
+
+	if _, err := os.Stat(d.volumeCompleteMarkerPath(id)); err != nil {
+		if !os.IsNotExist(err) {
+			return "", errorspkg.Wrap(err, "checking volume completeness")
+		}
+		complete, err := d.legacyVolumeComplete(id)
+		if err != nil {
+			return "", errorspkg.Wrap(err, "checking volume completeness")
+		}
+		if !complete {
+			return "", errorspkg.Wrapf(ErrIncompleteVolume, "creating volume %s", id)
+		}
+	}
+
+	return volumePath, nil
+}
+
+// legacyVolumeComplete tells whether a volume without a complete marker,
+// e.g. created before the markers were introduced, got as far as having its
+// link and its meta written.
+func (d *Driver) legacyVolumeComplete(id string) (bool, error) {
+	for _, path := range []string{filepath.Join(d.storePath, LinksDirName, id), d.volumeMetaFilePath(id)} {
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// moveVolumeCompleteMarker follows a volume being moved. Volumes created
+// before the markers were introduced have none.
+func (d *Driver) moveVolumeCompleteMarker(from, to string) error {
+	err := os.Rename(d.volumeCompleteMarkerPath(filepath.Base(from)), d.volumeCompleteMarkerPath(filepath.Base(to)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package overlayxfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/lager/v3"
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+var ErrVolumeDigestNotFound = errorspkg.New("no volume with this digest")
+
+// Volumes can be looked up by the digest of their content, as in OCI layouts,
+// through links in the volumes directory: volumes/<algorithm>/<encoded>
+// pointing at the volume.
+func (d *Driver) volumeDigestLinkPath(digest digestpkg.Digest) string {
+	return filepath.Join(d.storePath, store.VolumesDirName, digest.Algorithm().String(), digest.Encoded())
+}
+
+// isVolumeDigestDir tells the directories holding the digest links apart from
+// the volumes.
+func isVolumeDigestDir(name string) bool {
+	return digestpkg.Algorithm(name).Available()
+}
+
+// LinkVolumeDigest makes the volume resolvable by the digest of its content,
+// replacing the volume the digest resolved to before, if any.
+func (d *Driver) LinkVolumeDigest(logger lager.Logger, id string, digest digestpkg.Digest) error {
+	logger = logger.Session("overlayxfs-linking-volume-digest", lager.Data{"volumeID": id, "digest": digest})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	return d.linkVolumeDigest(id, digest)
+}
+
+func (d *Driver) linkVolumeDigest(id string, digest digestpkg.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errorspkg.Wrapf(err, "invalid digest %q", digest)
+	}
+
+	if _, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, id)); err != nil {
+		return errorspkg.Wrapf(err, "volume does not exist `%s`", id)
+	}
+
+	linkPath := d.volumeDigestLinkPath(digest)
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return errorspkg.Wrap(err, "creating volume digests directory")
+	}
+
+	// The link is relative, so that the store can be moved around. It is
+	// renamed into place, each process linking under a name of its own.
+	tmpLinkPath := fmt.Sprintf("%s.tmp-%d-%d", linkPath, os.Getpid(), d.clock.Now().UnixNano())
+	if err := os.Symlink(filepath.Join("..", id), tmpLinkPath); err != nil {
+		return errorspkg.Wrapf(err, "linking digest %s", digest)
+	}
+
+	if err := os.Rename(tmpLinkPath, linkPath); err != nil {
+		_ = os.Remove(tmpLinkPath)
+		return errorspkg.Wrapf(err, "linking digest %s", digest)
+	}
+
+	return nil
+}
+
+// ResolveVolumeDigest returns the id of the volume with the given content
+// digest. Volumes named after the encoded digest, which is how layers are
+// usually stored, are linked on first use.
+func (d *Driver) ResolveVolumeDigest(logger lager.Logger, digest digestpkg.Digest) (string, error) {
+	logger = logger.Session("overlayxfs-resolving-volume-digest", lager.Data{"digest": digest})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	return d.resolveVolumeDigest(logger, digest)
+}
+
+func (d *Driver) resolveVolumeDigest(logger lager.Logger, digest digestpkg.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errorspkg.Wrapf(err, "invalid digest %q", digest)
+	}
+
+	linkPath := d.volumeDigestLinkPath(digest)
+	target, err := os.Readlink(linkPath)
+	if err == nil {
+		// Links to destroyed volumes are left behind
+		if _, err := os.Stat(linkPath); err == nil {
+			return filepath.Base(target), nil
+		}
+		logger.Info("removing-dangling-digest-link", lager.Data{"target": target})
+		if err := os.Remove(linkPath); err != nil && !os.IsNotExist(err) {
+			return "", errorspkg.Wrapf(err, "removing dangling link of digest %s", digest)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", errorspkg.Wrapf(err, "reading link of digest %s", digest)
+	}
+
+	id := digest.Encoded()
+	if _, err := os.Stat(filepath.Join(d.storePath, store.VolumesDirName, id)); err != nil {
+		return "", errorspkg.Wrap(ErrVolumeDigestNotFound, digest.String())
+	}
+
+	logger.Debug("linking-volume-named-after-digest", lager.Data{"volumeID": id})
+	if err := d.linkVolumeDigest(id, digest); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
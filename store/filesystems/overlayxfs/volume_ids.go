@@ -0,0 +1,88 @@
+package overlayxfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	digestpkg "github.com/opencontainers/go-digest"
+	errorspkg "github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidVolumeID  = errorspkg.New("invalid volume id")
+	ErrInvalidImagePath = errorspkg.New("invalid image path")
+)
+
+// GenerateVolumeID derives the id of the volume of a layer from its diff id
+// and the id of the volume of its parent layer, empty for the bottom layer.
+// It is the chain id of the layer, as computed by the layer fetcher, so the
+// same layer on top of the same parents is stored once whichever image it
+// comes from, while the same layer on top of different parents never
+// collides.
+func GenerateVolumeID(diffID digestpkg.Digest, parentID string) (string, error) {
+	if err := diffID.Validate(); err != nil {
+		return "", errorspkg.Wrapf(err, "invalid diff id %q", diffID)
+	}
+
+	if parentID == "" {
+		return diffID.Encoded(), nil
+	}
+
+	if err := validateVolumeID(parentID); err != nil {
+		return "", err
+	}
+
+	chainID := sha256.Sum256([]byte(fmt.Sprintf("%s %s", parentID, diffID.Encoded())))
+	return hex.EncodeToString(chainID[:]), nil
+}
+
+// validateVolumeID checks that the id names a directory in the volumes
+// directory, and cannot be used to reach outside of it.
+func validateVolumeID(id string) error {
+	if problem := unsafePathElement(id); problem != "" {
+		return errorspkg.Wrapf(ErrInvalidVolumeID, "%q %s", id, problem)
+	}
+
+	return nil
+}
+
+// validateImagePathElements checks that the image path cannot be used to
+// reach outside of the directory it names: the image id at its end is used as
+// a path element of its own, e.g. in the project mapping files.
+func validateImagePathElements(imagePath string) error {
+	if strings.ContainsRune(imagePath, 0) {
+		return errorspkg.Wrapf(ErrInvalidImagePath, "%q must not contain null bytes", imagePath)
+	}
+
+	for _, element := range strings.Split(imagePath, "/") {
+		if element == ".." {
+			return errorspkg.Wrapf(ErrInvalidImagePath, "%q must not contain '..'", imagePath)
+		}
+	}
+
+	if problem := unsafePathElement(filepath.Base(imagePath)); problem != "" {
+		return errorspkg.Wrapf(ErrInvalidImagePath, "image id of %q %s", imagePath, problem)
+	}
+
+	return nil
+}
+
+// unsafePathElement describes why an id cannot be used as a single path
+// element, or is empty if it can.
+func unsafePathElement(id string) string {
+	switch {
+	case id == "" || id == ".":
+		return "is not a valid name"
+	case strings.ContainsRune(id, 0):
+		return "must not contain null bytes"
+	case strings.Contains(id, "/"):
+		return "must not contain path separators"
+	case strings.Contains(id, ".."):
+		return "must not contain '..'"
+	}
+
+	return ""
+}
@@ -0,0 +1,96 @@
+package overlayxfs
+
+import (
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+// lastUsedSuffix names the file in the meta directory whose modification time
+// is when the volume was last used. Only its timestamp is updated, so
+// concurrent touches cannot corrupt it.
+const lastUsedSuffix = ".last-used"
+
+type VolumeInfo struct {
+	Size int64
+	// LastUsedAt is when TouchVolume was last called for the volume, or zero.
+	LastUsedAt time.Time
+}
+
+// VolumeInfo returns the size of the volume and when it was last used by an
+// image, e.g. to evict the least recently used layers.
+func (d *Driver) VolumeInfo(logger lager.Logger, id string) (VolumeInfo, error) {
+	logger = logger.Session("overlayxfs-volume-info", lager.Data{"volumeID": id})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if _, err := d.volumePath(logger, id); err != nil {
+		return VolumeInfo{}, err
+	}
+
+	metadata, err := d.readVolumeMeta(id)
+	if err != nil {
+		logger.Error("reading-volume-metadata-failed", err)
+		return VolumeInfo{}, errorspkg.Wrapf(err, "reading metadata of volume %s", id)
+	}
+
+	info := VolumeInfo{Size: metadata.Size}
+	stat, err := os.Stat(d.volumeLastUsedPath(id))
+	if err == nil {
+		info.LastUsedAt = stat.ModTime()
+	} else if !os.IsNotExist(err) {
+		return VolumeInfo{}, errorspkg.Wrap(err, "reading volume last used time")
+	}
+
+	return info, nil
+}
+
+// TouchVolume records that the volume is being used. CreateImage calls it for
+// each of the layers of the image.
+func (d *Driver) TouchVolume(logger lager.Logger, id string) error {
+	logger = logger.Session("overlayxfs-touching-volume", lager.Data{"volumeID": id})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	if err := validateVolumeID(id); err != nil {
+		return err
+	}
+
+	lastUsedPath := d.volumeLastUsedPath(id)
+	now := d.clock.Now()
+	if err := os.Chtimes(lastUsedPath, now, now); err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("updating-last-used-time-failed", err)
+			return errorspkg.Wrap(err, "updating volume last used time")
+		}
+
+		file, err := os.OpenFile(lastUsedPath, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Error("creating-last-used-file-failed", err)
+			return errorspkg.Wrap(err, "creating volume last used file")
+		}
+		file.Close()
+
+		if err := os.Chtimes(lastUsedPath, now, now); err != nil {
+			return errorspkg.Wrap(err, "updating volume last used time")
+		}
+	}
+
+	return nil
+}
+
+// touchVolumes is best effort: failing to record the use of a layer must not
+// fail the image using it.
+func (d *Driver) touchVolumes(logger lager.Logger, ids []string) {
+	for _, id := range ids {
+		if err := d.TouchVolume(logger, id); err != nil {
+			logger.Info("touching-volume-failed", lager.Data{"volumeID": id, "error": err.Error()})
+		}
+	}
+}
+
+func (d *Driver) volumeLastUsedPath(id string) string {
+	return d.volumeMetaFilePath(id) + lastUsedSuffix
+}
@@ -0,0 +1,68 @@
+package overlayxfs_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// statCountingFSOperations counts the stats the driver makes.
+type statCountingFSOperations struct {
+	overlayxfs.OSFSOperations
+	stats int
+}
+
+func (o *statCountingFSOperations) Stat(path string) (os.FileInfo, error) {
+	o.stats++
+	return o.OSFSOperations.Stat(path)
+}
+
+// benchmarkVolumePath resolves the paths of the volumes of a 50 layer image,
+// each layer resolving the paths of the layers it depends on, as pulling it
+// does. Every iteration is a new create, so the cache starts empty. The stats
+// made per create are reported along with the time.
+func benchmarkVolumePath(b *testing.B, cached bool) {
+	storePath := b.TempDir()
+	volumeIDs := []string{}
+	for i := 0; i < 50; i++ {
+		volumeID := fmt.Sprintf("volume-%d", i)
+		if err := os.MkdirAll(filepath.Join(storePath, store.VolumesDirName, volumeID), 0755); err != nil {
+			b.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+
+	fsOperations := new(statCountingFSOperations)
+	logger := lager.NewLogger("benchmark")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		driver := overlayxfs.NewDriver(storePath, "", nil, nil).
+			WithFSOperations(fsOperations).
+			WithVolumePathCache(cached)
+
+		for layer := range volumeIDs {
+			for _, volumeID := range volumeIDs[:layer+1] {
+				if _, err := driver.VolumePath(logger, volumeID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	b.ReportMetric(float64(fsOperations.stats)/float64(b.N), "stats/op")
+}
+
+func BenchmarkVolumePath(b *testing.B) {
+	benchmarkVolumePath(b, false)
+}
+
+// BenchmarkCachedVolumePath only stats each volume once per create.
+func BenchmarkCachedVolumePath(b *testing.B) {
+	benchmarkVolumePath(b, true)
+}
@@ -0,0 +1,64 @@
+package overlayxfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+)
+
+var errStopWalk = errors.New("stop walk")
+
+// walkUntil walks the tree under root until match returns true for an entry,
+// so that checks only needing one matching file do not walk the whole tree.
+// It reports whether an entry matched.
+func walkUntil(root string, match func(path string, entry fs.DirEntry) bool) (bool, error) {
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if match(path, entry) {
+			return errStopWalk
+		}
+		return nil
+	})
+
+	if err == errStopWalk {
+		return true, nil
+	}
+	return false, err
+}
+
+// HasWrites reports whether anything was written to the image, i.e. whether
+// its upperdir has any entry.
+func (d *Driver) HasWrites(logger lager.Logger, imagePath string) (bool, error) {
+	logger = logger.Session("overlayxfs-has-writes", lager.Data{"imagePath": imagePath})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	// Read-only images have nowhere to write to
+	if d.isReadOnlyImage(imagePath) {
+		return false, nil
+	}
+
+	upperDir := filepath.Join(imagePath, UpperDir)
+	if _, err := os.Stat(upperDir); os.IsNotExist(err) {
+		// The upperdir might have been compressed by CompressIdleUpper
+		if _, err := os.Stat(filepath.Join(imagePath, compressedUpperName)); err == nil {
+			return true, nil
+		}
+	}
+
+	hasWrites, err := walkUntil(upperDir, func(path string, _ fs.DirEntry) bool {
+		return path != upperDir
+	})
+	if err != nil {
+		logger.Error("walking-upperdir-failed", err)
+		return false, errorspkg.Wrap(err, "walking upperdir")
+	}
+
+	return hasWrites, nil
+}
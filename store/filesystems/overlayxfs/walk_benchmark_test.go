@@ -0,0 +1,62 @@
+package overlayxfs_test
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// largeUpperImage creates an image directory whose upperdir holds dirs
+// directories of files files each.
+func largeUpperImage(b *testing.B, dirs, files int) string {
+	imagePath := b.TempDir()
+	for i := 0; i < dirs; i++ {
+		dir := filepath.Join(imagePath, overlayxfs.UpperDir, fmt.Sprintf("dir-%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < files; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", j)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return imagePath
+}
+
+func BenchmarkHasWrites(b *testing.B) {
+	imagePath := largeUpperImage(b, 100, 100)
+	driver := overlayxfs.NewDriver(filepath.Dir(imagePath), "", nil, nil)
+	logger := lager.NewLogger("benchmark")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := driver.HasWrites(logger, imagePath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFullUpperWalk is what HasWrites would cost without stopping at
+// the first entry.
+func BenchmarkFullUpperWalk(b *testing.B) {
+	imagePath := largeUpperImage(b, 100, 100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entries := 0
+		err := filepath.WalkDir(filepath.Join(imagePath, overlayxfs.UpperDir), func(_ string, _ fs.DirEntry, err error) error {
+			entries++
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
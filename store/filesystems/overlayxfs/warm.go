@@ -0,0 +1,57 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// WarmVolume asks the kernel to read the files of a volume into the page
+// cache, so that the first containers using it do not wait on the disk. The
+// reads happen in the background: it returns once they are scheduled.
+func (d *Driver) WarmVolume(logger lager.Logger, id string) error {
+	logger = logger.Session("overlayxfs-warming-volume", lager.Data{"volumeID": id})
+	logger.Debug("starting")
+	defer logger.Debug("ending")
+
+	volumePath, err := d.volumePath(logger, id)
+	if err != nil {
+		return err
+	}
+
+	var files int
+	err = filepath.Walk(volumePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+
+		if err := adviseWillNeed(path); err != nil {
+			return errorspkg.Wrapf(err, "warming %s", path)
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		logger.Error("warming-volume-failed", err)
+		return err
+	}
+
+	logger.Debug("warmed-volume", lager.Data{"files": files})
+	return nil
+}
+
+func adviseWillNeed(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,87 @@
+package overlayxfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/grootfs/store"
+	"code.cloudfoundry.org/grootfs/store/filesystems/overlayxfs"
+	"code.cloudfoundry.org/lager/v3"
+	"golang.org/x/sys/unix"
+)
+
+// warmableVolume creates a volume of files files of 1MiB each.
+func warmableVolume(b *testing.B, files int) (*overlayxfs.Driver, []string) {
+	storePath := b.TempDir()
+	volumePath := filepath.Join(storePath, store.VolumesDirName, "volume")
+	if err := os.MkdirAll(volumePath, 0755); err != nil {
+		b.Fatal(err)
+	}
+
+	paths := []string{}
+	for i := 0; i < files; i++ {
+		path := filepath.Join(volumePath, fmt.Sprintf("file-%d", i))
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte{1}, 1024*1024), 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	return overlayxfs.NewDriver(storePath, "", nil, nil), paths
+}
+
+// evict drops the files from the page cache, where the filesystem allows it.
+func evict(b *testing.B, paths []string) {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+		file.Close()
+	}
+}
+
+func readAll(b *testing.B, paths []string) {
+	for _, path := range paths {
+		if _, err := ioutil.ReadFile(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkColdFirstAccess(b *testing.B) {
+	_, paths := warmableVolume(b, 20)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		evict(b, paths)
+		b.StartTimer()
+
+		readAll(b, paths)
+	}
+}
+
+// BenchmarkWarmedFirstAccess reads the files after WarmVolume, which is
+// left out of the timings as it would run before the container starts.
+func BenchmarkWarmedFirstAccess(b *testing.B) {
+	driver, paths := warmableVolume(b, 20)
+	logger := lager.NewLogger("benchmark")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		evict(b, paths)
+		if err := driver.WarmVolume(logger, "volume"); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		readAll(b, paths)
+	}
+}
@@ -0,0 +1,80 @@
+package overlayxfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	errorspkg "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// CreateWhiteout replaces path with an overlay whiteout, a hard link to the
+// whiteout device of the store open as storeDir.
+func CreateWhiteout(storeDir *os.File, path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return errorspkg.Wrap(err, "deleting file")
+	}
+
+	targetDir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return errorspkg.Wrap(err, "opening target whiteout directory")
+	}
+	defer targetDir.Close()
+
+	if err := unix.Linkat(int(storeDir.Fd()), WhiteoutDevice, int(targetDir.Fd()), filepath.Base(path), 0); err != nil {
+		return errorspkg.Wrapf(err, "failed to create whiteout node: %s", path)
+	}
+
+	return nil
+}
+
+// convertWhiteouts turns the OCI whiteouts extracted into a volume into
+// their overlay counterparts, as the unpacker does when pulling layers.
+func (d *Driver) convertWhiteouts(logger lager.Logger, id, volumePath string) error {
+	whiteouts := []string{}
+	opaqueWhiteouts := []string{}
+	err := filepath.Walk(volumePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Name() == opaqueWhiteout:
+			opaqueWhiteouts = append(opaqueWhiteouts, strings.TrimPrefix(path, volumePath))
+		case strings.HasPrefix(info.Name(), whiteoutPrefix):
+			whiteouts = append(whiteouts, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return errorspkg.Wrap(err, "walking volume")
+	}
+
+	if len(whiteouts) > 0 {
+		storeDir, err := os.Open(d.storePath)
+		if err != nil {
+			return errorspkg.Wrap(err, "opening store")
+		}
+		defer storeDir.Close()
+
+		for _, path := range whiteouts {
+			if err := os.Remove(path); err != nil {
+				return errorspkg.Wrap(err, "removing whiteout file")
+			}
+			deletedPath := filepath.Join(filepath.Dir(path), strings.TrimPrefix(filepath.Base(path), whiteoutPrefix))
+			if err := CreateWhiteout(storeDir, deletedPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, path := range opaqueWhiteouts {
+		if err := os.Remove(filepath.Join(volumePath, path)); err != nil {
+			return errorspkg.Wrap(err, "removing opaque whiteout file")
+		}
+	}
+
+	return d.HandleOpaqueWhiteouts(logger, id, opaqueWhiteouts)
+}
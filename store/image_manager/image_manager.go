@@ -5,23 +5,102 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 
 	"code.cloudfoundry.org/grootfs/groot"
 	"code.cloudfoundry.org/grootfs/store"
 	"code.cloudfoundry.org/lager/v3"
+	digestpkg "github.com/opencontainers/go-digest"
 	specsv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	errorspkg "github.com/pkg/errors"
 )
 
+// DurabilityPolicy trades the crash safety of an image for write speed.
+type DurabilityPolicy string
+
+const (
+	// DurabilitySafe keeps the image consistent across crashes. It is the
+	// default.
+	DurabilitySafe DurabilityPolicy = "safe"
+	// DurabilityFast skips the syncs of the overlay upper and work dirs. After
+	// a crash, or even a clean unmount, the upperdir of the image can no longer
+	// be trusted and the image cannot be mounted again.
+	DurabilityFast DurabilityPolicy = "fast"
+)
+
 type ImageDriverSpec struct {
-	BaseVolumeIDs      []string
-	Mount              bool
-	ImagePath          string
-	DiskLimit          int64
+	// BaseVolumeIDs are ordered bottom layer first, unless LowerOrderTopFirst
+	// is set.
+	BaseVolumeIDs []string
+	// BaseVolumeDigests give the base volumes by the digest of their content
+	// instead, in the same order.
+	BaseVolumeDigests []digestpkg.Digest
+	Mount             bool
+	ImagePath         string
+	// DiskLimit caps the bytes of the image, 0 meaning no limit. The quota
+	// is set on the image directory, so it counts the upperdir, including the
+	// files copied up from the base volumes when written to, the workdir and
+	// the metadata files of the image. The base volumes are shared and not
+	// counted: by default their size is taken off the limit, so that the base
+	// and the image directory add up to it.
+	DiskLimit int64
+	// ExclusiveDiskLimit applies the whole DiskLimit to the writes of the
+	// image, regardless of the size of its base volumes.
 	ExclusiveDiskLimit bool
 	OwnerUID           int
 	OwnerGID           int
+	// RedirectDirNoFollow mounts the image with redirect_dir=nofollow, so that
+	// redirects present in the layers, e.g. crafted by untrusted layers, are
+	// ignored. Directories renamed through a redirect lose the contents they
+	// had in the lower layers, and no new redirects are created: renaming a
+	// directory of the lower layers fails with EXDEV.
+	RedirectDirNoFollow bool
+	// MountSource is the source of the overlay mount as it shows up in
+	// mountinfo (e.g. the image id). It defaults to "overlay".
+	MountSource string
+	// Annotations are arbitrary key-value pairs stored along with the image,
+	// e.g. to correlate it with the workload using it.
+	Annotations map[string]string
+	// Durability defaults to DurabilitySafe.
+	Durability DurabilityPolicy
+	// InodeLimit caps the number of files of images with a disk limit. It
+	// defaults to the inode limit of the driver.
+	InodeLimit uint64
+	// LowerOrderTopFirst is for callers whose BaseVolumeIDs are ordered top
+	// layer first. Either way, overlay is given the top layer as its first
+	// lowerdir.
+	LowerOrderTopFirst bool
+	// ProtectedPaths are paths of the rootfs that cannot be written to, e.g.
+	// configuration the workload must not override. They must exist in the
+	// base volumes and are only protected while the image is mounted.
+	ProtectedPaths []string
+	// ReadOnly images have no upperdir: their base volumes are mounted
+	// read-only, bind mounted if there is only one.
+	ReadOnly bool
+	// MountOptions are extra overlay options, e.g. {"redirect_dir": "on",
+	// "metacopy": "on"}. The kernel must support them: redirect_dir needs
+	// 4.10 and metacopy 4.19.
+	MountOptions map[string]string
+	// ExtraMounts are bind mounted into the rootfs once it is mounted, in
+	// order, e.g. to share read-only data volumes between images.
+	ExtraMounts []Mount
+}
+
+// Mount is a bind mount into the rootfs of an image.
+type Mount struct {
+	// Source is the absolute path of the directory or file to bind mount.
+	Source string
+	// Destination is relative to the rootfs and must not escape it. It is
+	// created if the image does not have it.
+	Destination string
+	ReadOnly    bool
+}
+
+// ImagePaths are where the driver lays the directories of an image out.
+type ImagePaths struct {
+	// Rootfs is where the image is mounted.
+	Rootfs   string
+	UpperDir string
+	WorkDir  string
 }
 
 //go:generate counterfeiter . ImageDriver
@@ -29,6 +108,7 @@ type ImageDriver interface {
 	CreateImage(logger lager.Logger, spec ImageDriverSpec) (groot.MountInfo, error)
 	DestroyImage(logger lager.Logger, path string) error
 	FetchStats(logger lager.Logger, path string) (groot.VolumeStats, error)
+	ImagePaths(path string) ImagePaths
 }
 
 type ImageManager struct {
@@ -64,7 +144,7 @@ func (b *ImageManager) Create(logger lager.Logger, spec groot.ImageSpec) (groot.
 	defer logger.Info("ending")
 
 	imagePath := b.imagePath(spec.ID)
-	imageRootFSPath := filepath.Join(imagePath, "rootfs")
+	imageRootFSPath := b.imageDriver.ImagePaths(imagePath).Rootfs
 
 	var err error
 	defer func() {
@@ -44,6 +44,9 @@ var _ = Describe("Image", func() {
 				Options:     []string{"my-option"},
 			}, os.Mkdir(filepath.Join(spec.ImagePath, "rootfs"), 0777)
 		}
+		fakeImageDriver.ImagePathsStub = func(imagePath string) imagemanager.ImagePaths {
+			return imagemanager.ImagePaths{Rootfs: filepath.Join(imagePath, "rootfs")}
+		}
 
 		storePath, err = ioutil.TempDir("", "")
 		Expect(err).NotTo(HaveOccurred())
@@ -80,6 +83,20 @@ var _ = Describe("Image", func() {
 			Expect(image.Mounts).To(BeNil())
 		})
 
+		It("takes the rootfs path from the driver", func() {
+			fakeImageDriver.ImagePathsStub = func(imagePath string) imagemanager.ImagePaths {
+				return imagemanager.ImagePaths{Rootfs: filepath.Join(imagePath, "merged")}
+			}
+			fakeImageDriver.CreateImageStub = func(_ lager.Logger, spec imagemanager.ImageDriverSpec) (groot.MountInfo, error) {
+				return groot.MountInfo{}, os.Mkdir(filepath.Join(spec.ImagePath, "merged"), 0777)
+			}
+
+			image, err := imageManager.Create(logger, groot.ImageSpec{ID: "some-id", BaseImage: imageConfig, Mount: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(image.Rootfs).To(Equal(filepath.Join(imagesPath, "some-id/merged")))
+			Expect(fakeImageDriver.ImagePathsArgsForCall(0)).To(Equal(filepath.Join(imagesPath, "some-id")))
+		})
+
 		It("keeps the images in the same image directory", func() {
 			someImage, err := imageManager.Create(logger, groot.ImageSpec{ID: "some-id", BaseImage: imageConfig})
 			Expect(err).NotTo(HaveOccurred())
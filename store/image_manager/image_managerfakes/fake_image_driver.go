@@ -50,6 +50,17 @@ type FakeImageDriver struct {
 		result1 groot.VolumeStats
 		result2 error
 	}
+	ImagePathsStub        func(string) image_manager.ImagePaths
+	imagePathsMutex       sync.RWMutex
+	imagePathsArgsForCall []struct {
+		arg1 string
+	}
+	imagePathsReturns struct {
+		result1 image_manager.ImagePaths
+	}
+	imagePathsReturnsOnCall map[int]struct {
+		result1 image_manager.ImagePaths
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -246,6 +257,67 @@ func (fake *FakeImageDriver) FetchStatsReturnsOnCall(i int, result1 groot.Volume
 	}{result1, result2}
 }
 
+func (fake *FakeImageDriver) ImagePaths(arg1 string) image_manager.ImagePaths {
+	fake.imagePathsMutex.Lock()
+	ret, specificReturn := fake.imagePathsReturnsOnCall[len(fake.imagePathsArgsForCall)]
+	fake.imagePathsArgsForCall = append(fake.imagePathsArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	stub := fake.ImagePathsStub
+	fakeReturns := fake.imagePathsReturns
+	fake.recordInvocation("ImagePaths", []interface{}{arg1})
+	fake.imagePathsMutex.Unlock()
+	if stub != nil {
+		return stub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fakeReturns.result1
+}
+
+func (fake *FakeImageDriver) ImagePathsCallCount() int {
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
+	return len(fake.imagePathsArgsForCall)
+}
+
+func (fake *FakeImageDriver) ImagePathsCalls(stub func(string) image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = stub
+}
+
+func (fake *FakeImageDriver) ImagePathsArgsForCall(i int) string {
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
+	argsForCall := fake.imagePathsArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *FakeImageDriver) ImagePathsReturns(result1 image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = nil
+	fake.imagePathsReturns = struct {
+		result1 image_manager.ImagePaths
+	}{result1}
+}
+
+func (fake *FakeImageDriver) ImagePathsReturnsOnCall(i int, result1 image_manager.ImagePaths) {
+	fake.imagePathsMutex.Lock()
+	defer fake.imagePathsMutex.Unlock()
+	fake.ImagePathsStub = nil
+	if fake.imagePathsReturnsOnCall == nil {
+		fake.imagePathsReturnsOnCall = make(map[int]struct {
+			result1 image_manager.ImagePaths
+		})
+	}
+	fake.imagePathsReturnsOnCall[i] = struct {
+		result1 image_manager.ImagePaths
+	}{result1}
+}
+
 func (fake *FakeImageDriver) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -255,6 +327,8 @@ func (fake *FakeImageDriver) Invocations() map[string][][]interface{} {
 	defer fake.destroyImageMutex.RUnlock()
 	fake.fetchStatsMutex.RLock()
 	defer fake.fetchStatsMutex.RUnlock()
+	fake.imagePathsMutex.RLock()
+	defer fake.imagePathsMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
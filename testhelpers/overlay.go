@@ -51,7 +51,7 @@ func internalMountPoints(mountPath string) []string {
 	for scanner.Scan() {
 		mountLine := scanner.Text()
 		mountInfo := strings.Split(mountLine, " ")
-		mountType := mountInfo[0]
+		mountType := mountInfo[2]
 		if mountType == "overlay" && strings.Contains(mountLine, mountPath) {
 			mountPoint := mountInfo[1]
 			mountPoints = append(mountPoints, mountPoint)